@@ -4,22 +4,30 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"math"
+	"math/big"
 	"strconv"
+	"strings"
+	"sync/atomic"
 )
 
 // Constants for RESP types
 const (
-	STRING  = '+'
-	ERROR   = '-'
-	INTEGER = ':'
-	BULK    = '$'
-	ARRAY   = '*'
-	NULL    = '_'
-	BOOLEAN = '#'
-	DOUBLES = ','
-	MAP     = '%'
-	ATTR    = '`'
-	SETS    = '~'
+	STRING    = '+'
+	ERROR     = '-'
+	INTEGER   = ':'
+	BULK      = '$'
+	ARRAY     = '*'
+	NULL      = '_'
+	BOOLEAN   = '#'
+	DOUBLES   = ','
+	BIGNUMBER = '('
+	BLOBERROR = '!'
+	VERBATIM  = '='
+	MAP       = '%'
+	ATTR      = '|'
+	SETS      = '~'
+	PUSH      = '>'
 )
 
 // Value structure for RESP formatting and storage
@@ -30,7 +38,11 @@ type Value struct {
 	double float64
 	bulk   string
 	array  []Value
-	err    error
+
+	// Attributes sent ahead of the value, flat like map entries
+	attrs []Value
+	// Code of an error reply built by the server, counted by INFO errorstats
+	code string
 }
 
 // need to add timestamping for TTL
@@ -38,11 +50,34 @@ type Value struct {
 // Reader for reading RESP
 type Resp struct {
 	reader *bufio.Reader
+
+	// Arguments of the last request, reused by the next one
+	args []Value
 }
 
-// Writer for writing RESP
+// Size at which buffered replies are written without waiting for Flush
+const writerFlushSize = 64 * 1024
+
+// Writer for writing RESP, replies are appended to a buffer until Flush
 type Writer struct {
 	writer io.Writer
+	buf    []byte
+
+	// Protocol version chosen by the client with HELLO, 2 or 3
+	protocol atomic.Int32
+}
+
+// Elements allocated ahead of reading an aggregate, like the argv of Redis
+const maxPrealloc = 1024
+
+// Bytes allocated ahead of reading a blob
+const maxBlobPrealloc = 1024 * 1024
+
+// Malformed request, the client is told and then disconnected
+type ProtocolError string
+
+func (e ProtocolError) Error() string {
+	return "Protocol error: " + string(e)
 }
 
 // Creates new reader
@@ -52,194 +87,265 @@ func NewResp(rd io.Reader) *Resp {
 
 // Created new writer
 func NewWriter(w io.Writer) *Writer {
-	return &Writer{writer: w}
+	writer := &Writer{writer: w}
+	writer.protocol.Store(2)
+
+	return writer
 }
 
 // Decision structure for writing RESP protocol based on value type
 // Returns a byte array representing the Value in RESP format
 func (v Value) Marshal() []byte {
+	return v.AppendMarshal(nil, 0)
+}
+
+// Appends the RESP form of the value to buf. Handlers reply with a mix of
+// RESP2 and RESP3 types which are adapted to the protocol version of the
+// client, 2 or 3, while 0 writes every type as it is.
+func (v Value) AppendMarshal(buf []byte, protocol int) []byte {
+	// Attributes have no RESP2 form so they are dropped
+	if len(v.attrs) > 0 && protocol != 2 {
+		buf = appendHeader(buf, ATTR, len(v.attrs)/2)
+		buf = appendElements(buf, v.attrs, protocol)
+	}
+
 	switch v.typ {
 	case "array":
-		return v.marshalArray()
+		buf = appendHeader(buf, ARRAY, len(v.array))
+		return appendElements(buf, v.array, protocol)
+	case "push":
+		buf = appendHeader(buf, pick(protocol, ARRAY, PUSH), len(v.array))
+		return appendElements(buf, v.array, protocol)
+	case "set":
+		buf = appendHeader(buf, pick(protocol, ARRAY, SETS), len(v.array))
+		return appendElements(buf, v.array, protocol)
+	case "map":
+		// Entries are stored flat as key, value, key, value
+		if protocol == 2 {
+			buf = appendHeader(buf, ARRAY, len(v.array))
+		} else {
+			buf = appendHeader(buf, MAP, len(v.array)/2)
+		}
+		return appendElements(buf, v.array, protocol)
+	case "pairmap":
+		if protocol != 2 {
+			buf = appendHeader(buf, MAP, len(v.array)/2)
+			return appendElements(buf, v.array, protocol)
+		}
+
+		// Sent as an array of [key, value] arrays instead of a flat one
+		buf = appendHeader(buf, ARRAY, len(v.array)/2)
+
+		for i := 0; i+1 < len(v.array); i += 2 {
+			buf = appendHeader(buf, ARRAY, 2)
+			buf = appendElements(buf, v.array[i:i+2], protocol)
+		}
+
+		return buf
+	case "pairs":
+		if protocol == 2 {
+			buf = appendHeader(buf, ARRAY, len(v.array))
+			return appendElements(buf, v.array, protocol)
+		}
+
+		// Sent to RESP3 clients as an array of [key, value] arrays
+		buf = appendHeader(buf, ARRAY, len(v.array)/2)
+
+		for i := 0; i+1 < len(v.array); i += 2 {
+			buf = appendHeader(buf, ARRAY, 2)
+			buf = appendElements(buf, v.array[i:i+2], protocol)
+		}
+
+		return buf
 	case "string":
-		return v.marshalString()
+		return appendLine(buf, STRING, v.str)
 	case "error":
-		return v.marshalError()
+		return appendLine(buf, ERROR, v.str)
+	case "bloberror":
+		if protocol == 2 {
+			return appendLine(buf, ERROR, v.str)
+		}
+		return appendBlob(buf, BLOBERROR, v.str)
 	case "bulk":
-		return v.marshalBulk()
+		return appendBlob(buf, BULK, v.bulk)
+	case "verbatim":
+		if protocol == 2 {
+			return appendBlob(buf, BULK, v.bulk)
+		}
+
+		// The three letter format and a colon come before the content
+		buf = appendHeader(buf, VERBATIM, len(v.str)+1+len(v.bulk))
+		buf = append(buf, v.str...)
+		buf = append(buf, ':')
+		buf = append(buf, v.bulk...)
+		return append(buf, '\r', '\n')
+	case "bignumber":
+		if protocol == 2 {
+			return appendBlob(buf, BULK, v.str)
+		}
+		return appendLine(buf, BIGNUMBER, v.str)
 	case "null":
-		return v.marshalNull()
+		// Sent to RESP2 clients as a null bulk string
+		if protocol == 2 {
+			return append(buf, "$-1\r\n"...)
+		}
+		return append(buf, "_\r\n"...)
+	case "nullbulk":
+		if protocol == 3 {
+			return append(buf, "_\r\n"...)
+		}
+		return append(buf, "$-1\r\n"...)
+	case "nullarray":
+		// Null array of blocking commands that timed out
+		if protocol == 3 {
+			return append(buf, "_\r\n"...)
+		}
+		return append(buf, "*-1\r\n"...)
 	case "boolean":
-		return v.marshalBoolean()
+		if protocol == 2 {
+			return appendHeader(buf, INTEGER, v.num)
+		}
+		if v.num != 0 {
+			return append(buf, "#t\r\n"...)
+		}
+		return append(buf, "#f\r\n"...)
 	case "double":
-		return v.marshalDouble()
-	case "map":
-		return v.marshalMap()
-	case "set":
-		return v.marshalSet()
+		if protocol == 2 {
+			return appendBlob(buf, BULK, formatDouble(v.double))
+		}
+		return appendLine(buf, DOUBLES, formatDouble(v.double))
 	case "integer":
-		return v.marshalInteger()
+		return appendHeader(buf, INTEGER, v.num)
 	default:
-		return []byte{}
+		return buf
 	}
 }
 
-// RESP representation of a boolean return for writing
-func (v Value) marshalBoolean() []byte {
-	var bytes []byte
-
-	bytes = append(bytes, BOOLEAN)
-	bytes = append(bytes, strconv.Itoa(v.num)...)
-	bytes = append(bytes, '\r', '\n')
+// Chooses the RESP2 or RESP3 prefix of a type
+func pick(protocol int, resp2 byte, resp3 byte) byte {
+	if protocol == 2 {
+		return resp2
+	}
 
-	return bytes
+	return resp3
 }
 
-// RESP representation of a integer return for writing
-func (v Value) marshalInteger() []byte {
-	var bytes []byte
+// Appends a prefix followed by a number, the header of lengths and integers
+func appendHeader(buf []byte, prefix byte, n int) []byte {
+	buf = append(buf, prefix)
+	buf = strconv.AppendInt(buf, int64(n), 10)
 
-	bytes = append(bytes, INTEGER)
-	bytes = append(bytes, strconv.Itoa(v.num)...)
-	bytes = append(bytes, '\r', '\n')
-
-	return bytes
+	return append(buf, '\r', '\n')
 }
 
-// RESP representation of a double return for writing
-func (v Value) marshalDouble() []byte {
-	var bytes []byte
+// Appends a simple type that fits on one line. Errors often quote what the
+// client sent, so line breaks are turned into spaces like Redis does.
+func appendLine(buf []byte, prefix byte, line string) []byte {
+	buf = append(buf, prefix)
+	start := len(buf)
+	buf = append(buf, line...)
 
-	bytes = append(bytes, DOUBLES)
-	bytes = append(bytes, strconv.FormatFloat(v.double, 'f', -1, 64)...)
-	bytes = append(bytes, '\r', '\n')
+	for i := start; i < len(buf); i++ {
+		if buf[i] == '\r' || buf[i] == '\n' {
+			buf[i] = ' '
+		}
+	}
 
-	return bytes
+	return append(buf, '\r', '\n')
 }
 
-// RESP representation of a map return for writing
-func (v Value) marshalMap() []byte {
-	var bytes []byte
+// Appends a length prefixed string such as a bulk string or blob error
+func appendBlob(buf []byte, prefix byte, blob string) []byte {
+	buf = appendHeader(buf, prefix, len(blob))
+	buf = append(buf, blob...)
 
-	bytes = append(bytes, MAP)
-	bytes = append(bytes, strconv.Itoa(len(v.array))...)
-	bytes = append(bytes, '\r', '\n')
+	return append(buf, '\r', '\n')
+}
 
-	for _, element := range v.array {
-		bytes = append(bytes, element.Marshal()...)
+// Appends the elements of an aggregate type
+func appendElements(buf []byte, elements []Value, protocol int) []byte {
+	for i := range elements {
+		buf = elements[i].AppendMarshal(buf, protocol)
 	}
 
-	return bytes
+	return buf
 }
 
-// RESP representation of a set return for writing
-func (v Value) marshalSet() []byte {
-	var bytes []byte
-
-	bytes = append(bytes, SETS)
-	bytes = append(bytes, strconv.Itoa(len(v.array))...)
-	bytes = append(bytes, '\r', '\n')
-
-	for _, element := range v.array {
-		bytes = append(bytes, element.Marshal()...)
+// Formats a double the way RESP3 spells it, also used for RESP2 bulk strings
+func formatDouble(f float64) string {
+	if math.IsNaN(f) {
+		return "nan"
 	}
-
-	return bytes
+	return formatScore(f)
 }
 
-// Stores the values string for writing back to client
-// Returns a byte representation of the string
-func (v Value) marshalString() []byte {
-	var bytes []byte
-
-	bytes = append(bytes, STRING)
-	bytes = append(bytes, v.str...)
-	bytes = append(bytes, '\r', '\n')
-
-	return bytes
-}
+// Reads full RESP line, which must end with CRLF. The line points into the
+// read buffer unless it was longer than it, so it is only valid until the
+// next read.
+func (r *Resp) readLine() (line []byte, n int, err error) {
+	line, err = r.reader.ReadSlice('\n')
 
-// Prepares the values bulk string for writing back to the client in RESP format
-// Returns a byte representation in RESP format
-func (v Value) marshalBulk() []byte {
-	var bytes []byte
+	if err == bufio.ErrBufferFull {
+		// Lines longer than the buffer are gathered in a copy
+		long := append([]byte(nil), line...)
 
-	bytes = append(bytes, BULK)
-	bytes = append(bytes, strconv.Itoa(len(v.bulk))...)
-	bytes = append(bytes, '\r', '\n')
-	bytes = append(bytes, v.bulk...)
-	bytes = append(bytes, '\r', '\n')
+		for err == bufio.ErrBufferFull && len(long) <= protoInlineMaxSize {
+			line, err = r.reader.ReadSlice('\n')
+			long = append(long, line...)
+		}
 
-	return bytes
-}
+		line = long
+	}
 
-// Prepares the values array for writing back to the client in RESP format
-// Returns a byte representation in RESP format
-func (v Value) marshalArray() []byte {
-	len := len(v.array)
-	var bytes []byte
+	if len(line) > protoInlineMaxSize {
+		return nil, 0, ProtocolError("too big line")
+	}
+	if err != nil {
+		return nil, 0, err
+	}
 
-	bytes = append(bytes, ARRAY)
-	bytes = append(bytes, strconv.Itoa(len)...)
-	bytes = append(bytes, '\r', '\n')
+	n = len(line)
 
-	for i := 0; i < len; i++ {
-		bytes = append(bytes, v.array[i].Marshal()...)
+	if n < 2 || line[n-2] != '\r' {
+		return nil, 0, ProtocolError("expected CRLF at the end of the line")
 	}
 
-	return bytes
+	return line[:n-2], n, nil
 }
 
-// Handles simple errors in RESP format
-// Returns byte representation in RESP format
-func (v Value) marshalError() []byte {
-	var bytes []byte
-
-	bytes = append(bytes, ERROR)
-	bytes = append(bytes, v.str...)
-	bytes = append(bytes, '\r', '\n')
+// Reads the length of a blob, -1 stands for null. Lengths above
+// proto-max-bulk-len are refused before anything is allocated.
+func (r *Resp) readBlobLength() (int, error) {
+	line, _, err := r.readLine()
 
-	return bytes
-}
+	if err != nil {
+		return 0, err
+	}
 
-// Returns NULL value in RESP format for missing commands or returns
-func (v Value) marshalNull() []byte {
-	return []byte("$-1\r\n")
-}
+	length, err := strconv.Atoi(string(line))
 
-// Reads full RESP line
-func (r *Resp) readLine() (line []byte, n int, err error) {
-	for {
-		byt, err := r.reader.ReadByte()
-		if err != nil {
-			return nil, 0, err
-		}
-		n += 1
-		line = append(line, byt)
-
-		if len(line) >= 2 && line[len(line)-2] == '\r' {
-			break
-		}
+	if err != nil || length < -1 || length > configInt("proto-max-bulk-len") {
+		return 0, ProtocolError("invalid bulk length")
 	}
 
-	return line[:len(line)-2], n, nil
+	return length, nil
 }
 
-// Parses and returns integer in RESP protocol
-func (r *Resp) readInteger() (x int, n int, err error) {
-	line, n, err := r.readLine()
+// Reads the number of elements of an aggregate type, -1 stands for null
+func (r *Resp) readAggregateLength() (int, error) {
+	line, _, err := r.readLine()
 
 	if err != nil {
-		return 0, 0, err
+		return 0, err
 	}
 
-	i64, err := strconv.ParseInt(string(line), 10, 64)
+	length, err := strconv.Atoi(string(line))
 
-	if err != nil {
-		return 0, n, err
+	if err != nil || length < -1 || length > math.MaxInt32 {
+		return 0, ProtocolError("invalid multibulk length")
 	}
 
-	return int(i64), n, nil
+	return length, nil
 }
 
 // Reads integer in RESP format and returns it
@@ -264,13 +370,20 @@ func (r *Resp) readBoolean() (Value, error) {
 	v := Value{}
 	v.typ = "boolean"
 
-	num, _, err := r.readInteger()
+	line, _, err := r.readLine()
 
 	if err != nil {
 		return v, err
 	}
 
-	v.num = num
+	switch string(line) {
+	case "t":
+		v.num = 1
+	case "f":
+		v.num = 0
+	default:
+		return Value{}, fmt.Errorf("invalid boolean %q", line)
+	}
 
 	return v, nil
 }
@@ -299,114 +412,316 @@ func (r *Resp) readDouble() (Value, error) {
 
 // Reads map in RESP format and returns it
 func (r *Resp) readMap() (Value, error) {
-	v := Value{}
-	v.typ = "map"
+	length, err := r.readAggregateLength()
+
+	if err != nil {
+		return Value{}, err
+	}
+	if length < 0 {
+		return Value{}, ProtocolError("invalid map length")
+	}
+
+	// Entries are stored flat as key, value, key, value
+	return r.readElements("map", length*2)
+}
+
+// Reads set in RESP format and returns it
+func (r *Resp) readSet() (Value, error) {
+	length, err := r.readAggregateLength()
 
-	length, _, err := r.readInteger()
+	if err != nil {
+		return Value{}, err
+	}
+	if length < 0 {
+		return Value{}, ProtocolError("invalid set length")
+	}
+
+	return r.readElements("set", length)
+}
+
+// Reads out of band data pushed by the server
+func (r *Resp) readPush() (Value, error) {
+	length, err := r.readAggregateLength()
 
 	if err != nil {
 		return Value{}, err
 	}
+	if length < 0 {
+		return Value{}, ProtocolError("invalid push length")
+	}
 
-	v.array = make([]Value, length*2)
+	return r.readElements("push", length)
+}
 
-	for i := 0; i < length; i++ {
-		key, err := r.readBulk()
+// Reads attributes and the value they describe, which follows them
+func (r *Resp) readAttribute() (Value, error) {
+	attrs, err := r.readMap()
 
-		if err != nil {
-			return v, err
-		}
+	if err != nil {
+		return Value{}, err
+	}
 
-		value, err := r.readBulk()
+	v, err := r.Read()
+
+	if err != nil {
+		return Value{}, err
+	}
+
+	v.attrs = attrs.array
+
+	return v, nil
+}
+
+// Reads the elements of an aggregate type. The length comes from the peer
+// so only a bounded part of it is allocated up front.
+func (r *Resp) readElements(typ string, length int) (Value, error) {
+	v := Value{typ: typ, array: make([]Value, 0, min(length, maxPrealloc))}
+
+	for i := 0; i < length; i++ {
+		element, err := r.Read()
 
 		if err != nil {
-			return v, err
+			return Value{}, err
 		}
 
-		v.array[i*2] = key
-		v.array[i*2+1] = value
+		v.array = append(v.array, element)
 	}
 
 	return v, nil
 }
 
-// Reads set in RESP format and returns it
-func (r *Resp) readSet() (Value, error) {
-	v := Value{}
-	v.typ = "set"
+// Reads a simple string in RESP format and returns it
+func (r *Resp) readString() (Value, error) {
+	line, _, err := r.readLine()
+
+	if err != nil {
+		return Value{}, err
+	}
+
+	return Value{typ: "string", str: string(line)}, nil
+}
 
-	length, _, err := r.readInteger()
+// Reads a simple error in RESP format and returns it
+func (r *Resp) readError() (Value, error) {
+	line, _, err := r.readLine()
 
 	if err != nil {
-		return v, err
+		return Value{}, err
 	}
 
-	v.array = make([]Value, 0)
+	return Value{typ: "error", str: string(line)}, nil
+}
 
-	for i := 0; i < length; i++ {
-		cur, err := r.Read()
+// Reads the RESP3 null
+func (r *Resp) readNull() (Value, error) {
+	line, _, err := r.readLine()
+
+	if err != nil {
+		return Value{}, err
+	}
+	if len(line) != 0 {
+		return Value{}, fmt.Errorf("invalid null %q", line)
+	}
+
+	return Value{typ: "null"}, nil
+}
+
+// Reads a big number, its digits are kept as they are
+func (r *Resp) readBigNumber() (Value, error) {
+	line, _, err := r.readLine()
+
+	if err != nil {
+		return Value{}, err
+	}
+
+	if _, ok := new(big.Int).SetString(string(line), 10); !ok {
+		return Value{}, fmt.Errorf("invalid big number %q", line)
+	}
+
+	return Value{typ: "bignumber", str: string(line)}, nil
+}
+
+// Reads the data of a blob and its trailing CRLF. The data is copied out
+// of the read buffer once, straight into the string that is returned.
+func (r *Resp) readBlobData(length int) (string, error) {
+	// Only a bounded part of the claimed length is allocated up front so
+	// a header alone cannot reserve proto-max-bulk-len bytes
+	var blob strings.Builder
+	blob.Grow(min(length, maxBlobPrealloc))
+
+	for blob.Len() < length {
+		chunk, err := r.reader.Peek(min(length-blob.Len(), r.reader.Size()))
+		blob.Write(chunk)
+		r.reader.Discard(len(chunk))
 
 		if err != nil {
-			return v, nil
+			return "", err
 		}
+	}
 
-		v.array[i] = cur
+	crlf, err := r.reader.Peek(2)
+
+	if err != nil {
+		return "", err
+	}
+	if crlf[0] != '\r' || crlf[1] != '\n' {
+		return "", ProtocolError("expected CRLF after bulk data")
 	}
 
-	return v, nil
+	r.reader.Discard(2)
+
+	return blob.String(), nil
 }
 
-// Reads bulk string in RESP format and returns it
-func (r *Resp) readBulk() (Value, error) {
-	v := Value{}
-	v.typ = "bulk"
+// Reads a length prefixed string that cannot be null
+func (r *Resp) readBlob() (string, error) {
+	length, err := r.readBlobLength()
 
-	// Length of bulk string
-	bytes, _, err := r.readInteger()
+	if err != nil {
+		return "", err
+	}
+	if length < 0 {
+		return "", ProtocolError("invalid bulk length")
+	}
+
+	return r.readBlobData(length)
+}
+
+// Reads a blob error in RESP format and returns it
+func (r *Resp) readBlobError() (Value, error) {
+	blob, err := r.readBlob()
 
 	if err != nil {
-		return v, err
+		return Value{}, err
 	}
 
-	bul := make([]byte, bytes)
+	return Value{typ: "bloberror", str: blob}, nil
+}
 
-	// Read string
-	r.reader.Read(bul)
+// Reads a verbatim string, which starts with its three letter format
+func (r *Resp) readVerbatim() (Value, error) {
+	blob, err := r.readBlob()
 
-	// Store string
-	v.bulk = string(bul)
+	if err != nil {
+		return Value{}, err
+	}
+	if len(blob) < 4 || blob[3] != ':' {
+		return Value{}, fmt.Errorf("invalid verbatim string %q", blob)
+	}
 
-	// Read the trailing CRLF
-	r.readLine()
+	return Value{typ: "verbatim", str: blob[:3], bulk: blob[4:]}, nil
+}
 
-	return v, nil
+// Reads bulk string in RESP format and returns it
+func (r *Resp) readBulk() (Value, error) {
+	length, err := r.readBlobLength()
+
+	if err != nil {
+		return Value{}, err
+	}
+	if length < 0 {
+		return Value{typ: "nullbulk"}, nil
+	}
+
+	bulk, err := r.readBlobData(length)
+
+	if err != nil {
+		return Value{}, err
+	}
+
+	return Value{typ: "bulk", bulk: bulk}, nil
 }
 
 // Parsing RESP protocol for array and returns it
 func (r *Resp) readArray() (Value, error) {
-	v := Value{}
-	v.typ = "array"
-
-	length, _, err := r.readInteger()
+	length, err := r.readAggregateLength()
 
 	if err != nil {
-		return v, err
+		return Value{}, err
+	}
+	if length < 0 {
+		return Value{typ: "nullarray"}, nil
+	}
+
+	return r.readElements("array", length)
+}
+
+// Reads a request sent by a client, either a RESP array of bulk strings or
+// an inline command typed by hand in telnet or netcat. The array is reused
+// by the next call so it must not be kept.
+func (r *Resp) ReadRequest() (Value, error) {
+	for {
+		first, err := r.reader.Peek(1)
+
+		if err != nil {
+			return Value{}, err
+		}
+
+		var args []Value
+
+		if first[0] == ARRAY {
+			args, err = r.readCommand()
+		} else {
+			args, err = r.readInline()
+		}
+
+		if err != nil {
+			return Value{}, err
+		}
+
+		// Empty requests are skipped like Redis does
+		if len(args) > 0 {
+			return Value{typ: "array", array: args}, nil
+		}
+	}
+}
+
+// Reads a command sent as a RESP array, whose arguments must be bulk strings
+func (r *Resp) readCommand() ([]Value, error) {
+	r.reader.ReadByte()
+
+	length, err := r.readAggregateLength()
+
+	if err != nil || length <= 0 {
+		return nil, err
 	}
 
-	v.array = make([]Value, length)
+	args := r.args[:0]
+
+	if cap(args) < min(length, maxPrealloc) {
+		args = make([]Value, 0, min(length, maxPrealloc))
+	}
 
-	// Reads values and stores into array
 	for i := 0; i < length; i++ {
-		cur, err := r.Read()
+		dataType, err := r.reader.ReadByte()
 
 		if err != nil {
-			return v, err
+			return nil, err
 		}
+		if dataType != BULK {
+			return nil, ProtocolError(fmt.Sprintf("expected '$', got '%c'", dataType))
+		}
+
+		arg, err := r.readBulk()
 
-		v.array[i] = cur
+		if err != nil {
+			return nil, err
+		}
+		if arg.typ != "bulk" {
+			return nil, ProtocolError("invalid bulk length")
+		}
+
+		args = append(args, arg)
 	}
 
-	return v, nil
+	// Drop what the previous request left past the new arguments
+	if len(r.args) > len(args) {
+		clear(r.args[len(args):])
+	}
+
+	r.args = args
+
+	return args, nil
 }
 
 // Reads first byte in RESP protocol and executes proper
@@ -429,25 +744,57 @@ func (r *Resp) Read() (Value, error) {
 		return r.readBoolean()
 	case DOUBLES:
 		return r.readDouble()
+	case STRING:
+		return r.readString()
+	case ERROR:
+		return r.readError()
+	case NULL:
+		return r.readNull()
+	case BIGNUMBER:
+		return r.readBigNumber()
+	case BLOBERROR:
+		return r.readBlobError()
+	case VERBATIM:
+		return r.readVerbatim()
 	case MAP:
 		return r.readMap()
 	case SETS:
 		return r.readSet()
+	case PUSH:
+		return r.readPush()
+	case ATTR:
+		return r.readAttribute()
 	default:
-		fmt.Println("Unknown")
-		return Value{}, nil
+		return Value{}, fmt.Errorf("unknown RESP type %q", dataType)
 	}
 }
 
-// Writes to console RESP format
+// Appends a reply in the protocol version of the client. The buffer is
+// written out by Flush, or right away once it grows past writerFlushSize.
 func (w *Writer) Write(v Value) error {
-	var bytes = v.Marshal()
-
-	_, err := w.writer.Write(bytes)
+	w.buf = v.AppendMarshal(w.buf, int(w.protocol.Load()))
 
-	if err != nil {
-		return err
+	if len(w.buf) >= writerFlushSize {
+		return w.Flush()
 	}
 
 	return nil
 }
+
+// Sends the buffered replies to the connection
+func (w *Writer) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	_, err := w.writer.Write(w.buf)
+
+	// A buffer grown by a large reply is not kept around
+	if cap(w.buf) > writerFlushSize {
+		w.buf = nil
+	} else {
+		w.buf = w.buf[:0]
+	}
+
+	return err
+}
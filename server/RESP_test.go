@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Values that must read back exactly as they were marshalled
+var roundTripValues = []Value{
+	{typ: "string", str: "OK"},
+	{typ: "error", str: "ERR something went wrong"},
+	{typ: "integer", num: -42},
+	{typ: "bulk", bulk: ""},
+	{typ: "bulk", bulk: "line\r\nbreak"},
+	{typ: "null"},
+	{typ: "boolean", num: 1},
+	{typ: "boolean", num: 0},
+	{typ: "double", double: 3.25},
+	{typ: "double", double: math.Inf(1)},
+	{typ: "double", double: math.Inf(-1)},
+	{typ: "bignumber", str: "3492890328409238509324850943850943825024385"},
+	{typ: "bignumber", str: "-1"},
+	{typ: "bloberror", str: "SYNTAX invalid\r\nsyntax"},
+	{typ: "verbatim", str: "txt", bulk: "Some string"},
+	{typ: "verbatim", str: "mkd", bulk: ""},
+	{typ: "array", array: []Value{}},
+	{typ: "array", array: []Value{
+		{typ: "bulk", bulk: "a"},
+		{typ: "integer", num: 1},
+		{typ: "array", array: []Value{{typ: "null"}}},
+	}},
+	{typ: "map", array: []Value{
+		{typ: "bulk", bulk: "first"}, {typ: "integer", num: 1},
+		{typ: "string", str: "second"}, {typ: "map", array: []Value{
+			{typ: "bulk", bulk: "nested"}, {typ: "boolean", num: 1},
+		}},
+	}},
+	{typ: "set", array: []Value{
+		{typ: "bulk", bulk: "a"},
+		{typ: "bulk", bulk: "b"},
+	}},
+	{typ: "push", array: []Value{
+		{typ: "bulk", bulk: "message"},
+		{typ: "bulk", bulk: "channel"},
+		{typ: "bulk", bulk: "payload"},
+	}},
+	{
+		typ: "array",
+		array: []Value{
+			{typ: "integer", num: 2039123},
+			{typ: "integer", num: 9543892},
+		},
+		attrs: []Value{
+			{typ: "bulk", bulk: "key-popularity"},
+			{typ: "map", array: []Value{
+				{typ: "bulk", bulk: "a"}, {typ: "double", double: 0.1923},
+				{typ: "bulk", bulk: "b"}, {typ: "double", double: 0.0012},
+			}},
+		},
+	},
+}
+
+func TestMarshalReadRoundTrip(t *testing.T) {
+	for _, want := range roundTripValues {
+		wire := want.Marshal()
+		got, err := NewResp(bytes.NewReader(wire)).Read()
+
+		if err != nil {
+			t.Errorf("Read(%q): %v", wire, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Read(%q) = %+v, want %+v", wire, got, want)
+		}
+	}
+}
+
+func TestReadMarshalRoundTrip(t *testing.T) {
+	wires := []string{
+		"+OK\r\n",
+		"-ERR unknown command\r\n",
+		":1000\r\n",
+		"$5\r\nhello\r\n",
+		"*2\r\n$3\r\nfoo\r\n:1\r\n",
+		"_\r\n",
+		"#t\r\n",
+		"#f\r\n",
+		",1.5\r\n",
+		",inf\r\n",
+		",-inf\r\n",
+		"(3492890328409238509324850943850943825024385\r\n",
+		"!21\r\nSYNTAX invalid syntax\r\n",
+		"=15\r\ntxt:Some string\r\n",
+		"%2\r\n+first\r\n:1\r\n+second\r\n:2\r\n",
+		"~3\r\n+orange\r\n+apple\r\n#t\r\n",
+		">3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n",
+		"|1\r\n+ttl\r\n:3600\r\n$5\r\nvalue\r\n",
+		"*2\r\n|1\r\n+a\r\n:1\r\n:10\r\n:20\r\n",
+		"$-1\r\n",
+		"*-1\r\n",
+		"*2\r\n$-1\r\n*-1\r\n",
+	}
+
+	for _, wire := range wires {
+		v, err := NewResp(strings.NewReader(wire)).Read()
+
+		if err != nil {
+			t.Errorf("Read(%q): %v", wire, err)
+			continue
+		}
+		if got := string(v.Marshal()); got != wire {
+			t.Errorf("Marshal(Read(%q)) = %q", wire, got)
+		}
+	}
+}
+
+func TestReadNaN(t *testing.T) {
+	v, err := NewResp(strings.NewReader(",nan\r\n")).Read()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.typ != "double" || !math.IsNaN(v.double) {
+		t.Fatalf("Read(nan) = %+v", v)
+	}
+	if got := string(v.Marshal()); got != ",nan\r\n" {
+		t.Fatalf("Marshal(nan) = %q", got)
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	wires := []string{
+		"?unknown\r\n",
+		"_x\r\n",
+		"#x\r\n",
+		"(12a\r\n",
+		"=3\r\ntxt\r\n",
+		"$10\r\nshort\r\n",
+		"$3\r\nabcde\r\n",
+		"$-2\r\n",
+		"$x\r\n",
+		"$536870913\r\n",
+		"*-2\r\n",
+		"*2147483648\r\n",
+		"%-1\r\n",
+		"+OK\n",
+	}
+
+	for _, wire := range wires {
+		if v, err := NewResp(strings.NewReader(wire)).Read(); err == nil {
+			t.Errorf("Read(%q) = %+v, want an error", wire, v)
+		}
+	}
+}
+
+func TestResp2Downgrade(t *testing.T) {
+	tests := []struct {
+		v    Value
+		want string
+	}{
+		{Value{typ: "null"}, "$-1\r\n"},
+		{Value{typ: "boolean", num: 1}, ":1\r\n"},
+		{Value{typ: "double", double: 1.5}, "$3\r\n1.5\r\n"},
+		{Value{typ: "bignumber", str: "12345678901234567890"}, "$20\r\n12345678901234567890\r\n"},
+		{Value{typ: "verbatim", str: "txt", bulk: "hi"}, "$2\r\nhi\r\n"},
+		{Value{typ: "bloberror", str: "ERR two\r\nlines"}, "-ERR two  lines\r\n"},
+		{Value{typ: "push", array: []Value{{typ: "bulk", bulk: "pong"}}}, "*1\r\n$4\r\npong\r\n"},
+		{Value{typ: "pairs", array: []Value{{typ: "bulk", bulk: "m"}, {typ: "double", double: 1.5}}}, "*2\r\n$1\r\nm\r\n$3\r\n1.5\r\n"},
+		{Value{typ: "integer", num: 1, attrs: []Value{{typ: "bulk", bulk: "a"}, {typ: "null"}}}, ":1\r\n"},
+	}
+
+	for _, tt := range tests {
+		if got := string(tt.v.AppendMarshal(nil, 2)); got != tt.want {
+			t.Errorf("AppendMarshal(%+v, 2) = %q, want %q", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestResp3Pairs(t *testing.T) {
+	v := Value{typ: "pairs", array: []Value{
+		{typ: "bulk", bulk: "a"}, {typ: "double", double: 1},
+		{typ: "bulk", bulk: "b"}, {typ: "double", double: 2.5},
+	}}
+	want := "*2\r\n*2\r\n$1\r\na\r\n,1\r\n*2\r\n$1\r\nb\r\n,2.5\r\n"
+
+	if got := string(v.AppendMarshal(nil, 3)); got != want {
+		t.Errorf("AppendMarshal(pairs, 3) = %q, want %q", got, want)
+	}
+}
+
+func TestReadRequest(t *testing.T) {
+	tests := []struct {
+		wire string
+		want []string
+	}{
+		{"*2\r\n$3\r\nGET\r\n$1\r\nk\r\n", []string{"GET", "k"}},
+		{"*0\r\n*-1\r\n*1\r\n$4\r\nPING\r\n", []string{"PING"}},
+		{"\r\nset k \"a b\"\r\n", []string{"set", "k", "a b"}},
+	}
+
+	for _, tt := range tests {
+		v, err := NewResp(strings.NewReader(tt.wire)).ReadRequest()
+
+		if err != nil {
+			t.Errorf("ReadRequest(%q): %v", tt.wire, err)
+			continue
+		}
+
+		var got []string
+
+		for _, arg := range v.array {
+			got = append(got, arg.bulk)
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ReadRequest(%q) = %q, want %q", tt.wire, got, tt.want)
+		}
+	}
+}
+
+func TestReadRequestProtocolError(t *testing.T) {
+	tests := []struct {
+		wire string
+		want string
+	}{
+		{"*1\r\n:1\r\n", "Protocol error: expected '$', got ':'"},
+		{"*1\r\n$-1\r\n", "Protocol error: invalid bulk length"},
+		{"*2147483647\r\n", ""},
+		{"*2147483648\r\n", "Protocol error: invalid multibulk length"},
+		{"*x\r\n", "Protocol error: invalid multibulk length"},
+		{"*1\r\n$999999999\r\n", "Protocol error: invalid bulk length"},
+		{"echo \"a\n", "Protocol error: unbalanced quotes in request"},
+		{strings.Repeat("a", protoInlineMaxSize+1), "Protocol error: too big inline request"},
+	}
+
+	for _, tt := range tests {
+		_, err := NewResp(strings.NewReader(tt.wire)).ReadRequest()
+
+		var protocolErr ProtocolError
+		isProtocolErr := errors.As(err, &protocolErr)
+
+		switch {
+		case tt.want == "" && isProtocolErr:
+			t.Errorf("ReadRequest(%.20q) = %v, want a read error", tt.wire, err)
+		case tt.want != "" && (!isProtocolErr || err.Error() != tt.want):
+			t.Errorf("ReadRequest(%.20q) = %v, want %s", tt.wire, err, tt.want)
+		}
+	}
+}
@@ -16,6 +16,10 @@ type Aof struct {
 	mu   sync.Mutex
 }
 
+// Appends a command to the AOF from inside a handler, used when a command is
+// logged in a different form than it was received. Set once the AOF is loaded.
+var propagate = func(value Value) {}
+
 func NewAof(path string) (*Aof, error) {
 	// Create or open file
 	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Clients blocked on a key in the order they blocked, each waiting on its own
+// channel. Like Redis the oldest is served first: only it is woken when the
+// key receives data, and it hands the wake up on to the next in line
+var blockedKeys = map[string][]chan struct{}{}
+var blockedKeysMu = sync.Mutex{}
+
+// Queues a channel that is signalled when any of the keys receives data
+func watchKeys(keys []string) chan struct{} {
+	ch := make(chan struct{}, 1)
+
+	blockedKeysMu.Lock()
+	for _, key := range keys {
+		blockedKeys[key] = append(blockedKeys[key], ch)
+	}
+	blockedKeysMu.Unlock()
+
+	return ch
+}
+
+// Removes a channel queued with watchKeys
+func unwatchKeys(keys []string, ch chan struct{}) {
+	blockedKeysMu.Lock()
+	for _, key := range keys {
+		queue := blockedKeys[key]
+
+		for i := range queue {
+			if queue[i] == ch {
+				queue = append(queue[:i:i], queue[i+1:]...)
+				break
+			}
+		}
+
+		if len(queue) == 0 {
+			delete(blockedKeys, key)
+		} else {
+			blockedKeys[key] = queue
+		}
+	}
+	blockedKeysMu.Unlock()
+}
+
+// Wakes the client queued on key right after ch, or the oldest one when ch is
+// nil, without waiting for it
+func wakeAfter(key string, ch chan struct{}) {
+	blockedKeysMu.Lock()
+	defer blockedKeysMu.Unlock()
+
+	queue := blockedKeys[key]
+	i := 0
+
+	if ch != nil {
+		for i < len(queue) && queue[i] != ch {
+			i++
+		}
+		i++
+	}
+
+	if i < len(queue) {
+		select {
+		case queue[i] <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Wakes the oldest client blocked on key
+func signalKey(key string) {
+	wakeAfter(key, nil)
+}
+
+// Calls try until it succeeds, waiting for one of the keys to be signalled
+// between attempts. A zero timeout waits forever. Returns false on timeout or
+// once the client is closed. Without a client, as for commands run by EXEC,
+// try is called once and nothing is waited for.
+func blockUntil(c *Client, keys []string, timeout time.Duration, try func() bool) bool {
+	if c == nil {
+		return try()
+	}
+
+	var expired <-chan time.Time
+
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	// Queued once before trying so a push between the two is not missed, and
+	// the client keeps its place while it retries
+	ch := watchKeys(keys)
+	woken := false
+
+	for {
+		if try() {
+			unwatchKeys(keys, ch)
+
+			// Whatever is left goes to the next client in line
+			for _, key := range keys {
+				signalKey(key)
+			}
+			return true
+		}
+
+		// Nothing here for this client, the next one may want what arrived
+		if woken {
+			for _, key := range keys {
+				wakeAfter(key, ch)
+			}
+		}
+
+		select {
+		case <-ch:
+			woken = true
+		case <-expired:
+			stopWaiting(keys, ch)
+			return false
+		case <-c.done:
+			stopWaiting(keys, ch)
+			return false
+		}
+	}
+}
+
+// Dequeues a client that gives up, passing on a wake up it did not act on
+func stopWaiting(keys []string, ch chan struct{}) {
+	unwatchKeys(keys, ch)
+
+	select {
+	case <-ch:
+		for _, key := range keys {
+			signalKey(key)
+		}
+	default:
+	}
+}
+
+// Timeouts longer than a time.Duration can hold
+var errTimeoutRange = newReplyError(codeErr, "timeout is out of range")
+
+// Parses a blocking timeout given in seconds
+func parseTimeout(s string) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(s, 64)
+
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return 0, newReplyError(codeErr, "timeout is not a float or out of range")
+	}
+	if seconds < 0 {
+		return 0, newReplyError(codeErr, "timeout is negative")
+	}
+	if seconds >= float64(math.MaxInt64/time.Second) {
+		return 0, errTimeoutRange
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Waits up to a second for the number of clients blocked on key to be want
+func waitBlocked(t *testing.T, key string, want int) {
+	t.Helper()
+
+	for deadline := time.Now().Add(time.Second); ; {
+		blockedKeysMu.Lock()
+		n := len(blockedKeys[key])
+		blockedKeysMu.Unlock()
+
+		if n == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d clients blocked on %s, want %d", n, key, want)
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestBlockingInsideExec(t *testing.T) {
+	c := dialTestServer(t)
+
+	c.expect("+OK\r\n", "MULTI")
+	c.expect("+QUEUED\r\n", "BZPOPMIN", "block:exec", "0")
+	c.expect("+QUEUED\r\n", "XREAD", "BLOCK", "0", "STREAMS", "block:exec:stream", "$")
+	c.expect("*2\r\n*-1\r\n*-1\r\n", "EXEC")
+}
+
+func TestBlockedClientHangup(t *testing.T) {
+	addr := startTestServer(t)
+	c := dialTest(t, addr)
+
+	if _, err := c.conn.Write(commandValue("BZPOPMIN", "block:hangup", "0").Marshal()); err != nil {
+		t.Fatal(err)
+	}
+
+	waitBlocked(t, "block:hangup", 1)
+
+	// Another client's transaction does not stop the first one waiting
+	other := dialTest(t, addr)
+	other.expect("+OK\r\n", "MULTI")
+	other.expect("+QUEUED\r\n", "PING")
+	other.expect("*1\r\n+PONG\r\n", "EXEC")
+	waitBlocked(t, "block:hangup", 1)
+
+	c.conn.Close()
+	waitBlocked(t, "block:hangup", 0)
+}
+
+func TestBlockedClientPipelinesMore(t *testing.T) {
+	addr := startTestServer(t)
+	c := dialTest(t, addr)
+
+	batch := append(commandValue("BZPOPMIN", "block:more", "0").Marshal(), commandValue("PING").Marshal()...)
+
+	if _, err := c.conn.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	waitBlocked(t, "block:more", 1)
+	dialTest(t, addr).expect(":1\r\n", "ZADD", "block:more", "1", "a")
+
+	if v, err := c.resp.Read(); err != nil || len(v.array) != 3 {
+		t.Fatalf("BZPOPMIN = %+v, %v", v, err)
+	}
+
+	// The command pipelined behind it was kept while it waited
+	if v, err := c.resp.Read(); err != nil || v.str != "PONG" {
+		t.Fatalf("PING after BZPOPMIN = %+v, %v", v, err)
+	}
+}
+
+func TestBlockedClientsServedInOrder(t *testing.T) {
+	addr := startTestServer(t)
+
+	for round := 0; round < 20; round++ {
+		first, second := dialTest(t, addr), dialTest(t, addr)
+
+		if _, err := first.conn.Write(commandValue("BZPOPMIN", "block:fifo", "0").Marshal()); err != nil {
+			t.Fatal(err)
+		}
+		waitBlocked(t, "block:fifo", 1)
+
+		if _, err := second.conn.Write(commandValue("BZPOPMIN", "block:fifo", "0").Marshal()); err != nil {
+			t.Fatal(err)
+		}
+		waitBlocked(t, "block:fifo", 2)
+
+		pusher := dialTest(t, addr)
+		pusher.expect(":1\r\n", "ZADD", "block:fifo", "1", "a")
+		first.receive("*3\r\n$10\r\nblock:fifo\r\n$1\r\na\r\n$1\r\n1\r\n")
+
+		pusher.expect(":1\r\n", "ZADD", "block:fifo", "2", "b")
+		second.receive("*3\r\n$10\r\nblock:fifo\r\n$1\r\nb\r\n$1\r\n2\r\n")
+	}
+}
+
+func TestGeoAddWakesBlockedPop(t *testing.T) {
+	addr := startTestServer(t)
+	c := dialTest(t, addr)
+
+	if _, err := c.conn.Write(commandValue("BZPOPMIN", "block:geo", "0").Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	waitBlocked(t, "block:geo", 1)
+
+	dialTest(t, addr).expect(":1\r\n", "GEOADD", "block:geo", "13.361389", "38.115556", "Palermo")
+
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	if v, err := c.resp.Read(); err != nil || len(v.array) != 3 || v.array[1].bulk != "Palermo" {
+		t.Fatalf("BZPOPMIN = %+v, %v", v, err)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Messages a subscriber may have waiting before it is considered too slow
+// and disconnected, like the pubsub client-output-buffer-limit of Redis
+const clientQueueSize = 1024
+
+// Source of client IDs, the first client gets 1
+var clientIDs atomic.Int64
+
+// State of a connected client
+type Client struct {
+	id     int64
+	name   string
+	conn   net.Conn
+	writer *Writer
+
+	// False until AUTH or HELLO succeeds while requirepass is set
+	authenticated bool
+
+	// Nil until the first subscription starts the delivery goroutine. From
+	// then on replies are queued behind the messages so both stay in order.
+	out       chan Value
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// Subscriptions, only touched by the goroutine serving the client
+	channels      map[string]bool
+	patterns      map[string]bool
+	shardChannels map[string]bool
+}
+
+// Creates the state of a new connection
+func NewClient(conn net.Conn) *Client {
+	return &Client{
+		id:            clientIDs.Add(1),
+		authenticated: configString("requirepass") == "",
+		conn:          conn,
+		writer:        NewWriter(conn),
+		done:          make(chan struct{}),
+		channels:      map[string]bool{},
+		patterns:      map[string]bool{},
+		shardChannels: map[string]bool{},
+	}
+}
+
+// Sends a reply to the client
+func (c *Client) send(v Value) {
+	countErrorReply(v)
+
+	if c.out == nil {
+		c.writer.Write(v)
+		return
+	}
+
+	select {
+	case c.out <- v:
+	case <-c.done:
+	}
+}
+
+// Queues a message without waiting, dropping the client when its queue is
+// full so a slow reader never holds up the sender
+func (c *Client) push(v Value) {
+	select {
+	case c.out <- v:
+	default:
+		c.Close()
+	}
+}
+
+// Starts writing queued values to the connection in the background
+func (c *Client) startDelivery() {
+	if c.out != nil {
+		return
+	}
+
+	c.out = make(chan Value, clientQueueSize)
+
+	go func() {
+		for {
+			select {
+			case v := <-c.out:
+				if v.typ == "close" {
+					c.writer.Flush()
+					c.Close()
+					return
+				}
+				if err := c.writer.Write(v); err != nil {
+					c.Close()
+					return
+				}
+
+				// Flush once the queue is drained so bursts share a write
+				if len(c.out) == 0 {
+					if err := c.writer.Flush(); err != nil {
+						c.Close()
+						return
+					}
+				}
+			case <-c.done:
+				return
+			}
+		}
+	}()
+}
+
+// Writes the buffered replies, which the delivery goroutine does on its
+// own once it has started
+func (c *Client) flush() {
+	if c.out != nil {
+		return
+	}
+
+	if err := c.writer.Flush(); err != nil {
+		c.Close()
+	}
+}
+
+// Closes the connection once the replies sent so far are written, and
+// returns when it is closed
+func (c *Client) closeAfterReplies() {
+	c.flush()
+
+	if c.out == nil {
+		c.Close()
+		return
+	}
+
+	c.send(Value{typ: "close"})
+	<-c.done
+}
+
+// Closes the client if the peer hangs up while a command waits. Nothing else
+// may read from reader until the returned function, which stops watching,
+// has been called.
+func (c *Client) watchHangup(reader *bufio.Reader) func() {
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		// Returns with data when the client pipelined more commands, which
+		// are then read once the wait is over
+		if _, err := reader.Peek(1); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			c.Close()
+		}
+	}()
+
+	return func() {
+		c.conn.SetReadDeadline(time.Now())
+		<-stopped
+		c.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// Reports whether the connection was closed by the server
+func (c *Client) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Closes the connection, which also ends the goroutine serving it
+func (c *Client) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// Protocol version the client speaks
+func (c *Client) protocol() int {
+	return int(c.writer.protocol.Load())
+}
+
+// Errors of AUTH and HELLO
+var (
+	errNoAuth    = newReplyError(codeNoAuth, "Authentication required.")
+	errWrongPass = newReplyError(codeWrongPass, "invalid username-password pair or user is disabled.")
+)
+
+// Checks credentials against requirepass. Only the default user exists and
+// any password is accepted for it while requirepass is empty.
+func checkPassword(username string, password string) error {
+	requirepass := configString("requirepass")
+
+	if username != "default" || (requirepass != "" && password != requirepass) {
+		return errWrongPass
+	}
+
+	return nil
+}
+
+// AUTH [username] password
+func auth(c *Client, args []Value) {
+	username := "default"
+
+	switch len(args) {
+	case 1:
+		if configString("requirepass") == "" {
+			c.send(errorValue(codeErr, "AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?"))
+			return
+		}
+	case 2:
+		username = args[0].bulk
+	default:
+		c.send(errorReply(errSyntax))
+		return
+	}
+
+	if err := checkPassword(username, args[len(args)-1].bulk); err != nil {
+		c.send(errorReply(err))
+		return
+	}
+
+	c.authenticated = true
+	c.send(Value{typ: "string", str: "OK"})
+}
+
+// Client names are sent in CLIENT LIST so they cannot hold spaces
+func validClientName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+func hello(c *Client, args []Value) {
+	protocol := c.protocol()
+	var username, password, name string
+	var withAuth, withName bool
+
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0].bulk)
+
+		if err != nil {
+			c.send(errorValue(codeErr, "Protocol version is not an integer or out of range"))
+			return
+		}
+
+		protocol = n
+	}
+
+	for i := 1; i < len(args); i++ {
+		moreArgs := len(args) - 1 - i
+
+		switch opt := strings.ToUpper(args[i].bulk); {
+		case opt == "AUTH" && moreArgs >= 2:
+			username, password = args[i+1].bulk, args[i+2].bulk
+			withAuth = true
+			i += 2
+		case opt == "SETNAME" && moreArgs >= 1:
+			name = args[i+1].bulk
+			withName = true
+			i++
+		default:
+			c.send(errorValue(codeErr, "Syntax error in HELLO option '"+args[i].bulk+"'"))
+			return
+		}
+	}
+
+	if protocol < 2 || protocol > 3 {
+		c.send(errorValue(codeNoProto, "unsupported protocol version"))
+		return
+	}
+
+	if withAuth {
+		if err := checkPassword(username, password); err != nil {
+			c.send(errorReply(err))
+			return
+		}
+
+		c.authenticated = true
+	}
+
+	if !c.authenticated {
+		c.send(errorValue(codeNoAuth, "HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time"))
+		return
+	}
+
+	if withName {
+		if !validClientName(name) {
+			c.send(errorValue(codeErr, "Client names cannot contain spaces, newlines or special characters."))
+			return
+		}
+
+		c.name = name
+	}
+
+	c.writer.protocol.Store(int32(protocol))
+
+	role := "master"
+
+	if RedisInstance.role == "slave" {
+		role = "replica"
+	}
+
+	c.send(Value{typ: "map", array: []Value{
+		{typ: "bulk", bulk: "server"}, {typ: "bulk", bulk: "redis"},
+		{typ: "bulk", bulk: "version"}, {typ: "bulk", bulk: serverVersion},
+		{typ: "bulk", bulk: "proto"}, {typ: "integer", num: protocol},
+		{typ: "bulk", bulk: "id"}, {typ: "integer", num: int(c.id)},
+		{typ: "bulk", bulk: "mode"}, {typ: "bulk", bulk: "standalone"},
+		{typ: "bulk", bulk: "role"}, {typ: "bulk", bulk: role},
+		{typ: "bulk", bulk: "modules"}, {typ: "array", array: []Value{}},
+	}})
+}
+
+// QUIT
+func quit(c *Client, args []Value) {
+	c.send(Value{typ: "string", str: "OK"})
+	c.closeAfterReplies()
+}
+
+// RESET returns the connection to the state of a new one
+func reset(c *Client, args []Value) {
+	if len(args) != 0 {
+		c.send(arityError("reset"))
+		return
+	}
+
+	c.unsubscribeAll()
+	c.name = ""
+	c.authenticated = configString("requirepass") == ""
+	c.writer.protocol.Store(2)
+	c.send(Value{typ: "string", str: "RESET"})
+}
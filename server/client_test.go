@@ -0,0 +1,75 @@
+package main
+
+import "testing"
+
+func TestHelloNegotiation(t *testing.T) {
+	c := dialTestServer(t)
+
+	c.expect("-NOPROTO unsupported protocol version\r\n", "HELLO", "4")
+	c.expect("-ERR Protocol version is not an integer or out of range\r\n", "HELLO", "three")
+	c.expect("-ERR Syntax error in HELLO option 'FOO'\r\n", "HELLO", "3", "FOO")
+	c.expect("-ERR Client names cannot contain spaces, newlines or special characters.\r\n", "HELLO", "3", "SETNAME", "a b")
+
+	// Without a version HELLO keeps the protocol and replies in it
+	v := c.do("HELLO")
+	if v.typ != "array" || len(v.array) != 14 || v.array[4].bulk != "proto" || v.array[5].num != 2 {
+		t.Fatalf("HELLO = %q, want the server map flattened for RESP2", v.Marshal())
+	}
+
+	c.do("HSET", "hello:h", "f", "v")
+	c.do("ZADD", "hello:z", "1.5", "m")
+	c.expect("*2\r\n$1\r\nf\r\n$1\r\nv\r\n", "HGETALL", "hello:h")
+	c.expect("$3\r\n1.5\r\n", "ZSCORE", "hello:z", "m")
+	c.expect("$-1\r\n", "GET", "hello:missing")
+
+	v = c.do("HELLO", "3", "SETNAME", "resp3-client")
+	if v.typ != "map" || v.array[5].num != 3 {
+		t.Fatalf("HELLO 3 = %q, want a map with proto 3", v.Marshal())
+	}
+
+	// RESP3 replies keep their types
+	c.expect("%1\r\n$1\r\nf\r\n$1\r\nv\r\n", "HGETALL", "hello:h")
+	c.expect(",1.5\r\n", "ZSCORE", "hello:z", "m")
+	c.expect("_\r\n", "GET", "hello:missing")
+	c.expect("*1\r\n*2\r\n$1\r\nm\r\n,1.5\r\n", "ZRANGE", "hello:z", "0", "-1", "WITHSCORES")
+
+	c.do("HELLO", "2")
+	c.expect("*2\r\n$1\r\nm\r\n$3\r\n1.5\r\n", "ZRANGE", "hello:z", "0", "-1", "WITHSCORES")
+	c.expect("$3\r\n1.5\r\n", "ZSCORE", "hello:z", "m")
+	c.expect("$-1\r\n", "GET", "hello:missing")
+}
+
+func TestAuth(t *testing.T) {
+	addr := startTestServer(t)
+	c := dialTest(t, addr)
+	t.Cleanup(func() { runCommand("CONFIG", "SET", "requirepass", "") })
+
+	c.expect("-ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?\r\n", "AUTH", "secret")
+	c.expect("+OK\r\n", "AUTH", "default", "anything")
+	c.expect("-WRONGPASS invalid username-password pair or user is disabled.\r\n", "AUTH", "alice", "anything")
+
+	// Connections made before requirepass was set stay authenticated
+	c.expect("+OK\r\n", "CONFIG", "SET", "requirepass", "secret")
+	c.expect("$-1\r\n", "GET", "auth:k")
+
+	locked := dialTest(t, addr)
+	locked.expect("-NOAUTH Authentication required.\r\n", "GET", "auth:k")
+	locked.expect("-NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time\r\n", "HELLO", "3")
+	locked.expect("-WRONGPASS invalid username-password pair or user is disabled.\r\n", "AUTH", "wrong")
+	locked.expect("-NOAUTH Authentication required.\r\n", "GET", "auth:k")
+	locked.expect("+OK\r\n", "AUTH", "secret")
+	locked.expect("$-1\r\n", "GET", "auth:k")
+
+	// HELLO authenticates and switches protocol in one step
+	other := dialTest(t, addr)
+	other.expect("-WRONGPASS invalid username-password pair or user is disabled.\r\n", "HELLO", "3", "AUTH", "default", "wrong")
+	other.expect("-NOAUTH Authentication required.\r\n", "GET", "auth:k")
+	if v := other.do("HELLO", "3", "AUTH", "default", "secret"); v.typ != "map" {
+		t.Fatalf("HELLO 3 AUTH = %q, want a map", v.Marshal())
+	}
+	other.expect("_\r\n", "GET", "auth:k")
+
+	// RESET forgets the authentication
+	other.expect("+RESET\r\n", "RESET")
+	other.expect("-NOAUTH Authentication required.\r\n", "GET", "auth:k")
+}
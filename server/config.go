@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Server configuration parameters and their current values
+var configs = map[string]string{
+	"dir":                       "/tmp/redis-data",
+	"dbfilename":                "dump.rdb",
+	"hash-max-listpack-entries": "128",
+	"hash-max-listpack-value":   "64",
+	"set-max-listpack-entries":  "128",
+	"set-max-listpack-value":    "64",
+	"zset-max-listpack-entries": "128",
+	"zset-max-listpack-value":   "64",
+	"stream-node-max-entries":   "100",
+	"stream-node-max-bytes":     "4096",
+	"hll-sparse-max-bytes":      "3000",
+	"maxmemory-policy":          "noeviction",
+	"lfu-log-factor":            "10",
+	"lfu-decay-time":            "1",
+	"notify-keyspace-events":    "",
+	"requirepass":               "",
+	"proto-max-bulk-len":        "536870912",
+}
+var configsMu = sync.RWMutex{}
+
+// Older names still accepted by CONFIG SET
+var configAliases = map[string]string{
+	"hash-max-ziplist-entries": "hash-max-listpack-entries",
+	"hash-max-ziplist-value":   "hash-max-listpack-value",
+	"zset-max-ziplist-entries": "zset-max-listpack-entries",
+	"zset-max-ziplist-value":   "zset-max-listpack-value",
+}
+
+// Checks applied to a value before CONFIG SET stores it
+var configValidators = map[string]func(string) error{
+	"hash-max-listpack-entries": validateConfigInt,
+	"hash-max-listpack-value":   validateConfigInt,
+	"set-max-listpack-entries":  validateConfigInt,
+	"set-max-listpack-value":    validateConfigInt,
+	"zset-max-listpack-entries": validateConfigInt,
+	"zset-max-listpack-value":   validateConfigInt,
+	"stream-node-max-entries":   validateConfigInt,
+	"stream-node-max-bytes":     validateConfigInt,
+	"hll-sparse-max-bytes":      validateConfigInt,
+	"maxmemory-policy":          validateMaxmemoryPolicy,
+	"lfu-log-factor":            validateConfigInt,
+	"lfu-decay-time":            validateConfigInt,
+	"notify-keyspace-events":    validateNotifyFlags,
+	"proto-max-bulk-len":        validateProtoMaxBulkLen,
+}
+
+// Rewrites valid values into the form CONFIG GET reports
+var configNormalizers = map[string]func(string) string{
+	"notify-keyspace-events": normalizeNotifyFlags,
+}
+
+// Updates state derived from a parameter once CONFIG SET stored it, called
+// with configsMu held for writing
+var configAppliers = map[string]func(string){
+	"notify-keyspace-events": applyNotifyFlags,
+}
+
+// Accepts non negative integers
+func validateConfigInt(value string) error {
+	n, err := strconv.Atoi(value)
+
+	if err != nil {
+		return errors.New("argument couldn't be parsed into an integer")
+	}
+	if n < 0 {
+		return errors.New("argument must be between 0 and 2147483647 inclusive")
+	}
+
+	return nil
+}
+
+// Bulk strings may not be limited below 1mb, the Redis minimum
+func validateProtoMaxBulkLen(value string) error {
+	n, err := strconv.Atoi(value)
+
+	if err != nil {
+		return errors.New("argument couldn't be parsed into an integer")
+	}
+	if n < 1024*1024 {
+		return errors.New("argument must be between 1048576 and 9223372036854775807 inclusive")
+	}
+
+	return nil
+}
+
+// Returns a parameter as it is stored
+func configString(name string) string {
+	configsMu.RLock()
+	defer configsMu.RUnlock()
+
+	return configs[name]
+}
+
+// Returns an integer parameter
+func configInt(name string) int {
+	configsMu.RLock()
+	n, _ := strconv.Atoi(configs[name])
+	configsMu.RUnlock()
+
+	return n
+}
+
+// CONFIG GET parameter [parameter ...] and CONFIG SET parameter value [parameter value ...]
+func config(args []Value) Value {
+	if len(args) < 2 {
+		return arityError("config")
+	}
+
+	switch strings.ToUpper(args[0].bulk) {
+	case "GET":
+		return configGet(args[1:])
+	case "SET":
+		if len(args)%2 != 1 {
+			return arityError("config|set")
+		}
+		return configSet(args[1:])
+	default:
+		return errorValue(codeErr, "unknown subcommand '"+args[0].bulk+"'. Try CONFIG HELP.")
+	}
+}
+
+// Replies with every parameter matching any of the glob patterns
+func configGet(patterns []Value) Value {
+	matched := map[string]bool{}
+
+	configsMu.RLock()
+	defer configsMu.RUnlock()
+
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(globToRegex(strings.ToLower(pattern.bulk)))
+
+		if err != nil {
+			continue
+		}
+
+		for name := range configs {
+			if re.MatchString(name) {
+				matched[name] = true
+			}
+		}
+	}
+
+	names := make([]string, 0, len(matched))
+
+	for name := range matched {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	list := make([]Value, 0, len(names)*2)
+
+	for _, name := range names {
+		list = append(list, Value{typ: "bulk", bulk: name})
+		list = append(list, Value{typ: "bulk", bulk: configs[name]})
+	}
+
+	return Value{typ: "map", array: list}
+}
+
+// Validates every pair before applying any of them
+func configSet(pairs []Value) Value {
+	updates := map[string]string{}
+
+	for i := 0; i < len(pairs); i += 2 {
+		name := strings.ToLower(pairs[i].bulk)
+		value := pairs[i+1].bulk
+
+		if alias, ok := configAliases[name]; ok {
+			name = alias
+		}
+
+		configsMu.RLock()
+		_, ok := configs[name]
+		configsMu.RUnlock()
+
+		if !ok {
+			return errorValue(codeErr, "Unknown option or number of arguments for CONFIG SET - '"+pairs[i].bulk+"'")
+		}
+
+		if validate, ok := configValidators[name]; ok {
+			if err := validate(value); err != nil {
+				return errorValue(codeErr, "CONFIG SET failed (possibly related to argument '"+pairs[i].bulk+"') - "+err.Error())
+			}
+		}
+
+		if normalize, ok := configNormalizers[name]; ok {
+			value = normalize(value)
+		}
+
+		updates[name] = value
+	}
+
+	configsMu.Lock()
+	for name, value := range updates {
+		configs[name] = value
+
+		if apply, ok := configAppliers[name]; ok {
+			apply(value)
+		}
+	}
+	configsMu.Unlock()
+
+	return Value{typ: "string", str: "OK"}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Seeds shared by the codec fuzz targets
+var fuzzWireSeeds = []string{
+	"+OK\r\n",
+	"-ERR bad\r\n",
+	":12\r\n",
+	"$3\r\nfoo\r\n",
+	"$-1\r\n",
+	"*-1\r\n",
+	"*2\r\n$3\r\nGET\r\n$1\r\nk\r\n",
+	"_\r\n",
+	"#t\r\n",
+	",1.5\r\n",
+	",nan\r\n",
+	"(123456789012345678901234567890\r\n",
+	"!3\r\nERR\r\n",
+	"=7\r\ntxt:abc\r\n",
+	"%1\r\n+k\r\n:1\r\n",
+	"~2\r\n+a\r\n+b\r\n",
+	">2\r\n+message\r\n$1\r\nx\r\n",
+	"|1\r\n+ttl\r\n:1\r\n$1\r\nv\r\n",
+	"~0\r\n",
+	"set k \"a b\" 'c'\r\n",
+}
+
+func FuzzRead(f *testing.F) {
+	for _, seed := range fuzzWireSeeds {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		resp := NewResp(bytes.NewReader(data))
+
+		for {
+			if _, err := resp.Read(); err != nil {
+				break
+			}
+		}
+
+		resp = NewResp(bytes.NewReader(data))
+
+		for {
+			value, err := resp.ReadRequest()
+
+			if err != nil {
+				break
+			}
+			if value.typ != "array" || len(value.array) == 0 {
+				t.Fatalf("ReadRequest(%q) = %+v", data, value)
+			}
+		}
+	})
+}
+
+func FuzzMarshalRoundTrip(f *testing.F) {
+	for _, seed := range fuzzWireSeeds {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		value, err := NewResp(bytes.NewReader(data)).Read()
+
+		if err != nil {
+			return
+		}
+
+		// The input may spell a value in several ways, its marshalled form
+		// has to read back to the same value
+		wire := value.Marshal()
+		again, err := NewResp(bytes.NewReader(wire)).Read()
+
+		if err != nil {
+			t.Fatalf("Read(Marshal(%+v)) = %q: %v", value, wire, err)
+		}
+		if rewire := again.Marshal(); !bytes.Equal(rewire, wire) {
+			t.Fatalf("Marshal(Read(%q)) = %q", wire, rewire)
+		}
+
+		for _, protocol := range []int{2, 3} {
+			reply := value.AppendMarshal(nil, protocol)
+
+			if _, err := NewResp(bytes.NewReader(reply)).Read(); err != nil {
+				t.Fatalf("Read(AppendMarshal(%+v, %d)) = %q: %v", value, protocol, reply, err)
+			}
+		}
+	})
+}
+
+// Commands left out of dispatch fuzzing because they close connections or
+// only make sense on one
+var fuzzSkippedCommands = map[string]bool{
+	"PSYNC":    true,
+	"REPLCONF": true,
+}
+
+func FuzzHandlers(f *testing.F) {
+	var commands []string
+
+	for name := range Handlers {
+		if !fuzzSkippedCommands[name] {
+			commands = append(commands, name)
+		}
+	}
+
+	sort.Strings(commands)
+
+	// A command index followed by its arguments separated by zero bytes
+	index := map[string]uint8{}
+
+	for i, name := range commands {
+		index[name] = uint8(i)
+		f.Add(uint8(i), "")
+		f.Add(uint8(i), "key\x00value")
+	}
+
+	// Arguments that get past the parsing of particular commands
+	seeds := []struct {
+		command string
+		args    string
+	}{
+		{"ZRANGE", "key\x000\x00-1"},
+		{"XADD", "key\x00*\x00field\x00value"},
+		{"XREAD", "STREAMS\x00key\x00$"},
+		{"ZADD", "key\x00NX\x001.5\x00member"},
+		{"ZUNIONSTORE", "dst\x002\x00a\x00b\x00WEIGHTS\x001\x002"},
+		{"GEOADD", "key\x0013.36\x0038.11\x00m"},
+		{"GEOSEARCH", "key\x00FROMLONLAT\x000\x000\x00BYRADIUS\x001\x00km"},
+	}
+
+	for _, seed := range seeds {
+		i, ok := index[seed.command]
+
+		if !ok {
+			f.Fatalf("seed for unknown command %s", seed.command)
+		}
+
+		f.Add(i, seed.args)
+	}
+
+	f.Fuzz(func(t *testing.T, index uint8, args string) {
+		command := commands[int(index)%len(commands)]
+		var argv []Value
+
+		if args != "" {
+			for _, arg := range strings.Split(args, "\x00") {
+				argv = append(argv, Value{typ: "bulk", bulk: arg})
+			}
+		}
+
+		reply := Handlers[command](argv)
+
+		// A MULTI left open would queue the commands of later tests
+		discardTransaction()
+
+		if _, err := NewResp(bytes.NewReader(reply.Marshal())).Read(); err != nil {
+			t.Fatalf("%s %q replied %+v: %v", command, args, reply, err)
+		}
+	})
+}
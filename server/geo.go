@@ -0,0 +1,768 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Geohash parameters, identical to Redis. Latitudes stop where the Web
+// Mercator projection does.
+const (
+	geoLatMin       = -85.05112878
+	geoLatMax       = 85.05112878
+	geoLonMin       = -180.0
+	geoLonMax       = 180.0
+	geoStepMax      = 26 // bits per coordinate, 52 in total
+	geoEarthRadius  = 6372797.560856
+	geoMercatorMax  = 20037726.37
+	geoHashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+)
+
+// Cell of the geohash grid covering a range of longitudes and latitudes
+type geoArea struct {
+	bits           uint64
+	step           uint
+	lonMin, lonMax float64
+	latMin, latMax float64
+}
+
+// Search shape of GEOSEARCH, sizes are in meters
+type geoShape struct {
+	lon, lat      float64
+	radius        float64 // zero for boxes
+	width, height float64
+	box           bool
+}
+
+// Member found by a search
+type geoPoint struct {
+	member   string
+	score    float64
+	lon, lat float64
+	dist     float64 // in meters
+}
+
+// Error for a member missing from the sorted set
+var errGeoMember = newReplyError(codeErr, "could not decode requested zset member")
+
+// Spreads the bits of x over the even bits and those of y over the odd bits
+func interleave64(x uint32, y uint32) uint64 {
+	var bits uint64
+
+	for i := 0; i < 32; i++ {
+		bits |= uint64(x>>i&1) << (2 * i)
+		bits |= uint64(y>>i&1) << (2*i + 1)
+	}
+
+	return bits
+}
+
+// Reverses interleave64
+func deinterleave64(bits uint64) (uint32, uint32) {
+	var x, y uint32
+
+	for i := 0; i < 32; i++ {
+		x |= uint32(bits>>(2*i)&1) << i
+		y |= uint32(bits>>(2*i+1)&1) << i
+	}
+
+	return x, y
+}
+
+// Encodes a position with the given number of bits per coordinate, latitudes
+// in the even bits and longitudes in the odd ones
+func geohashEncode(lon float64, lat float64, latMin float64, latMax float64, step uint) uint64 {
+	latOffset := (lat - latMin) / (latMax - latMin) * float64(uint64(1)<<step)
+	lonOffset := (lon - geoLonMin) / (geoLonMax - geoLonMin) * float64(uint64(1)<<step)
+
+	return interleave64(uint32(latOffset), uint32(lonOffset))
+}
+
+// Returns the cell of the grid a geohash stands for
+func geohashDecode(bits uint64, step uint) geoArea {
+	latCell, lonCell := deinterleave64(bits)
+	cells := float64(uint64(1) << step)
+
+	return geoArea{
+		bits:   bits,
+		step:   step,
+		latMin: geoLatMin + float64(latCell)/cells*(geoLatMax-geoLatMin),
+		latMax: geoLatMin + float64(latCell+1)/cells*(geoLatMax-geoLatMin),
+		lonMin: geoLonMin + float64(lonCell)/cells*(geoLonMax-geoLonMin),
+		lonMax: geoLonMin + float64(lonCell+1)/cells*(geoLonMax-geoLonMin),
+	}
+}
+
+// Returns the position of a 52 bit score, the center of its cell
+func geoDecodeScore(score float64) (float64, float64) {
+	area := geohashDecode(uint64(score), geoStepMax)
+	lon := math.Max(geoLonMin, math.Min(geoLonMax, (area.lonMin+area.lonMax)/2))
+	lat := math.Max(geoLatMin, math.Min(geoLatMax, (area.latMin+area.latMax)/2))
+
+	return lon, lat
+}
+
+// Radians in a degree, multiplied by as Redis does so distances round the same
+const geoDegToRad = math.Pi / 180
+
+// Converts degrees to radians
+func degRad(deg float64) float64 {
+	return deg * geoDegToRad
+}
+
+// Converts radians to degrees
+func radDeg(rad float64) float64 {
+	return rad / geoDegToRad
+}
+
+// Haversine distance in meters between two positions
+func geoDistance(lon1 float64, lat1 float64, lon2 float64, lat2 float64) float64 {
+	lat1r, lat2r := degRad(lat1), degRad(lat2)
+	u := math.Sin((lat2r - lat1r) / 2)
+	v := math.Sin((degRad(lon2) - degRad(lon1)) / 2)
+
+	return 2 * geoEarthRadius * math.Asin(math.Sqrt(u*u+math.Cos(lat1r)*math.Cos(lat2r)*v*v))
+}
+
+// Returns the distance of a position from the center of the shape, false
+// when the position is outside of it
+func (s geoShape) contains(lon float64, lat float64) (float64, bool) {
+	if !s.box {
+		dist := geoDistance(s.lon, s.lat, lon, lat)
+		return dist, dist <= s.radius
+	}
+
+	// The latitude check is cheaper so it goes first
+	if geoEarthRadius*math.Abs(degRad(lat)-degRad(s.lat)) > s.height/2 {
+		return 0, false
+	}
+	if geoDistance(lon, lat, s.lon, lat) > s.width/2 {
+		return 0, false
+	}
+
+	return geoDistance(s.lon, s.lat, lon, lat), true
+}
+
+// Returns the longitudes and latitudes bounding the shape
+func (s geoShape) bounds() (lonMin float64, latMin float64, lonMax float64, latMax float64) {
+	height, width := s.radius, s.radius
+
+	if s.box {
+		height, width = s.height/2, s.width/2
+	}
+
+	latDelta := radDeg(height / geoEarthRadius)
+	lonDeltaTop := radDeg(width / geoEarthRadius / math.Cos(degRad(s.lat+latDelta)))
+	lonDeltaBottom := radDeg(width / geoEarthRadius / math.Cos(degRad(s.lat-latDelta)))
+	lonDelta := lonDeltaTop
+
+	if s.lat < 0 {
+		lonDelta = lonDeltaBottom
+	}
+
+	return s.lon - lonDelta, s.lat - latDelta, s.lon + lonDelta, s.lat + latDelta
+}
+
+// Picks a cell size where the search radius spans about one cell
+func geoEstimateSteps(meters float64, lat float64) uint {
+	if meters == 0 {
+		return geoStepMax
+	}
+
+	step := 1
+
+	for meters < geoMercatorMax {
+		meters *= 2
+		step++
+	}
+
+	// Make sure the range is included in most of the base cases
+	step -= 2
+
+	// Cells shrink towards the poles
+	if lat > 66 || lat < -66 {
+		step--
+		if lat > 80 || lat < -80 {
+			step--
+		}
+	}
+
+	return uint(max(1, min(geoStepMax, step)))
+}
+
+// Returns the cell around the center of the shape and its eight neighbours,
+// leaving out the neighbours the shape cannot reach
+func (s geoShape) areas() []geoArea {
+	lonMin, latMin, lonMax, latMax := s.bounds()
+	meters := s.radius
+
+	if s.box {
+		meters = math.Sqrt((s.width/2)*(s.width/2) + (s.height/2)*(s.height/2))
+	}
+
+	step := geoEstimateSteps(meters, s.lat)
+	center := geohashDecode(geohashEncode(s.lon, s.lat, geoLatMin, geoLatMax, step), step)
+	cellLon, cellLat := center.lonMax-center.lonMin, center.latMax-center.latMin
+
+	// Cells next to the search area may still be too small to cover it
+	if step > 1 && (center.latMax+cellLat < latMax || center.latMin-cellLat > latMin ||
+		center.lonMax+cellLon < lonMax || center.lonMin-cellLon > lonMin) {
+		step--
+		center = geohashDecode(geohashEncode(s.lon, s.lat, geoLatMin, geoLatMax, step), step)
+		cellLon, cellLat = center.lonMax-center.lonMin, center.latMax-center.latMin
+	}
+
+	areas := []geoArea{}
+	seen := map[uint64]bool{}
+
+	for _, dLat := range []int{0, 1, -1} {
+		for _, dLon := range []int{0, 1, -1} {
+			if step >= 2 && ((dLat < 0 && center.latMin < latMin) || (dLat > 0 && center.latMax > latMax) ||
+				(dLon < 0 && center.lonMin < lonMin) || (dLon > 0 && center.lonMax > lonMax)) {
+				continue
+			}
+
+			lat := (center.latMin+center.latMax)/2 + float64(dLat)*cellLat
+			lon := (center.lonMin+center.lonMax)/2 + float64(dLon)*cellLon
+
+			if lat < geoLatMin || lat > geoLatMax {
+				continue
+			}
+
+			// Longitudes wrap around the antimeridian
+			if lon < geoLonMin {
+				lon += 360
+			} else if lon > geoLonMax {
+				lon -= 360
+			}
+
+			bits := geohashEncode(lon, lat, geoLatMin, geoLatMax, step)
+
+			if !seen[bits] {
+				seen[bits] = true
+				areas = append(areas, geohashDecode(bits, step))
+			}
+		}
+	}
+
+	return areas
+}
+
+// Finds the members of a sorted set inside the shape by scanning the score
+// ranges of the cells covering it. Stops after count members when any is set.
+func geoSearch(z *ZSet, shape geoShape, count int, any bool) []geoPoint {
+	points := []geoPoint{}
+
+	for _, area := range shape.areas() {
+		shift := 2 * (geoStepMax - area.step)
+		r := zscoreRange{
+			min:   float64(area.bits << shift),
+			max:   float64((area.bits + 1) << shift),
+			maxex: true,
+		}
+
+		for _, e := range z.rangeByScore(r, false, 0, -1) {
+			lon, lat := geoDecodeScore(e.score)
+
+			if dist, ok := shape.contains(lon, lat); ok {
+				points = append(points, geoPoint{member: e.member, score: e.score, lon: lon, lat: lat, dist: dist})
+
+				if any && len(points) == count {
+					return points
+				}
+			}
+		}
+	}
+
+	return points
+}
+
+// Returns the number of meters in a unit
+func geoUnit(unit string) (float64, error) {
+	switch strings.ToLower(unit) {
+	case "m":
+		return 1, nil
+	case "km":
+		return 1000, nil
+	case "ft":
+		return 0.3048, nil
+	case "mi":
+		return 1609.34, nil
+	}
+	return 0, newReplyError(codeErr, "unsupported unit provided. please use M, KM, FT, MI")
+}
+
+// Formats a distance in the given unit as Redis does
+func geoFormatDist(meters float64, unit float64) string {
+	return strconv.FormatFloat(meters/unit, 'f', 4, 64)
+}
+
+// Formats a coordinate with as many digits as Redis prints
+func geoFormatCoord(v float64) string {
+	s := strconv.FormatFloat(v, 'f', 17, 64)
+	s = strings.TrimRight(s, "0")
+
+	return strings.TrimSuffix(s, ".")
+}
+
+// Parses a longitude and latitude pair
+func parseLonLat(lonArg string, latArg string) (float64, float64, error) {
+	lon, err := strconv.ParseFloat(lonArg, 64)
+
+	if err != nil {
+		return 0, 0, errNotFloat
+	}
+
+	lat, err := strconv.ParseFloat(latArg, 64)
+
+	if err != nil {
+		return 0, 0, errNotFloat
+	}
+
+	if lon < geoLonMin || lon > geoLonMax || lat < geoLatMin || lat > geoLatMax {
+		return 0, 0, newReplyError(codeErr, "invalid longitude,latitude pair "+
+			strconv.FormatFloat(lon, 'f', 6, 64)+","+strconv.FormatFloat(lat, 'f', 6, 64))
+	}
+
+	return lon, lat, nil
+}
+
+// GEOADD key [NX|XX] [CH] longitude latitude member [longitude latitude member ...]
+func geoAdd(args []Value) Value {
+	if len(args) < 4 {
+		return arityError("geoadd")
+	}
+
+	i := 1
+
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].bulk)
+
+		if opt != "NX" && opt != "XX" && opt != "CH" {
+			break
+		}
+	}
+
+	triples := args[i:]
+
+	if len(triples) == 0 || len(triples)%3 != 0 {
+		return errorValue(codeErr, "syntax error. Try GEOADD key [x1] [y1] [name1] [x2] [y2] [name2] ... ")
+	}
+
+	// Stored through ZADD with the geohash of each position as its score
+	zaddArgs := append([]Value{}, args[:i]...)
+
+	for j := 0; j < len(triples); j += 3 {
+		lon, lat, err := parseLonLat(triples[j].bulk, triples[j+1].bulk)
+
+		if err != nil {
+			return errorReply(err)
+		}
+
+		score := geohashEncode(lon, lat, geoLatMin, geoLatMax, geoStepMax)
+		zaddArgs = append(zaddArgs, Value{typ: "bulk", bulk: strconv.FormatUint(score, 10)}, triples[j+2])
+	}
+
+	// ZADD wakes the clients blocked on key with BZPOPMIN and the like
+	return zAdd(zaddArgs)
+}
+
+// GEODIST key member1 member2 [M|KM|FT|MI]
+func geoDist(args []Value) Value {
+	if len(args) < 3 || len(args) > 4 {
+		return arityError("geodist")
+	}
+
+	unit := 1.0
+
+	if len(args) == 4 {
+		var err error
+
+		if unit, err = geoUnit(args[3].bulk); err != nil {
+			return errorReply(err)
+		}
+	}
+
+	if err := checkZsetType(args[0].bulk); err != nil {
+		return errorReply(err)
+	}
+
+	ZSETsMu.RLock()
+	defer ZSETsMu.RUnlock()
+
+	z, ok := ZSETs[args[0].bulk]
+
+	if !ok {
+		return Value{typ: "null"}
+	}
+
+	score1, ok1 := z.Score(args[1].bulk)
+	score2, ok2 := z.Score(args[2].bulk)
+
+	if !ok1 || !ok2 {
+		return Value{typ: "null"}
+	}
+
+	lon1, lat1 := geoDecodeScore(score1)
+	lon2, lat2 := geoDecodeScore(score2)
+
+	return Value{typ: "bulk", bulk: geoFormatDist(geoDistance(lon1, lat1, lon2, lat2), unit)}
+}
+
+// GEOHASH key [member [member ...]]
+func geoHash(args []Value) Value {
+	if len(args) < 1 {
+		return arityError("geohash")
+	}
+
+	if err := checkZsetType(args[0].bulk); err != nil {
+		return errorReply(err)
+	}
+
+	ZSETsMu.RLock()
+	defer ZSETsMu.RUnlock()
+
+	z := ZSETs[args[0].bulk]
+	hashes := make([]Value, len(args)-1)
+
+	for i, member := range args[1:] {
+		score, ok := 0.0, false
+
+		if z != nil {
+			score, ok = z.Score(member.bulk)
+		}
+
+		if !ok {
+			hashes[i] = Value{typ: "null"}
+			continue
+		}
+
+		// Re-encoded over the standard latitude range of geohash strings
+		lon, lat := geoDecodeScore(score)
+		bits := geohashEncode(lon, lat, -90, 90, geoStepMax)
+		hash := make([]byte, 11)
+
+		for j := range hash {
+			index := 0
+
+			// Only 52 bits are stored, the last character is always 0
+			if j < 10 {
+				index = int(bits >> (52 - (j+1)*5) & 0x1f)
+			}
+
+			hash[j] = geoHashAlphabet[index]
+		}
+
+		hashes[i] = Value{typ: "bulk", bulk: string(hash)}
+	}
+
+	return Value{typ: "array", array: hashes}
+}
+
+// GEOPOS key [member [member ...]]
+func geoPos(args []Value) Value {
+	if len(args) < 1 {
+		return arityError("geopos")
+	}
+
+	if err := checkZsetType(args[0].bulk); err != nil {
+		return errorReply(err)
+	}
+
+	ZSETsMu.RLock()
+	defer ZSETsMu.RUnlock()
+
+	z := ZSETs[args[0].bulk]
+	positions := make([]Value, len(args)-1)
+
+	for i, member := range args[1:] {
+		score, ok := 0.0, false
+
+		if z != nil {
+			score, ok = z.Score(member.bulk)
+		}
+
+		if !ok {
+			positions[i] = Value{typ: "nullarray"}
+			continue
+		}
+
+		lon, lat := geoDecodeScore(score)
+		positions[i] = Value{typ: "array", array: []Value{
+			{typ: "bulk", bulk: geoFormatCoord(lon)},
+			{typ: "bulk", bulk: geoFormatCoord(lat)},
+		}}
+	}
+
+	return Value{typ: "array", array: positions}
+}
+
+// Options of GEOSEARCH and GEOSEARCHSTORE
+type geoSearchArgs struct {
+	fromMember string
+	fromLonLat bool
+	shape      geoShape
+	byShape    int
+	unit       float64
+	sort       int // 0 unsorted, 1 ascending, -1 descending
+	count      int
+	any        bool
+	withCoord  bool
+	withDist   bool
+	withHash   bool
+	storeDist  bool
+}
+
+// Parses the options of GEOSEARCH, or of GEOSEARCHSTORE when store is set
+func parseGeoSearch(args []Value, store bool) (geoSearchArgs, error) {
+	g := geoSearchArgs{unit: 1}
+	fromCount := 0
+
+	for i := 0; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].bulk)
+		moreArgs := len(args) - 1 - i
+
+		switch {
+		case opt == "FROMMEMBER" && moreArgs >= 1:
+			g.fromMember = args[i+1].bulk
+			fromCount++
+			i++
+		case opt == "FROMLONLAT" && moreArgs >= 2:
+			lon, lat, err := parseLonLat(args[i+1].bulk, args[i+2].bulk)
+
+			if err != nil {
+				return g, err
+			}
+
+			g.shape.lon, g.shape.lat = lon, lat
+			g.fromLonLat = true
+			fromCount++
+			i += 2
+		case opt == "BYRADIUS" && moreArgs >= 2:
+			radius, err := strconv.ParseFloat(args[i+1].bulk, 64)
+
+			if err != nil {
+				return g, newReplyError(codeErr, "need numeric radius")
+			}
+			if radius < 0 {
+				return g, newReplyError(codeErr, "radius cannot be negative")
+			}
+			if g.unit, err = geoUnit(args[i+2].bulk); err != nil {
+				return g, err
+			}
+
+			g.shape.radius = radius * g.unit
+			g.byShape++
+			i += 2
+		case opt == "BYBOX" && moreArgs >= 3:
+			width, err := strconv.ParseFloat(args[i+1].bulk, 64)
+
+			if err != nil {
+				return g, newReplyError(codeErr, "need numeric width")
+			}
+
+			height, err := strconv.ParseFloat(args[i+2].bulk, 64)
+
+			if err != nil {
+				return g, newReplyError(codeErr, "need numeric height")
+			}
+			if width < 0 || height < 0 {
+				return g, newReplyError(codeErr, "height or width cannot be negative")
+			}
+			if g.unit, err = geoUnit(args[i+3].bulk); err != nil {
+				return g, err
+			}
+
+			g.shape.width, g.shape.height = width*g.unit, height*g.unit
+			g.shape.box = true
+			g.byShape++
+			i += 3
+		case opt == "ASC":
+			g.sort = 1
+		case opt == "DESC":
+			g.sort = -1
+		case opt == "COUNT" && moreArgs >= 1:
+			n, err := strconv.Atoi(args[i+1].bulk)
+
+			if err != nil {
+				return g, errNotInteger
+			}
+			if n <= 0 {
+				return g, newReplyError(codeErr, "COUNT must be > 0")
+			}
+
+			g.count = n
+			i++
+
+			if i+1 < len(args) && strings.ToUpper(args[i+1].bulk) == "ANY" {
+				g.any = true
+				i++
+			}
+		case opt == "WITHCOORD":
+			g.withCoord = true
+		case opt == "WITHDIST":
+			g.withDist = true
+		case opt == "WITHHASH":
+			g.withHash = true
+		case opt == "STOREDIST" && store:
+			g.storeDist = true
+		default:
+			return g, errSyntax
+		}
+	}
+
+	command := "GEOSEARCH"
+
+	if store {
+		command = "GEOSEARCHSTORE"
+	}
+
+	if store && (g.withCoord || g.withDist || g.withHash) {
+		return g, newReplyError(codeErr, "GEOSEARCHSTORE is not compatible with WITHDIST, WITHHASH and WITHCOORD options")
+	}
+	if fromCount != 1 {
+		return g, newReplyError(codeErr, "exactly one of FROMMEMBER or FROMLONLAT can be specified for "+command)
+	}
+	if g.byShape != 1 {
+		return g, newReplyError(codeErr, "exactly one of BYRADIUS and BYBOX can be specified for "+command)
+	}
+
+	// A count without an order returns the closest members
+	if g.count > 0 && !g.any && g.sort == 0 {
+		g.sort = 1
+	}
+
+	return g, nil
+}
+
+// Runs a search on the sorted set at key, the caller holds ZSETsMu
+func geoRunSearch(key string, g geoSearchArgs) ([]geoPoint, error) {
+	z, ok := ZSETs[key]
+
+	if !ok {
+		if !g.fromLonLat {
+			return nil, errGeoMember
+		}
+		return []geoPoint{}, nil
+	}
+
+	if !g.fromLonLat {
+		score, ok := z.Score(g.fromMember)
+
+		if !ok {
+			return nil, errGeoMember
+		}
+
+		g.shape.lon, g.shape.lat = geoDecodeScore(score)
+	}
+
+	points := geoSearch(z, g.shape, g.count, g.any)
+
+	switch g.sort {
+	case 1:
+		sort.SliceStable(points, func(i, j int) bool { return points[i].dist < points[j].dist })
+	case -1:
+		sort.SliceStable(points, func(i, j int) bool { return points[i].dist > points[j].dist })
+	}
+
+	if g.count > 0 && len(points) > g.count {
+		points = points[:g.count]
+	}
+
+	return points, nil
+}
+
+// GEOSEARCH key FROMMEMBER member|FROMLONLAT longitude latitude
+// BYRADIUS radius unit|BYBOX width height unit [ASC|DESC] [COUNT count [ANY]]
+// [WITHCOORD] [WITHDIST] [WITHHASH]
+func geoSearchCommand(args []Value) Value {
+	if len(args) < 6 {
+		return arityError("geosearch")
+	}
+
+	g, err := parseGeoSearch(args[1:], false)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	if err := checkZsetType(args[0].bulk); err != nil {
+		return errorReply(err)
+	}
+
+	ZSETsMu.RLock()
+	points, err := geoRunSearch(args[0].bulk, g)
+	ZSETsMu.RUnlock()
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	results := make([]Value, len(points))
+
+	for i, p := range points {
+		if !g.withDist && !g.withHash && !g.withCoord {
+			results[i] = Value{typ: "bulk", bulk: p.member}
+			continue
+		}
+
+		item := []Value{{typ: "bulk", bulk: p.member}}
+
+		if g.withDist {
+			item = append(item, Value{typ: "bulk", bulk: geoFormatDist(p.dist, g.unit)})
+		}
+		if g.withHash {
+			item = append(item, Value{typ: "integer", num: int(p.score)})
+		}
+		if g.withCoord {
+			item = append(item, Value{typ: "array", array: []Value{
+				{typ: "bulk", bulk: geoFormatCoord(p.lon)},
+				{typ: "bulk", bulk: geoFormatCoord(p.lat)},
+			}})
+		}
+
+		results[i] = Value{typ: "array", array: item}
+	}
+
+	return Value{typ: "array", array: results}
+}
+
+// GEOSEARCHSTORE destination source FROMMEMBER member|FROMLONLAT longitude latitude
+// BYRADIUS radius unit|BYBOX width height unit [ASC|DESC] [COUNT count [ANY]] [STOREDIST]
+func geoSearchStore(args []Value) Value {
+	if len(args) < 7 {
+		return arityError("geosearchstore")
+	}
+
+	g, err := parseGeoSearch(args[2:], true)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	if err := checkZsetType(args[1].bulk); err != nil {
+		return errorReply(err)
+	}
+
+	ZSETsMu.RLock()
+	points, err := geoRunSearch(args[1].bulk, g)
+	ZSETsMu.RUnlock()
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	members := make(map[string]float64, len(points))
+
+	for _, p := range points {
+		if g.storeDist {
+			members[p.member] = p.dist / g.unit
+		} else {
+			members[p.member] = p.score
+		}
+	}
+
+	return zsetStoreResult("geosearchstore", args[0].bulk, members)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestGeoSearchFromEmptyMember(t *testing.T) {
+	c := dialTestServer(t)
+
+	c.expect(":2\r\n", "GEOADD", "geo:empty", "13.361389", "38.115556", "", "15.087269", "37.502669", "Catania")
+	c.expect("*1\r\n$0\r\n\r\n", "GEOSEARCH", "geo:empty", "FROMMEMBER", "", "BYRADIUS", "10", "km")
+	c.expect("*1\r\n$7\r\nCatania\r\n", "GEOSEARCH", "geo:empty", "FROMLONLAT", "15", "37.5", "BYRADIUS", "10", "km")
+
+	c.expect("-ERR could not decode requested zset member\r\n", "GEOSEARCH", "geo:other", "FROMMEMBER", "", "BYRADIUS", "10", "km")
+	c.expect(":1\r\n", "GEOADD", "geo:other", "0.001", "0.001", "origin")
+	c.expect("-ERR could not decode requested zset member\r\n", "GEOSEARCH", "geo:other", "FROMMEMBER", "", "BYRADIUS", "10", "km")
+}
+
+func TestGeoMatchesRedisRounding(t *testing.T) {
+	c := dialTestServer(t)
+
+	// Redis stores this distance of its documentation example, degrees are
+	// turned to radians by multiplying by a precomputed pi/180
+	c.expect(":1\r\n", "GEOADD", "geo:round", "17.241510", "38.788135", "edge2")
+	c.expect(":1\r\n", "GEOSEARCHSTORE", "geo:dist", "geo:round", "FROMLONLAT", "15", "37", "BYRADIUS", "300", "km", "STOREDIST")
+	c.expect("$17\r\n279.7403417843143\r\n", "ZSCORE", "geo:dist", "edge2")
+
+	c.expect("-ERR GEOSEARCHSTORE is not compatible with WITHDIST, WITHHASH and WITHCOORD options\r\n",
+		"GEOSEARCHSTORE", "geo:dst", "geo:round", "FROMLONLAT", "15", "37", "BYRADIUS", "300", "km", "WITHDIST")
+	c.expect("-ERR exactly one of BYRADIUS and BYBOX can be specified for GEOSEARCHSTORE\r\n",
+		"GEOSEARCHSTORE", "geo:dst", "geo:round", "FROMLONLAT", "15", "37", "ASC", "STOREDIST")
+	c.expect("-ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for GEOSEARCH\r\n",
+		"GEOSEARCH", "geo:round", "BYRADIUS", "300", "km", "ASC", "WITHDIST")
+}
+
+// Reference replies below are those of the Redis documentation
+func TestGeoCommands(t *testing.T) {
+	c := dialTestServer(t)
+
+	c.expect(":2\r\n", "GEOADD", "Sicily", "13.361389", "38.115556", "Palermo", "15.087269", "37.502669", "Catania")
+	c.expect(":0\r\n", "GEOADD", "Sicily", "NX", "13", "38", "Palermo")
+	c.expect("-ERR invalid longitude,latitude pair 200.000000,38.000000\r\n", "GEOADD", "Sicily", "200", "38", "Nowhere")
+
+	c.expect("$11\r\n166274.1516\r\n", "GEODIST", "Sicily", "Palermo", "Catania")
+	c.expect("$8\r\n166.2742\r\n", "GEODIST", "Sicily", "Palermo", "Catania", "km")
+	c.expect("$8\r\n103.3182\r\n", "GEODIST", "Sicily", "Palermo", "Catania", "mi")
+	c.expect("$-1\r\n", "GEODIST", "Sicily", "Foo", "Bar")
+	c.expect("-ERR unsupported unit provided. please use M, KM, FT, MI\r\n", "GEODIST", "Sicily", "Palermo", "Catania", "parsec")
+
+	c.expect("*2\r\n$11\r\nsqc8b49rny0\r\n$11\r\nsqdtr74hyu0\r\n", "GEOHASH", "Sicily", "Palermo", "Catania")
+	c.expect("*3\r\n*2\r\n$20\r\n13.36138933897018433\r\n$20\r\n38.11555639549629859\r\n*2\r\n$20\r\n15.08726745843887329\r\n$20\r\n37.50266842333162032\r\n*-1\r\n",
+		"GEOPOS", "Sicily", "Palermo", "Catania", "NonExisting")
+
+	c.expect("*2\r\n*2\r\n$7\r\nCatania\r\n$7\r\n56.4413\r\n*2\r\n$7\r\nPalermo\r\n$8\r\n190.4424\r\n",
+		"GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "ASC", "WITHDIST")
+
+	c.expect(":2\r\n", "GEOADD", "Sicily", "12.758489", "38.788135", "edge1", "17.241510", "38.788135", "edge2")
+	c.expect("*2\r\n$7\r\nCatania\r\n$7\r\nPalermo\r\n",
+		"GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "ASC")
+	c.expect("*4\r\n"+
+		"*3\r\n$7\r\nCatania\r\n$7\r\n56.4413\r\n*2\r\n$20\r\n15.08726745843887329\r\n$20\r\n37.50266842333162032\r\n"+
+		"*3\r\n$7\r\nPalermo\r\n$8\r\n190.4424\r\n*2\r\n$20\r\n13.36138933897018433\r\n$20\r\n38.11555639549629859\r\n"+
+		"*3\r\n$5\r\nedge2\r\n$8\r\n279.7403\r\n*2\r\n$20\r\n17.24151045083999634\r\n$20\r\n38.78813451624225195\r\n"+
+		"*3\r\n$5\r\nedge1\r\n$8\r\n279.7405\r\n*2\r\n$19\r\n12.7584877610206604\r\n$20\r\n38.78813451624225195\r\n",
+		"GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "BYBOX", "400", "400", "km", "ASC", "WITHCOORD", "WITHDIST")
+	c.expect("*3\r\n*2\r\n$7\r\nPalermo\r\n:3479099956230698\r\n*2\r\n$5\r\nedge1\r\n:3479273021651468\r\n*2\r\n$7\r\nCatania\r\n:3479447370796909\r\n",
+		"GEOSEARCH", "Sicily", "FROMMEMBER", "Palermo", "BYRADIUS", "200", "km", "ASC", "WITHHASH")
+	c.expect("*1\r\n$5\r\nedge1\r\n",
+		"GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "BYBOX", "400", "400", "km", "DESC", "COUNT", "1")
+
+	c.expect(":3\r\n", "GEOSEARCHSTORE", "key1", "Sicily", "FROMLONLAT", "15", "37", "BYBOX", "400", "400", "km", "ASC", "COUNT", "3")
+	c.expect("*3\r\n$7\r\nCatania\r\n$7\r\nPalermo\r\n$5\r\nedge2\r\n",
+		"GEOSEARCH", "key1", "FROMLONLAT", "15", "37", "BYBOX", "400", "400", "km", "ASC")
+	c.expect(":3\r\n", "GEOSEARCHSTORE", "key2", "Sicily", "FROMLONLAT", "15", "37", "BYBOX", "400", "400", "km", "ASC", "COUNT", "3", "STOREDIST")
+
+	// Scores are checked as GEOSEARCH prints distances, the last digits
+	// depend on the math library
+	stored := c.do("ZRANGE", "key2", "0", "-1", "WITHSCORES").array
+	want := []string{"Catania", "56.4413", "Palermo", "190.4424", "edge2", "279.7403"}
+	if len(stored) != len(want) {
+		t.Fatalf("ZRANGE key2 = %d values, want %d", len(stored), len(want))
+	}
+	for i := 0; i < len(want); i += 2 {
+		score, err := strconv.ParseFloat(stored[i+1].bulk, 64)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := geoFormatDist(score, 1); stored[i].bulk != want[i] || got != want[i+1] {
+			t.Errorf("ZRANGE key2 entry %d = %s %s, want %s %s", i/2, stored[i].bulk, got, want[i], want[i+1])
+		}
+	}
+	c.expect(":0\r\n", "GEOSEARCHSTORE", "key2", "Sicily", "FROMLONLAT", "0", "0", "BYRADIUS", "1", "m")
+	c.expect(":0\r\n", "EXISTS", "key2")
+
+	c.expect("-ERR exactly one of BYRADIUS and BYBOX can be specified for GEOSEARCH\r\n",
+		"GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "ASC", "WITHDIST")
+	c.expect("-ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for GEOSEARCHSTORE\r\n",
+		"GEOSEARCHSTORE", "key3", "Sicily", "BYRADIUS", "200", "km", "ASC", "STOREDIST")
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"math"
+	"math/rand"
 	"regexp"
 	"strconv"
 	"strings"
@@ -9,22 +11,22 @@ import (
 )
 
 // In memory Database DS
-var SETs = map[string][2]string{}
+var SETs = map[string]*StringObject{}
 var SETsMu = sync.RWMutex{}
 
 // In memory hashmap for the DB
-var HSETs = map[string]map[string]string{}
+var HSETs = map[string]*Hash{}
 var HSETsMu = sync.RWMutex{}
 
 // Stores streams
-var XSETs = map[string]map[string]map[string]string{}
-var XPREV = "0-0"
+var XSETs = map[string]*Stream{}
 var XSETsMu = sync.RWMutex{}
 
 // Stores for transactions
 var QUEUE = make([][]Value, 0)
 var queuing = false
 var multiExecuted = false
+var multiAborted = false
 
 // Ping Command
 func ping(args []Value) Value {
@@ -50,40 +52,41 @@ func echo(args []Value) Value {
 	return v
 }
 
-// Multiple sets at once for batch writes
+// Multiple sets at once for batch writes, applied under one lock so no
+// client sees only part of them
 func mSet(args []Value) Value {
-	if len(args)%2 != 0 {
-		return Value{typ: "string", str: "ERR: Mset requires an even nummber of arguments."}
+	if len(args) == 0 || len(args)%2 != 0 {
+		return arityError("mset")
+	}
+
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+
+	for i := 0; i < len(args); i += 2 {
+		replaceWithString(args[i].bulk)
 	}
-	count := 0
 
 	SETsMu.Lock()
-	for i := range args {
-		list := make([]Value, 0)
-		list = append(list, args[i])
-		if _, ok := SETs[args[i].bulk]; !ok {
-			count += 1
-		}
-		set(list)
+	for i := 0; i < len(args); i += 2 {
+		SETs[args[i].bulk] = NewStringObject(args[i+1].bulk, 0)
+		notifyKeyspaceEvent(notifyString, "set", args[i].bulk)
 	}
+	SETsMu.Unlock()
 
-	return Value{typ: "integer", num: count}
+	return Value{typ: "string", str: "OK"}
 }
 
 // Multiple gets at once for batch reading
 func mGet(args []Value) Value {
 	if len(args) == 0 {
-		return Value{typ: "string", str: "ERR: Mget command needs at least one key"}
+		return arityError("mget")
 	}
 	v := Value{}
 	v.typ = "array"
-	v.array = make([]Value, 0)
+	v.array = make([]Value, len(args))
 
 	for i := range args {
-		list := make([]Value, 0)
-		list = append(list, args[i])
-
-		v.array = append(v.array, get(list))
+		v.array[i] = get(args[i : i+1])
 	}
 
 	return v
@@ -92,88 +95,81 @@ func mGet(args []Value) Value {
 // Incr command
 func incr(args []Value) Value {
 	if len(args) != 1 {
-		return Value{typ: "string", str: "ERR: Incorrect number of arguments for incr command"}
-	}
-
-	key := args[0].bulk
-
-	SETsMu.RLock()
-	value, ok := SETs[key]
-	SETsMu.RUnlock()
-
-	if !ok {
-		return Value{typ: "string", str: "Key Does not exist"}
-	}
-
-	num, err := strconv.Atoi(value[0])
-
-	if err != nil {
-		return Value{typ: "error", err: err}
+		return arityError("incr")
 	}
 
-	num += 1
-
-	SETsMu.Lock()
-	SETs[key] = [2]string{strconv.Itoa(num), value[1]}
-	SETsMu.Unlock()
-
-	return Value{typ: "integer", num: num}
+	return incrBy(args[0].bulk, 1, "incrby")
 }
 
 // Decr command
 func decr(args []Value) Value {
 	if len(args) != 1 {
-		return Value{typ: "string", str: "ERR: Incorrect number of arguments for decr command"}
+		return arityError("decr")
 	}
 
-	key := args[0].bulk
+	return incrBy(args[0].bulk, -1, "decrby")
+}
+
+// Adds delta to the integer stored at key, a missing key starts at 0
+func incrBy(key string, delta int64, event string) Value {
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+
+	switch keyType(key) {
+	case "string", "none":
+	default:
+		return errorReply(errWrongType)
+	}
+
+	SETsMu.Lock()
+	defer SETsMu.Unlock()
 
-	SETsMu.RLock()
 	value, ok := SETs[key]
-	SETsMu.RUnlock()
 
 	if !ok {
-		return Value{typ: "string", str: "Key Does not exist"}
+		value = NewStringObject("0", 0)
 	}
 
-	num, err := strconv.Atoi(value[0])
+	num, err := value.Int()
 
 	if err != nil {
-		return Value{typ: "error", err: err}
+		return errorReply(err)
 	}
 
-	num -= 1
+	if (delta > 0 && num > math.MaxInt64-delta) || (delta < 0 && num < math.MinInt64-delta) {
+		return errorReply(errOverflow)
+	}
 
-	SETsMu.Lock()
-	SETs[key] = [2]string{strconv.Itoa(num), value[1]}
-	SETsMu.Unlock()
+	// Stored back as an integer so no string is allocated
+	value.SetInt(num + delta)
+	SETs[key] = value
+	notifyKeyspaceEvent(notifyString, event, key)
 
-	return Value{typ: "integer", num: num}
+	return Value{typ: "integer", num: int(num + delta)}
 }
 
 // Time to live command
 func TTL(args []Value) Value {
 	if len(args) != 1 {
-		return Value{typ: "string", str: "ERR: Wrong number of arguments for TTL command"}
+		return arityError("ttl")
 	}
 
 	v := Value{typ: "integer"}
 	now := time.Now().Unix()
-	value, ok := SETs[args[0].bulk]
 
 	SETsMu.RLock()
-	if ok {
-		timestamp, err := strconv.Atoi(value[1])
-		num := int64(timestamp) - now
-		if err != nil {
-			return Value{typ: "error", err: err}
-		}
+	value, ok := SETs[args[0].bulk]
+	SETsMu.RUnlock()
 
-		v.num = int(num)
-	} else {
+	if !ok {
 		return Value{typ: "null"}
 	}
-	SETsMu.RUnlock()
+
+	if value.expire == 0 {
+		v.num = -1
+	} else {
+		v.num = int(value.expire - now)
+	}
 
 	return v
 }
@@ -181,17 +177,16 @@ func TTL(args []Value) Value {
 // Checks if key exists returning boolean
 func exists(args []Value) Value {
 	if len(args) != 1 {
-		return Value{typ: "error", str: "ERR: Wrong number of arguments for exists command"}
+		return arityError("exists")
 	}
 
 	v := Value{}
 	v.typ = "integer"
 	v.num = 0
-	SETsMu.RLock()
-	if _, ok := SETs[args[0].bulk]; ok {
+
+	if keyType(args[0].bulk) != "none" {
 		v.num = 1
 	}
-	SETsMu.RUnlock()
 
 	return v
 }
@@ -199,19 +194,20 @@ func exists(args []Value) Value {
 // Safe deletes from map and returns number deleted
 func del(args []Value) Value {
 	if len(args) == 0 {
-		return Value{typ: "error", str: "ERR: Wrong number of arguments for del command"}
+		return arityError("del")
 	}
 
 	numDel := 0
 
-	SETsMu.Lock()
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+
 	for i := 0; i < len(args); i++ {
-		if _, ok := SETs[args[i].bulk]; ok {
-			delete(SETs, args[i].bulk)
+		if deleteKey(args[i].bulk) {
+			notifyKeyspaceEvent(notifyGeneric, "del", args[i].bulk)
 			numDel += 1
 		}
 	}
-	SETsMu.Unlock()
 
 	return Value{typ: "integer", num: numDel}
 }
@@ -219,7 +215,7 @@ func del(args []Value) Value {
 // Set command
 func set(args []Value) Value {
 	if len(args) != 2 && len(args) != 4 {
-		return Value{typ: "error", str: "ERR: Wrong number of arguments for set command"}
+		return arityError("set")
 	}
 
 	key := args[0].bulk
@@ -235,15 +231,27 @@ func set(args []Value) Value {
 			go func(key string, duration int) {
 				time.Sleep(time.Duration(duration) * time.Second)
 				SETsMu.Lock()
-				delete(SETs, key)
+				if _, ok := SETs[key]; ok {
+					delete(SETs, key)
+					notifyKeyspaceEvent(notifyExpired, "expired", key)
+				}
 				SETsMu.Unlock()
 			}(key, exp)
 		}
 
 	}
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+
+	replaceWithString(key)
+
 	// Locking because of concurrent connections
 	SETsMu.Lock()
-	SETs[key] = [2]string{value, strconv.Itoa(int(expireTime))}
+	SETs[key] = NewStringObject(value, expireTime)
+	notifyKeyspaceEvent(notifyString, "set", key)
+	if expireTime != 0 {
+		notifyKeyspaceEvent(notifyGeneric, "expire", key)
+	}
 	SETsMu.Unlock()
 
 	return Value{typ: "string", str: "OK"}
@@ -252,7 +260,7 @@ func set(args []Value) Value {
 // GET Command
 func get(args []Value) Value {
 	if len(args) != 1 {
-		return Value{typ: "string", str: "ERR: Wrong number of arguments for get command"}
+		return arityError("get")
 	}
 
 	key := args[0].bulk
@@ -260,48 +268,119 @@ func get(args []Value) Value {
 	// Lock due to multiple concurrent connections
 	SETsMu.RLock()
 	value, ok := SETs[key]
+	var str string
+	if ok {
+		str = value.String()
+	}
 	SETsMu.RUnlock()
 
 	if !ok {
+		notifyKeyspaceEvent(notifyKeyMiss, "keymiss", key)
 		return Value{typ: "null"}
 	}
 
-	return Value{typ: "bulk", bulk: value[0]}
+	return Value{typ: "bulk", bulk: str}
 }
 
-// HSET command
+// HSET command, sets one or more fields and returns the number of new fields
 func hSet(args []Value) Value {
-	if len(args) != 3 {
-		return Value{typ: "string", str: "ERR: Wrong number of arguments for hset command"}
+	if len(args) < 3 || len(args)%2 != 1 {
+		return arityError("hset")
+	}
+
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+
+	if err := checkHashType(args[0].bulk); err != nil {
+		return errorReply(err)
 	}
 
 	hashMap := args[0].bulk
-	key := args[1].bulk
-	value := args[2].bulk
+	added := 0
 
 	// Lock due to multiple connections
 	HSETsMu.Lock()
 	if _, ok := HSETs[hashMap]; !ok {
-		HSETs[hashMap] = map[string]string{}
+		HSETs[hashMap] = NewHash()
 	}
-	HSETs[hashMap][key] = value
+	for i := 1; i < len(args); i += 2 {
+		if HSETs[hashMap].Set(args[i].bulk, args[i+1].bulk) {
+			added += 1
+		}
+
+		// Overwriting a field clears its expiration
+		hashPersistFieldLocked(hashMap, args[i].bulk)
+	}
+	notifyKeyspaceEvent(notifyHash, "hset", hashMap)
 	HSETsMu.Unlock()
 
+	return Value{typ: "integer", num: added}
+}
+
+// HMSET command, deprecated form of HSET replying OK
+func hMSet(args []Value) Value {
+	if len(args) < 3 || len(args)%2 != 1 {
+		return arityError("hmset")
+	}
+
+	if reply := hSet(args); reply.typ == "error" {
+		return reply
+	}
+
 	return Value{typ: "string", str: "OK"}
 }
 
+// HSETNX command, sets a field only if it does not exist yet
+func hSetNX(args []Value) Value {
+	if len(args) != 3 {
+		return arityError("hsetnx")
+	}
+
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+
+	if err := checkHashType(args[0].bulk); err != nil {
+		return errorReply(err)
+	}
+
+	hashMap := args[0].bulk
+	key := args[1].bulk
+
+	hashExpireFields(hashMap)
+
+	HSETsMu.Lock()
+	defer HSETsMu.Unlock()
+
+	if _, ok := HSETs[hashMap].Get(key); ok {
+		return Value{typ: "integer", num: 0}
+	}
+	if _, ok := HSETs[hashMap]; !ok {
+		HSETs[hashMap] = NewHash()
+	}
+	HSETs[hashMap].Set(key, args[2].bulk)
+	notifyKeyspaceEvent(notifyHash, "hset", hashMap)
+
+	return Value{typ: "integer", num: 1}
+}
+
 // HGET command
 func hGet(args []Value) Value {
 	if len(args) != 2 {
-		return Value{typ: "string", str: "ERR: Wrong number of arguments for hget command"}
+		return arityError("hget")
+	}
+
+	if err := checkHashType(args[0].bulk); err != nil {
+		return errorReply(err)
 	}
 
 	hashMap := args[0].bulk
 	key := args[1].bulk
 
+	hashExpireFields(hashMap)
+
 	// Lock due to multiple connections
 	HSETsMu.RLock()
-	value, ok := HSETs[hashMap][key]
+	value, ok := HSETs[hashMap].Get(key)
 	HSETsMu.RUnlock()
 
 	if !ok {
@@ -311,69 +390,395 @@ func hGet(args []Value) Value {
 	return Value{typ: "bulk", bulk: value}
 }
 
-// HGETALL Command
-func hGetAll(args []Value) Value {
-	if len(args) != 1 {
-		return Value{typ: "string", str: "ERR: Wrong number of arguments for hgetall command"}
+// HMGET command, returns nulls for missing fields
+func hMGet(args []Value) Value {
+	if len(args) < 2 {
+		return arityError("hmget")
+	}
+
+	if err := checkHashType(args[0].bulk); err != nil {
+		return errorReply(err)
 	}
 
 	hashMap := args[0].bulk
+	values := make([]Value, 0, len(args)-1)
+
+	hashExpireFields(hashMap)
 
 	HSETsMu.RLock()
-	value, ok := HSETs[hashMap]
+	for _, key := range args[1:] {
+		if value, ok := HSETs[hashMap].Get(key.bulk); ok {
+			values = append(values, Value{typ: "bulk", bulk: value})
+		} else {
+			values = append(values, Value{typ: "null"})
+		}
+	}
 	HSETsMu.RUnlock()
 
-	if !ok {
-		return Value{typ: "null"}
+	return Value{typ: "array", array: values}
+}
+
+// HGETALL Command, replies with a map which RESP2 clients receive as a flat array
+func hGetAll(args []Value) Value {
+	if len(args) != 1 {
+		return arityError("hgetall")
+	}
+
+	if err := checkHashType(args[0].bulk); err != nil {
+		return errorReply(err)
 	}
 
-	var values = make([]Value, len(value)*2)
+	hashMap := args[0].bulk
+
+	hashExpireFields(hashMap)
+
+	HSETsMu.RLock()
+	value := HSETs[hashMap]
+
+	var values = make([]Value, value.Len()*2)
 	j := 0
-	for key, v := range value {
+	value.Range(func(key string, v string) bool {
 		values[j] = Value{typ: "bulk", bulk: key}
 		values[j+1] = Value{typ: "bulk", bulk: v}
 		j += 2
+		return true
+	})
+	HSETsMu.RUnlock()
+
+	return Value{typ: "map", array: values}
+}
+
+// HDEL command, returns the number of fields removed
+func hDel(args []Value) Value {
+	if len(args) < 2 {
+		return arityError("hdel")
 	}
 
+	if err := checkHashType(args[0].bulk); err != nil {
+		return errorReply(err)
+	}
+
+	hashMap := args[0].bulk
+	removed := 0
+
+	hashExpireFields(hashMap)
+
+	HSETsMu.Lock()
+	for _, key := range args[1:] {
+		if HSETs[hashMap].Delete(key.bulk) {
+			hashPersistFieldLocked(hashMap, key.bulk)
+			removed += 1
+		}
+	}
+	if removed > 0 {
+		notifyKeyspaceEvent(notifyHash, "hdel", hashMap)
+	}
+	if value, ok := HSETs[hashMap]; ok && value.Len() == 0 {
+		delete(HSETs, hashMap)
+		notifyKeyspaceEvent(notifyGeneric, "del", hashMap)
+	}
+	HSETsMu.Unlock()
+
+	return Value{typ: "integer", num: removed}
+}
+
+// HEXISTS command
+func hExists(args []Value) Value {
+	if len(args) != 2 {
+		return arityError("hexists")
+	}
+
+	if err := checkHashType(args[0].bulk); err != nil {
+		return errorReply(err)
+	}
+
+	hashExpireFields(args[0].bulk)
+
+	HSETsMu.RLock()
+	_, ok := HSETs[args[0].bulk].Get(args[1].bulk)
+	HSETsMu.RUnlock()
+
+	if ok {
+		return Value{typ: "integer", num: 1}
+	}
+
+	return Value{typ: "integer", num: 0}
+}
+
+// HLEN command
+func hLen(args []Value) Value {
+	if len(args) != 1 {
+		return arityError("hlen")
+	}
+
+	if err := checkHashType(args[0].bulk); err != nil {
+		return errorReply(err)
+	}
+
+	hashExpireFields(args[0].bulk)
+
+	HSETsMu.RLock()
+	n := HSETs[args[0].bulk].Len()
+	HSETsMu.RUnlock()
+
+	return Value{typ: "integer", num: n}
+}
+
+// HSTRLEN command, returns the length of a field's value
+func hStrLen(args []Value) Value {
+	if len(args) != 2 {
+		return arityError("hstrlen")
+	}
+
+	if err := checkHashType(args[0].bulk); err != nil {
+		return errorReply(err)
+	}
+
+	hashExpireFields(args[0].bulk)
+
+	HSETsMu.RLock()
+	value, _ := HSETs[args[0].bulk].Get(args[1].bulk)
+	HSETsMu.RUnlock()
+
+	return Value{typ: "integer", num: len(value)}
+}
+
+// HKEYS command
+func hKeys(args []Value) Value {
+	if len(args) != 1 {
+		return arityError("hkeys")
+	}
+
+	if err := checkHashType(args[0].bulk); err != nil {
+		return errorReply(err)
+	}
+
+	hashExpireFields(args[0].bulk)
+
+	values := make([]Value, 0)
+
+	HSETsMu.RLock()
+	HSETs[args[0].bulk].Range(func(key string, value string) bool {
+		values = append(values, Value{typ: "bulk", bulk: key})
+		return true
+	})
+	HSETsMu.RUnlock()
+
 	return Value{typ: "array", array: values}
 }
 
-// config command
-func config(args []Value) Value {
-	if len(args) != 2 && len(args) != 3 {
-		return Value{typ: "string", str: "ERR: Wrong number of arguments for the config command"}
+// HVALS command
+func hVals(args []Value) Value {
+	if len(args) != 1 {
+		return arityError("hvals")
 	}
 
-	dir := "dir"
-	dirR := "/tmp/redis-data"
-	dbFileName := "dbfilename"
-	dbFileNameR := "dump.rdb"
+	if err := checkHashType(args[0].bulk); err != nil {
+		return errorReply(err)
+	}
 
-	list := make([]Value, 0)
+	hashExpireFields(args[0].bulk)
 
-	switch strings.ToUpper(args[0].bulk) {
-	case "GET":
-		if args[1].bulk == dir || len(args) == 3 && args[2].bulk == dir {
-			list = append(list, Value{typ: "bulk", bulk: dir})
-			list = append(list, Value{typ: "bulk", bulk: dirR})
+	values := make([]Value, 0)
+
+	HSETsMu.RLock()
+	HSETs[args[0].bulk].Range(func(key string, value string) bool {
+		values = append(values, Value{typ: "bulk", bulk: value})
+		return true
+	})
+	HSETsMu.RUnlock()
+
+	return Value{typ: "array", array: values}
+}
+
+// HINCRBY command, missing fields start at 0
+func hIncrBy(args []Value) Value {
+	if len(args) != 3 {
+		return arityError("hincrby")
+	}
+
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+
+	if err := checkHashType(args[0].bulk); err != nil {
+		return errorReply(err)
+	}
+
+	hashMap := args[0].bulk
+	key := args[1].bulk
+
+	hashExpireFields(hashMap)
+
+	incr, err := strconv.ParseInt(args[2].bulk, 10, 64)
+
+	if err != nil {
+		return errorReply(errNotInteger)
+	}
+
+	HSETsMu.Lock()
+	defer HSETsMu.Unlock()
+
+	var num int64
+
+	if value, ok := HSETs[hashMap].Get(key); ok {
+		num, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return errorValue(codeErr, "hash value is not an integer")
 		}
-		if args[1].bulk == dbFileName || len(args) == 3 && args[2].bulk == dbFileName {
-			list = append(list, Value{typ: "bulk", bulk: dbFileName})
-			list = append(list, Value{typ: "bulk", bulk: dbFileNameR})
+	}
+
+	if (incr > 0 && num > math.MaxInt64-incr) || (incr < 0 && num < math.MinInt64-incr) {
+		return errorReply(errOverflow)
+	}
+
+	num += incr
+
+	if _, ok := HSETs[hashMap]; !ok {
+		HSETs[hashMap] = NewHash()
+	}
+	HSETs[hashMap].Set(key, strconv.FormatInt(num, 10))
+	notifyKeyspaceEvent(notifyHash, "hincrby", hashMap)
+
+	return Value{typ: "integer", num: int(num)}
+}
+
+// HINCRBYFLOAT command, missing fields start at 0
+func hIncrByFloat(args []Value) Value {
+	if len(args) != 3 {
+		return arityError("hincrbyfloat")
+	}
+
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+
+	if err := checkHashType(args[0].bulk); err != nil {
+		return errorReply(err)
+	}
+
+	hashMap := args[0].bulk
+	key := args[1].bulk
+
+	hashExpireFields(hashMap)
+
+	incr, err := parseScore(args[2].bulk)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	HSETsMu.Lock()
+	defer HSETsMu.Unlock()
+
+	var num float64
+
+	if value, ok := HSETs[hashMap].Get(key); ok {
+		num, err = parseScore(value)
+		if err != nil {
+			return errorValue(codeErr, "hash value is not a float")
 		}
+	}
 
-		return Value{typ: "array", array: list}
-	case "SET":
-		return Value{}
-	default:
-		return Value{typ: "error", str: "ERR: unsupported CONFIG Parameter"}
+	num += incr
+
+	if math.IsNaN(num) || math.IsInf(num, 0) {
+		return errorValue(codeErr, "increment would produce NaN or Infinity")
+	}
+
+	result := strconv.FormatFloat(num, 'f', -1, 64)
+
+	if _, ok := HSETs[hashMap]; !ok {
+		HSETs[hashMap] = NewHash()
 	}
+	HSETs[hashMap].Set(key, result)
+	notifyKeyspaceEvent(notifyHash, "hincrbyfloat", hashMap)
+
+	return Value{typ: "bulk", bulk: result}
+}
+
+// HRANDFIELD command, a negative count allows the same field more than once
+func hRandField(args []Value) Value {
+	if len(args) < 1 || len(args) > 3 {
+		return arityError("hrandfield")
+	}
+
+	if err := checkHashType(args[0].bulk); err != nil {
+		return errorReply(err)
+	}
+
+	hashExpireFields(args[0].bulk)
+
+	HSETsMu.RLock()
+	keys := make([]string, 0)
+	values := make([]string, 0)
+	HSETs[args[0].bulk].Range(func(key string, value string) bool {
+		keys = append(keys, key)
+		values = append(values, value)
+		return true
+	})
+	HSETsMu.RUnlock()
+
+	if len(args) == 1 {
+		if len(keys) == 0 {
+			return Value{typ: "null"}
+		}
+		return Value{typ: "bulk", bulk: keys[rand.Intn(len(keys))]}
+	}
+
+	count, err := strconv.Atoi(args[1].bulk)
+
+	if err != nil {
+		return errorReply(errNotInteger)
+	}
+
+	// Negating the smallest integer would overflow
+	if count < -math.MaxInt64/2 || count > math.MaxInt64/2 {
+		return errorReply(errOutOfRange)
+	}
+
+	withValues := false
+
+	if len(args) == 3 {
+		if strings.ToUpper(args[2].bulk) != "WITHVALUES" {
+			return errorReply(errSyntax)
+		}
+		withValues = true
+	}
+
+	var picked []int
+
+	if count >= 0 {
+		// Distinct fields, at most the whole hash
+		picked = rand.Perm(len(keys))
+		if count < len(picked) {
+			picked = picked[:count]
+		}
+	} else if len(keys) > 0 {
+		picked = make([]int, -count)
+		for i := range picked {
+			picked[i] = rand.Intn(len(keys))
+		}
+	}
+
+	reply := make([]Value, 0, len(picked))
+
+	for _, i := range picked {
+		reply = append(reply, Value{typ: "bulk", bulk: keys[i]})
+		if withValues {
+			reply = append(reply, Value{typ: "bulk", bulk: values[i]})
+		}
+	}
+
+	if withValues {
+		return Value{typ: "pairs", array: reply}
+	}
+
+	return Value{typ: "array", array: reply}
 }
 
 // Keys command supports glob style
 func keys(args []Value) Value {
 	if len(args) != 1 {
-		return Value{typ: "string", str: "ERR: Wrong number of arguments for the keys command"}
+		return arityError("keys")
 	}
 
 	// Creates pattern checker
@@ -381,8 +786,9 @@ func keys(args []Value) Value {
 	regexPattern := globToRegex(pattern)
 	re, err := regexp.Compile(regexPattern)
 
+	// A pattern that cannot be translated matches no key
 	if err != nil {
-		return Value{typ: "error", err: err}
+		return Value{typ: "array", array: []Value{}}
 	}
 
 	valueList := make([]Value, 0)
@@ -399,10 +805,10 @@ func keys(args []Value) Value {
 
 // Returns info on redis instance
 func info(args []Value) Value {
-	// Return replication info only
+	// Return replication info and error counts only
 	v := Value{}
 
-	if len(args) == 1 && args[0].bulk == "replication" {
+	if len(args) == 1 && strings.ToLower(args[0].bulk) == "replication" {
 		v.typ = "array"
 		v.array = make([]Value, 0)
 		v.array = append(v.array, Value{typ: "bulk",
@@ -411,6 +817,9 @@ func info(args []Value) Value {
 		v.array = append(v.array, Value{typ: "bulk",
 			bulk: "master_repl_offset:" +
 				string(RedisInstance.master_repl_offset)})
+	} else if len(args) == 1 && strings.ToLower(args[0].bulk) == "errorstats" {
+		v.typ = "bulk"
+		v.bulk = errorStatsInfo()
 	} else {
 		v.typ = "bulk"
 		v.bulk = "role:" + RedisInstance.role
@@ -432,76 +841,41 @@ func psync(args []Value) Value {
 // Returns the type stored
 func typeC(args []Value) Value {
 	if len(args) != 1 {
-		return Value{typ: "string", str: "Err not the correct number of args for type command"}
-	}
-	val := get(args)
-	v := Value{typ: "string"}
-
-	switch val.typ {
-	case "bulk":
-		v.str = "string"
-	case "null":
-		v.str = "none"
-	case "array":
-		v.str = "hash"
-	}
-
-	return v
-}
-
-// Adds stream entry into any identified stream
-func xadd(args []Value) Value {
-	hashMap := args[0].bulk
-	id := args[1].bulk
-	index := strings.Index(XPREV, "-")
-
-	if XPREV[:index] > id[:index] {
-		return Value{typ: "string", str: "Err"}
-	} else if XPREV[index+1:] > id[index+1:] {
-		return Value{typ: "string", str: "err"}
-	}
-	XPREV = id
-
-	// Lock due to multiple connections
-	XSETsMu.Lock()
-	if _, ok := HSETs[hashMap]; !ok {
-		XSETs[hashMap] = map[string]map[string]string{}
-	}
-
-	if _, ok := HSETs[hashMap][id]; !ok {
-		XSETs[hashMap][id] = map[string]string{}
+		return arityError("type")
 	}
 
-	for i := 2; i < len(args)-2; i++ {
-		key := args[i].bulk
-		val := args[i+1].bulk
-
-		XSETs[hashMap][id][key] = val
-	}
-
-	XSETsMu.Unlock()
-
-	return Value{typ: "bulk", bulk: id}
+	return Value{typ: "string", str: keyType(args[0].bulk)}
 }
 
 // Starts transaction
 func multi(args []Value) Value {
 	if len(args) != 0 {
-		return Value{typ: "string", str: "Err"}
+		return arityError("multi")
+	}
+	if multiExecuted {
+		return errorValue(codeErr, "MULTI calls can not be nested")
 	}
 	queuing = true
 	multiExecuted = true
+	multiAborted = false
 	return Value{typ: "string", str: "OK"}
 }
 
 // Executes stored transactions
 func exec(args []Value) Value {
 	if len(args) != 0 {
-		return Value{typ: "string", str: "Err"}
+		return arityError("exec")
 	}
 	if !multiExecuted {
-		return Value{typ: "string", str: "ERR: EXEC without Multi"}
+		return errorValue(codeErr, "EXEC without MULTI")
+	}
+
+	// A command refused while queuing discards the whole transaction
+	if multiAborted {
+		discardTransaction()
+		return errorValue(codeExecAbort, "Transaction discarded because of previous errors.")
 	}
+
 	results := make([]Value, 0)
 	queuing = false
 	multiExecuted = false
@@ -511,12 +885,18 @@ func exec(args []Value) Value {
 		args := QUEUE[i][1:]
 		handler, ok := Handlers[command]
 
-		if !ok {
-			results = append(results, Value{typ: "string", str: "ERR Unknown Command"})
-			continue
+		var res Value
+
+		if ok {
+			res = handler(args)
+			touchKeys(commandKeys(command, args))
+		} else {
+			res = unknownCommandError(QUEUE[i][0].bulk, args)
 		}
 
-		results = append(results, handler(args))
+		// Errors inside the reply array are counted like other replies
+		countErrorReply(res)
+		results = append(results, res)
 	}
 
 	QUEUE = make([][]Value, 0)
@@ -527,47 +907,301 @@ func exec(args []Value) Value {
 // Discard command for transactions
 func discard(args []Value) Value {
 	if len(args) != 0 {
-		return Value{typ: "string", str: "ERR: Wrong number of args for Discard command"}
+		return arityError("discard")
 	}
 	if !multiExecuted {
-		return Value{typ: "string", str: "DISCARD without MULTI"}
+		return errorValue(codeErr, "DISCARD without MULTI")
 	}
+	discardTransaction()
+
+	return Value{typ: "string", str: "OK"}
+}
+
+// Ends the transaction without running its commands
+func discardTransaction() {
 	multiExecuted = false
+	multiAborted = false
 	queuing = false
 	QUEUE = make([][]Value, 0)
-
-	return Value{typ: "string", str: "OK"}
 }
 
 // Commmand handler variable initialized after all functions are defined
 var Handlers map[string]func([]Value) Value
 
+// Commands that need the state of the connection sending them
+var ClientHandlers map[string]func(*Client, []Value)
+
+// Commands that may wait for data, served with the client so they can give up
+// when it disconnects. Handlers holds their forms that never wait, for EXEC.
+var BlockingHandlers map[string]func(*Client, []Value) Value
+
 // handles function calls for commands
 func init() {
+	ClientHandlers = map[string]func(*Client, []Value){
+		"SUBSCRIBE":    subscribe,
+		"UNSUBSCRIBE":  unsubscribe,
+		"PSUBSCRIBE":   pSubscribe,
+		"PUNSUBSCRIBE": pUnsubscribe,
+		"SSUBSCRIBE":   sSubscribe,
+		"SUNSUBSCRIBE": sUnsubscribe,
+		"QUIT":         quit,
+		"RESET":        reset,
+		"HELLO":        hello,
+		"AUTH":         auth,
+	}
+
+	BlockingHandlers = map[string]func(*Client, []Value) Value{
+		"BZPOPMIN":   bzPopMinBlocking,
+		"BZPOPMAX":   bzPopMaxBlocking,
+		"BZMPOP":     bzmPopBlocking,
+		"XREAD":      xreadBlocking,
+		"XREADGROUP": xreadgroupBlocking,
+	}
+
 	Handlers = map[string]func([]Value) Value{
-		"PING":     ping,
-		"ECHO":     echo,
-		"SET":      set,
-		"GET":      get,
-		"HSET":     hSet,
-		"HGET":     hGet,
-		"HGETALL":  hGetAll,
-		"CONFIG":   config,
-		"KEYS":     keys,
-		"INFO":     info,
-		"DEL":      del,
-		"EXISTS":   exists,
-		"TTL":      TTL,
-		"INCR":     incr,
-		"DECR":     decr,
-		"MGET":     mGet,
-		"MSET":     mSet,
-		"REPLCONF": replconf,
-		"PSYNC":    psync,
-		"TYPE":     typeC,
-		"XADD":     xadd,
-		"MULTI":    multi,
-		"EXEC":     exec,
-		"DISCARD":  discard,
+		"PING":         ping,
+		"ECHO":         echo,
+		"SET":          set,
+		"GET":          get,
+		"HSET":         hSet,
+		"HGET":         hGet,
+		"HGETALL":      hGetAll,
+		"HMSET":        hMSet,
+		"HSETNX":       hSetNX,
+		"HMGET":        hMGet,
+		"HDEL":         hDel,
+		"HEXISTS":      hExists,
+		"HLEN":         hLen,
+		"HSTRLEN":      hStrLen,
+		"HKEYS":        hKeys,
+		"HVALS":        hVals,
+		"HINCRBY":      hIncrBy,
+		"HRANDFIELD":   hRandField,
+		"HINCRBYFLOAT": hIncrByFloat,
+		"HEXPIRE":      hExpire,
+		"HPEXPIRE":     hPExpire,
+		"HEXPIREAT":    hExpireAt,
+		"HPEXPIREAT":   hPExpireAt,
+		"HTTL":         hTTL,
+		"HPTTL":        hPTTL,
+		"HEXPIRETIME":  hExpireTime,
+		"HPEXPIRETIME": hPExpireTime,
+		"HPERSIST":     hPersist,
+		"CONFIG":       config,
+		"OBJECT":       object,
+		"KEYS":         keys,
+		"INFO":         info,
+		"DEL":          del,
+		"EXISTS":       exists,
+		"TTL":          TTL,
+		"INCR":         incr,
+		"DECR":         decr,
+		"MGET":         mGet,
+		"MSET":         mSet,
+		"REPLCONF":     replconf,
+		"PSYNC":        psync,
+		"TYPE":         typeC,
+		"XADD":         xadd,
+		"XRANGE":       xrange,
+		"XREVRANGE":    xrevrange,
+		"XLEN":         xlen,
+		"XDEL":         xdel,
+		"XTRIM":        xtrim,
+		"XREAD":        xread,
+		"XGROUP":       xgroup,
+		"XREADGROUP":   xreadgroup,
+		"XACK":         xack,
+		"XPENDING":     xpending,
+		"XCLAIM":       xclaim,
+		"XAUTOCLAIM":   xautoclaim,
+		"XINFO":        xinfo,
+		"PFADD":        pfAdd,
+		"PFCOUNT":      pfCount,
+		"PFMERGE":      pfMerge,
+
+		"GEOADD":         geoAdd,
+		"GEODIST":        geoDist,
+		"GEOHASH":        geoHash,
+		"GEOPOS":         geoPos,
+		"GEOSEARCH":      geoSearchCommand,
+		"GEOSEARCHSTORE": geoSearchStore,
+		"PUBLISH":        publish,
+		"SPUBLISH":       sPublish,
+		"PUBSUB":         pubsubCommand,
+
+		"MULTI":   multi,
+		"EXEC":    exec,
+		"DISCARD": discard,
+
+		"ZADD":             zAdd,
+		"ZREM":             zRem,
+		"ZCARD":            zCard,
+		"ZSCORE":           zScore,
+		"ZRANGE":           zRange,
+		"ZRANGESTORE":      zRangeStore,
+		"ZREVRANGE":        zRevRange,
+		"ZRANGEBYSCORE":    zRangeByScore,
+		"ZREVRANGEBYSCORE": zRevRangeByScore,
+		"ZRANGEBYLEX":      zRangeByLex,
+		"ZREVRANGEBYLEX":   zRevRangeByLex,
+		"ZCOUNT":           zCount,
+		"ZLEXCOUNT":        zLexCount,
+		"ZREMRANGEBYRANK":  zRemRangeByRank,
+		"ZREMRANGEBYSCORE": zRemRangeByScore,
+		"ZREMRANGEBYLEX":   zRemRangeByLex,
+		"ZUNION":           zUnion,
+		"ZINTER":           zInter,
+		"ZDIFF":            zDiff,
+		"ZUNIONSTORE":      zUnionStore,
+		"ZINTERSTORE":      zInterStore,
+		"ZDIFFSTORE":       zDiffStore,
+		"ZINTERCARD":       zInterCard,
+		"ZPOPMIN":          zPopMin,
+		"ZPOPMAX":          zPopMax,
+		"BZPOPMIN":         bzPopMin,
+		"BZPOPMAX":         bzPopMax,
+		"ZMPOP":            zmPop,
+		"BZMPOP":           bzmPop,
+
+		"SADD":      sAdd,
+		"SREM":      sRem,
+		"SMEMBERS":  sMembers,
+		"SISMEMBER": sIsMember,
+		"SCARD":     sCard,
 	}
 }
+
+// Positions of the key arguments of a command as first, last and step, where a
+// negative last counts back from the end. Commands missing from the table do
+// not touch their keys, as OBJECT, TYPE and TTL must not alter idle times.
+var KeySpecs = map[string][3]int{
+	"GET":              {0, 0, 1},
+	"SET":              {0, 0, 1},
+	"MGET":             {0, -1, 1},
+	"MSET":             {0, -1, 2},
+	"INCR":             {0, 0, 1},
+	"DECR":             {0, 0, 1},
+	"HSET":             {0, 0, 1},
+	"HMSET":            {0, 0, 1},
+	"HSETNX":           {0, 0, 1},
+	"HGET":             {0, 0, 1},
+	"HMGET":            {0, 0, 1},
+	"HGETALL":          {0, 0, 1},
+	"HDEL":             {0, 0, 1},
+	"HEXISTS":          {0, 0, 1},
+	"HLEN":             {0, 0, 1},
+	"HSTRLEN":          {0, 0, 1},
+	"HKEYS":            {0, 0, 1},
+	"HVALS":            {0, 0, 1},
+	"HINCRBY":          {0, 0, 1},
+	"HINCRBYFLOAT":     {0, 0, 1},
+	"HRANDFIELD":       {0, 0, 1},
+	"HEXPIRE":          {0, 0, 1},
+	"HPEXPIRE":         {0, 0, 1},
+	"HEXPIREAT":        {0, 0, 1},
+	"HPEXPIREAT":       {0, 0, 1},
+	"HPERSIST":         {0, 0, 1},
+	"SADD":             {0, 0, 1},
+	"SREM":             {0, 0, 1},
+	"SMEMBERS":         {0, 0, 1},
+	"SISMEMBER":        {0, 0, 1},
+	"SCARD":            {0, 0, 1},
+	"ZADD":             {0, 0, 1},
+	"ZREM":             {0, 0, 1},
+	"ZCARD":            {0, 0, 1},
+	"ZSCORE":           {0, 0, 1},
+	"ZRANGE":           {0, 0, 1},
+	"ZRANGESTORE":      {0, 1, 1},
+	"ZREVRANGE":        {0, 0, 1},
+	"ZRANGEBYSCORE":    {0, 0, 1},
+	"ZREVRANGEBYSCORE": {0, 0, 1},
+	"ZRANGEBYLEX":      {0, 0, 1},
+	"ZREVRANGEBYLEX":   {0, 0, 1},
+	"ZCOUNT":           {0, 0, 1},
+	"ZLEXCOUNT":        {0, 0, 1},
+	"ZREMRANGEBYRANK":  {0, 0, 1},
+	"ZREMRANGEBYSCORE": {0, 0, 1},
+	"ZREMRANGEBYLEX":   {0, 0, 1},
+	"ZUNIONSTORE":      {0, 0, 1},
+	"ZINTERSTORE":      {0, 0, 1},
+	"ZDIFFSTORE":       {0, 0, 1},
+	"ZPOPMIN":          {0, 0, 1},
+	"ZPOPMAX":          {0, 0, 1},
+	"BZPOPMIN":         {0, -2, 1},
+	"BZPOPMAX":         {0, -2, 1},
+	"XADD":             {0, 0, 1},
+	"XRANGE":           {0, 0, 1},
+	"XREVRANGE":        {0, 0, 1},
+	"XLEN":             {0, 0, 1},
+	"XDEL":             {0, 0, 1},
+	"XTRIM":            {0, 0, 1},
+	"XGROUP":           {1, 1, 1},
+	"PFADD":            {0, 0, 1},
+	"PFCOUNT":          {0, -1, 1},
+	"PFMERGE":          {0, -1, 1},
+	"GEOADD":           {0, 0, 1},
+	"GEODIST":          {0, 0, 1},
+	"GEOHASH":          {0, 0, 1},
+	"GEOPOS":           {0, 0, 1},
+	"GEOSEARCH":        {0, 0, 1},
+	"GEOSEARCHSTORE":   {0, 1, 1},
+	"XACK":             {0, 0, 1},
+	"XPENDING":         {0, 0, 1},
+	"XCLAIM":           {0, 0, 1},
+	"XAUTOCLAIM":       {0, 0, 1},
+}
+
+// Commands whose keys follow a numkeys argument at the given position
+var NumKeysSpecs = map[string]int{
+	"ZUNION":      0,
+	"ZINTER":      0,
+	"ZDIFF":       0,
+	"ZINTERCARD":  0,
+	"ZMPOP":       0,
+	"ZUNIONSTORE": 1,
+	"ZINTERSTORE": 1,
+	"ZDIFFSTORE":  1,
+	"BZMPOP":      1,
+}
+
+// Commands whose keys follow the STREAMS argument, each paired with an ID
+var StreamsKeySpecs = map[string]bool{
+	"XREAD":      true,
+	"XREADGROUP": true,
+}
+
+// Commands that modify the dataset and are appended to the AOF
+var WriteCommands = map[string]bool{
+	"HSET":             true,
+	"HMSET":            true,
+	"HSETNX":           true,
+	"HDEL":             true,
+	"HINCRBY":          true,
+	"HINCRBYFLOAT":     true,
+	"HPERSIST":         true,
+	"SET":              true,
+	"DEL":              true,
+	"MSET":             true,
+	"INCR":             true,
+	"DECR":             true,
+	"ZADD":             true,
+	"ZREM":             true,
+	"ZRANGESTORE":      true,
+	"ZREMRANGEBYRANK":  true,
+	"ZREMRANGEBYSCORE": true,
+	"ZREMRANGEBYLEX":   true,
+	"ZUNIONSTORE":      true,
+	"ZINTERSTORE":      true,
+	"ZDIFFSTORE":       true,
+	"ZPOPMIN":          true,
+	"ZPOPMAX":          true,
+	"ZMPOP":            true,
+	"SADD":             true,
+	"SREM":             true,
+	"XDEL":             true,
+	"XACK":             true,
+	"PFADD":            true,
+	"PFMERGE":          true,
+	"GEOADD":           true,
+	"GEOSEARCHSTORE":   true,
+}
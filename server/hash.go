@@ -0,0 +1,168 @@
+package main
+
+// Hash stored as a listpack of field, value pairs while small and
+// as a map once it grows past hash-max-listpack-entries or -value
+type Hash struct {
+	objectMeta
+	lp   listpack
+	dict map[string]string
+}
+
+// Creates an empty listpack encoded hash
+func NewHash() *Hash {
+	return &Hash{objectMeta: newObjectMeta()}
+}
+
+// Returns the name OBJECT ENCODING reports
+func (h *Hash) Encoding() string {
+	if h.dict == nil {
+		return "listpack"
+	}
+	return "hashtable"
+}
+
+// Returns the number of fields, a missing hash has none
+func (h *Hash) Len() int {
+	if h == nil {
+		return 0
+	}
+	if h.dict == nil {
+		return h.lp.Len() / 2
+	}
+	return len(h.dict)
+}
+
+// Finds a field in the listpack, returning the offsets of the field,
+// of its value and of the entry after the value
+func (h *Hash) lpFind(field string) (off int, valueOff int, end int, ok bool) {
+	isField := true
+
+	h.lp.Iterate(func(s string, start int, next int) bool {
+		if isField {
+			if s == field {
+				off, valueOff, ok = start, next, true
+			}
+		} else if ok {
+			end = next
+			return false
+		}
+		isField = !isField
+		return true
+	})
+
+	return off, valueOff, end, ok
+}
+
+// Returns the value of a field
+func (h *Hash) Get(field string) (string, bool) {
+	if h == nil {
+		return "", false
+	}
+	if h.dict != nil {
+		value, ok := h.dict[field]
+		return value, ok
+	}
+
+	_, valueOff, _, ok := h.lpFind(field)
+
+	if !ok {
+		return "", false
+	}
+
+	value, _ := h.lp.entryAt(valueOff)
+
+	return value, true
+}
+
+// Sets a field, returns true if the field is new
+func (h *Hash) Set(field string, value string) bool {
+	if h.dict == nil {
+		maxValue := configInt("hash-max-listpack-value")
+
+		if len(field) > maxValue || len(value) > maxValue {
+			h.convert()
+		}
+	}
+
+	if h.dict != nil {
+		_, exists := h.dict[field]
+		h.dict[field] = value
+		return !exists
+	}
+
+	if _, valueOff, end, ok := h.lpFind(field); ok {
+		h.lp.Replace(valueOff, end, value)
+		return false
+	}
+
+	if h.Len() >= configInt("hash-max-listpack-entries") {
+		h.convert()
+		h.dict[field] = value
+		return true
+	}
+
+	h.lp.Append(field, value)
+
+	return true
+}
+
+// Removes a field, returns true if it existed
+func (h *Hash) Delete(field string) bool {
+	if h == nil {
+		return false
+	}
+	if h.dict != nil {
+		_, ok := h.dict[field]
+		delete(h.dict, field)
+		return ok
+	}
+
+	off, _, end, ok := h.lpFind(field)
+
+	if ok {
+		h.lp.Remove(off, end, 2)
+	}
+
+	return ok
+}
+
+// Calls fn with every field and value until fn returns false
+func (h *Hash) Range(fn func(field string, value string) bool) {
+	if h == nil {
+		return
+	}
+	if h.dict != nil {
+		for field, value := range h.dict {
+			if !fn(field, value) {
+				return
+			}
+		}
+		return
+	}
+
+	var field string
+	isField := true
+
+	h.lp.Iterate(func(s string, off int, next int) bool {
+		if isField {
+			field = s
+		} else if !fn(field, s) {
+			return false
+		}
+		isField = !isField
+		return true
+	})
+}
+
+// Moves the fields from the listpack into a map, hashes never convert back
+func (h *Hash) convert() {
+	dict := make(map[string]string, h.Len())
+
+	h.Range(func(field string, value string) bool {
+		dict[field] = value
+		return true
+	})
+
+	h.dict = dict
+	h.lp = listpack{}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHashWrongType(t *testing.T) {
+	c := dialTestServer(t)
+	wrongType := "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+
+	c.expect("+OK\r\n", "SET", "hwrong:str", "v")
+
+	for _, command := range [][]string{
+		{"HSET", "hwrong:str", "f", "v"},
+		{"HMSET", "hwrong:str", "f", "v"},
+		{"HSETNX", "hwrong:str", "f", "v"},
+		{"HGET", "hwrong:str", "f"},
+		{"HMGET", "hwrong:str", "f"},
+		{"HGETALL", "hwrong:str"},
+		{"HDEL", "hwrong:str", "f"},
+		{"HEXISTS", "hwrong:str", "f"},
+		{"HLEN", "hwrong:str"},
+		{"HSTRLEN", "hwrong:str", "f"},
+		{"HKEYS", "hwrong:str"},
+		{"HVALS", "hwrong:str"},
+		{"HINCRBY", "hwrong:str", "f", "1"},
+		{"HINCRBYFLOAT", "hwrong:str", "f", "1"},
+		{"HRANDFIELD", "hwrong:str"},
+		{"HEXPIRE", "hwrong:str", "10", "FIELDS", "1", "f"},
+		{"HTTL", "hwrong:str", "FIELDS", "1", "f"},
+		{"HPERSIST", "hwrong:str", "FIELDS", "1", "f"},
+	} {
+		c.expect(wrongType, command...)
+	}
+
+	c.expect("+string\r\n", "TYPE", "hwrong:str")
+	c.expect("$1\r\nv\r\n", "GET", "hwrong:str")
+}
+
+func TestHashReadsShareTheLock(t *testing.T) {
+	resetDataset()
+	runCommand("HSET", "hfe:shared", "a", "1", "b", "2")
+	runCommand("HEXPIRE", "hfe:shared", "100", "FIELDS", "1", "a")
+
+	// Readers with nothing to expire must not wait for the write lock
+	HSETsMu.RLock()
+	done := make(chan struct{})
+
+	go func() {
+		hashExpireFields("hfe:shared")
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("hashExpireFields waited for the write lock without expired fields")
+	}
+	HSETsMu.RUnlock()
+	<-done
+}
+
+func TestHashFieldsExpireOnRead(t *testing.T) {
+	c := dialTestServer(t)
+
+	c.expect(":2\r\n", "HSET", "hfe:lazy", "a", "1", "b", "2")
+	c.expect("*2\r\n:1\r\n:-2\r\n", "HPEXPIRE", "hfe:lazy", "20", "FIELDS", "2", "a", "c")
+	time.Sleep(40 * time.Millisecond)
+
+	c.expect("$-1\r\n", "HGET", "hfe:lazy", "a")
+	c.expect("*2\r\n:-2\r\n:-1\r\n", "HTTL", "hfe:lazy", "FIELDS", "2", "a", "b")
+	c.expect(":1\r\n", "HLEN", "hfe:lazy")
+
+	// A hash whose last field expires is removed
+	c.expect("*1\r\n:1\r\n", "HPEXPIRE", "hfe:lazy", "20", "FIELDS", "1", "b")
+	time.Sleep(40 * time.Millisecond)
+	c.expect(":0\r\n", "HLEN", "hfe:lazy")
+	c.expect(":0\r\n", "EXISTS", "hfe:lazy")
+}
+
+func TestHashCommands(t *testing.T) {
+	c := dialTestServer(t)
+
+	c.expect(":2\r\n", "HSET", "hcmd:k", "a", "1", "b", "hello")
+	c.expect("+OK\r\n", "HMSET", "hcmd:k", "c", "3")
+	c.expect(":0\r\n", "HSETNX", "hcmd:k", "a", "9")
+	c.expect(":1\r\n", "HSETNX", "hcmd:k", "d", "4")
+	c.expect(":4\r\n", "HLEN", "hcmd:k")
+	c.expect(":1\r\n", "HEXISTS", "hcmd:k", "b")
+	c.expect(":0\r\n", "HEXISTS", "hcmd:k", "z")
+	c.expect(":5\r\n", "HSTRLEN", "hcmd:k", "b")
+	c.expect(":0\r\n", "HSTRLEN", "hcmd:k", "z")
+	c.expect("*3\r\n$1\r\n1\r\n$-1\r\n$5\r\nhello\r\n", "HMGET", "hcmd:k", "a", "z", "b")
+
+	// Small hashes keep insertion order
+	c.expect("*4\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\nd\r\n", "HKEYS", "hcmd:k")
+	c.expect("*4\r\n$1\r\n1\r\n$5\r\nhello\r\n$1\r\n3\r\n$1\r\n4\r\n", "HVALS", "hcmd:k")
+	c.expect("*8\r\n$1\r\na\r\n$1\r\n1\r\n$1\r\nb\r\n$5\r\nhello\r\n$1\r\nc\r\n$1\r\n3\r\n$1\r\nd\r\n$1\r\n4\r\n", "HGETALL", "hcmd:k")
+
+	c.expect(":11\r\n", "HINCRBY", "hcmd:k", "a", "10")
+	c.expect(":-5\r\n", "HINCRBY", "hcmd:k", "new", "-5")
+	c.expect("-ERR hash value is not an integer\r\n", "HINCRBY", "hcmd:k", "b", "1")
+	c.expect("-ERR value is not an integer or out of range\r\n", "HINCRBY", "hcmd:k", "a", "x")
+	c.expect("$4\r\n13.5\r\n", "HINCRBYFLOAT", "hcmd:k", "a", "2.5")
+	c.expect("$3\r\n0.1\r\n", "HINCRBYFLOAT", "hcmd:f", "x", "0.1")
+	c.expect("-ERR hash value is not a float\r\n", "HINCRBYFLOAT", "hcmd:k", "b", "1")
+
+	c.expect(":2\r\n", "HDEL", "hcmd:k", "a", "b", "z")
+	c.expect(":3\r\n", "HLEN", "hcmd:k")
+
+	if v := c.do("HRANDFIELD", "hcmd:k", "-5"); len(v.array) != 5 {
+		t.Errorf("HRANDFIELD with a negative count returned %d fields, want 5", len(v.array))
+	}
+	if v := c.do("HRANDFIELD", "hcmd:k", "10", "WITHVALUES"); len(v.array) != 6 {
+		t.Errorf("HRANDFIELD 10 WITHVALUES returned %d items, want every field and value", len(v.array))
+	}
+	c.expect("$-1\r\n", "HRANDFIELD", "hcmd:missing")
+	c.expect("*0\r\n", "HRANDFIELD", "hcmd:missing", "3")
+
+	// Removing the last field removes the key
+	c.expect(":1\r\n", "HDEL", "hcmd:f", "x")
+	c.expect(":0\r\n", "EXISTS", "hcmd:f")
+}
+
+func TestHashFieldExpiration(t *testing.T) {
+	c := dialTestServer(t)
+
+	c.expect(":3\r\n", "HSET", "hfe:k", "a", "1", "b", "2", "c", "3")
+	c.expect("*3\r\n:1\r\n:1\r\n:-2\r\n", "HEXPIRE", "hfe:k", "100", "FIELDS", "3", "a", "b", "z")
+	c.expect("*2\r\n:0\r\n:1\r\n", "HEXPIRE", "hfe:k", "200", "NX", "FIELDS", "2", "a", "c")
+	c.expect("*1\r\n:0\r\n", "HEXPIRE", "hfe:k", "50", "GT", "FIELDS", "1", "a")
+	c.expect("*1\r\n:1\r\n", "HEXPIRE", "hfe:k", "50", "LT", "FIELDS", "1", "a")
+	c.expect("*3\r\n:50\r\n:100\r\n:200\r\n", "HTTL", "hfe:k", "FIELDS", "3", "a", "b", "c")
+
+	if v := c.do("HPTTL", "hfe:k", "FIELDS", "1", "b"); v.array[0].num <= 99000 || v.array[0].num > 100000 {
+		t.Errorf("HPTTL = %d, want close to 100000", v.array[0].num)
+	}
+
+	at := time.Now().Unix() + 1000
+	c.expect("*1\r\n:1\r\n", "HEXPIREAT", "hfe:k", strconv.FormatInt(at, 10), "FIELDS", "1", "a")
+	c.expect("*1\r\n:"+strconv.FormatInt(at, 10)+"\r\n", "HEXPIRETIME", "hfe:k", "FIELDS", "1", "a")
+	c.expect("*1\r\n:"+strconv.FormatInt(at*1000, 10)+"\r\n", "HPEXPIRETIME", "hfe:k", "FIELDS", "1", "a")
+
+	c.expect("*3\r\n:1\r\n:-1\r\n:-2\r\n", "HPERSIST", "hfe:k", "FIELDS", "3", "a", "a", "z")
+	c.expect("*1\r\n:-1\r\n", "HTTL", "hfe:k", "FIELDS", "1", "a")
+
+	// A time in the past deletes the field straight away
+	c.expect("*1\r\n:2\r\n", "HEXPIREAT", "hfe:k", "1", "FIELDS", "1", "b")
+	c.expect(":0\r\n", "HEXISTS", "hfe:k", "b")
+
+	// Setting a field again clears its expiration
+	c.expect(":0\r\n", "HSET", "hfe:k", "c", "new")
+	c.expect("*1\r\n:-1\r\n", "HTTL", "hfe:k", "FIELDS", "1", "c")
+
+	c.expect("*1\r\n:-2\r\n", "HTTL", "hfe:missing", "FIELDS", "1", "a")
+	c.expect("-ERR Mandatory argument FIELDS is missing or not at the right position\r\n", "HEXPIRE", "hfe:k", "10", "FIELD", "1", "a")
+	c.expect("-ERR The `numfields` parameter must match the number of arguments\r\n", "HEXPIRE", "hfe:k", "10", "FIELDS", "2", "a")
+	c.expect("-ERR invalid expire time in 'hexpire' command\r\n", "HEXPIRE", "hfe:k", "-1", "FIELDS", "1", "a")
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Expiration of hash fields as unix milliseconds, guarded by HSETsMu
+var HFIELDTTLs = map[string]map[string]int64{}
+
+// Replies of the field expiration commands
+const (
+	hexpireNoField  = -2
+	hexpireNoTTL    = -1
+	hexpireNotSet   = 0
+	hexpireSet      = 1
+	hexpireDeleted  = 2
+	hpersistRemoved = 1
+)
+
+// Hashes sampled per active expire cycle
+const activeExpireKeys = 20
+
+// Removes the expired fields of a hash and the hash itself once empty.
+// Caller must hold HSETsMu for writing. Returns the number of fields removed.
+func hashExpireFieldsLocked(hashMap string, now int64) int {
+	ttls, ok := HFIELDTTLs[hashMap]
+
+	if !ok {
+		return 0
+	}
+
+	removed := 0
+
+	for key, at := range ttls {
+		if at <= now {
+			delete(ttls, key)
+			HSETs[hashMap].Delete(key)
+			removed += 1
+		}
+	}
+
+	if len(ttls) == 0 {
+		delete(HFIELDTTLs, hashMap)
+	}
+	if removed > 0 {
+		notifyKeyspaceEvent(notifyHash, "hexpired", hashMap)
+	}
+	if value, ok := HSETs[hashMap]; ok && value.Len() == 0 {
+		delete(HSETs, hashMap)
+		notifyKeyspaceEvent(notifyGeneric, "del", hashMap)
+	}
+
+	return removed
+}
+
+// Checks whether a hash has a field past its expiration, caller must hold
+// HSETsMu
+func hashHasExpiredFields(hashMap string, now int64) bool {
+	for _, at := range HFIELDTTLs[hashMap] {
+		if at <= now {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Lazily expires the fields of a hash before a command reads it. Readers only
+// take the write lock when a field actually has to be removed.
+func hashExpireFields(hashMap string) {
+	now := time.Now().UnixMilli()
+
+	HSETsMu.RLock()
+	expired := hashHasExpiredFields(hashMap, now)
+	HSETsMu.RUnlock()
+
+	if !expired {
+		return
+	}
+
+	HSETsMu.Lock()
+	hashExpireFieldsLocked(hashMap, now)
+	HSETsMu.Unlock()
+}
+
+// Removes the expiration of a field, caller must hold HSETsMu for writing
+func hashPersistFieldLocked(hashMap string, key string) bool {
+	if _, ok := HFIELDTTLs[hashMap][key]; !ok {
+		return false
+	}
+
+	delete(HFIELDTTLs[hashMap], key)
+
+	if len(HFIELDTTLs[hashMap]) == 0 {
+		delete(HFIELDTTLs, hashMap)
+	}
+
+	return true
+}
+
+// Background cycle sampling hashes with field expirations and removing expired
+// fields, repeating straight away while many of the sampled hashes had some
+func activeExpireHashFields() {
+	for {
+		expired := activeExpireKeys
+
+		for expired > activeExpireKeys/4 {
+			expired = 0
+			sampled := 0
+			now := time.Now().UnixMilli()
+
+			HSETsMu.Lock()
+			for hashMap := range HFIELDTTLs {
+				if sampled == activeExpireKeys {
+					break
+				}
+				sampled += 1
+				if hashExpireFieldsLocked(hashMap, now) > 0 {
+					expired += 1
+				}
+			}
+			HSETsMu.Unlock()
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Parses FIELDS numfields field [field ...] at the end of a command
+func parseHashFields(args []Value) ([]string, error) {
+	if len(args) < 2 || strings.ToUpper(args[0].bulk) != "FIELDS" {
+		return nil, newReplyError(codeErr, "Mandatory argument FIELDS is missing or not at the right position")
+	}
+
+	n, err := strconv.Atoi(args[1].bulk)
+
+	if err != nil || n <= 0 {
+		return nil, newReplyError(codeErr, "Parameter `numFields` should be greater than 0")
+	}
+	if n != len(args)-2 {
+		return nil, newReplyError(codeErr, "The `numfields` parameter must match the number of arguments")
+	}
+
+	fields := make([]string, n)
+
+	for i := range fields {
+		fields[i] = args[i+2].bulk
+	}
+
+	return fields, nil
+}
+
+// Shared body of HEXPIRE, HPEXPIRE, HEXPIREAT and HPEXPIREAT. unit converts the
+// given time to milliseconds and absolute tells whether it is a unix time.
+func hexpire(command string, args []Value, unit int64, absolute bool) Value {
+	if len(args) < 4 {
+		return arityError(command)
+	}
+
+	if err := checkHashType(args[0].bulk); err != nil {
+		return errorReply(err)
+	}
+
+	hashMap := args[0].bulk
+	t, err := strconv.ParseInt(args[1].bulk, 10, 64)
+
+	if err != nil {
+		return errorReply(errNotInteger)
+	}
+
+	now := time.Now().UnixMilli()
+
+	if t < 0 || t > (math.MaxInt64-now)/unit {
+		return errorValue(codeErr, "invalid expire time in '"+command+"' command")
+	}
+
+	at := t * unit
+
+	if !absolute {
+		at += now
+	}
+
+	var nx, xx, gt, lt bool
+	rest := args[2:]
+
+	switch strings.ToUpper(rest[0].bulk) {
+	case "NX":
+		nx = true
+	case "XX":
+		xx = true
+	case "GT":
+		gt = true
+	case "LT":
+		lt = true
+	}
+	if nx || xx || gt || lt {
+		rest = rest[1:]
+	}
+
+	fields, err := parseHashFields(rest)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	replies := make([]Value, len(fields))
+	applied := make([]string, 0, len(fields))
+
+	HSETsMu.Lock()
+	hashExpireFieldsLocked(hashMap, now)
+
+	set, deleted := false, false
+
+	for i, key := range fields {
+		reply := hexpireSet
+
+		cur, hasTTL := HFIELDTTLs[hashMap][key]
+
+		switch {
+		case !hashFieldExists(hashMap, key):
+			reply = hexpireNoField
+		case nx && hasTTL, xx && !hasTTL:
+			reply = hexpireNotSet
+		// A field without expiration counts as never expiring
+		case gt && (!hasTTL || at <= cur), lt && hasTTL && at >= cur:
+			reply = hexpireNotSet
+		case at <= now:
+			HSETs[hashMap].Delete(key)
+			hashPersistFieldLocked(hashMap, key)
+			reply = hexpireDeleted
+		default:
+			if _, ok := HFIELDTTLs[hashMap]; !ok {
+				HFIELDTTLs[hashMap] = map[string]int64{}
+			}
+			HFIELDTTLs[hashMap][key] = at
+		}
+
+		if reply == hexpireSet || reply == hexpireDeleted {
+			applied = append(applied, key)
+		}
+		set = set || reply == hexpireSet
+		deleted = deleted || reply == hexpireDeleted
+		replies[i] = Value{typ: "integer", num: reply}
+	}
+
+	if set {
+		notifyKeyspaceEvent(notifyHash, "hexpire", hashMap)
+	}
+	if deleted {
+		notifyKeyspaceEvent(notifyHash, "hdel", hashMap)
+	}
+	if value, ok := HSETs[hashMap]; ok && value.Len() == 0 {
+		delete(HSETs, hashMap)
+		notifyKeyspaceEvent(notifyGeneric, "del", hashMap)
+	}
+	HSETsMu.Unlock()
+
+	// Logged as an absolute time so replaying the AOF later keeps the deadline
+	if len(applied) > 0 {
+		parts := []string{"HPEXPIREAT", hashMap, strconv.FormatInt(at, 10), "FIELDS", strconv.Itoa(len(applied))}
+		propagate(commandValue(append(parts, applied...)...))
+	}
+
+	return Value{typ: "array", array: replies}
+}
+
+// Checks a field exists, caller must hold HSETsMu
+func hashFieldExists(hashMap string, key string) bool {
+	_, ok := HSETs[hashMap].Get(key)
+	return ok
+}
+
+// HEXPIRE key seconds [NX|XX|GT|LT] FIELDS numfields field [field ...]
+func hExpire(args []Value) Value {
+	return hexpire("hexpire", args, 1000, false)
+}
+
+// HPEXPIRE key milliseconds [NX|XX|GT|LT] FIELDS numfields field [field ...]
+func hPExpire(args []Value) Value {
+	return hexpire("hpexpire", args, 1, false)
+}
+
+// HEXPIREAT key unix-time-seconds [NX|XX|GT|LT] FIELDS numfields field [field ...]
+func hExpireAt(args []Value) Value {
+	return hexpire("hexpireat", args, 1000, true)
+}
+
+// HPEXPIREAT key unix-time-milliseconds [NX|XX|GT|LT] FIELDS numfields field [field ...]
+func hPExpireAt(args []Value) Value {
+	return hexpire("hpexpireat", args, 1, true)
+}
+
+// Shared body of HTTL, HPTTL, HEXPIRETIME and HPEXPIRETIME. unit converts
+// milliseconds to the reply unit and absolute replies with the unix time.
+func httl(command string, args []Value, unit int64, absolute bool) Value {
+	if len(args) < 3 {
+		return arityError(command)
+	}
+
+	if err := checkHashType(args[0].bulk); err != nil {
+		return errorReply(err)
+	}
+
+	hashMap := args[0].bulk
+	fields, err := parseHashFields(args[1:])
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	hashExpireFields(hashMap)
+
+	replies := make([]Value, len(fields))
+	now := time.Now().UnixMilli()
+
+	HSETsMu.RLock()
+	for i, key := range fields {
+		at, hasTTL := HFIELDTTLs[hashMap][key]
+
+		switch {
+		// A field expiring since the check above counts as gone already
+		case !hashFieldExists(hashMap, key), hasTTL && at <= now:
+			replies[i] = Value{typ: "integer", num: hexpireNoField}
+		case !hasTTL:
+			replies[i] = Value{typ: "integer", num: hexpireNoTTL}
+		case absolute:
+			replies[i] = Value{typ: "integer", num: int(at / unit)}
+		default:
+			// Round up so a field about to expire does not report 0 seconds
+			replies[i] = Value{typ: "integer", num: int((at - now + unit - 1) / unit)}
+		}
+	}
+	HSETsMu.RUnlock()
+
+	return Value{typ: "array", array: replies}
+}
+
+// HTTL key FIELDS numfields field [field ...]
+func hTTL(args []Value) Value {
+	return httl("httl", args, 1000, false)
+}
+
+// HPTTL key FIELDS numfields field [field ...]
+func hPTTL(args []Value) Value {
+	return httl("hpttl", args, 1, false)
+}
+
+// HEXPIRETIME key FIELDS numfields field [field ...]
+func hExpireTime(args []Value) Value {
+	return httl("hexpiretime", args, 1000, true)
+}
+
+// HPEXPIRETIME key FIELDS numfields field [field ...]
+func hPExpireTime(args []Value) Value {
+	return httl("hpexpiretime", args, 1, true)
+}
+
+// HPERSIST key FIELDS numfields field [field ...]
+func hPersist(args []Value) Value {
+	if len(args) < 3 {
+		return arityError("hpersist")
+	}
+
+	if err := checkHashType(args[0].bulk); err != nil {
+		return errorReply(err)
+	}
+
+	hashMap := args[0].bulk
+	fields, err := parseHashFields(args[1:])
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	replies := make([]Value, len(fields))
+
+	HSETsMu.Lock()
+	hashExpireFieldsLocked(hashMap, time.Now().UnixMilli())
+
+	persisted := false
+
+	for i, key := range fields {
+		switch {
+		case !hashFieldExists(hashMap, key):
+			replies[i] = Value{typ: "integer", num: hexpireNoField}
+		case hashPersistFieldLocked(hashMap, key):
+			replies[i] = Value{typ: "integer", num: hpersistRemoved}
+			persisted = true
+		default:
+			replies[i] = Value{typ: "integer", num: hexpireNoTTL}
+		}
+	}
+
+	if persisted {
+		notifyKeyspaceEvent(notifyHash, "hpersist", hashMap)
+	}
+	HSETsMu.Unlock()
+
+	return Value{typ: "array", array: replies}
+}
@@ -1,7 +1,26 @@
 package main
 
 import (
+	"errors"
+	"strconv"
 	"strings"
+	"sync"
+)
+
+// Held by commands that may create a key from their type check until the value
+// is stored, so two writers can't put one key in different stores. It is taken
+// before any store lock
+var keyspaceMu = sync.Mutex{}
+
+// Errors shared by command handlers
+var (
+	errSyntax     = newReplyError(codeErr, "syntax error")
+	errNotInteger = newReplyError(codeErr, "value is not an integer or out of range")
+	errOutOfRange = newReplyError(codeErr, "value is out of range")
+	errNotFloat   = newReplyError(codeErr, "value is not a valid float")
+	errOverflow   = newReplyError(codeErr, "increment or decrement would overflow")
+	errWrongType  = newReplyError(codeWrongType, "Operation against a key holding the wrong kind of value")
+	errCrossSlot  = newReplyError(codeCrossSlot, "Keys in request don't hash to the same slot")
 )
 
 // Changes glob pattern to regex for ease of search
@@ -38,3 +57,191 @@ func globToRegex(glob string) string {
 	sb.WriteString("$")
 	return sb.String()
 }
+
+// Returns the type name of the value stored at key or "none"
+func keyType(key string) string {
+	SETsMu.RLock()
+	_, ok := SETs[key]
+	SETsMu.RUnlock()
+	if ok {
+		return "string"
+	}
+
+	HSETsMu.RLock()
+	_, ok = HSETs[key]
+	HSETsMu.RUnlock()
+	if ok {
+		return "hash"
+	}
+
+	XSETsMu.RLock()
+	_, ok = XSETs[key]
+	XSETsMu.RUnlock()
+	if ok {
+		return "stream"
+	}
+
+	ZSETsMu.RLock()
+	_, ok = ZSETs[key]
+	ZSETsMu.RUnlock()
+	if ok {
+		return "zset"
+	}
+
+	SSETsMu.RLock()
+	_, ok = SSETs[key]
+	SSETsMu.RUnlock()
+	if ok {
+		return "set"
+	}
+
+	return "none"
+}
+
+// Fails when key holds a value other than a sorted set
+func checkZsetType(key string) error {
+	switch keyType(key) {
+	case "zset", "none":
+		return nil
+	}
+	return errWrongType
+}
+
+// Fails when key holds a value other than a hash
+func checkHashType(key string) error {
+	switch keyType(key) {
+	case "hash", "none":
+		return nil
+	}
+	return errWrongType
+}
+
+// Fails when key holds a value other than a set
+func checkSetType(key string) error {
+	switch keyType(key) {
+	case "set", "none":
+		return nil
+	}
+	return errWrongType
+}
+
+// Removes key from whichever store holds it, returns true if it existed.
+// Callers hold keyspaceMu
+func deleteKey(key string) bool {
+	switch keyType(key) {
+	case "string":
+		SETsMu.Lock()
+		delete(SETs, key)
+		SETsMu.Unlock()
+	case "hash":
+		HSETsMu.Lock()
+		delete(HSETs, key)
+		delete(HFIELDTTLs, key)
+		HSETsMu.Unlock()
+	case "stream":
+		XSETsMu.Lock()
+		delete(XSETs, key)
+		XSETsMu.Unlock()
+	case "zset":
+		ZSETsMu.Lock()
+		delete(ZSETs, key)
+		ZSETsMu.Unlock()
+	case "set":
+		SSETsMu.Lock()
+		delete(SSETs, key)
+		SSETsMu.Unlock()
+	default:
+		return false
+	}
+
+	return true
+}
+
+// Drops a value of another type at key before SET or MSET overwrites it,
+// callers hold keyspaceMu
+func replaceWithString(key string) {
+	if keyType(key) != "string" {
+		deleteKey(key)
+	}
+}
+
+// Builds a RESP command array out of its parts
+func commandValue(parts ...string) Value {
+	array := make([]Value, len(parts))
+
+	for i, part := range parts {
+		array[i] = Value{typ: "bulk", bulk: part}
+	}
+
+	return Value{typ: "array", array: array}
+}
+
+// Builds an error reply from an error, errors without a code of their own
+// are sent as ERR
+func errorReply(err error) Value {
+	var replyErr *ReplyError
+
+	if errors.As(err, &replyErr) {
+		return errorValue(replyErr.Code, replyErr.Message)
+	}
+
+	return errorValue(codeErr, err.Error())
+}
+
+// Builds the error for a command that does not exist, quoting the start of
+// its arguments like Redis
+func unknownCommandError(name string, args []Value) Value {
+	var sb strings.Builder
+
+	for _, arg := range args {
+		if sb.Len() >= 128 {
+			break
+		}
+
+		sb.WriteString("'" + arg.bulk[:min(len(arg.bulk), 128-sb.Len())] + "' ")
+	}
+
+	return errorValue(codeErr, "unknown command '"+name[:min(len(name), 128)]+"', with args beginning with: "+sb.String())
+}
+
+// Builds the wrong number of arguments error for a command
+func arityError(command string) Value {
+	return errorValue(codeErr, "wrong number of arguments for '"+command+"' command")
+}
+
+// Returns the key arguments of a command according to KeySpecs and NumKeysSpecs
+func commandKeys(command string, args []Value) []string {
+	keys := make([]string, 0)
+
+	if spec, ok := KeySpecs[command]; ok {
+		last := spec[1]
+		if last < 0 {
+			last += len(args)
+		}
+		for i := spec[0]; i <= last && i < len(args); i += spec[2] {
+			keys = append(keys, args[i].bulk)
+		}
+	}
+
+	if pos, ok := NumKeysSpecs[command]; ok && pos < len(args) {
+		numkeys, err := strconv.Atoi(args[pos].bulk)
+		for i := 1; err == nil && i <= numkeys && pos+i < len(args); i++ {
+			keys = append(keys, args[pos+i].bulk)
+		}
+	}
+
+	if StreamsKeySpecs[command] {
+		for i, arg := range args {
+			if strings.ToUpper(arg.bulk) != "STREAMS" {
+				continue
+			}
+			rest := args[i+1:]
+			for _, key := range rest[:len(rest)/2] {
+				keys = append(keys, key.bulk)
+			}
+			break
+		}
+	}
+
+	return keys
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// HyperLogLog parameters, identical to Redis so values can be exchanged
+const (
+	hllP          = 14                                      // index bits
+	hllQ          = 64 - hllP                               // bits used to count leading zeroes
+	hllRegisters  = 1 << hllP                               // number of registers
+	hllBits       = 6                                       // bits per dense register
+	hllRegMax     = (1 << hllBits) - 1                      // largest register value
+	hllHdrSize    = 16                                      // "HYLL", encoding, unused, cardinality
+	hllDenseSize  = hllHdrSize + (hllRegisters*hllBits+7)/8 // size of dense values
+	hllDense      = 0                                       // encoding byte of dense values
+	hllSparse     = 1                                       // encoding byte of sparse values
+	hllAlphaInf   = 0.721347520444481703680                 // 1 / (2 ln 2)
+	hllHashSeed   = 0xadc83b19                              // seed of the MurmurHash64A hash
+	hllValMax     = 32                                      // largest value of a sparse VAL opcode
+	hllValLenMax  = 4                                       // longest run of a sparse VAL opcode
+	hllZeroLenMax = 64                                      // longest run of a sparse ZERO opcode
+	hllXZeroMax   = 16384                                   // longest run of a sparse XZERO opcode
+	hllCacheFlag  = 1 << 7                                  // set in the last cardinality byte when stale
+)
+
+// Errors of the HyperLogLog commands
+var (
+	errNotHLL     = newReplyError(codeWrongType, "Key is not a valid HyperLogLog string value.")
+	errCorruptHLL = newReplyError(codeInvalidObj, "Corrupted HLL object detected")
+)
+
+// 64 bit MurmurHash2 as used by Redis to hash HyperLogLog elements
+func murmurHash64A(data []byte, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+
+	h := seed ^ (uint64(len(data)) * m)
+
+	for len(data) >= 8 {
+		k := binary.LittleEndian.Uint64(data)
+		k *= m
+		k ^= k >> r
+		k *= m
+
+		h ^= k
+		h *= m
+		data = data[8:]
+	}
+
+	if len(data) > 0 {
+		for i := len(data) - 1; i >= 0; i-- {
+			h ^= uint64(data[i]) << (8 * i)
+		}
+		h *= m
+	}
+
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+
+	return h
+}
+
+// Returns the register an element maps to and the length of the run of
+// zeroes after the index bits plus one
+func hllPatLen(element string) (int, uint8) {
+	hash := murmurHash64A([]byte(element), hllHashSeed)
+	index := int(hash & (hllRegisters - 1))
+
+	// Stops at bit Q so the count never exceeds Q+1
+	hash >>= hllP
+	hash |= 1 << hllQ
+
+	count := uint8(1)
+
+	for bit := uint64(1); hash&bit == 0; bit <<= 1 {
+		count++
+	}
+
+	return index, count
+}
+
+// Checks the header of a string holding a HyperLogLog
+func hllValidate(s string) error {
+	if len(s) < hllHdrSize || s[:4] != "HYLL" {
+		return errNotHLL
+	}
+
+	switch s[4] {
+	case hllSparse:
+	case hllDense:
+		if len(s) != hllDenseSize {
+			return errNotHLL
+		}
+	default:
+		return errNotHLL
+	}
+
+	return nil
+}
+
+// Returns the HyperLogLog held by a string as bytes that are updated in
+// place. Other strings are refused before their encoding is touched.
+func hllBytes(o *StringObject) ([]byte, error) {
+	// Bytes edited in place were checked when they were first taken
+	if o.buf == nil {
+		if err := hllValidate(o.String()); err != nil {
+			return nil, err
+		}
+	}
+
+	return o.Bytes(), nil
+}
+
+// Reads register i of a dense body
+func hllDenseGet(body []byte, i int) uint8 {
+	pos := i * hllBits
+	b, shift := pos/8, uint(pos%8)
+	v := uint16(body[b]) >> shift
+
+	if b+1 < len(body) {
+		v |= uint16(body[b+1]) << (8 - shift)
+	}
+
+	return uint8(v & hllRegMax)
+}
+
+// Writes register i of a dense body
+func hllDenseSet(body []byte, i int, v uint8) {
+	pos := i * hllBits
+	b, shift := pos/8, uint(pos%8)
+	w := uint16(body[b])
+
+	if b+1 < len(body) {
+		w |= uint16(body[b+1]) << 8
+	}
+
+	w = w&^(hllRegMax<<shift) | uint16(v)<<shift
+	body[b] = byte(w)
+
+	if b+1 < len(body) {
+		body[b+1] = byte(w >> 8)
+	}
+}
+
+// Decodes the registers of a dense or sparse HyperLogLog
+func hllDecode(s []byte) ([]uint8, error) {
+	regs := make([]uint8, hllRegisters)
+	body := s[hllHdrSize:]
+
+	if s[4] == hllDense {
+		for i := range regs {
+			regs[i] = hllDenseGet(body, i)
+		}
+
+		return regs, nil
+	}
+
+	index := 0
+
+	for p := 0; p < len(body); p++ {
+		op := body[p]
+
+		switch op & 0xc0 {
+		case 0x00:
+			// ZERO: 00xxxxxx
+			index += int(op&0x3f) + 1
+		case 0x40:
+			// XZERO: 01xxxxxx yyyyyyyy
+			if p+1 >= len(body) {
+				return nil, errCorruptHLL
+			}
+			index += (int(op&0x3f)<<8 | int(body[p+1])) + 1
+			p++
+		default:
+			// VAL: 1vvvvvxx
+			value := (op>>2)&0x1f + 1
+			run := int(op&0x03) + 1
+
+			if index+run > hllRegisters {
+				return nil, errCorruptHLL
+			}
+
+			for j := 0; j < run; j++ {
+				regs[index+j] = value
+			}
+
+			index += run
+		}
+
+		if index > hllRegisters {
+			return nil, errCorruptHLL
+		}
+	}
+
+	if index != hllRegisters {
+		return nil, errCorruptHLL
+	}
+
+	return regs, nil
+}
+
+// Packs registers into 6 bit dense registers
+func hllEncodeDense(regs []uint8) []byte {
+	body := make([]byte, hllDenseSize-hllHdrSize)
+
+	for i, v := range regs {
+		hllDenseSet(body, i, v)
+	}
+
+	return body
+}
+
+// Run length encodes registers with the sparse opcodes, false when a register
+// is too large for a VAL opcode
+func hllEncodeSparse(regs []uint8) ([]byte, bool) {
+	body := []byte{}
+
+	for i := 0; i < len(regs); {
+		v := regs[i]
+		run := 1
+
+		for i+run < len(regs) && regs[i+run] == v {
+			run++
+		}
+
+		i += run
+
+		switch {
+		case v > hllValMax:
+			return nil, false
+		case v == 0:
+			for run > 0 {
+				n := min(run, hllXZeroMax)
+
+				if n <= hllZeroLenMax {
+					body = append(body, byte(n-1))
+				} else {
+					body = append(body, 0x40|byte((n-1)>>8), byte((n-1)&0xff))
+				}
+
+				run -= n
+			}
+		default:
+			for run > 0 {
+				n := min(run, hllValLenMax)
+				body = append(body, 0x80|(v-1)<<2|byte(n-1))
+				run -= n
+			}
+		}
+	}
+
+	return body, true
+}
+
+// Builds a HyperLogLog string from its registers, staying sparse while the
+// registers fit and the size is within hll-sparse-max-bytes
+func hllBuild(regs []uint8, sparse bool) string {
+	header := []byte{'H', 'Y', 'L', 'L', hllDense, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, hllCacheFlag}
+
+	if sparse {
+		if body, ok := hllEncodeSparse(regs); ok && len(body)+hllHdrSize <= configInt("hll-sparse-max-bytes") {
+			header[4] = hllSparse
+			return string(append(header, body...))
+		}
+	}
+
+	return string(append(header, hllEncodeDense(regs)...))
+}
+
+// Returns an empty sparse HyperLogLog, its cached cardinality of 0 is valid
+func hllEmpty() string {
+	b := []byte(hllBuild(make([]uint8, hllRegisters), true))
+	b[hllHdrSize-1] = 0
+
+	return string(b)
+}
+
+// Estimates the cardinality from the registers with the improved estimator
+// of Otmar Ertl that Redis uses
+func hllCount(regs []uint8) uint64 {
+	m := float64(hllRegisters)
+	histogram := make([]int, 64)
+
+	for _, v := range regs {
+		histogram[v]++
+	}
+
+	z := m * hllTau((m-float64(histogram[hllQ+1]))/m)
+
+	for j := hllQ; j >= 1; j-- {
+		z += float64(histogram[j])
+		z *= 0.5
+	}
+
+	z += m * hllSigma(float64(histogram[0])/m)
+
+	return uint64(math.Round(hllAlphaInf * m * m / z))
+}
+
+// Helper of the estimator for registers that are zero
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+
+	y := 1.0
+	z := x
+
+	for {
+		x *= x
+		zPrime := z
+		z += x * y
+		y += y
+
+		if zPrime == z {
+			return z
+		}
+	}
+}
+
+// Helper of the estimator for registers that overflowed
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+
+	y := 1.0
+	z := 1 - x
+
+	for {
+		x = math.Sqrt(x)
+		zPrime := z
+		y *= 0.5
+		z -= math.Pow(1-x, 2) * y
+
+		if zPrime == z {
+			return z / 3
+		}
+	}
+}
+
+// Loads the registers of the HyperLogLog stored at key, nil if the key is
+// missing. The caller holds SETsMu.
+func hllLoad(key string) ([]uint8, error) {
+	o, ok := SETs[key]
+
+	if !ok {
+		return nil, nil
+	}
+
+	s, err := hllBytes(o)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return hllDecode(s)
+}
+
+// PFADD key [element [element ...]]
+func pfAdd(args []Value) Value {
+	if len(args) < 1 {
+		return arityError("pfadd")
+	}
+
+	key := args[0].bulk
+
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+
+	switch keyType(key) {
+	case "string", "none":
+	default:
+		return errorReply(errWrongType)
+	}
+
+	SETsMu.Lock()
+	defer SETsMu.Unlock()
+
+	o, exists := SETs[key]
+
+	if !exists {
+		o = NewStringObject(hllEmpty(), 0)
+	}
+
+	hll, err := hllBytes(o)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	if !exists {
+		SETs[key] = o
+	}
+
+	changed := false
+
+	if hll[4] == hllDense {
+		// Dense registers are updated where they are
+		body := hll[hllHdrSize:]
+
+		for _, element := range args[1:] {
+			index, count := hllPatLen(element.bulk)
+
+			if count > hllDenseGet(body, index) {
+				hllDenseSet(body, index, count)
+				changed = true
+			}
+		}
+
+		if changed {
+			hll[hllHdrSize-1] |= hllCacheFlag
+		}
+	} else {
+		regs, err := hllDecode(hll)
+
+		if err != nil {
+			return errorReply(err)
+		}
+
+		for _, element := range args[1:] {
+			index, count := hllPatLen(element.bulk)
+
+			if count > regs[index] {
+				regs[index] = count
+				changed = true
+			}
+		}
+
+		// Sparse values turn dense for good once they outgrow the encoding
+		if changed {
+			o.SetString(hllBuild(regs, true))
+		}
+	}
+
+	if changed {
+		notifyKeyspaceEvent(notifyString, "pfadd", key)
+	}
+
+	if changed || !exists {
+		return Value{typ: "integer", num: 1}
+	}
+
+	return Value{typ: "integer", num: 0}
+}
+
+// PFCOUNT key [key ...]
+func pfCount(args []Value) Value {
+	if len(args) < 1 {
+		return arityError("pfcount")
+	}
+
+	for _, arg := range args {
+		switch keyType(arg.bulk) {
+		case "string", "none":
+		default:
+			return errorReply(errWrongType)
+		}
+	}
+
+	SETsMu.Lock()
+	defer SETsMu.Unlock()
+
+	if len(args) > 1 {
+		// Counts the union without storing it
+		max := make([]uint8, hllRegisters)
+
+		for _, arg := range args {
+			regs, err := hllLoad(arg.bulk)
+
+			if err != nil {
+				return errorReply(err)
+			}
+
+			for i, v := range regs {
+				if v > max[i] {
+					max[i] = v
+				}
+			}
+		}
+
+		return Value{typ: "integer", num: int(hllCount(max))}
+	}
+
+	key := args[0].bulk
+	o, ok := SETs[key]
+
+	if !ok {
+		return Value{typ: "integer", num: 0}
+	}
+
+	s, err := hllBytes(o)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	// The cardinality cached in the header is valid until a register changes
+	if s[hllHdrSize-1]&hllCacheFlag == 0 {
+		return Value{typ: "integer", num: int(binary.LittleEndian.Uint64(s[8:hllHdrSize]))}
+	}
+
+	regs, err := hllDecode(s)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	card := hllCount(regs)
+	binary.LittleEndian.PutUint64(s[8:hllHdrSize], card)
+
+	return Value{typ: "integer", num: int(card)}
+}
+
+// PFMERGE destkey [sourcekey [sourcekey ...]]
+func pfMerge(args []Value) Value {
+	if len(args) < 1 {
+		return arityError("pfmerge")
+	}
+
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+
+	for _, arg := range args {
+		switch keyType(arg.bulk) {
+		case "string", "none":
+		default:
+			return errorReply(errWrongType)
+		}
+	}
+
+	SETsMu.Lock()
+	defer SETsMu.Unlock()
+
+	max := make([]uint8, hllRegisters)
+	dense := false
+
+	// The destination is merged too, so its registers never decrease
+	for _, arg := range args {
+		regs, err := hllLoad(arg.bulk)
+
+		if err != nil {
+			return errorReply(err)
+		}
+		if regs == nil {
+			continue
+		}
+		if SETs[arg.bulk].Bytes()[4] == hllDense {
+			dense = true
+		}
+
+		for i, v := range regs {
+			if v > max[i] {
+				max[i] = v
+			}
+		}
+	}
+
+	dest := args[0].bulk
+
+	if o, ok := SETs[dest]; ok {
+		o.SetString(hllBuild(max, !dense))
+	} else {
+		SETs[dest] = NewStringObject(hllBuild(max, !dense), 0)
+	}
+
+	notifyKeyspaceEvent(notifyString, "pfadd", dest)
+
+	return Value{typ: "string", str: "OK"}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"strconv"
+)
+
+// Longest inline command accepted, the limit Redis applies to requests
+// that are not sent as RESP arrays
+const protoInlineMaxSize = 64 * 1024
+
+// Reads one line of an inline command and splits it into arguments
+func (r *Resp) readInline() ([]Value, error) {
+	var line []byte
+
+	for {
+		chunk, err := r.reader.ReadSlice('\n')
+		line = append(line, chunk...)
+
+		if len(line) > protoInlineMaxSize {
+			return nil, ProtocolError("too big inline request")
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		break
+	}
+
+	line = line[:len(line)-1]
+
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+
+	words, ok := splitArgs(line)
+
+	if !ok {
+		return nil, ProtocolError("unbalanced quotes in request")
+	}
+
+	args := make([]Value, len(words))
+
+	for i, word := range words {
+		args[i] = Value{typ: "bulk", bulk: word}
+	}
+
+	return args, nil
+}
+
+// Splits a line into arguments separated by spaces. Double quoted arguments
+// may hold escapes like \n and \x41, single quoted ones only \'. A closing
+// quote must be followed by a space or the end of the line.
+func splitArgs(line []byte) ([]string, bool) {
+	var args []string
+	i := 0
+
+	for {
+		for i < len(line) && isArgSpace(line[i]) {
+			i++
+		}
+
+		if i >= len(line) {
+			return args, true
+		}
+
+		var arg []byte
+		inDouble, inSingle := false, false
+
+		for done := false; !done; i++ {
+			switch {
+			case inDouble:
+				if i == len(line) {
+					return nil, false
+				}
+
+				switch c := line[i]; {
+				case c == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]):
+					b, _ := strconv.ParseUint(string(line[i+2:i+4]), 16, 8)
+					arg = append(arg, byte(b))
+					i += 3
+				case c == '\\' && i+1 < len(line):
+					i++
+					arg = append(arg, unescapeArg(line[i]))
+				case c == '"':
+					if i+1 < len(line) && !isArgSpace(line[i+1]) {
+						return nil, false
+					}
+					done = true
+				default:
+					arg = append(arg, c)
+				}
+			case inSingle:
+				if i == len(line) {
+					return nil, false
+				}
+
+				switch c := line[i]; {
+				case c == '\\' && i+1 < len(line) && line[i+1] == '\'':
+					i++
+					arg = append(arg, '\'')
+				case c == '\'':
+					if i+1 < len(line) && !isArgSpace(line[i+1]) {
+						return nil, false
+					}
+					done = true
+				default:
+					arg = append(arg, c)
+				}
+			default:
+				if i == len(line) {
+					done = true
+					break
+				}
+
+				switch c := line[i]; c {
+				case ' ', '\n', '\r', '\t', 0:
+					done = true
+				case '"':
+					inDouble = true
+				case '\'':
+					inSingle = true
+				default:
+					arg = append(arg, c)
+				}
+			}
+		}
+
+		args = append(args, string(arg))
+	}
+}
+
+// Characters that separate inline arguments
+func isArgSpace(c byte) bool {
+	switch c {
+	case ' ', '\t', '\n', '\v', '\f', '\r':
+		return true
+	}
+
+	return false
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// Character a backslash escape in a double quoted argument stands for
+func unescapeArg(c byte) byte {
+	switch c {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'b':
+		return '\b'
+	case 'a':
+		return '\a'
+	default:
+		return c
+	}
+}
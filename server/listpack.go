@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/binary"
+	"strconv"
+)
+
+// Compact encoding of a small list of strings in one contiguous byte slice.
+// Each entry starts with a uvarint tag, even tags are followed by a string of
+// tag/2 bytes and odd tags hold a zigzag encoded integer in the tag itself so
+// numeric values take as little as a single byte.
+type listpack struct {
+	buf []byte
+	n   int
+}
+
+// Returns the number of entries
+func (lp *listpack) Len() int {
+	return lp.n
+}
+
+// Returns the integer a string canonically represents, if any
+func listpackInt(s string) (int64, bool) {
+	if len(s) == 0 || len(s) > 20 {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+
+	if err != nil || strconv.FormatInt(n, 10) != s {
+		return 0, false
+	}
+
+	return n, true
+}
+
+// Encodes a single entry
+func listpackEncode(s string) []byte {
+	var tag [binary.MaxVarintLen64]byte
+
+	// The tag keeps one bit for the kind, so integers whose zigzag form needs
+	// all 64 bits are stored as strings
+	if n, ok := listpackInt(s); ok {
+		if zigzag := uint64(n<<1) ^ uint64(n>>63); zigzag>>63 == 0 {
+			size := binary.PutUvarint(tag[:], zigzag<<1|1)
+			return tag[:size]
+		}
+	}
+
+	size := binary.PutUvarint(tag[:], uint64(len(s))<<1)
+	entry := make([]byte, 0, size+len(s))
+	entry = append(entry, tag[:size]...)
+
+	return append(entry, s...)
+}
+
+// Decodes the entry starting at off, returns it and the offset of the next one
+func (lp *listpack) entryAt(off int) (string, int) {
+	tag, size := binary.Uvarint(lp.buf[off:])
+	off += size
+
+	if tag&1 == 1 {
+		zigzag := tag >> 1
+		n := int64(zigzag>>1) ^ -int64(zigzag&1)
+		return strconv.FormatInt(n, 10), off
+	}
+
+	end := off + int(tag>>1)
+
+	return string(lp.buf[off:end]), end
+}
+
+// Calls fn with each entry and its offsets until fn returns false
+func (lp *listpack) Iterate(fn func(s string, off int, next int) bool) {
+	for off := 0; off < len(lp.buf); {
+		s, next := lp.entryAt(off)
+
+		if !fn(s, off, next) {
+			return
+		}
+
+		off = next
+	}
+}
+
+// Returns all entries in order
+func (lp *listpack) Entries() []string {
+	entries := make([]string, 0, lp.n)
+
+	lp.Iterate(func(s string, off int, next int) bool {
+		entries = append(entries, s)
+		return true
+	})
+
+	return entries
+}
+
+// Adds entries at the end
+func (lp *listpack) Append(entries ...string) {
+	for _, s := range entries {
+		lp.buf = append(lp.buf, listpackEncode(s)...)
+	}
+
+	lp.n += len(entries)
+}
+
+// Removes count entries stored between the offsets off and end
+func (lp *listpack) Remove(off int, end int, count int) {
+	lp.buf = append(lp.buf[:off], lp.buf[end:]...)
+	lp.n -= count
+}
+
+// Replaces the single entry stored between the offsets off and end
+func (lp *listpack) Replace(off int, end int, s string) {
+	entry := listpackEncode(s)
+	buf := make([]byte, 0, len(lp.buf)-(end-off)+len(entry))
+	buf = append(buf, lp.buf[:off]...)
+	buf = append(buf, entry...)
+
+	lp.buf = append(buf, lp.buf[end:]...)
+}
+
+// Rebuilds the listpack out of a list of entries
+func (lp *listpack) Reset(entries []string) {
+	lp.buf = lp.buf[:0]
+	lp.n = 0
+	lp.Append(entries...)
+}
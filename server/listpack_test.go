@@ -0,0 +1,47 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestListpackRoundTrip(t *testing.T) {
+	entries := []string{"", "a", "0", "-1", "1", "007", "-0", "1.5", "hello world"}
+
+	for _, n := range []int64{
+		math.MaxInt64, math.MinInt64, 1 << 62, -1 << 62, 1<<62 - 1, -1<<62 - 1, 1<<62 + 1,
+		math.MaxInt32, math.MinInt32,
+	} {
+		entries = append(entries, strconv.FormatInt(n, 10))
+	}
+
+	var lp listpack
+	lp.Append(entries...)
+
+	got := lp.Entries()
+
+	if lp.Len() != len(entries) || len(got) != len(entries) {
+		t.Fatalf("listpack holds %d entries, want %d", len(got), len(entries))
+	}
+	for i := range entries {
+		if got[i] != entries[i] {
+			t.Errorf("entry %d = %q, want %q", i, got[i], entries[i])
+		}
+	}
+}
+
+func TestListpackLargeIntegers(t *testing.T) {
+	c := dialTestServer(t)
+
+	for _, n := range []string{"4611686018427387904", "-4611686018427387905", "9223372036854775807", "-9223372036854775808"} {
+		c.expect(":1\r\n", "HSET", "lpint:h", n, n)
+		c.expect("$"+strconv.Itoa(len(n))+"\r\n"+n+"\r\n", "HGET", "lpint:h", n)
+		c.expect(":1\r\n", "SADD", "lpint:s", n)
+		c.expect(":1\r\n", "SISMEMBER", "lpint:s", n)
+		c.expect(":1\r\n", "ZADD", "lpint:z", "1", n)
+		c.expect("$1\r\n1\r\n", "ZSCORE", "lpint:z", n)
+	}
+
+	c.expect("$8\r\nlistpack\r\n", "OBJECT", "ENCODING", "lpint:h")
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+)
+
+// Classes of keyspace events, each selected by a letter of notify-keyspace-events
+const (
+	notifyKeyspace = 1 << iota // K, published on __keyspace@0__:<key>
+	notifyKeyevent             // E, published on __keyevent@0__:<event>
+	notifyGeneric              // g, type independent commands like DEL
+	notifyString               // $
+	notifyList                 // l
+	notifySet                  // s
+	notifyHash                 // h
+	notifyZset                 // z
+	notifyExpired              // x
+	notifyEvicted              // e, accepted like Redis but never fires since keys are never evicted
+	notifyStream               // t
+	notifyKeyMiss              // m, only sent when asked for explicitly
+	notifyModule               // d
+	notifyNew                  // n, only sent when asked for explicitly
+
+	// A, every class but key misses and new keys
+	notifyAll = notifyGeneric | notifyString | notifyList | notifySet | notifyHash |
+		notifyZset | notifyExpired | notifyEvicted | notifyStream | notifyModule
+)
+
+// Enabled event classes, parsed once when notify-keyspace-events is set so
+// publishing an event only loads the mask
+var notifyFlags atomic.Int32
+
+// Letters of notify-keyspace-events in the order Redis prints them
+var notifyFlagLetters = []struct {
+	letter byte
+	class  int
+}{
+	{'g', notifyGeneric},
+	{'$', notifyString},
+	{'l', notifyList},
+	{'s', notifySet},
+	{'h', notifyHash},
+	{'z', notifyZset},
+	{'x', notifyExpired},
+	{'e', notifyEvicted},
+	{'t', notifyStream},
+	{'d', notifyModule},
+	{'K', notifyKeyspace},
+	{'E', notifyKeyevent},
+	{'m', notifyKeyMiss},
+	{'n', notifyNew},
+}
+
+// Parses the value of notify-keyspace-events
+func parseNotifyFlags(s string) (int, error) {
+	flags := 0
+
+	for i := 0; i < len(s); i++ {
+		if s[i] == 'A' {
+			flags |= notifyAll
+			continue
+		}
+
+		class := 0
+
+		for _, f := range notifyFlagLetters {
+			if f.letter == s[i] {
+				class = f.class
+				break
+			}
+		}
+
+		if class == 0 {
+			return 0, errors.New("Invalid event class character. Use 'Ag$lshzxeKEtmdn'.")
+		}
+
+		flags |= class
+	}
+
+	return flags, nil
+}
+
+// Formats flags the way CONFIG GET reports them
+func formatNotifyFlags(flags int) string {
+	var sb strings.Builder
+
+	if flags&notifyAll == notifyAll {
+		sb.WriteByte('A')
+		flags &^= notifyAll
+	}
+
+	for _, f := range notifyFlagLetters {
+		if flags&f.class != 0 {
+			sb.WriteByte(f.letter)
+		}
+	}
+
+	return sb.String()
+}
+
+// Accepts valid notify-keyspace-events values
+func validateNotifyFlags(value string) error {
+	_, err := parseNotifyFlags(value)
+	return err
+}
+
+// Rewrites a notify-keyspace-events value in its canonical form
+func normalizeNotifyFlags(value string) string {
+	flags, _ := parseNotifyFlags(value)
+	return formatNotifyFlags(flags)
+}
+
+// Stores the mask of a notify-keyspace-events value CONFIG SET accepted
+func applyNotifyFlags(value string) {
+	flags, _ := parseNotifyFlags(value)
+	notifyFlags.Store(int32(flags))
+}
+
+// Publishes a keyspace event if its class is enabled. Safe to call while
+// holding the lock of a store, delivery never waits on subscribers.
+func notifyKeyspaceEvent(class int, event string, key string) {
+	flags := int(notifyFlags.Load())
+
+	if flags&class == 0 {
+		return
+	}
+
+	if flags&notifyKeyspace != 0 {
+		publishMessage("__keyspace@0__:"+key, event)
+	}
+	if flags&notifyKeyevent != 0 {
+		publishMessage("__keyevent@0__:"+event, key)
+	}
+}
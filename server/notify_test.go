@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeyspaceEvents(t *testing.T) {
+	addr := startTestServer(t)
+	c := dialTest(t, addr)
+	t.Cleanup(func() { runCommand("CONFIG", "SET", "notify-keyspace-events", "") })
+
+	c.expect("+OK\r\n", "CONFIG", "SET", "notify-keyspace-events", "Khz")
+	c.expect("*2\r\n$22\r\nnotify-keyspace-events\r\n$3\r\nhzK\r\n", "CONFIG", "GET", "notify-keyspace-events")
+
+	sub := dialTest(t, addr)
+	sub.expect("*3\r\n$10\r\npsubscribe\r\n$6\r\n__key*\r\n:1\r\n", "PSUBSCRIBE", "__key*")
+
+	// Strings are not enabled, so SET publishes nothing before HSET does
+	c.expect("+OK\r\n", "SET", "ev:str", "v")
+	c.expect(":1\r\n", "HSET", "ev:hash", "f", "v")
+	sub.receive("*4\r\n$8\r\npmessage\r\n$6\r\n__key*\r\n$22\r\n__keyspace@0__:ev:hash\r\n$4\r\nhset\r\n")
+
+	c.expect(":1\r\n", "ZADD", "ev:zset", "1", "m")
+	sub.receive("*4\r\n$8\r\npmessage\r\n$6\r\n__key*\r\n$22\r\n__keyspace@0__:ev:zset\r\n$4\r\nzadd\r\n")
+
+	// A CONFIG SET failing on a later parameter keeps the previous classes
+	c.expect("-ERR CONFIG SET failed (possibly related to argument 'lfu-log-factor') - argument couldn't be parsed into an integer\r\n",
+		"CONFIG", "SET", "notify-keyspace-events", "", "lfu-log-factor", "x")
+	c.expect(":1\r\n", "HSET", "ev:hash", "g", "v")
+	sub.receive("*4\r\n$8\r\npmessage\r\n$6\r\n__key*\r\n$22\r\n__keyspace@0__:ev:hash\r\n$4\r\nhset\r\n")
+
+	c.expect("+OK\r\n", "CONFIG", "SET", "notify-keyspace-events", "")
+	c.expect(":1\r\n", "HSET", "ev:hash", "h", "v")
+	c.expect("+OK\r\n", "CONFIG", "SET", "notify-keyspace-events", "Eg")
+	c.expect(":1\r\n", "DEL", "ev:hash")
+	sub.receive("*4\r\n$8\r\npmessage\r\n$6\r\n__key*\r\n$18\r\n__keyevent@0__:del\r\n$7\r\nev:hash\r\n")
+
+	c.expect("-ERR CONFIG SET failed (possibly related to argument 'notify-keyspace-events') - Invalid event class character. Use 'Ag$lshzxeKEtmdn'.\r\n",
+		"CONFIG", "SET", "notify-keyspace-events", "Kq")
+}
+
+func TestKeyspaceEventClasses(t *testing.T) {
+	addr := startTestServer(t)
+	c := dialTest(t, addr)
+	t.Cleanup(func() { runCommand("CONFIG", "SET", "notify-keyspace-events", "") })
+
+	sub := dialTest(t, addr)
+	sub.expect("*3\r\n$10\r\npsubscribe\r\n$6\r\n__key*\r\n:1\r\n", "PSUBSCRIBE", "__key*")
+
+	// A stands for every class but m and n, E sends the event channel only
+	c.expect("+OK\r\n", "CONFIG", "SET", "notify-keyspace-events", "EA")
+	c.expect("*2\r\n$22\r\nnotify-keyspace-events\r\n$2\r\nAE\r\n", "CONFIG", "GET", "notify-keyspace-events")
+
+	c.expect("$-1\r\n", "GET", "ev:missing")
+	c.do("XADD", "ev:stream", "1-0", "f", "v")
+	sub.receive("*4\r\n$8\r\npmessage\r\n$6\r\n__key*\r\n$19\r\n__keyevent@0__:xadd\r\n$9\r\nev:stream\r\n")
+	c.do("XGROUP", "CREATE", "ev:stream", "g", "0")
+	sub.receive("*4\r\n$8\r\npmessage\r\n$6\r\n__key*\r\n$28\r\n__keyevent@0__:xgroup-create\r\n$9\r\nev:stream\r\n")
+	c.do("SADD", "ev:set", "a")
+	sub.receive("*4\r\n$8\r\npmessage\r\n$6\r\n__key*\r\n$19\r\n__keyevent@0__:sadd\r\n$6\r\nev:set\r\n")
+
+	// Expired hash fields are reported by the hash class
+	c.do("HSET", "ev:hash", "f", "v")
+	sub.receive("*4\r\n$8\r\npmessage\r\n$6\r\n__key*\r\n$19\r\n__keyevent@0__:hset\r\n$7\r\nev:hash\r\n")
+	c.do("HPEXPIRE", "ev:hash", "1", "FIELDS", "1", "f")
+	sub.receive("*4\r\n$8\r\npmessage\r\n$6\r\n__key*\r\n$22\r\n__keyevent@0__:hexpire\r\n$7\r\nev:hash\r\n")
+	time.Sleep(10 * time.Millisecond)
+	c.expect("*0\r\n", "HGETALL", "ev:hash")
+	sub.receive("*4\r\n$8\r\npmessage\r\n$6\r\n__key*\r\n$23\r\n__keyevent@0__:hexpired\r\n$7\r\nev:hash\r\n")
+	sub.receive("*4\r\n$8\r\npmessage\r\n$6\r\n__key*\r\n$18\r\n__keyevent@0__:del\r\n$7\r\nev:hash\r\n")
+
+	// Key misses are only sent when m is given, K and E together send both
+	c.expect("+OK\r\n", "CONFIG", "SET", "notify-keyspace-events", "KEm")
+	c.expect("$-1\r\n", "GET", "ev:missing")
+	sub.receive("*4\r\n$8\r\npmessage\r\n$6\r\n__key*\r\n$25\r\n__keyspace@0__:ev:missing\r\n$7\r\nkeymiss\r\n")
+	sub.receive("*4\r\n$8\r\npmessage\r\n$6\r\n__key*\r\n$22\r\n__keyevent@0__:keymiss\r\n$10\r\nev:missing\r\n")
+
+	// Without K or E nothing is published whatever the classes
+	c.expect("+OK\r\n", "CONFIG", "SET", "notify-keyspace-events", "A")
+	c.do("SADD", "ev:set", "b")
+	c.expect("+OK\r\n", "CONFIG", "SET", "notify-keyspace-events", "Es")
+	c.do("SREM", "ev:set", "b")
+	sub.receive("*4\r\n$8\r\npmessage\r\n$6\r\n__key*\r\n$19\r\n__keyevent@0__:srem\r\n$6\r\nev:set\r\n")
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Encodings of a stored string
+const (
+	encodingInt = iota
+	encodingEmbstr
+	encodingRaw
+)
+
+// Longest string Redis stores in the same allocation as its object
+const embstrSizeLimit = 44
+
+// Starting value of the LFU counter so new keys are not evicted straight away
+const lfuInitVal = 5
+
+// Integers from 0 up to this limit are shared objects in Redis
+const sharedIntegers = 10000
+
+// Access metadata kept on every stored value. Readers update it while only
+// holding the read lock of its store, so the fields are accessed atomically.
+type objectMeta struct {
+	lru     int64  // unix milliseconds of the last access
+	lfu     uint32 // logarithmic access counter, at most 255
+	lfuTime int64  // unix minutes of the last counter decay
+}
+
+// String value with its expiration and access metadata. Integer values are
+// kept in num instead of str, like the int encoding of Redis.
+type StringObject struct {
+	objectMeta
+	encoding int
+	num      int64
+	str      string
+	buf      []byte // value edited in place, replaces str while set
+	expire   int64
+}
+
+// Metadata for a value created now
+func newObjectMeta() objectMeta {
+	now := time.Now()
+
+	return objectMeta{lru: now.UnixMilli(), lfu: lfuInitVal, lfuTime: now.Unix() / 60}
+}
+
+// Counter after decrementing it once per lfu-decay-time minutes since the last decay
+func (m *objectMeta) lfuDecay(now time.Time) uint8 {
+	decayTime := int64(configInt("lfu-decay-time"))
+
+	if decayTime == 0 {
+		return uint8(atomic.LoadUint32(&m.lfu))
+	}
+
+	lfu := atomic.LoadUint32(&m.lfu)
+	periods := (now.Unix()/60 - atomic.LoadInt64(&m.lfuTime)) / decayTime
+
+	if periods >= int64(lfu) {
+		return 0
+	}
+
+	return uint8(lfu - uint32(periods))
+}
+
+// Records an access, the LFU counter grows logarithmically as in Redis
+func (m *objectMeta) touch(now time.Time) {
+	counter := m.lfuDecay(now)
+
+	if counter < 255 {
+		base := float64(counter) - lfuInitVal
+		if base < 0 {
+			base = 0
+		}
+		if rand.Float64() < 1.0/(base*float64(configInt("lfu-log-factor"))+1) {
+			counter++
+		}
+	}
+
+	// Concurrent accesses may lose an increment, the counter is an estimate
+	atomic.StoreUint32(&m.lfu, uint32(counter))
+	atomic.StoreInt64(&m.lfuTime, now.Unix()/60)
+	atomic.StoreInt64(&m.lru, now.UnixMilli())
+}
+
+// Copy of the metadata read atomically
+func (m *objectMeta) load() objectMeta {
+	return objectMeta{
+		lru:     atomic.LoadInt64(&m.lru),
+		lfu:     atomic.LoadUint32(&m.lfu),
+		lfuTime: atomic.LoadInt64(&m.lfuTime),
+	}
+}
+
+// Creates a string picking its encoding from the value
+func NewStringObject(value string, expire int64) *StringObject {
+	o := &StringObject{objectMeta: newObjectMeta(), expire: expire}
+	o.SetString(value)
+
+	return o
+}
+
+// Replaces the value, integers are stored without a string
+func (o *StringObject) SetString(value string) {
+	if n, ok := listpackInt(value); ok {
+		o.SetInt(n)
+		return
+	}
+
+	o.str = value
+	o.buf = nil
+	o.num = 0
+	o.encoding = encodingRaw
+
+	if len(value) <= embstrSizeLimit {
+		o.encoding = encodingEmbstr
+	}
+}
+
+// Replaces the value with an integer
+func (o *StringObject) SetInt(n int64) {
+	o.encoding = encodingInt
+	o.num = n
+	o.str = ""
+	o.buf = nil
+}
+
+// Returns the value as bytes the caller may change in place, for values
+// updated a few bytes at a time like dense HyperLogLogs. The value stays raw
+// encoded until it is replaced.
+func (o *StringObject) Bytes() []byte {
+	if o.buf == nil {
+		o.buf = []byte(o.String())
+		o.str = ""
+		o.num = 0
+		o.encoding = encodingRaw
+	}
+
+	return o.buf
+}
+
+// Returns the value as a string
+func (o *StringObject) String() string {
+	if o.encoding == encodingInt {
+		return strconv.FormatInt(o.num, 10)
+	}
+	if o.buf != nil {
+		return string(o.buf)
+	}
+	return o.str
+}
+
+// Returns the value as an integer
+func (o *StringObject) Int() (int64, error) {
+	if o.encoding == encodingInt {
+		return o.num, nil
+	}
+
+	n, err := strconv.ParseInt(o.String(), 10, 64)
+
+	if err != nil {
+		return 0, errNotInteger
+	}
+
+	return n, nil
+}
+
+// Returns the name OBJECT ENCODING reports
+func (o *StringObject) Encoding() string {
+	switch o.encoding {
+	case encodingInt:
+		return "int"
+	case encodingEmbstr:
+		return "embstr"
+	default:
+		return "raw"
+	}
+}
+
+// Value of any type as OBJECT and the access tracking see it
+type storedObject interface {
+	Encoding() string
+	meta() *objectMeta
+}
+
+func (m *objectMeta) meta() *objectMeta {
+	return m
+}
+
+// Calls fn with the value stored at key while the read lock of its store is
+// held, returns false if the key does not exist
+func readObject(key string, fn func(o storedObject)) bool {
+	SETsMu.RLock()
+	if o, ok := SETs[key]; ok {
+		fn(o)
+		SETsMu.RUnlock()
+		return true
+	}
+	SETsMu.RUnlock()
+
+	HSETsMu.RLock()
+	if h, ok := HSETs[key]; ok {
+		fn(h)
+		HSETsMu.RUnlock()
+		return true
+	}
+	HSETsMu.RUnlock()
+
+	SSETsMu.RLock()
+	if s, ok := SSETs[key]; ok {
+		fn(s)
+		SSETsMu.RUnlock()
+		return true
+	}
+	SSETsMu.RUnlock()
+
+	ZSETsMu.RLock()
+	if z, ok := ZSETs[key]; ok {
+		fn(z)
+		ZSETsMu.RUnlock()
+		return true
+	}
+	ZSETsMu.RUnlock()
+
+	XSETsMu.RLock()
+	if x, ok := XSETs[key]; ok {
+		fn(x)
+		XSETsMu.RUnlock()
+		return true
+	}
+	XSETsMu.RUnlock()
+
+	return false
+}
+
+// Returns the encoding of the value stored at key
+func objectEncoding(key string) (string, bool) {
+	var encoding string
+
+	ok := readObject(key, func(o storedObject) {
+		encoding = o.Encoding()
+
+		// Small hashes with field expirations keep them alongside the listpack
+		if _, isHash := o.(*Hash); isHash && encoding == "listpack" {
+			if _, ok := HFIELDTTLs[key]; ok {
+				encoding = "listpackex"
+			}
+		}
+	})
+
+	return encoding, ok
+}
+
+// Returns a copy of the access metadata of the value stored at key
+func objectMetaOf(key string) (objectMeta, bool) {
+	var meta objectMeta
+
+	ok := readObject(key, func(o storedObject) {
+		meta = o.meta().load()
+	})
+
+	return meta, ok
+}
+
+// Records an access to each key that exists. The metadata is updated
+// atomically so readers only need the read lock.
+func touchKeys(keys []string) {
+	now := time.Now()
+
+	for _, key := range keys {
+		readObject(key, func(o storedObject) {
+			o.meta().touch(now)
+		})
+	}
+}
+
+// Checks whether maxmemory-policy evicts by access frequency
+func lfuPolicy() bool {
+	configsMu.RLock()
+	defer configsMu.RUnlock()
+
+	return strings.HasSuffix(configs["maxmemory-policy"], "-lfu")
+}
+
+// Accepts the eviction policies Redis knows
+func validateMaxmemoryPolicy(value string) error {
+	switch value {
+	case "volatile-lru", "allkeys-lru", "volatile-lfu", "allkeys-lfu",
+		"volatile-random", "allkeys-random", "volatile-ttl", "noeviction":
+		return nil
+	}
+	return errors.New("argument(s) must be one of the following: volatile-lru, allkeys-lru, volatile-lfu, allkeys-lfu, volatile-random, allkeys-random, volatile-ttl, noeviction")
+}
+
+// Help lines for OBJECT HELP
+var objectHelp = []string{
+	"OBJECT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"ENCODING <key>",
+	"    Return the kind of internal representation used in order to store the value",
+	"    associated with a <key>.",
+	"FREQ <key>",
+	"    Return the access frequency index of the <key>. The returned integer is",
+	"    proportional to the logarithm of the recent access frequency of the key.",
+	"IDLETIME <key>",
+	"    Return the idle time of the <key>, that is the approximated number of",
+	"    seconds elapsed since the last access to the key.",
+	"REFCOUNT <key>",
+	"    Return the number of references of the value associated with the specified",
+	"    <key>.",
+	"HELP",
+	"    Print this help.",
+}
+
+// OBJECT ENCODING|FREQ|IDLETIME|REFCOUNT key and OBJECT HELP
+func object(args []Value) Value {
+	if len(args) == 0 {
+		return arityError("object")
+	}
+
+	subcommand := strings.ToUpper(args[0].bulk)
+
+	if subcommand == "HELP" {
+		lines := make([]Value, len(objectHelp))
+		for i, line := range objectHelp {
+			lines[i] = Value{typ: "string", str: line}
+		}
+		return Value{typ: "array", array: lines}
+	}
+
+	switch subcommand {
+	case "ENCODING", "FREQ", "IDLETIME", "REFCOUNT":
+		if len(args) != 2 {
+			return arityError("object|" + strings.ToLower(subcommand))
+		}
+	default:
+		return errorValue(codeErr, "unknown subcommand '"+args[0].bulk+"'. Try OBJECT HELP.")
+	}
+
+	key := args[1].bulk
+
+	if subcommand == "ENCODING" {
+		encoding, ok := objectEncoding(key)
+
+		if !ok {
+			return Value{typ: "null"}
+		}
+
+		return Value{typ: "bulk", bulk: encoding}
+	}
+
+	meta, ok := objectMetaOf(key)
+
+	if !ok {
+		return Value{typ: "null"}
+	}
+
+	now := time.Now()
+
+	switch subcommand {
+	case "FREQ":
+		if !lfuPolicy() {
+			return errorValue(codeErr, "An LFU maxmemory policy is not selected, access frequency not tracked. Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.")
+		}
+		return Value{typ: "integer", num: int(meta.lfuDecay(now))}
+	case "IDLETIME":
+		if lfuPolicy() {
+			return errorValue(codeErr, "An LFU maxmemory policy is selected, idle time not tracked. Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.")
+		}
+		return Value{typ: "integer", num: int((now.UnixMilli() - meta.lru) / 1000)}
+	default:
+		refcount := 1
+
+		SETsMu.RLock()
+		if o, ok := SETs[key]; ok && o.encoding == encodingInt && o.num >= 0 && o.num < sharedIntegers {
+			refcount = 2147483647
+		}
+		SETsMu.RUnlock()
+
+		return Value{typ: "integer", num: refcount}
+	}
+}
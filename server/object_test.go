@@ -0,0 +1,164 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestObjectConcurrentWithDelete(t *testing.T) {
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			Handlers["ZADD"](commandValue("object:race", "1", "a").array)
+			Handlers["DEL"](commandValue("object:race").array)
+		}
+	}()
+
+	// A key deleted between finding its type and reading it used to crash
+	for i := 0; i < 200000; i++ {
+		objectEncoding("object:race")
+		objectMetaOf("object:race")
+		touchKeys([]string{"object:race"})
+	}
+
+	close(stop)
+	wg.Wait()
+}
+
+func TestObjectEncodingAndIdletime(t *testing.T) {
+	c := dialTestServer(t)
+
+	c.expect("+OK\r\n", "SET", "object:int", "12")
+	c.expect("$3\r\nint\r\n", "OBJECT", "ENCODING", "object:int")
+	c.expect("+OK\r\n", "SET", "object:str", "hello")
+	c.expect("$6\r\nembstr\r\n", "OBJECT", "ENCODING", "object:str")
+	c.expect(":1\r\n", "HSET", "object:hash", "f", "v")
+	c.expect("$8\r\nlistpack\r\n", "OBJECT", "ENCODING", "object:hash")
+	c.expect(":0\r\n", "OBJECT", "IDLETIME", "object:hash")
+	c.expect("$-1\r\n", "OBJECT", "ENCODING", "object:missing")
+}
+
+func TestListpackConversion(t *testing.T) {
+	c := dialTestServer(t)
+	t.Cleanup(func() {
+		for _, name := range []string{"hash", "set", "zset"} {
+			runCommand("CONFIG", "SET", name+"-max-listpack-entries", "128")
+			runCommand("CONFIG", "SET", name+"-max-listpack-value", "64")
+		}
+	})
+
+	for _, name := range []string{"hash", "set", "zset"} {
+		c.expect("+OK\r\n", "CONFIG", "SET", name+"-max-listpack-entries", "3")
+		c.expect("+OK\r\n", "CONFIG", "SET", name+"-max-listpack-value", "8")
+	}
+
+	c.expect(":3\r\n", "HSET", "lp:hash", "a", "1", "b", "2", "c", "3")
+	c.expect("$8\r\nlistpack\r\n", "OBJECT", "ENCODING", "lp:hash")
+	c.expect(":1\r\n", "HSET", "lp:hash", "d", "4")
+	c.expect("$9\r\nhashtable\r\n", "OBJECT", "ENCODING", "lp:hash")
+	c.expect("$1\r\n2\r\n", "HGET", "lp:hash", "b")
+
+	// Converted values stay converted once they shrink, like in Redis
+	c.expect(":3\r\n", "HDEL", "lp:hash", "a", "b", "c")
+	c.expect("$9\r\nhashtable\r\n", "OBJECT", "ENCODING", "lp:hash")
+
+	c.expect(":1\r\n", "HSET", "lp:hashvalue", "f", "123456789")
+	c.expect("$9\r\nhashtable\r\n", "OBJECT", "ENCODING", "lp:hashvalue")
+	c.expect(":1\r\n", "HSET", "lp:hashfield", "123456789", "v")
+	c.expect("$9\r\nhashtable\r\n", "OBJECT", "ENCODING", "lp:hashfield")
+
+	c.expect(":3\r\n", "SADD", "lp:set", "a", "b", "c")
+	c.expect("$8\r\nlistpack\r\n", "OBJECT", "ENCODING", "lp:set")
+	c.expect(":1\r\n", "SADD", "lp:set", "d")
+	c.expect("$9\r\nhashtable\r\n", "OBJECT", "ENCODING", "lp:set")
+	c.expect(":1\r\n", "SISMEMBER", "lp:set", "a")
+	c.expect(":4\r\n", "SCARD", "lp:set")
+	c.expect(":1\r\n", "SADD", "lp:setvalue", "123456789")
+	c.expect("$9\r\nhashtable\r\n", "OBJECT", "ENCODING", "lp:setvalue")
+
+	c.expect(":3\r\n", "ZADD", "lp:zset", "3", "c", "1", "a", "2", "b")
+	c.expect("$8\r\nlistpack\r\n", "OBJECT", "ENCODING", "lp:zset")
+	c.expect(":1\r\n", "ZADD", "lp:zset", "0", "d")
+	c.expect("$8\r\nskiplist\r\n", "OBJECT", "ENCODING", "lp:zset")
+	c.expect("*4\r\n$1\r\nd\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n", "ZRANGE", "lp:zset", "0", "-1")
+	c.expect(":1\r\n", "ZADD", "lp:zsetvalue", "1", "123456789")
+	c.expect("$8\r\nskiplist\r\n", "OBJECT", "ENCODING", "lp:zsetvalue")
+}
+
+func TestObjectStringEncodings(t *testing.T) {
+	c := dialTestServer(t)
+
+	for _, tc := range []struct{ value, encoding string }{
+		{"123", "int"},
+		{"-9223372036854775808", "int"},
+		{"012", "embstr"},
+		{"1.5", "embstr"},
+		{strings.Repeat("x", 44), "embstr"},
+		{strings.Repeat("x", 45), "raw"},
+	} {
+		c.expect("+OK\r\n", "SET", "objenc:k", tc.value)
+		c.expect("$"+strconv.Itoa(len(tc.encoding))+"\r\n"+tc.encoding+"\r\n", "OBJECT", "ENCODING", "objenc:k")
+		c.expect("$"+strconv.Itoa(len(tc.value))+"\r\n"+tc.value+"\r\n", "GET", "objenc:k")
+	}
+
+	c.expect("+OK\r\n", "SET", "objenc:n", "41")
+	c.expect(":42\r\n", "INCR", "objenc:n")
+	c.expect("$3\r\nint\r\n", "OBJECT", "ENCODING", "objenc:n")
+
+	// Small integers are shared in Redis, which reports them as never freed
+	c.expect(":2147483647\r\n", "OBJECT", "REFCOUNT", "objenc:n")
+	c.expect("+OK\r\n", "SET", "objenc:n", "10000")
+	c.expect(":1\r\n", "OBJECT", "REFCOUNT", "objenc:n")
+	c.expect("$-1\r\n", "OBJECT", "REFCOUNT", "objenc:missing")
+}
+
+func TestObjectAccessTracking(t *testing.T) {
+	c := dialTestServer(t)
+	t.Cleanup(func() { runCommand("CONFIG", "SET", "maxmemory-policy", "noeviction", "lfu-log-factor", "10") })
+
+	// Without a log factor every access counts, so the counter is predictable
+	runCommand("CONFIG", "SET", "lfu-log-factor", "0")
+
+	c.expect("+OK\r\n", "SET", "objacc:k", "v")
+
+	SETsMu.RLock()
+	atomic.StoreInt64(&SETs["objacc:k"].lru, time.Now().UnixMilli()-5000)
+	SETsMu.RUnlock()
+
+	c.expect(":5\r\n", "OBJECT", "IDLETIME", "objacc:k")
+
+	// Reading the key resets its idle time, OBJECT itself does not
+	c.expect("$1\r\nv\r\n", "GET", "objacc:k")
+	c.expect(":0\r\n", "OBJECT", "IDLETIME", "objacc:k")
+	c.expect("-ERR An LFU maxmemory policy is not selected, access frequency not tracked. Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.\r\n",
+		"OBJECT", "FREQ", "objacc:k")
+
+	c.expect("+OK\r\n", "CONFIG", "SET", "maxmemory-policy", "allkeys-lfu")
+	// The counter starts at 5 and counted both the SET and the GET
+	c.expect(":7\r\n", "OBJECT", "FREQ", "objacc:k")
+
+	for i := 0; i < 200; i++ {
+		c.do("GET", "objacc:k")
+	}
+
+	c.expect(":207\r\n", "OBJECT", "FREQ", "objacc:k")
+
+	c.expect("-ERR An LFU maxmemory policy is selected, idle time not tracked. Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.\r\n",
+		"OBJECT", "IDLETIME", "objacc:k")
+	c.expect("-ERR unknown subcommand 'NOPE'. Try OBJECT HELP.\r\n", "OBJECT", "NOPE", "objacc:k")
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Clients subscribed to each channel
+var pubsubChannels = map[string]map[*Client]struct{}{}
+
+// Clients subscribed to each pattern, with the pattern compiled once
+type pubsubPattern struct {
+	re      *regexp.Regexp
+	clients map[*Client]struct{}
+}
+
+var pubsubPatterns = map[string]*pubsubPattern{}
+
+// Clients subscribed to each sharded channel, grouped by the hash slot of the
+// channel so a slot can move to another node with its subscribers
+var pubsubShardChannels = map[int]map[string]map[*Client]struct{}{}
+var pubsubMu = sync.RWMutex{}
+
+// Commands a RESP2 client may still send once it has subscriptions
+var subscribedCommands = map[string]bool{
+	"SUBSCRIBE":    true,
+	"UNSUBSCRIBE":  true,
+	"PSUBSCRIBE":   true,
+	"PUNSUBSCRIBE": true,
+	"SSUBSCRIBE":   true,
+	"SUNSUBSCRIBE": true,
+	"PING":         true,
+	"QUIT":         true,
+	"RESET":        true,
+}
+
+// Number of channels and patterns the client is subscribed to
+func (c *Client) subscriptions() int {
+	return len(c.channels) + len(c.patterns)
+}
+
+// Reports whether the client has any subscription, sharded ones included
+func (c *Client) subscribed() bool {
+	return c.subscriptions() > 0 || len(c.shardChannels) > 0
+}
+
+// Builds the reply confirming a subscription change
+func subscriptionReply(kind string, name Value, count int) Value {
+	return Value{typ: "push", array: []Value{
+		{typ: "bulk", bulk: kind},
+		name,
+		{typ: "integer", num: count},
+	}}
+}
+
+// SUBSCRIBE channel [channel ...]
+func subscribe(c *Client, args []Value) {
+	if len(args) < 1 {
+		c.send(arityError("subscribe"))
+		return
+	}
+
+	c.startDelivery()
+
+	for _, arg := range args {
+		channel := arg.bulk
+
+		if !c.channels[channel] {
+			c.channels[channel] = true
+
+			pubsubMu.Lock()
+			if _, ok := pubsubChannels[channel]; !ok {
+				pubsubChannels[channel] = map[*Client]struct{}{}
+			}
+			pubsubChannels[channel][c] = struct{}{}
+			pubsubMu.Unlock()
+		}
+
+		c.send(subscriptionReply("subscribe", Value{typ: "bulk", bulk: channel}, c.subscriptions()))
+	}
+}
+
+// UNSUBSCRIBE [channel [channel ...]]
+func unsubscribe(c *Client, args []Value) {
+	channels := make([]string, 0, len(args))
+
+	for _, arg := range args {
+		channels = append(channels, arg.bulk)
+	}
+
+	// Without arguments every channel is left
+	if len(args) == 0 {
+		for channel := range c.channels {
+			channels = append(channels, channel)
+		}
+
+		sort.Strings(channels)
+
+		if len(channels) == 0 {
+			c.send(subscriptionReply("unsubscribe", Value{typ: "null"}, c.subscriptions()))
+			return
+		}
+	}
+
+	for _, channel := range channels {
+		if c.channels[channel] {
+			delete(c.channels, channel)
+
+			pubsubMu.Lock()
+			delete(pubsubChannels[channel], c)
+			if len(pubsubChannels[channel]) == 0 {
+				delete(pubsubChannels, channel)
+			}
+			pubsubMu.Unlock()
+		}
+
+		c.send(subscriptionReply("unsubscribe", Value{typ: "bulk", bulk: channel}, c.subscriptions()))
+	}
+}
+
+// PSUBSCRIBE pattern [pattern ...]
+func pSubscribe(c *Client, args []Value) {
+	if len(args) < 1 {
+		c.send(arityError("psubscribe"))
+		return
+	}
+
+	c.startDelivery()
+
+	for _, arg := range args {
+		pattern := arg.bulk
+
+		if !c.patterns[pattern] {
+			re, err := regexp.Compile(globToRegex(pattern))
+
+			// Patterns that cannot match anything are kept so they can be left
+			if err != nil {
+				re = regexp.MustCompile(`^\b\B$`)
+			}
+
+			c.patterns[pattern] = true
+
+			pubsubMu.Lock()
+			if _, ok := pubsubPatterns[pattern]; !ok {
+				pubsubPatterns[pattern] = &pubsubPattern{re: re, clients: map[*Client]struct{}{}}
+			}
+			pubsubPatterns[pattern].clients[c] = struct{}{}
+			pubsubMu.Unlock()
+		}
+
+		c.send(subscriptionReply("psubscribe", Value{typ: "bulk", bulk: pattern}, c.subscriptions()))
+	}
+}
+
+// PUNSUBSCRIBE [pattern [pattern ...]]
+func pUnsubscribe(c *Client, args []Value) {
+	patterns := make([]string, 0, len(args))
+
+	for _, arg := range args {
+		patterns = append(patterns, arg.bulk)
+	}
+
+	// Without arguments every pattern is left
+	if len(args) == 0 {
+		for pattern := range c.patterns {
+			patterns = append(patterns, pattern)
+		}
+
+		sort.Strings(patterns)
+
+		if len(patterns) == 0 {
+			c.send(subscriptionReply("punsubscribe", Value{typ: "null"}, c.subscriptions()))
+			return
+		}
+	}
+
+	for _, pattern := range patterns {
+		if c.patterns[pattern] {
+			delete(c.patterns, pattern)
+
+			pubsubMu.Lock()
+			if p, ok := pubsubPatterns[pattern]; ok {
+				delete(p.clients, c)
+				if len(p.clients) == 0 {
+					delete(pubsubPatterns, pattern)
+				}
+			}
+			pubsubMu.Unlock()
+		}
+
+		c.send(subscriptionReply("punsubscribe", Value{typ: "bulk", bulk: pattern}, c.subscriptions()))
+	}
+}
+
+// Drops every subscription of a client without replying
+func (c *Client) unsubscribeAll() {
+	pubsubMu.Lock()
+	defer pubsubMu.Unlock()
+
+	for channel := range c.channels {
+		delete(pubsubChannels[channel], c)
+		if len(pubsubChannels[channel]) == 0 {
+			delete(pubsubChannels, channel)
+		}
+	}
+
+	for pattern := range c.patterns {
+		if p, ok := pubsubPatterns[pattern]; ok {
+			delete(p.clients, c)
+			if len(p.clients) == 0 {
+				delete(pubsubPatterns, pattern)
+			}
+		}
+	}
+
+	for channel := range c.shardChannels {
+		removeShardSubscriber(channel, c)
+	}
+
+	c.channels = map[string]bool{}
+	c.patterns = map[string]bool{}
+	c.shardChannels = map[string]bool{}
+}
+
+// Queues a message for every client subscribed to the channel or to a
+// pattern matching it. Returns the number of clients reached.
+func publishMessage(channel string, message string) int {
+	pubsubMu.RLock()
+	defer pubsubMu.RUnlock()
+
+	receivers := 0
+
+	for c := range pubsubChannels[channel] {
+		c.push(Value{typ: "push", array: []Value{
+			{typ: "bulk", bulk: "message"},
+			{typ: "bulk", bulk: channel},
+			{typ: "bulk", bulk: message},
+		}})
+		receivers++
+	}
+
+	for pattern, p := range pubsubPatterns {
+		if !p.re.MatchString(channel) {
+			continue
+		}
+
+		for c := range p.clients {
+			c.push(Value{typ: "push", array: []Value{
+				{typ: "bulk", bulk: "pmessage"},
+				{typ: "bulk", bulk: pattern},
+				{typ: "bulk", bulk: channel},
+				{typ: "bulk", bulk: message},
+			}})
+			receivers++
+		}
+	}
+
+	return receivers
+}
+
+// PUBLISH channel message
+func publish(args []Value) Value {
+	if len(args) != 2 {
+		return arityError("publish")
+	}
+
+	return Value{typ: "integer", num: publishMessage(args[0].bulk, args[1].bulk)}
+}
+
+// PING [message] of a subscribed client, which replies with an array
+func subscribedPing(c *Client, args []Value) {
+	if len(args) > 1 {
+		c.send(arityError("ping"))
+		return
+	}
+
+	message := ""
+
+	if len(args) == 1 {
+		message = args[0].bulk
+	}
+
+	c.send(Value{typ: "array", array: []Value{
+		{typ: "bulk", bulk: "pong"},
+		{typ: "bulk", bulk: message},
+	}})
+}
+
+// Builds the error for commands a subscribed client cannot run
+func subscribedError(command string) Value {
+	return errorValue(codeErr, "Can't execute '"+strings.ToLower(command)+
+		"': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context")
+}
+
+// Removes a client from a sharded channel, the caller holds pubsubMu
+func removeShardSubscriber(channel string, c *Client) {
+	slot := keyHashSlot(channel)
+	channels := pubsubShardChannels[slot]
+
+	delete(channels[channel], c)
+
+	if len(channels[channel]) == 0 {
+		delete(channels, channel)
+	}
+	if len(channels) == 0 {
+		delete(pubsubShardChannels, slot)
+	}
+}
+
+// Fails unless every channel maps to the same hash slot
+func checkSameSlot(channels []Value) error {
+	for _, channel := range channels[1:] {
+		if keyHashSlot(channel.bulk) != keyHashSlot(channels[0].bulk) {
+			return errCrossSlot
+		}
+	}
+
+	return nil
+}
+
+// SSUBSCRIBE shardchannel [shardchannel ...]
+func sSubscribe(c *Client, args []Value) {
+	if len(args) < 1 {
+		c.send(arityError("ssubscribe"))
+		return
+	}
+
+	if err := checkSameSlot(args); err != nil {
+		c.send(errorReply(err))
+		return
+	}
+
+	c.startDelivery()
+
+	for _, arg := range args {
+		channel := arg.bulk
+
+		if !c.shardChannels[channel] {
+			c.shardChannels[channel] = true
+			slot := keyHashSlot(channel)
+
+			pubsubMu.Lock()
+			if _, ok := pubsubShardChannels[slot]; !ok {
+				pubsubShardChannels[slot] = map[string]map[*Client]struct{}{}
+			}
+			if _, ok := pubsubShardChannels[slot][channel]; !ok {
+				pubsubShardChannels[slot][channel] = map[*Client]struct{}{}
+			}
+			pubsubShardChannels[slot][channel][c] = struct{}{}
+			pubsubMu.Unlock()
+		}
+
+		c.send(subscriptionReply("ssubscribe", Value{typ: "bulk", bulk: channel}, len(c.shardChannels)))
+	}
+}
+
+// SUNSUBSCRIBE [shardchannel [shardchannel ...]]
+func sUnsubscribe(c *Client, args []Value) {
+	channels := make([]string, 0, len(args))
+
+	for _, arg := range args {
+		channels = append(channels, arg.bulk)
+	}
+
+	// Without arguments every sharded channel is left
+	if len(args) == 0 {
+		for channel := range c.shardChannels {
+			channels = append(channels, channel)
+		}
+
+		sort.Strings(channels)
+
+		if len(channels) == 0 {
+			c.send(subscriptionReply("sunsubscribe", Value{typ: "null"}, 0))
+			return
+		}
+	} else if err := checkSameSlot(args); err != nil {
+		c.send(errorReply(err))
+		return
+	}
+
+	for _, channel := range channels {
+		if c.shardChannels[channel] {
+			delete(c.shardChannels, channel)
+
+			pubsubMu.Lock()
+			removeShardSubscriber(channel, c)
+			pubsubMu.Unlock()
+		}
+
+		c.send(subscriptionReply("sunsubscribe", Value{typ: "bulk", bulk: channel}, len(c.shardChannels)))
+	}
+}
+
+// SPUBLISH shardchannel message
+func sPublish(args []Value) Value {
+	if len(args) != 2 {
+		return arityError("spublish")
+	}
+
+	channel, message := args[0].bulk, args[1].bulk
+
+	pubsubMu.RLock()
+	defer pubsubMu.RUnlock()
+
+	receivers := 0
+
+	for c := range pubsubShardChannels[keyHashSlot(channel)][channel] {
+		c.push(Value{typ: "push", array: []Value{
+			{typ: "bulk", bulk: "smessage"},
+			{typ: "bulk", bulk: channel},
+			{typ: "bulk", bulk: message},
+		}})
+		receivers++
+	}
+
+	return Value{typ: "integer", num: receivers}
+}
+
+// Help text of the PUBSUB command
+var pubsubHelp = []string{
+	"PUBSUB <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"CHANNELS [<pattern>]",
+	"    Return the currently active channels matching a <pattern> (default: '*').",
+	"NUMPAT",
+	"    Return number of subscriptions to patterns.",
+	"NUMSUB [<channel> ...]",
+	"    Return the number of subscribers for the specified channels, excluding",
+	"    pattern subscriptions(default: no channels).",
+	"SHARDCHANNELS [<pattern>]",
+	"    Return the currently active shard level channels matching a <pattern> (default: '*').",
+	"SHARDNUMSUB [<shardchannel> ...]",
+	"    Return the number of subscribers for the specified shard level channel(s)",
+	"HELP",
+	"    Print this help.",
+}
+
+// Lists the channels matching an optional glob pattern, sorted
+func pubsubMatchChannels(channels []string, args []Value) Value {
+	var re *regexp.Regexp
+
+	if len(args) == 1 {
+		var err error
+
+		if re, err = regexp.Compile(globToRegex(args[0].bulk)); err != nil {
+			return Value{typ: "array", array: []Value{}}
+		}
+	}
+
+	sort.Strings(channels)
+	list := make([]Value, 0, len(channels))
+
+	for _, channel := range channels {
+		if re == nil || re.MatchString(channel) {
+			list = append(list, Value{typ: "bulk", bulk: channel})
+		}
+	}
+
+	return Value{typ: "array", array: list}
+}
+
+// PUBSUB CHANNELS|NUMSUB|NUMPAT|SHARDCHANNELS|SHARDNUMSUB|HELP [arg ...]
+func pubsubCommand(args []Value) Value {
+	if len(args) < 1 {
+		return arityError("pubsub")
+	}
+
+	name := args[0].bulk
+	subcommand := strings.ToUpper(name)
+	args = args[1:]
+
+	pubsubMu.RLock()
+	defer pubsubMu.RUnlock()
+
+	switch {
+	case subcommand == "CHANNELS" && len(args) <= 1:
+		channels := make([]string, 0, len(pubsubChannels))
+
+		for channel := range pubsubChannels {
+			channels = append(channels, channel)
+		}
+
+		return pubsubMatchChannels(channels, args)
+	case subcommand == "SHARDCHANNELS" && len(args) <= 1:
+		channels := []string{}
+
+		for _, slotChannels := range pubsubShardChannels {
+			for channel := range slotChannels {
+				channels = append(channels, channel)
+			}
+		}
+
+		return pubsubMatchChannels(channels, args)
+	case subcommand == "NUMSUB" || subcommand == "SHARDNUMSUB":
+		counts := make([]Value, 0, 2*len(args))
+
+		for _, arg := range args {
+			subscribers := pubsubChannels[arg.bulk]
+
+			if subcommand == "SHARDNUMSUB" {
+				subscribers = pubsubShardChannels[keyHashSlot(arg.bulk)][arg.bulk]
+			}
+
+			counts = append(counts, Value{typ: "bulk", bulk: arg.bulk}, Value{typ: "integer", num: len(subscribers)})
+		}
+
+		return Value{typ: "array", array: counts}
+	case subcommand == "NUMPAT" && len(args) == 0:
+		return Value{typ: "integer", num: len(pubsubPatterns)}
+	case subcommand == "HELP" && len(args) == 0:
+		lines := make([]Value, len(pubsubHelp))
+
+		for i, line := range pubsubHelp {
+			lines[i] = Value{typ: "string", str: line}
+		}
+
+		return Value{typ: "array", array: lines}
+	}
+
+	return errorValue(codeErr, "unknown subcommand or wrong number of arguments for '"+name+"'. Try PUBSUB HELP.")
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPubsubNumsubIsFlatArray(t *testing.T) {
+	addr := startTestServer(t)
+	sub := dialTest(t, addr)
+	sub.expect("*3\r\n$9\r\nsubscribe\r\n$10\r\nnumsub:one\r\n:1\r\n", "SUBSCRIBE", "numsub:one")
+	sub.expect("*3\r\n$10\r\nssubscribe\r\n$10\r\nnumsub:two\r\n:1\r\n", "SSUBSCRIBE", "numsub:two")
+
+	c := dialTest(t, addr)
+	c.expect("*4\r\n$10\r\nnumsub:one\r\n:1\r\n$11\r\nnumsub:none\r\n:0\r\n", "PUBSUB", "NUMSUB", "numsub:one", "numsub:none")
+
+	// RESP3 clients get the same flat array of channel and count pairs
+	c.do("HELLO", "3")
+
+	for _, command := range [][]string{
+		{"PUBSUB", "NUMSUB", "numsub:one", "numsub:none"},
+		{"PUBSUB", "SHARDNUMSUB", "numsub:two", "numsub:none"},
+	} {
+		v := c.do(command...)
+
+		if v.typ != "array" || len(v.array) != 4 || v.array[1].num != 1 || v.array[3].num != 0 {
+			t.Errorf("%q = %q, want a flat array of pairs", command, v.Marshal())
+		}
+	}
+}
+
+func TestPubsubDelivery(t *testing.T) {
+	addr := startTestServer(t)
+	sub := dialTest(t, addr)
+	psub := dialTest(t, addr)
+	c := dialTest(t, addr)
+
+	c.expect(":0\r\n", "PUBLISH", "news.tech", "nobody")
+
+	// Each channel is confirmed with the count of the client's subscriptions
+	sub.expect("*3\r\n$9\r\nsubscribe\r\n$9\r\nnews.tech\r\n:1\r\n", "SUBSCRIBE", "news.tech", "news.art")
+	sub.receive("*3\r\n$9\r\nsubscribe\r\n$8\r\nnews.art\r\n:2\r\n")
+	psub.expect("*3\r\n$10\r\npsubscribe\r\n$6\r\nnews.*\r\n:1\r\n", "PSUBSCRIBE", "news.*")
+
+	// A subscribed client may only manage subscriptions and ping
+	sub.expect("-ERR Can't execute 'get': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context\r\n", "GET", "k")
+	sub.expect("*2\r\n$4\r\npong\r\n$0\r\n\r\n", "PING")
+	sub.expect("*2\r\n$4\r\npong\r\n$5\r\nhello\r\n", "PING", "hello")
+
+	c.expect(":2\r\n", "PUBLISH", "news.tech", "gophers")
+	sub.receive("*3\r\n$7\r\nmessage\r\n$9\r\nnews.tech\r\n$7\r\ngophers\r\n")
+	psub.receive("*4\r\n$8\r\npmessage\r\n$6\r\nnews.*\r\n$9\r\nnews.tech\r\n$7\r\ngophers\r\n")
+
+	c.expect(":1\r\n", "PUBLISH", "news.", "empty")
+	psub.receive("*4\r\n$8\r\npmessage\r\n$6\r\nnews.*\r\n$5\r\nnews.\r\n$5\r\nempty\r\n")
+
+	sub.expect("*3\r\n$11\r\nunsubscribe\r\n$9\r\nnews.tech\r\n:1\r\n", "UNSUBSCRIBE", "news.tech")
+	c.expect(":1\r\n", "PUBLISH", "news.tech", "patterns only")
+	psub.receive("*4\r\n$8\r\npmessage\r\n$6\r\nnews.*\r\n$9\r\nnews.tech\r\n$13\r\npatterns only\r\n")
+
+	// Leaving everything returns the client to normal commands
+	sub.expect("*3\r\n$11\r\nunsubscribe\r\n$8\r\nnews.art\r\n:0\r\n", "UNSUBSCRIBE")
+	sub.expect("*3\r\n$11\r\nunsubscribe\r\n$-1\r\n:0\r\n", "UNSUBSCRIBE")
+	sub.expect("$-1\r\n", "GET", "k")
+
+	psub.expect("*3\r\n$12\r\npunsubscribe\r\n$6\r\nnews.*\r\n:0\r\n", "PUNSUBSCRIBE", "news.*")
+	c.expect(":0\r\n", "PUBLISH", "news.tech", "nobody")
+
+	// RESP3 clients get messages as pushes and can run any command
+	resp3 := dialTest(t, addr)
+	resp3.do("HELLO", "3")
+	resp3.expect(">3\r\n$9\r\nsubscribe\r\n$5\r\nalpha\r\n:1\r\n", "SUBSCRIBE", "alpha")
+	resp3.expect("_\r\n", "GET", "k")
+	c.expect(":1\r\n", "PUBLISH", "alpha", "pushed")
+	resp3.receive(">3\r\n$7\r\nmessage\r\n$5\r\nalpha\r\n$6\r\npushed\r\n")
+}
+
+func TestPubsubIntrospectionAndShards(t *testing.T) {
+	addr := startTestServer(t)
+	sub := dialTest(t, addr)
+	c := dialTest(t, addr)
+
+	c.expect("*0\r\n", "PUBSUB", "CHANNELS")
+	c.expect(":0\r\n", "PUBSUB", "NUMPAT")
+
+	sub.do("SUBSCRIBE", "intro:a")
+	sub.do("SUBSCRIBE", "intro:b")
+	sub.do("SUBSCRIBE", "other")
+	sub.do("PSUBSCRIBE", "intro:*")
+	sub.do("PSUBSCRIBE", "x?")
+	sub.do("PSUBSCRIBE", "intro:*")
+
+	c.expect("*3\r\n$7\r\nintro:a\r\n$7\r\nintro:b\r\n$5\r\nother\r\n", "PUBSUB", "CHANNELS")
+	c.expect("*2\r\n$7\r\nintro:a\r\n$7\r\nintro:b\r\n", "PUBSUB", "CHANNELS", "intro:*")
+	c.expect(":2\r\n", "PUBSUB", "NUMPAT")
+	c.expect("-ERR unknown subcommand or wrong number of arguments for 'NUMPAT'. Try PUBSUB HELP.\r\n", "PUBSUB", "NUMPAT", "x")
+	c.expect("-ERR unknown subcommand or wrong number of arguments for 'nope'. Try PUBSUB HELP.\r\n", "PUBSUB", "nope")
+
+	// Sharded channels are counted apart from the others and must share a slot
+	shard := dialTest(t, addr)
+	shard.expect("-CROSSSLOT Keys in request don't hash to the same slot\r\n", "SSUBSCRIBE", "a", "b")
+	shard.expect("*3\r\n$10\r\nssubscribe\r\n$7\r\n{user}a\r\n:1\r\n", "SSUBSCRIBE", "{user}a", "{user}b")
+	shard.receive("*3\r\n$10\r\nssubscribe\r\n$7\r\n{user}b\r\n:2\r\n")
+
+	c.expect("*2\r\n$7\r\n{user}a\r\n$7\r\n{user}b\r\n", "PUBSUB", "SHARDCHANNELS")
+	c.expect("*1\r\n$7\r\n{user}b\r\n", "PUBSUB", "SHARDCHANNELS", "*b")
+	c.expect("*3\r\n$7\r\nintro:a\r\n$7\r\nintro:b\r\n$5\r\nother\r\n", "PUBSUB", "CHANNELS")
+	c.expect("*4\r\n$7\r\n{user}a\r\n:1\r\n$7\r\nintro:a\r\n:0\r\n", "PUBSUB", "SHARDNUMSUB", "{user}a", "intro:a")
+
+	// SPUBLISH reaches shard subscribers only, PUBLISH never does
+	c.expect(":0\r\n", "PUBLISH", "{user}a", "plain")
+	c.expect(":1\r\n", "SPUBLISH", "{user}a", "sharded")
+	shard.receive("*3\r\n$8\r\nsmessage\r\n$7\r\n{user}a\r\n$7\r\nsharded\r\n")
+	c.expect(":0\r\n", "SPUBLISH", "intro:a", "sharded")
+
+	shard.expect("*3\r\n$12\r\nsunsubscribe\r\n$7\r\n{user}a\r\n:1\r\n", "SUNSUBSCRIBE", "{user}a")
+	c.expect("*1\r\n$7\r\n{user}b\r\n", "PUBSUB", "SHARDCHANNELS")
+
+	// A client hanging up drops its subscriptions
+	if err := shard.conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sub.conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		channels := c.do("PUBSUB", "CHANNELS")
+		shards := c.do("PUBSUB", "SHARDCHANNELS")
+		patterns := c.do("PUBSUB", "NUMPAT")
+
+		if len(channels.array) == 0 && len(shards.array) == 0 && patterns.num == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("subscriptions left after hangup: %q %q %q", channels.Marshal(), shards.Marshal(), patterns.Marshal())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
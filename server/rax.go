@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+)
+
+// Radix tree mapping byte string keys to values in key order, as Redis
+// indexes the listpacks of a stream by their big endian master ID and the
+// pending entries of a consumer group by their ID
+type rax[T any] struct {
+	root raxNode[T]
+	size int
+}
+
+// Node of the radix tree, prefix is the part of the key below the parent
+type raxNode[T any] struct {
+	prefix   []byte
+	children []*raxNode[T]
+	value    *T
+}
+
+// Returns the number of keys
+func (t *rax[T]) Len() int {
+	return t.size
+}
+
+// Returns the number of nodes, counting the root
+func (t *rax[T]) Nodes() int {
+	return t.root.nodes()
+}
+
+// Number of nodes in the subtree rooted at n
+func (n *raxNode[T]) nodes() int {
+	count := 1
+
+	for _, child := range n.children {
+		count += child.nodes()
+	}
+
+	return count
+}
+
+// Position of the child starting with b, or where it would be inserted
+func (n *raxNode[T]) childIndex(b byte) (int, bool) {
+	i := sort.Search(len(n.children), func(i int) bool {
+		return n.children[i].prefix[0] >= b
+	})
+
+	return i, i < len(n.children) && n.children[i].prefix[0] == b
+}
+
+// Length of the common prefix of two byte strings
+func commonPrefixLen(a []byte, b []byte) int {
+	i := 0
+
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+
+	return i
+}
+
+// Stores value at key replacing any previous value
+func (t *rax[T]) Insert(key []byte, value *T) {
+	n := &t.root
+
+	for {
+		if len(key) == 0 {
+			if n.value == nil {
+				t.size++
+			}
+			n.value = value
+			return
+		}
+
+		i, found := n.childIndex(key[0])
+
+		if !found {
+			child := &raxNode[T]{prefix: append([]byte(nil), key...), value: value}
+			n.children = append(n.children, nil)
+			copy(n.children[i+1:], n.children[i:])
+			n.children[i] = child
+			t.size++
+			return
+		}
+
+		child := n.children[i]
+		common := commonPrefixLen(child.prefix, key)
+
+		if common < len(child.prefix) {
+			// Split the child where the keys diverge
+			split := &raxNode[T]{prefix: child.prefix[:common:common], children: []*raxNode[T]{child}}
+			child.prefix = child.prefix[common:]
+			n.children[i] = split
+			child = split
+		}
+
+		n = child
+		key = key[common:]
+	}
+}
+
+// Returns the value stored at key
+func (t *rax[T]) Find(key []byte) *T {
+	n := &t.root
+
+	for len(key) > 0 {
+		i, found := n.childIndex(key[0])
+
+		if !found || !bytes.HasPrefix(key, n.children[i].prefix) {
+			return nil
+		}
+
+		n = n.children[i]
+		key = key[len(n.prefix):]
+	}
+
+	return n.value
+}
+
+// Removes key, returns true if it was present
+func (t *rax[T]) Remove(key []byte) bool {
+	if t.root.remove(key) {
+		t.size--
+		return true
+	}
+
+	return false
+}
+
+// Removes key below n, pruning empty nodes and merging single children
+func (n *raxNode[T]) remove(key []byte) bool {
+	if len(key) == 0 {
+		if n.value == nil {
+			return false
+		}
+		n.value = nil
+		return true
+	}
+
+	i, found := n.childIndex(key[0])
+
+	if !found || !bytes.HasPrefix(key, n.children[i].prefix) {
+		return false
+	}
+
+	child := n.children[i]
+
+	if !child.remove(key[len(child.prefix):]) {
+		return false
+	}
+
+	if child.value == nil {
+		switch len(child.children) {
+		case 0:
+			n.children = append(n.children[:i], n.children[i+1:]...)
+		case 1:
+			grandchild := child.children[0]
+			grandchild.prefix = append(append([]byte(nil), child.prefix...), grandchild.prefix...)
+			n.children[i] = grandchild
+		}
+	}
+
+	return true
+}
+
+// Calls fn in ascending key order with every key not below from, a nil from
+// starts at the first key. Stops when fn returns false.
+func (t *rax[T]) Ascend(from []byte, fn func(key []byte, value *T) bool) {
+	t.root.ascend(nil, from, from != nil, fn)
+}
+
+// Calls fn in descending key order with every key not above to, a nil to
+// starts at the last key. Stops when fn returns false.
+func (t *rax[T]) Descend(to []byte, fn func(key []byte, value *T) bool) {
+	t.root.descend(nil, to, to != nil, fn)
+}
+
+// Compares the keys below a node with a bound, only looking at the bytes
+// both have so a whole subtree can be skipped or taken at once
+func comparePath(path []byte, bound []byte) int {
+	l := len(path)
+
+	if len(bound) < l {
+		l = len(bound)
+	}
+
+	return bytes.Compare(path[:l], bound[:l])
+}
+
+// In order traversal of the keys not below from
+func (n *raxNode[T]) ascend(path []byte, from []byte, bounded bool, fn func([]byte, *T) bool) bool {
+	path = append(append([]byte(nil), path...), n.prefix...)
+
+	if bounded {
+		switch comparePath(path, from) {
+		case -1:
+			return true
+		case 1:
+			bounded = false
+		}
+	}
+
+	// A key is smaller than the keys it prefixes
+	if n.value != nil && (!bounded || bytes.Compare(path, from) >= 0) {
+		if !fn(path, n.value) {
+			return false
+		}
+	}
+
+	for _, child := range n.children {
+		if !child.ascend(path, from, bounded, fn) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Reverse order traversal of the keys not above to
+func (n *raxNode[T]) descend(path []byte, to []byte, bounded bool, fn func([]byte, *T) bool) bool {
+	path = append(append([]byte(nil), path...), n.prefix...)
+
+	if bounded {
+		switch comparePath(path, to) {
+		case 1:
+			return true
+		case -1:
+			bounded = false
+		}
+	}
+
+	for i := len(n.children) - 1; i >= 0; i-- {
+		if !n.children[i].descend(path, to, bounded, fn) {
+			return false
+		}
+	}
+
+	if n.value != nil && (!bounded || bytes.Compare(path, to) <= 0) {
+		return fn(path, n.value)
+	}
+
+	return true
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Codes error replies start with, so clients can tell errors apart without
+// parsing the message
+const (
+	codeErr        = "ERR"
+	codeWrongType  = "WRONGTYPE"
+	codeNoAuth     = "NOAUTH"
+	codeReadOnly   = "READONLY"
+	codeExecAbort  = "EXECABORT"
+	codeCrossSlot  = "CROSSSLOT"
+	codeWrongPass  = "WRONGPASS"
+	codeNoProto    = "NOPROTO"
+	codeBusyGroup  = "BUSYGROUP"
+	codeNoGroup    = "NOGROUP"
+	codeInvalidObj = "INVALIDOBJ"
+)
+
+// Codes Redis replies with that nothing produces yet: there are no ACL users
+// but default (NOPERM), no scripts to be busy with (BUSY), no cluster to
+// redirect to (MOVED, ASK), no maxmemory limit (OOM), and the AOF is loaded
+// before connections are accepted (LOADING)
+const (
+	codeNoPerm  = "NOPERM"
+	codeBusy    = "BUSY"
+	codeMoved   = "MOVED"
+	codeAsk     = "ASK"
+	codeOOM     = "OOM"
+	codeLoading = "LOADING"
+)
+
+// Error sent to the client as an error reply
+type ReplyError struct {
+	Code    string
+	Message string
+}
+
+func (e *ReplyError) Error() string {
+	return e.Code + " " + e.Message
+}
+
+// Creates an error with its reply code
+func newReplyError(code string, message string) *ReplyError {
+	return &ReplyError{Code: code, Message: message}
+}
+
+// Builds an error reply from its code and message
+func errorValue(code string, message string) Value {
+	return Value{typ: "error", str: code + " " + message, code: code}
+}
+
+// Distinct codes INFO errorstats keeps counts for. Like Redis it stops
+// adding codes there so odd replies cannot grow the table without bound.
+const errorStatsMax = 128
+
+// Error replies sent per code
+var errorStats = map[string]int{}
+var errorStatsMu = sync.Mutex{}
+
+// Counts a reply if it is an error
+func countErrorReply(v Value) {
+	code := v.code
+
+	if code == "" {
+		return
+	}
+
+	errorStatsMu.Lock()
+	if _, ok := errorStats[code]; ok || len(errorStats) < errorStatsMax {
+		errorStats[code]++
+	}
+	errorStatsMu.Unlock()
+}
+
+// Errorstats section of INFO, one line per code
+func errorStatsInfo() string {
+	errorStatsMu.Lock()
+	defer errorStatsMu.Unlock()
+
+	codes := make([]string, 0, len(errorStats))
+
+	for code := range errorStats {
+		codes = append(codes, code)
+	}
+
+	sort.Strings(codes)
+
+	var sb strings.Builder
+	sb.WriteString("# Errorstats\r\n")
+
+	for _, code := range codes {
+		sb.WriteString("errorstat_" + code + ":count=" + strconv.Itoa(errorStats[code]) + "\r\n")
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestErrorStats(t *testing.T) {
+	c := dialTestServer(t)
+
+	c.expect("+OK\r\n", "SET", "errorstats:str", "v")
+	c.expect("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n", "ZADD", "errorstats:str", "1", "a")
+	c.expect("-ERR unknown command 'NOPE', with args beginning with: 'a' \r\n", "NOPE", "a")
+	c.expect("-NOGROUP No such key 'errorstats:stream' or consumer group 'g' in XREADGROUP with GROUP option\r\n",
+		"XREADGROUP", "GROUP", "g", "c", "STREAMS", "errorstats:stream", ">")
+
+	// An aborted transaction counts the refused command and EXECABORT
+	c.expect("+OK\r\n", "MULTI")
+	c.expect("-ERR unknown command 'NOPE', with args beginning with: \r\n", "NOPE")
+	c.expect("-EXECABORT Transaction discarded because of previous errors.\r\n", "EXEC")
+
+	// Errors inside the reply of EXEC are counted one by one
+	c.expect("+OK\r\n", "MULTI")
+	c.expect("+QUEUED\r\n", "HGET", "errorstats:str", "f")
+	c.expect("+QUEUED\r\n", "SCARD", "errorstats:str")
+	c.expect("*2\r\n-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"+
+		"-WRONGTYPE Operation against a key holding the wrong kind of value\r\n", "EXEC")
+
+	stats := "# Errorstats\r\n" +
+		"errorstat_ERR:count=2\r\n" +
+		"errorstat_EXECABORT:count=1\r\n" +
+		"errorstat_NOGROUP:count=1\r\n" +
+		"errorstat_WRONGTYPE:count=3\r\n"
+
+	if got := c.do("INFO", "errorstats").bulk; got != stats {
+		t.Errorf("INFO errorstats = %q, want %q", got, stats)
+	}
+}
+
+func TestErrorReplyCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want Value
+	}{
+		{errSyntax, Value{typ: "error", str: "ERR syntax error", code: codeErr}},
+		{errWrongType, Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value", code: codeWrongType}},
+		{errNoGroup("k", "g"), Value{typ: "error", str: "NOGROUP No such key 'k' or consumer group 'g'", code: codeNoGroup}},
+	}
+
+	for _, tt := range tests {
+		if got := errorReply(tt.err); got.typ != tt.want.typ || got.str != tt.want.str || got.code != tt.want.code {
+			t.Errorf("errorReply(%v) = %+v, want %+v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestInfoSectionIgnoresCase(t *testing.T) {
+	for _, section := range []string{"replication", "REPLICATION", "Replication"} {
+		v := runCommand("INFO", section)
+
+		if v.typ != "array" || len(v.array) == 0 || !strings.HasPrefix(v.array[0].bulk, "master_replid:") {
+			t.Errorf("INFO %s = %q, want the replication section", section, v.Marshal())
+		}
+	}
+
+	for _, section := range []string{"errorstats", "ERRORSTATS"} {
+		if v := runCommand("INFO", section); !strings.HasPrefix(v.bulk, "# Errorstats\r\n") {
+			t.Errorf("INFO %s = %q, want the errorstats section", section, v.Marshal())
+		}
+	}
+}
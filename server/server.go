@@ -1,14 +1,27 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"runtime/debug"
 	"strings"
 	"time"
 )
 
+// Version reported by HELLO, the Redis release whose behaviour is followed
+const serverVersion = "7.4.0"
+
+// Commands a client may run before authenticating
+var noAuthCommands = map[string]bool{
+	"AUTH":  true,
+	"HELLO": true,
+	"QUIT":  true,
+	"RESET": true,
+}
+
 // Redis structure for replication
 type Redis struct {
 	role               string
@@ -92,6 +105,13 @@ func main() {
 		handler(args)
 	})
 
+	propagate = func(value Value) {
+		aof.Write(value)
+	}
+
+	// Removes expired hash fields nobody reads
+	go activeExpireHashFields()
+
 	for {
 		// Listen for connections
 		conn, err := server.Accept()
@@ -108,53 +128,99 @@ func main() {
 
 // Go routine that handles multiple client connections to the server
 func handleClient(conn net.Conn, aof *Aof) {
+	client := NewClient(conn)
+
+	// A bug hit by one client drops its connection instead of the server
+	defer func() {
+		if err := recover(); err != nil {
+			fmt.Printf("Panic serving client %s: %v\n%s", conn.RemoteAddr(), err, debug.Stack())
+		}
+	}()
+
 	// Close on end of connection
-	defer conn.Close()
+	defer client.Close()
+	defer client.unsubscribeAll()
+
+	// Allow RESP to recieve requests, the reader is kept for the whole
+	// connection so pipelined commands it buffered are not lost
+	resp := NewResp(conn)
 
 	for {
-		// Allow RESP to recieve requests
-		resp := NewResp(conn)
+		// Replies of a pipeline are written together once every command
+		// read so far has been answered
+		if resp.reader.Buffered() == 0 {
+			client.flush()
+		}
 
-		// RESP serialize request into RESP array
-		value, err := resp.Read()
+		// RESP serialize request into RESP array, or split an inline command
+		value, err := resp.ReadRequest()
 
 		if err != nil {
-			if err == io.EOF {
+			if err == io.EOF || client.closed() {
 				break
 			}
+
+			var protocolErr ProtocolError
+
+			if errors.As(err, &protocolErr) {
+				client.send(errorValue(codeErr, protocolErr.Error()))
+				client.closeAfterReplies()
+				return
+			}
+
 			fmt.Println("Error reading from client: ", err.Error())
 			fmt.Printf("Error reading from client %s: %s\n", conn.RemoteAddr(), err.Error())
 			return
 		}
 
-		if value.typ != "array" {
-			fmt.Println("Invalid Request")
-			continue
-		}
+		// Decoding request from RESP array
+		command := strings.ToUpper(value.array[0].bulk)
+		args := value.array[1:]
 
-		if len(value.array) == 0 {
-			fmt.Println("Array cannot be empty.")
+		if !client.authenticated && !noAuthCommands[command] {
+			client.send(errorReply(errNoAuth))
 			continue
 		}
 
-		// Connecting writer to port
-		writer := NewWriter(conn)
+		// Subscribed RESP2 clients only manage their subscriptions, RESP3
+		// tells messages apart from replies so it has no such mode
+		if client.subscribed() && client.protocol() == 2 {
+			if !subscribedCommands[command] {
+				client.send(subscribedError(command))
+				continue
+			}
+			if command == "PING" {
+				subscribedPing(client, args)
+				continue
+			}
+		}
 
-		// Decoding request from RESP array
-		command := strings.ToUpper(value.array[0].bulk)
-		args := value.array[1:]
+		if clientHandler, ok := ClientHandlers[command]; ok {
+			clientHandler(client, args)
+			continue
+		}
 
 		// Checking command is valid and grabbing function
 		handler, ok := Handlers[command]
 
 		if !ok {
 			fmt.Println("Invalid Command: ", command)
-			writer.Write(Value{typ: "string", str: "ERR Unknown Command"})
+			client.send(unknownCommandError(value.array[0].bulk, args))
+
+			// Redis refuses to run a transaction once one of its commands was
+			if queuing {
+				multiAborted = true
+			}
+			continue
+		}
+
+		if WriteCommands[command] && RedisInstance.role == "slave" {
+			client.send(errorValue(codeReadOnly, "You can't write against a read only replica."))
 			continue
 		}
 
 		// Write to aof file if command is a write
-		if command == "HSET" || command == "SET" || command == "DEL" || command == "MSET" || command == "INCR" || command == "DECR" || command == "XADD" {
+		if WriteCommands[command] {
 			aof.Write(value)
 		}
 
@@ -163,14 +229,24 @@ func handleClient(conn net.Conn, aof *Aof) {
 
 		// Storing transactions and listening for EXEC command
 		if queuing && !(command == "EXEC" || command == "DISCARD") {
-			QUEUE = append(QUEUE, value.array)
+			// The reader reuses the arguments for the next request
+			QUEUE = append(QUEUE, append([]Value(nil), value.array...))
 			res = Value{typ: "string", str: "QUEUED"}
+		} else if blockingHandler, ok := BlockingHandlers[command]; ok {
+			// Replies before a command that may wait are written first so a
+			// pipelining client gets them, and the wait ends if it hangs up
+			client.flush()
+			stop := client.watchHangup(resp.reader)
+			res = blockingHandler(client, args)
+			stop()
+			touchKeys(commandKeys(command, args))
 		} else {
 			res = handler(args)
+			touchKeys(commandKeys(command, args))
 		}
 
 		// Response to client
-		writer.Write(res)
+		client.send(res)
 	}
 }
 
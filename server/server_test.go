@@ -0,0 +1,395 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Empties the dataset and the state shared between clients so every test
+// starts from a new server
+func resetDataset() {
+	SETsMu.Lock()
+	SETs = map[string]*StringObject{}
+	SETsMu.Unlock()
+
+	HSETsMu.Lock()
+	HSETs = map[string]*Hash{}
+	HFIELDTTLs = map[string]map[string]int64{}
+	HSETsMu.Unlock()
+
+	SSETsMu.Lock()
+	SSETs = map[string]*Set{}
+	SSETsMu.Unlock()
+
+	ZSETsMu.Lock()
+	ZSETs = map[string]*ZSet{}
+	ZSETsMu.Unlock()
+
+	XSETsMu.Lock()
+	XSETs = map[string]*Stream{}
+	XSETsMu.Unlock()
+
+	errorStatsMu.Lock()
+	errorStats = map[string]int{}
+	errorStatsMu.Unlock()
+
+	discardTransaction()
+}
+
+// Starts a server on a random local port and returns its address
+func startTestServer(tb testing.TB) string {
+	resetDataset()
+
+	aof, err := NewAof(tb.TempDir() + "/test.aof")
+
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	tb.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go handleClient(conn, aof)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// Client connection to a test server
+type testConn struct {
+	tb   testing.TB
+	conn net.Conn
+	resp *Resp
+}
+
+// Connects to a new test server
+func dialTestServer(tb testing.TB) *testConn {
+	return dialTest(tb, startTestServer(tb))
+}
+
+// Connects to a running test server
+func dialTest(tb testing.TB, addr string) *testConn {
+	conn, err := net.Dial("tcp", addr)
+
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	tb.Cleanup(func() { conn.Close() })
+
+	return &testConn{tb: tb, conn: conn, resp: NewResp(conn)}
+}
+
+// Sends a command and returns its reply
+func (c *testConn) do(parts ...string) Value {
+	c.tb.Helper()
+
+	if _, err := c.conn.Write(commandValue(parts...).Marshal()); err != nil {
+		c.tb.Fatal(err)
+	}
+
+	v, err := c.resp.Read()
+
+	if err != nil {
+		c.tb.Fatalf("%q: %v", parts, err)
+	}
+
+	return v
+}
+
+// Sends a command and checks its reply against the RESP2 encoding of want
+func (c *testConn) expect(want string, parts ...string) {
+	c.tb.Helper()
+
+	if got := string(c.do(parts...).Marshal()); got != want {
+		c.tb.Errorf("%q = %q, want %q", parts, got, want)
+	}
+}
+
+// Reads the next reply or message pushed to the connection and checks it
+// against the RESP2 encoding of want
+func (c *testConn) receive(want string) {
+	c.tb.Helper()
+
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer c.conn.SetReadDeadline(time.Time{})
+
+	v, err := c.resp.Read()
+
+	if err != nil {
+		c.tb.Fatalf("waiting for %q: %v", want, err)
+	}
+	if got := string(v.Marshal()); got != want {
+		c.tb.Errorf("received %q, want %q", got, want)
+	}
+}
+
+// Sends SET and GET in batches of pipeline commands like
+// redis-benchmark -P, each op is one command
+func BenchmarkPipeline(b *testing.B) {
+	for _, pipeline := range []int{1, 16} {
+		b.Run(fmt.Sprintf("P=%d", pipeline), func(b *testing.B) {
+			conn, err := net.Dial("tcp", startTestServer(b))
+
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+
+			var batch []byte
+
+			for i := 0; i < pipeline; i++ {
+				if i%2 == 0 {
+					batch = append(batch, commandValue("SET", "key:bench", "value").Marshal()...)
+				} else {
+					batch = append(batch, commandValue("GET", "key:bench").Marshal()...)
+				}
+			}
+
+			resp := NewResp(conn)
+
+			b.ResetTimer()
+
+			for sent := 0; sent < b.N; sent += pipeline {
+				if _, err := conn.Write(batch); err != nil {
+					b.Fatal(err)
+				}
+
+				for i := 0; i < pipeline; i++ {
+					if _, err := resp.Read(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPipelinedReplies(t *testing.T) {
+	conn, err := net.Dial("tcp", startTestServer(t))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	const commands = 5000
+
+	var batch []byte
+
+	for i := 0; i < commands; i++ {
+		batch = append(batch, commandValue("HINCRBY", "key:pipelined", "counter", "1").Marshal()...)
+	}
+
+	go conn.Write(batch)
+
+	resp := NewResp(conn)
+
+	for i := 0; i < commands; i++ {
+		v, err := resp.Read()
+
+		if err != nil {
+			t.Fatalf("reply %d: %v", i, err)
+		}
+		if v.typ != "integer" || v.num != i+1 {
+			t.Fatalf("reply %d = %+v", i, v)
+		}
+	}
+}
+
+func TestPipelineFlushedBeforeBlocking(t *testing.T) {
+	addr := startTestServer(t)
+	c := dialTest(t, addr)
+
+	batch := append(commandValue("PING").Marshal(), commandValue("BZPOPMIN", "key:pipeblock", "0").Marshal()...)
+
+	if _, err := c.conn.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	if v, err := c.resp.Read(); err != nil || v.str != "PONG" {
+		t.Fatalf("PING before a blocked command = %+v, %v", v, err)
+	}
+
+	c.conn.SetReadDeadline(time.Time{})
+	dialTest(t, addr).expect(":1\r\n", "ZADD", "key:pipeblock", "1", "a")
+
+	if v, err := c.resp.Read(); err != nil || len(v.array) != 3 || v.array[1].bulk != "a" {
+		t.Fatalf("BZPOPMIN woken by ZADD = %+v, %v", v, err)
+	}
+}
+
+// Endless stream of the same request
+type repeatReader struct {
+	data []byte
+	off  int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := 0
+
+	for n < len(p) {
+		copied := copy(p[n:], r.data[r.off:])
+		n += copied
+		r.off = (r.off + copied) % len(r.data)
+	}
+
+	return n, nil
+}
+
+// Reads, runs and answers the same command b.N times, without the network
+// so the allocations reported are those of the codec and the handler
+func benchmarkCommand(b *testing.B, parts ...string) {
+	resp := NewResp(&repeatReader{data: commandValue(parts...).Marshal()})
+	writer := NewWriter(io.Discard)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		value, err := resp.ReadRequest()
+
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		handler := Handlers[strings.ToUpper(value.array[0].bulk)]
+		writer.Write(handler(value.array[1:]))
+	}
+
+	writer.Flush()
+}
+
+func BenchmarkGet(b *testing.B) {
+	Handlers["SET"](commandValue("key:bench:get", "value").array)
+	benchmarkCommand(b, "GET", "key:bench:get")
+}
+
+func BenchmarkSet(b *testing.B) {
+	benchmarkCommand(b, "SET", "key:bench:set", "value")
+}
+
+func BenchmarkMGet(b *testing.B) {
+	keys := []string{"MGET"}
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprint("key:bench:mget:", i)
+		Handlers["SET"](commandValue(key, "value").array)
+		keys = append(keys, key)
+	}
+
+	benchmarkCommand(b, keys...)
+}
+
+// Counts the stores holding key
+func keyStores(key string) int {
+	n := 0
+
+	SETsMu.RLock()
+	if _, ok := SETs[key]; ok {
+		n++
+	}
+	SETsMu.RUnlock()
+
+	HSETsMu.RLock()
+	if _, ok := HSETs[key]; ok {
+		n++
+	}
+	HSETsMu.RUnlock()
+
+	SSETsMu.RLock()
+	if _, ok := SSETs[key]; ok {
+		n++
+	}
+	SSETsMu.RUnlock()
+
+	ZSETsMu.RLock()
+	if _, ok := ZSETs[key]; ok {
+		n++
+	}
+	ZSETsMu.RUnlock()
+
+	XSETsMu.RLock()
+	if _, ok := XSETs[key]; ok {
+		n++
+	}
+	XSETsMu.RUnlock()
+
+	return n
+}
+
+func TestSetReplacesOtherTypes(t *testing.T) {
+	resetDataset()
+
+	runCommand("ZADD", "replaced", "1", "a")
+
+	if v := runCommand("SET", "replaced", "v"); v.str != "OK" {
+		t.Fatalf("SET = %+v", v)
+	}
+	if v := runCommand("TYPE", "replaced"); v.str != "string" {
+		t.Fatalf("TYPE = %q, want string", v.str)
+	}
+
+	runCommand("SADD", "replaced:m", "a")
+	runCommand("MSET", "replaced:m", "v")
+
+	if n := keyStores("replaced:m"); n != 1 {
+		t.Fatalf("key held by %d stores after MSET", n)
+	}
+}
+
+func TestConcurrentWritersKeepOneType(t *testing.T) {
+	resetDataset()
+
+	writers := [][]string{
+		{"ZADD", "race", "1", "a"},
+		{"SADD", "race", "a"},
+		{"HSET", "race", "f", "v"},
+		{"XADD", "race", "*", "f", "v"},
+		{"PFADD", "race", "a"},
+		{"SET", "race", "v"},
+	}
+
+	for round := 0; round < 5000; round++ {
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+
+		for _, parts := range writers {
+			wg.Add(1)
+			go func(parts []string) {
+				defer wg.Done()
+				<-start
+				runCommand(parts...)
+			}(parts)
+		}
+		close(start)
+		wg.Wait()
+
+		if n := keyStores("race"); n != 1 {
+			t.Fatalf("round %d: key held by %d stores", round, n)
+		}
+
+		runCommand("DEL", "race")
+	}
+}
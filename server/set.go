@@ -0,0 +1,281 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// In memory unordered sets of members
+var SSETs = map[string]*Set{}
+var SSETsMu = sync.RWMutex{}
+
+// Set stored as a listpack of members while small and as a
+// map once it grows past set-max-listpack-entries or -value
+type Set struct {
+	objectMeta
+	lp   listpack
+	dict map[string]struct{}
+}
+
+// Creates an empty listpack encoded set
+func NewSet() *Set {
+	return &Set{objectMeta: newObjectMeta()}
+}
+
+// Returns the name OBJECT ENCODING reports
+func (s *Set) Encoding() string {
+	if s.dict == nil {
+		return "listpack"
+	}
+	return "hashtable"
+}
+
+// Returns the number of members, a missing set has none
+func (s *Set) Len() int {
+	if s == nil {
+		return 0
+	}
+	if s.dict == nil {
+		return s.lp.Len()
+	}
+	return len(s.dict)
+}
+
+// Finds a member in the listpack, returning its offsets
+func (s *Set) lpFind(member string) (off int, end int, ok bool) {
+	s.lp.Iterate(func(entry string, start int, next int) bool {
+		if entry == member {
+			off, end, ok = start, next, true
+			return false
+		}
+		return true
+	})
+
+	return off, end, ok
+}
+
+// Checks whether member belongs to the set
+func (s *Set) Contains(member string) bool {
+	if s == nil {
+		return false
+	}
+	if s.dict != nil {
+		_, ok := s.dict[member]
+		return ok
+	}
+
+	_, _, ok := s.lpFind(member)
+
+	return ok
+}
+
+// Adds a member, returns true if it is new
+func (s *Set) Add(member string) bool {
+	if s.Contains(member) {
+		return false
+	}
+
+	if s.dict == nil && (len(member) > configInt("set-max-listpack-value") ||
+		s.Len() >= configInt("set-max-listpack-entries")) {
+		s.convert()
+	}
+
+	if s.dict != nil {
+		s.dict[member] = struct{}{}
+	} else {
+		s.lp.Append(member)
+	}
+
+	return true
+}
+
+// Removes a member, returns true if it was present
+func (s *Set) Remove(member string) bool {
+	if s == nil {
+		return false
+	}
+	if s.dict != nil {
+		_, ok := s.dict[member]
+		delete(s.dict, member)
+		return ok
+	}
+
+	off, end, ok := s.lpFind(member)
+
+	if ok {
+		s.lp.Remove(off, end, 1)
+	}
+
+	return ok
+}
+
+// Returns every member in no particular order
+func (s *Set) Members() []string {
+	if s == nil {
+		return []string{}
+	}
+	if s.dict == nil {
+		return s.lp.Entries()
+	}
+
+	members := make([]string, 0, len(s.dict))
+
+	for member := range s.dict {
+		members = append(members, member)
+	}
+
+	return members
+}
+
+// Moves the members from the listpack into a map, sets never convert back
+func (s *Set) convert() {
+	dict := make(map[string]struct{}, s.Len())
+
+	for _, member := range s.Members() {
+		dict[member] = struct{}{}
+	}
+
+	s.dict = dict
+	s.lp = listpack{}
+}
+
+// SADD key member [member ...]
+func sAdd(args []Value) Value {
+	if len(args) < 2 {
+		return arityError("sadd")
+	}
+
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+
+	if err := checkSetType(args[0].bulk); err != nil {
+		return errorReply(err)
+	}
+
+	key := args[0].bulk
+	added := 0
+
+	SSETsMu.Lock()
+	defer SSETsMu.Unlock()
+
+	set, ok := SSETs[key]
+
+	if !ok {
+		set = NewSet()
+		SSETs[key] = set
+	}
+
+	for _, member := range args[1:] {
+		if set.Add(member.bulk) {
+			added++
+		}
+	}
+
+	if added > 0 {
+		notifyKeyspaceEvent(notifySet, "sadd", key)
+	}
+
+	return Value{typ: "integer", num: added}
+}
+
+// SREM key member [member ...]
+func sRem(args []Value) Value {
+	if len(args) < 2 {
+		return arityError("srem")
+	}
+
+	if err := checkSetType(args[0].bulk); err != nil {
+		return errorReply(err)
+	}
+
+	key := args[0].bulk
+	removed := 0
+
+	SSETsMu.Lock()
+	defer SSETsMu.Unlock()
+
+	set, ok := SSETs[key]
+
+	if !ok {
+		return Value{typ: "integer", num: 0}
+	}
+
+	for _, member := range args[1:] {
+		if set.Remove(member.bulk) {
+			removed++
+		}
+	}
+
+	if removed > 0 {
+		notifyKeyspaceEvent(notifySet, "srem", key)
+	}
+	if set.Len() == 0 {
+		delete(SSETs, key)
+		notifyKeyspaceEvent(notifyGeneric, "del", key)
+	}
+
+	return Value{typ: "integer", num: removed}
+}
+
+// SMEMBERS key
+func sMembers(args []Value) Value {
+	if len(args) != 1 {
+		return arityError("smembers")
+	}
+
+	if err := checkSetType(args[0].bulk); err != nil {
+		return errorReply(err)
+	}
+
+	SSETsMu.RLock()
+	members := SSETs[args[0].bulk].Members()
+	SSETsMu.RUnlock()
+
+	// Sorted so replies are stable between calls
+	sort.Strings(members)
+
+	values := make([]Value, len(members))
+	for i, member := range members {
+		values[i] = Value{typ: "bulk", bulk: member}
+	}
+
+	return Value{typ: "array", array: values}
+}
+
+// SISMEMBER key member
+func sIsMember(args []Value) Value {
+	if len(args) != 2 {
+		return arityError("sismember")
+	}
+
+	if err := checkSetType(args[0].bulk); err != nil {
+		return errorReply(err)
+	}
+
+	SSETsMu.RLock()
+	ok := SSETs[args[0].bulk].Contains(args[1].bulk)
+	SSETsMu.RUnlock()
+
+	if ok {
+		return Value{typ: "integer", num: 1}
+	}
+
+	return Value{typ: "integer", num: 0}
+}
+
+// SCARD key
+func sCard(args []Value) Value {
+	if len(args) != 1 {
+		return arityError("scard")
+	}
+
+	if err := checkSetType(args[0].bulk); err != nil {
+		return errorReply(err)
+	}
+
+	SSETsMu.RLock()
+	n := SSETs[args[0].bulk].Len()
+	SSETsMu.RUnlock()
+
+	return Value{typ: "integer", num: n}
+}
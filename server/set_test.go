@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestSetWrongType(t *testing.T) {
+	c := dialTestServer(t)
+	wrongType := "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+
+	c.expect("+OK\r\n", "SET", "swrong:str", "v")
+
+	for _, command := range [][]string{
+		{"SADD", "swrong:str", "a"},
+		{"SREM", "swrong:str", "a"},
+		{"SMEMBERS", "swrong:str"},
+		{"SISMEMBER", "swrong:str", "a"},
+		{"SCARD", "swrong:str"},
+	} {
+		c.expect(wrongType, command...)
+	}
+
+	c.expect("+string\r\n", "TYPE", "swrong:str")
+}
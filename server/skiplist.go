@@ -0,0 +1,192 @@
+package main
+
+import "math/rand"
+
+// Levels of the sorted set skiplist and the chance of a node reaching the
+// next one, the values Redis uses
+const (
+	zskiplistMaxLevel = 32
+	zskiplistP        = 0.25
+)
+
+// Skiplist ordering sorted set entries by score and then by member. Each link
+// records how many entries it skips so ranks are found in logarithmic time.
+type zskiplist struct {
+	header *zskiplistNode
+	tail   *zskiplistNode
+	length int
+	level  int
+}
+
+// Node of the skiplist, backward links the previous node on the lowest level
+type zskiplistNode struct {
+	entry    zsetEntry
+	backward *zskiplistNode
+	level    []zskiplistLevel
+}
+
+// Link of a node on one level
+type zskiplistLevel struct {
+	forward *zskiplistNode
+	span    int
+}
+
+// Creates an empty skiplist
+func newZskiplist() *zskiplist {
+	return &zskiplist{
+		header: &zskiplistNode{level: make([]zskiplistLevel, zskiplistMaxLevel)},
+		level:  1,
+	}
+}
+
+// Returns the level of a new node, higher levels being exponentially rarer
+func zslRandomLevel() int {
+	level := 1
+
+	for level < zskiplistMaxLevel && rand.Float64() < zskiplistP {
+		level++
+	}
+
+	return level
+}
+
+// Inserts an entry, the caller makes sure its member is not present yet
+func (sl *zskiplist) Insert(e zsetEntry) {
+	var update [zskiplistMaxLevel]*zskiplistNode
+	var rank [zskiplistMaxLevel]int
+
+	x := sl.header
+
+	for i := sl.level - 1; i >= 0; i-- {
+		if i < sl.level-1 {
+			rank[i] = rank[i+1]
+		}
+
+		for x.level[i].forward != nil && zsetLess(x.level[i].forward.entry, e) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+
+		update[i] = x
+	}
+
+	level := zslRandomLevel()
+
+	if level > sl.level {
+		for i := sl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = sl.header
+			update[i].level[i].span = sl.length
+		}
+		sl.level = level
+	}
+
+	x = &zskiplistNode{entry: e, level: make([]zskiplistLevel, level)}
+
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+
+	// Links above the new node now skip one more entry
+	for i := level; i < sl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != sl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		sl.tail = x
+	}
+
+	sl.length++
+}
+
+// Removes an entry, returns true if it was present
+func (sl *zskiplist) Delete(e zsetEntry) bool {
+	var update [zskiplistMaxLevel]*zskiplistNode
+
+	x := sl.header
+
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && zsetLess(x.level[i].forward.entry, e) {
+			x = x.level[i].forward
+		}
+
+		update[i] = x
+	}
+
+	x = x.level[0].forward
+
+	if x == nil || x.entry != e {
+		return false
+	}
+
+	for i := 0; i < sl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		sl.tail = x.backward
+	}
+
+	for sl.level > 1 && sl.header.level[sl.level-1].forward == nil {
+		sl.level--
+	}
+
+	sl.length--
+
+	return true
+}
+
+// Counts the leading entries for which below holds. below must hold for a
+// prefix of the order, like being under a score.
+func (sl *zskiplist) CountBelow(below func(zsetEntry) bool) int {
+	rank := 0
+	x := sl.header
+
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && below(x.level[i].forward.entry) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+	}
+
+	return rank
+}
+
+// Returns the node at a zero based position, nil when out of range
+func (sl *zskiplist) Node(index int) *zskiplistNode {
+	if index < 0 || index >= sl.length {
+		return nil
+	}
+
+	traversed := 0
+	x := sl.header
+
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= index+1 {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+
+		if traversed == index+1 {
+			return x
+		}
+	}
+
+	return nil
+}
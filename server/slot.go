@@ -0,0 +1,50 @@
+package main
+
+import "strings"
+
+// Number of hash slots keys are spread over in Redis Cluster
+const clusterSlots = 16384
+
+// CRC16 lookup table of the XMODEM variant used by Redis Cluster
+var crc16Table = func() [256]uint16 {
+	var table [256]uint16
+
+	for i := range table {
+		crc := uint16(i) << 8
+
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+
+		table[i] = crc
+	}
+
+	return table
+}()
+
+// CRC16 XMODEM checksum
+func crc16(s string) uint16 {
+	var crc uint16
+
+	for i := 0; i < len(s); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^s[i]]
+	}
+
+	return crc
+}
+
+// Returns the hash slot of a key. Only the part between the first { and the
+// following } is hashed when it is not empty, so related keys can share a slot.
+func keyHashSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+
+	return int(crc16(key)) & (clusterSlots - 1)
+}
@@ -0,0 +1,1140 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stream entry ID made of a unix millisecond time and a sequence number
+type StreamID struct {
+	ms  uint64
+	seq uint64
+}
+
+// Stream entry with its fields and values stored flat
+type streamEntry struct {
+	id     StreamID
+	fields []string
+}
+
+// Listpack holding consecutive entries of a stream. Each entry is stored as
+// flags, ms delta, seq delta and the number of fields relative to the master
+// ID of the node, followed by the fields and values.
+type streamNode struct {
+	master  StreamID
+	lp      listpack
+	count   int
+	deleted int
+}
+
+// Stream of entries indexed by a radix tree over the big endian master ID of
+// each listpack node, so entries are kept in ID order for range queries
+type Stream struct {
+	objectMeta
+	rax          rax[streamNode]
+	length       int
+	lastID       StreamID
+	maxDeletedID StreamID
+	entriesAdded uint64
+	groups       map[string]*streamGroup
+}
+
+// Flags of a stream entry
+const (
+	streamEntryLive    = 0
+	streamEntryDeleted = 1
+)
+
+// Errors shared by stream commands
+var (
+	errInvalidStreamID = newReplyError(codeErr, "Invalid stream ID specified as stream command argument")
+	errStreamIDSmaller = newReplyError(codeErr, "The ID specified in XADD is equal or smaller than the target stream top item")
+	errStreamIDZero    = newReplyError(codeErr, "The ID specified in XADD must be greater than 0-0")
+	errStreamExhausted = newReplyError(codeErr, "The stream has exhausted the last possible ID, unable to add more items")
+)
+
+// Smallest and largest possible IDs
+var (
+	streamMinID = StreamID{0, 0}
+	streamMaxID = StreamID{math.MaxUint64, math.MaxUint64}
+)
+
+// Formats the ID as ms-seq
+func (id StreamID) String() string {
+	return strconv.FormatUint(id.ms, 10) + "-" + strconv.FormatUint(id.seq, 10)
+}
+
+// Orders IDs numerically, returning -1, 0 or 1
+func (id StreamID) Compare(other StreamID) int {
+	switch {
+	case id.ms < other.ms:
+		return -1
+	case id.ms > other.ms:
+		return 1
+	case id.seq < other.seq:
+		return -1
+	case id.seq > other.seq:
+		return 1
+	}
+	return 0
+}
+
+// Checks the ID is smaller than another
+func (id StreamID) Less(other StreamID) bool {
+	return id.Compare(other) < 0
+}
+
+// Returns the following ID, false when the ID is the largest possible
+func (id StreamID) Incr() (StreamID, bool) {
+	switch {
+	case id.seq < math.MaxUint64:
+		return StreamID{id.ms, id.seq + 1}, true
+	case id.ms < math.MaxUint64:
+		return StreamID{id.ms + 1, 0}, true
+	}
+	return id, false
+}
+
+// Returns the preceding ID, false when the ID is the smallest possible
+func (id StreamID) Decr() (StreamID, bool) {
+	switch {
+	case id.seq > 0:
+		return StreamID{id.ms, id.seq - 1}, true
+	case id.ms > 0:
+		return StreamID{id.ms - 1, math.MaxUint64}, true
+	}
+	return id, false
+}
+
+// Big endian encoding so byte order matches ID order in the radix tree
+func (id StreamID) key() []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, id.ms)
+	binary.BigEndian.PutUint64(key[8:], id.seq)
+
+	return key
+}
+
+// Decodes an ID from its radix tree key
+func streamIDFromKey(key []byte) StreamID {
+	return StreamID{binary.BigEndian.Uint64(key), binary.BigEndian.Uint64(key[8:])}
+}
+
+// Parses ms-seq, using missingSeq when only the milliseconds are given
+func parseStreamID(s string, missingSeq uint64) (StreamID, error) {
+	msPart, seqPart, hasSeq := strings.Cut(s, "-")
+
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+
+	if err != nil {
+		return StreamID{}, errInvalidStreamID
+	}
+	if !hasSeq {
+		return StreamID{ms, missingSeq}, nil
+	}
+
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+
+	if err != nil {
+		return StreamID{}, errInvalidStreamID
+	}
+
+	return StreamID{ms, seq}, nil
+}
+
+// Creates an empty stream
+func NewStream() *Stream {
+	return &Stream{objectMeta: newObjectMeta(), groups: map[string]*streamGroup{}}
+}
+
+// Appends an entry to the node
+func (n *streamNode) append(id StreamID, fields []string) {
+	entry := make([]string, 0, 4+len(fields))
+	entry = append(entry,
+		strconv.Itoa(streamEntryLive),
+		strconv.FormatUint(id.ms-n.master.ms, 10),
+		// Wraps around when the sequence is below the master one, undone by decoding
+		strconv.FormatUint(id.seq-n.master.seq, 10),
+		strconv.Itoa(len(fields)/2))
+	entry = append(entry, fields...)
+
+	n.lp.Append(entry...)
+	n.count++
+}
+
+// Calls fn with each entry of the node, deleted or not, along with the offsets
+// of its flags so they can be replaced. Stops when fn returns false.
+func (n *streamNode) iterate(fn func(e streamEntry, deleted bool, flagsOff int, flagsEnd int) bool) {
+	for off := 0; off < len(n.lp.buf); {
+		flags, next := n.lp.entryAt(off)
+		flagsOff, flagsEnd := off, next
+
+		msDelta, next := n.lp.entryAt(next)
+		seqDelta, next := n.lp.entryAt(next)
+		numFields, next := n.lp.entryAt(next)
+
+		ms, _ := strconv.ParseUint(msDelta, 10, 64)
+		seq, _ := strconv.ParseUint(seqDelta, 10, 64)
+		nf, _ := strconv.Atoi(numFields)
+
+		e := streamEntry{
+			id:     StreamID{n.master.ms + ms, n.master.seq + seq},
+			fields: make([]string, nf*2),
+		}
+
+		for i := range e.fields {
+			e.fields[i], next = n.lp.entryAt(next)
+		}
+
+		off = next
+
+		if !fn(e, flags == strconv.Itoa(streamEntryDeleted), flagsOff, flagsEnd) {
+			return
+		}
+	}
+}
+
+// Returns the live entries of the node in ID order
+func (n *streamNode) entries() []streamEntry {
+	entries := make([]streamEntry, 0, n.count-n.deleted)
+
+	n.iterate(func(e streamEntry, deleted bool, flagsOff int, flagsEnd int) bool {
+		if !deleted {
+			entries = append(entries, e)
+		}
+		return true
+	})
+
+	return entries
+}
+
+// Resolves the ID argument of XADD: "*" picks the current time, "ms-*" picks
+// the next sequence and explicit IDs must be above the last entry
+func (s *Stream) nextID(arg string) (StreamID, error) {
+	if arg == "*" {
+		ms := uint64(time.Now().UnixMilli())
+
+		if ms > s.lastID.ms {
+			return StreamID{ms, 0}, nil
+		}
+
+		// Clock went backwards or many entries in the same millisecond
+		next, ok := s.lastID.Incr()
+
+		if !ok {
+			return StreamID{}, errStreamExhausted
+		}
+
+		return next, nil
+	}
+
+	if msPart, ok := strings.CutSuffix(arg, "-*"); ok {
+		ms, err := strconv.ParseUint(msPart, 10, 64)
+
+		if err != nil {
+			return StreamID{}, errInvalidStreamID
+		}
+
+		switch {
+		case ms < s.lastID.ms:
+			return StreamID{}, errStreamIDSmaller
+		case ms == s.lastID.ms:
+			if s.lastID.seq == math.MaxUint64 {
+				return StreamID{}, errStreamIDSmaller
+			}
+			return StreamID{ms, s.lastID.seq + 1}, nil
+		}
+
+		return StreamID{ms, 0}, nil
+	}
+
+	id, err := parseStreamID(arg, 0)
+
+	if err != nil {
+		return StreamID{}, err
+	}
+	if id == streamMinID {
+		return StreamID{}, errStreamIDZero
+	}
+	if !s.lastID.Less(id) {
+		return StreamID{}, errStreamIDSmaller
+	}
+
+	return id, nil
+}
+
+// Returns the node entries are appended to
+func (s *Stream) lastNode() *streamNode {
+	var last *streamNode
+
+	s.rax.Descend(nil, func(key []byte, n *streamNode) bool {
+		last = n
+		return false
+	})
+
+	return last
+}
+
+// Appends an entry, opening a new node once the last one reaches
+// stream-node-max-entries or stream-node-max-bytes
+func (s *Stream) Append(id StreamID, fields []string) {
+	n := s.lastNode()
+	maxEntries := configInt("stream-node-max-entries")
+	maxBytes := configInt("stream-node-max-bytes")
+
+	if n == nil || (maxEntries > 0 && n.count >= maxEntries) || (maxBytes > 0 && len(n.lp.buf) >= maxBytes) {
+		n = &streamNode{master: id}
+		s.rax.Insert(id.key(), n)
+	}
+
+	n.append(id, fields)
+
+	s.length++
+	s.lastID = id
+	s.entriesAdded++
+}
+
+// Calls fn with the live entries between start and end inclusive, from the
+// last one backwards when rev is set. Stops when fn returns false.
+func (s *Stream) Range(start StreamID, end StreamID, rev bool, fn func(e streamEntry) bool) {
+	if end.Less(start) {
+		return
+	}
+
+	if rev {
+		s.rax.Descend(end.key(), func(key []byte, n *streamNode) bool {
+			entries := n.entries()
+
+			for i := len(entries) - 1; i >= 0; i-- {
+				switch {
+				case end.Less(entries[i].id):
+					continue
+				case entries[i].id.Less(start):
+					return false
+				case !fn(entries[i]):
+					return false
+				}
+			}
+
+			return true
+		})
+		return
+	}
+
+	// The node holding start is the last one whose master ID is not above it
+	var from []byte
+
+	s.rax.Descend(start.key(), func(key []byte, n *streamNode) bool {
+		from = key
+		return false
+	})
+
+	s.rax.Ascend(from, func(key []byte, n *streamNode) bool {
+		more := true
+
+		n.iterate(func(e streamEntry, deleted bool, flagsOff int, flagsEnd int) bool {
+			switch {
+			case deleted || e.id.Less(start):
+				return true
+			case end.Less(e.id), !fn(e):
+				more = false
+				return false
+			}
+			return true
+		})
+
+		return more
+	})
+}
+
+// Returns the first live entry
+func (s *Stream) First() (streamEntry, bool) {
+	var first streamEntry
+	found := false
+
+	s.Range(streamMinID, streamMaxID, false, func(e streamEntry) bool {
+		first, found = e, true
+		return false
+	})
+
+	return first, found
+}
+
+// Returns the last live entry
+func (s *Stream) Last() (streamEntry, bool) {
+	var last streamEntry
+	found := false
+
+	s.Range(streamMinID, streamMaxID, true, func(e streamEntry) bool {
+		last, found = e, true
+		return false
+	})
+
+	return last, found
+}
+
+// Builds the [id, [field, value, ...]] reply of an entry
+func streamEntryReply(e streamEntry) Value {
+	fields := make([]Value, len(e.fields))
+
+	for i, field := range e.fields {
+		fields[i] = Value{typ: "bulk", bulk: field}
+	}
+
+	return Value{typ: "array", array: []Value{
+		{typ: "bulk", bulk: e.id.String()},
+		{typ: "array", array: fields},
+	}}
+}
+
+// Returns the first node along with its key in the radix tree
+func (s *Stream) firstNode() ([]byte, *streamNode) {
+	var first []byte
+	var node *streamNode
+
+	s.rax.Ascend(nil, func(key []byte, n *streamNode) bool {
+		first, node = key, n
+		return false
+	})
+
+	return first, node
+}
+
+// Marks an entry of the node as deleted, dropping the node once every entry is
+func (s *Stream) deleteEntry(key []byte, n *streamNode, flagsOff int, flagsEnd int) {
+	n.lp.Replace(flagsOff, flagsEnd, strconv.Itoa(streamEntryDeleted))
+	n.deleted++
+	s.length--
+
+	if n.deleted == n.count {
+		s.rax.Remove(key)
+	}
+}
+
+// Deletes the entry with the given ID, returns true if it existed
+func (s *Stream) Delete(id StreamID) bool {
+	var key []byte
+	var node *streamNode
+
+	// Only the last node whose master ID is not above id can hold it
+	s.rax.Descend(id.key(), func(k []byte, n *streamNode) bool {
+		key, node = k, n
+		return false
+	})
+
+	if node == nil {
+		return false
+	}
+
+	found := false
+	var flagsOff, flagsEnd int
+
+	node.iterate(func(e streamEntry, deleted bool, off int, end int) bool {
+		if e.id == id {
+			found = !deleted
+			flagsOff, flagsEnd = off, end
+			return false
+		}
+		return e.id.Less(id)
+	})
+
+	if !found {
+		return false
+	}
+
+	s.deleteEntry(key, node, flagsOff, flagsEnd)
+
+	if s.maxDeletedID.Less(id) {
+		s.maxDeletedID = id
+	}
+
+	return true
+}
+
+// Trimming options shared by XADD and XTRIM
+type streamTrimArgs struct {
+	strategy   string // MAXLEN, MINID or empty when not trimming
+	approx     bool
+	maxLen     int
+	minID      StreamID
+	limit      int // most entries removed by an approximate trim, 0 for no limit
+	limitGiven bool
+	nomkstream bool
+}
+
+// Parses the options of XADD or XTRIM following the key. For XADD parsing
+// stops at the first argument that is not an option, its position is returned.
+func parseStreamTrimArgs(args []Value, xadd bool) (streamTrimArgs, int, error) {
+	t := streamTrimArgs{}
+	i := 0
+
+options:
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].bulk)
+		moreArgs := len(args) - 1 - i
+
+		switch {
+		case xadd && opt == "NOMKSTREAM":
+			t.nomkstream = true
+		case (opt == "MAXLEN" || opt == "MINID") && moreArgs > 0:
+			if t.strategy != "" && t.strategy != opt {
+				return t, i, newReplyError(codeErr, "syntax error, MAXLEN and MINID options at the same time are not compatible")
+			}
+			t.strategy = opt
+			i++
+
+			if next := args[i].bulk; (next == "~" || next == "=") && moreArgs > 1 {
+				t.approx = next == "~"
+				i++
+			}
+
+			if opt == "MAXLEN" {
+				n, err := strconv.Atoi(args[i].bulk)
+
+				if err != nil {
+					return t, i, errNotInteger
+				}
+				if n < 0 {
+					return t, i, newReplyError(codeErr, "The MAXLEN argument must be >= 0.")
+				}
+
+				t.maxLen = n
+			} else {
+				id, err := parseStreamID(args[i].bulk, 0)
+
+				if err != nil {
+					return t, i, err
+				}
+
+				t.minID = id
+			}
+		case opt == "LIMIT" && moreArgs > 0:
+			i++
+			n, err := strconv.Atoi(args[i].bulk)
+
+			if err != nil {
+				return t, i, errNotInteger
+			}
+			if n < 0 {
+				return t, i, newReplyError(codeErr, "The LIMIT argument must be >= 0.")
+			}
+
+			t.limit = n
+			t.limitGiven = true
+		case xadd:
+			// Reached the entry ID
+			break options
+		default:
+			return t, i, errSyntax
+		}
+	}
+
+	if !xadd && t.strategy == "" {
+		return t, i, newReplyError(codeErr, "syntax error, XTRIM must be called with a trimming strategy")
+	}
+	if t.limitGiven && !t.approx {
+		return t, i, newReplyError(codeErr, "syntax error, LIMIT cannot be used without the special ~ option")
+	}
+
+	if t.approx && !t.limitGiven {
+		t.limit = 10000
+
+		if maxEntries := configInt("stream-node-max-entries"); maxEntries > 0 {
+			t.limit = 100 * maxEntries
+		}
+	}
+
+	return t, i, nil
+}
+
+// Removes entries from the head of the stream until it satisfies the trimming
+// strategy. Approximate trimming only drops whole nodes and stops at the limit.
+// Returns the number of entries removed.
+func (s *Stream) Trim(t streamTrimArgs) int {
+	removed := 0
+
+	for {
+		key, n := s.firstNode()
+
+		if n == nil || (t.strategy == "MAXLEN" && s.length <= t.maxLen) {
+			return removed
+		}
+
+		entries := n.entries()
+		whole := false
+
+		if t.strategy == "MAXLEN" {
+			whole = s.length-len(entries) >= t.maxLen
+		} else {
+			whole = entries[len(entries)-1].id.Less(t.minID)
+		}
+
+		if whole {
+			if t.limit > 0 && removed+n.count > t.limit {
+				return removed
+			}
+
+			s.rax.Remove(key)
+			s.length -= len(entries)
+			removed += len(entries)
+			continue
+		}
+
+		if t.approx {
+			return removed
+		}
+
+		// The threshold falls inside this node, tombstone its first entries
+		var flags [][2]int
+
+		n.iterate(func(e streamEntry, deleted bool, flagsOff int, flagsEnd int) bool {
+			switch {
+			case deleted:
+				return true
+			case t.strategy == "MAXLEN" && s.length-len(flags) <= t.maxLen:
+				return false
+			case t.strategy == "MINID" && !e.id.Less(t.minID):
+				return false
+			}
+			flags = append(flags, [2]int{flagsOff, flagsEnd})
+			return true
+		})
+
+		for _, f := range flags {
+			s.deleteEntry(key, n, f[0], f[1])
+		}
+
+		return removed + len(flags)
+	}
+}
+
+// Arguments logging a trim so replicas and the AOF remove the same entries,
+// approximate trims become exact ones up to what was actually kept
+func (s *Stream) trimLogArgs(t streamTrimArgs) []string {
+	if !t.approx {
+		if t.strategy == "MAXLEN" {
+			return []string{"MAXLEN", "=", strconv.Itoa(t.maxLen)}
+		}
+		return []string{"MINID", "=", t.minID.String()}
+	}
+
+	if t.strategy == "MAXLEN" {
+		return []string{"MAXLEN", "=", strconv.Itoa(s.length)}
+	}
+
+	if first, ok := s.First(); ok {
+		return []string{"MINID", "=", first.id.String()}
+	}
+
+	return []string{"MINID", "=", t.minID.String()}
+}
+
+// Parses a range bound where - and + are the smallest and largest IDs, a
+// missing sequence covers the whole millisecond and ( excludes the ID itself
+func parseRangeID(s string, start bool) (StreamID, error) {
+	switch s {
+	case "-":
+		return streamMinID, nil
+	case "+":
+		return streamMaxID, nil
+	}
+
+	missingSeq := uint64(0)
+
+	if !start {
+		missingSeq = math.MaxUint64
+	}
+
+	exclusive := strings.HasPrefix(s, "(")
+
+	id, err := parseStreamID(strings.TrimPrefix(s, "("), missingSeq)
+
+	if err != nil || !exclusive {
+		return id, err
+	}
+
+	ok := false
+
+	if start {
+		if id, ok = id.Incr(); !ok {
+			return id, newReplyError(codeErr, "invalid start ID for the interval")
+		}
+	} else if id, ok = id.Decr(); !ok {
+		return id, newReplyError(codeErr, "invalid end ID for the interval")
+	}
+
+	return id, nil
+}
+
+// Returns the name OBJECT ENCODING reports
+func (s *Stream) Encoding() string {
+	return "stream"
+}
+
+// Fails when key holds a value other than a stream
+func checkStreamType(key string) error {
+	switch keyType(key) {
+	case "stream", "none":
+		return nil
+	}
+	return errWrongType
+}
+
+// XADD key [NOMKSTREAM] [MAXLEN|MINID [=|~] threshold [LIMIT count]]
+// <* | ms-* | id> field value [field value ...]
+func xadd(args []Value) Value {
+	if len(args) < 4 {
+		return arityError("xadd")
+	}
+
+	key := args[0].bulk
+	trim, pos, err := parseStreamTrimArgs(args[1:], true)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	pos++
+	if pos >= len(args) {
+		return arityError("xadd")
+	}
+
+	fieldArgs := args[pos+1:]
+
+	if len(fieldArgs) == 0 || len(fieldArgs)%2 != 0 {
+		return arityError("xadd")
+	}
+
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+
+	if err := checkStreamType(key); err != nil {
+		return errorReply(err)
+	}
+
+	XSETsMu.Lock()
+	defer XSETsMu.Unlock()
+
+	stream, ok := XSETs[key]
+
+	if !ok {
+		if trim.nomkstream {
+			return Value{typ: "null"}
+		}
+		stream = NewStream()
+	}
+
+	id, err := stream.nextID(args[pos].bulk)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	fields := make([]string, len(fieldArgs))
+
+	for i, field := range fieldArgs {
+		fields[i] = field.bulk
+	}
+
+	XSETs[key] = stream
+	stream.Append(id, fields)
+	notifyKeyspaceEvent(notifyStream, "xadd", key)
+
+	// Logged with the resolved ID and an exact trim so replaying the AOF
+	// recreates the same entries
+	logged := []string{"XADD", key}
+	if trim.nomkstream {
+		logged = append(logged, "NOMKSTREAM")
+	}
+	if trim.strategy != "" {
+		if stream.Trim(trim) > 0 {
+			notifyKeyspaceEvent(notifyStream, "xtrim", key)
+		}
+		logged = append(logged, stream.trimLogArgs(trim)...)
+	}
+	logged = append(logged, id.String())
+	logged = append(logged, fields...)
+	propagate(commandValue(logged...))
+
+	signalKey(key)
+
+	return Value{typ: "bulk", bulk: id.String()}
+}
+
+// XTRIM key MAXLEN|MINID [=|~] threshold [LIMIT count]
+func xtrim(args []Value) Value {
+	if len(args) < 3 {
+		return arityError("xtrim")
+	}
+
+	key := args[0].bulk
+	trim, _, err := parseStreamTrimArgs(args[1:], false)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	if err := checkStreamType(key); err != nil {
+		return errorReply(err)
+	}
+
+	XSETsMu.Lock()
+	defer XSETsMu.Unlock()
+
+	stream, ok := XSETs[key]
+
+	if !ok {
+		return Value{typ: "integer", num: 0}
+	}
+
+	removed := stream.Trim(trim)
+
+	if removed > 0 {
+		notifyKeyspaceEvent(notifyStream, "xtrim", key)
+		propagate(commandValue(append([]string{"XTRIM", key}, stream.trimLogArgs(trim)...)...))
+	}
+
+	return Value{typ: "integer", num: removed}
+}
+
+// XDEL key id [id ...]
+func xdel(args []Value) Value {
+	if len(args) < 2 {
+		return arityError("xdel")
+	}
+
+	key := args[0].bulk
+	ids := make([]StreamID, len(args)-1)
+
+	// Every ID is validated before deleting any entry
+	for i, arg := range args[1:] {
+		id, err := parseStreamID(arg.bulk, 0)
+
+		if err != nil {
+			return errorReply(err)
+		}
+
+		ids[i] = id
+	}
+
+	if err := checkStreamType(key); err != nil {
+		return errorReply(err)
+	}
+
+	XSETsMu.Lock()
+	defer XSETsMu.Unlock()
+
+	stream, ok := XSETs[key]
+	deleted := 0
+
+	if !ok {
+		return Value{typ: "integer", num: 0}
+	}
+
+	for _, id := range ids {
+		if stream.Delete(id) {
+			deleted++
+		}
+	}
+
+	if deleted > 0 {
+		notifyKeyspaceEvent(notifyStream, "xdel", key)
+	}
+
+	return Value{typ: "integer", num: deleted}
+}
+
+// XLEN key
+func xlen(args []Value) Value {
+	if len(args) != 1 {
+		return arityError("xlen")
+	}
+
+	if err := checkStreamType(args[0].bulk); err != nil {
+		return errorReply(err)
+	}
+
+	XSETsMu.RLock()
+	defer XSETsMu.RUnlock()
+
+	length := 0
+
+	if stream, ok := XSETs[args[0].bulk]; ok {
+		length = stream.length
+	}
+
+	return Value{typ: "integer", num: length}
+}
+
+// XRANGE key start end [COUNT count] and XREVRANGE key end start [COUNT count]
+func xrangeGeneric(args []Value, rev bool, command string) Value {
+	if len(args) < 3 {
+		return arityError(command)
+	}
+
+	key := args[0].bulk
+	startArg, endArg := args[1].bulk, args[2].bulk
+
+	if rev {
+		startArg, endArg = endArg, startArg
+	}
+
+	start, err := parseRangeID(startArg, true)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	end, err := parseRangeID(endArg, false)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	count := -1
+
+	if len(args) > 3 {
+		if len(args) != 5 || strings.ToUpper(args[3].bulk) != "COUNT" {
+			return errorReply(errSyntax)
+		}
+
+		count, err = strconv.Atoi(args[4].bulk)
+
+		if err != nil {
+			return errorReply(errNotInteger)
+		}
+		if count < 0 {
+			count = 0
+		}
+	}
+
+	if err := checkStreamType(key); err != nil {
+		return errorReply(err)
+	}
+
+	XSETsMu.RLock()
+	defer XSETsMu.RUnlock()
+
+	entries := []Value{}
+	stream, ok := XSETs[key]
+
+	if !ok || count == 0 {
+		return Value{typ: "array", array: entries}
+	}
+
+	stream.Range(start, end, rev, func(e streamEntry) bool {
+		entries = append(entries, streamEntryReply(e))
+		return count < 0 || len(entries) < count
+	})
+
+	return Value{typ: "array", array: entries}
+}
+
+// XRANGE key start end [COUNT count]
+func xrange(args []Value) Value {
+	return xrangeGeneric(args, false, "xrange")
+}
+
+// XREVRANGE key end start [COUNT count]
+func xrevrange(args []Value) Value {
+	return xrangeGeneric(args, true, "xrevrange")
+}
+
+// Reads the entries after each ID, up to count per stream when count is
+// positive. Returns a null array when no stream has new entries.
+func streamReadAfter(keys []string, ids []StreamID, count int) Value {
+	XSETsMu.RLock()
+	defer XSETsMu.RUnlock()
+
+	streams := []Value{}
+
+	for i, key := range keys {
+		stream, ok := XSETs[key]
+		start, more := ids[i].Incr()
+
+		if !ok || !more {
+			continue
+		}
+
+		entries := []Value{}
+
+		stream.Range(start, streamMaxID, false, func(e streamEntry) bool {
+			entries = append(entries, streamEntryReply(e))
+			return count <= 0 || len(entries) < count
+		})
+
+		if len(entries) > 0 {
+			streams = append(streams, Value{typ: "bulk", bulk: key}, Value{typ: "array", array: entries})
+		}
+	}
+
+	if len(streams) == 0 {
+		return Value{typ: "nullarray"}
+	}
+
+	return Value{typ: "pairmap", array: streams}
+}
+
+// Options of XREAD and XREADGROUP
+type streamReadArgs struct {
+	count    int
+	block    bool
+	timeout  time.Duration
+	noack    bool
+	group    string
+	consumer string
+	keys     []string
+	ids      []string
+}
+
+// Parses the arguments of XREAD or XREADGROUP, the keys and IDs follow STREAMS
+func parseStreamReadArgs(args []Value, command string) (streamReadArgs, error) {
+	r := streamReadArgs{}
+	xreadgroup := command == "xreadgroup"
+	streams := false
+	i := 0
+
+options:
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].bulk)
+		moreArgs := len(args) - 1 - i
+
+		switch {
+		case opt == "COUNT" && moreArgs > 0:
+			i++
+			n, err := strconv.Atoi(args[i].bulk)
+
+			if err != nil {
+				return r, errNotInteger
+			}
+
+			r.count = n
+		case opt == "BLOCK" && moreArgs > 0:
+			i++
+			ms, err := strconv.ParseInt(args[i].bulk, 10, 64)
+
+			if err != nil {
+				return r, newReplyError(codeErr, "timeout is not an integer or out of range")
+			}
+			if ms < 0 {
+				return r, newReplyError(codeErr, "timeout is negative")
+			}
+			if ms >= int64(math.MaxInt64/time.Millisecond) {
+				return r, errTimeoutRange
+			}
+
+			r.block = true
+			r.timeout = time.Duration(ms) * time.Millisecond
+		case opt == "GROUP" && xreadgroup && moreArgs > 1:
+			r.group, r.consumer = args[i+1].bulk, args[i+2].bulk
+			i += 2
+		case opt == "NOACK" && xreadgroup:
+			r.noack = true
+		case opt == "NOACK":
+			return r, newReplyError(codeErr, "The NOACK option is only supported by XREADGROUP. You called XREAD instead.")
+		case opt == "STREAMS":
+			streams = true
+			i++
+			break options
+		default:
+			return r, errSyntax
+		}
+	}
+
+	if !streams {
+		return r, errSyntax
+	}
+	if xreadgroup && r.group == "" {
+		return r, newReplyError(codeErr, "Missing GROUP option for XREADGROUP")
+	}
+
+	rest := args[i:]
+
+	if len(rest) == 0 || len(rest)%2 != 0 {
+		return r, newReplyError(codeErr, "Unbalanced '"+command+"' list of streams: for each stream key an ID or '$' must be specified.")
+	}
+
+	r.keys = make([]string, len(rest)/2)
+	r.ids = make([]string, len(rest)/2)
+
+	for j := range r.keys {
+		r.keys[j] = rest[j].bulk
+		r.ids[j] = rest[len(r.keys)+j].bulk
+
+		switch {
+		case r.ids[j] == ">" && !xreadgroup:
+			return r, newReplyError(codeErr, "The > ID can be specified only when calling XREADGROUP using the GROUP <group> <consumer> option.")
+		case r.ids[j] == "$" && xreadgroup:
+			return r, newReplyError(codeErr, "The $ ID is meaningless in the context of XREADGROUP: you want to read the history of this consumer by specifying a proper ID, or use the > ID to get new messages. The $ ID would just return an empty result set.")
+		}
+	}
+
+	return r, nil
+}
+
+// XREAD [COUNT count] [BLOCK milliseconds] STREAMS key [key ...] id [id ...]
+func xread(args []Value) Value {
+	return xreadBlocking(nil, args)
+}
+
+// XREAD served to a client that may wait
+func xreadBlocking(c *Client, args []Value) Value {
+	r, err := parseStreamReadArgs(args, "xread")
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	keys := r.keys
+	ids := make([]StreamID, len(keys))
+
+	for _, key := range keys {
+		if err := checkStreamType(key); err != nil {
+			return errorReply(err)
+		}
+	}
+
+	// $ and + are resolved once so blocking waits for entries added afterwards
+	XSETsMu.RLock()
+	for j, arg := range r.ids {
+		stream, ok := XSETs[keys[j]]
+
+		switch arg {
+		case "$":
+			if ok {
+				ids[j] = stream.lastID
+			}
+		case "+":
+			// Reads the last entry only
+			if ok {
+				ids[j], _ = stream.lastID.Decr()
+			}
+		default:
+			id, err := parseStreamID(arg, 0)
+
+			if err != nil {
+				XSETsMu.RUnlock()
+				return errorReply(err)
+			}
+
+			ids[j] = id
+		}
+	}
+	XSETsMu.RUnlock()
+
+	reply := streamReadAfter(keys, ids, r.count)
+
+	if !r.block || reply.typ != "nullarray" {
+		return reply
+	}
+
+	blockUntil(c, keys, r.timeout, func() bool {
+		reply = streamReadAfter(keys, ids, r.count)
+		return reply.typ != "nullarray"
+	})
+
+	return reply
+}
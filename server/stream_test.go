@@ -0,0 +1,469 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Runs a command straight through its handler like the AOF loader does
+func runCommand(parts ...string) Value {
+	return Handlers[strings.ToUpper(parts[0])](commandValue(parts...).array[1:])
+}
+
+// Collects the commands handlers propagate to the AOF until the test ends
+func capturePropagated(t *testing.T) func() []Value {
+	var mu sync.Mutex
+	var logged []Value
+
+	saved := propagate
+	propagate = func(v Value) {
+		mu.Lock()
+		logged = append(logged, v)
+		mu.Unlock()
+	}
+	t.Cleanup(func() { propagate = saved })
+
+	return func() []Value {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]Value(nil), logged...)
+	}
+}
+
+func TestStreamGroupSurvivesReload(t *testing.T) {
+	resetDataset()
+	logged := capturePropagated(t)
+
+	for i := 1; i <= 5; i++ {
+		runCommand("XADD", "stream:reload", fmt.Sprintf("%d-0", i), "f", "v")
+	}
+	runCommand("XGROUP", "CREATE", "stream:reload", "g", "0")
+	runCommand("XREADGROUP", "GROUP", "g", "alice", "COUNT", "3", "STREAMS", "stream:reload", ">")
+
+	// Consumers created by claims that claim nothing are kept too
+	runCommand("XCLAIM", "stream:reload", "g", "bob", "3600000", "1-0")
+	runCommand("XAUTOCLAIM", "stream:reload", "g", "carol", "3600000", "0")
+
+	groups := string(runCommand("XINFO", "GROUPS", "stream:reload").Marshal())
+	consumers := runCommand("XINFO", "CONSUMERS", "stream:reload", "g")
+	pending := string(runCommand("XPENDING", "stream:reload", "g").Marshal())
+
+	resetDataset()
+
+	for _, v := range logged() {
+		runCommand(commandParts(v)...)
+	}
+
+	if got := string(runCommand("XINFO", "GROUPS", "stream:reload").Marshal()); got != groups {
+		t.Errorf("XINFO GROUPS after reload = %q, want %q", got, groups)
+	}
+	if got := string(runCommand("XPENDING", "stream:reload", "g").Marshal()); got != pending {
+		t.Errorf("XPENDING after reload = %q, want %q", got, pending)
+	}
+
+	reloaded := runCommand("XINFO", "CONSUMERS", "stream:reload", "g")
+
+	if len(reloaded.array) != len(consumers.array) {
+		t.Errorf("%d consumers after reload, want %d", len(reloaded.array), len(consumers.array))
+	}
+}
+
+// Returns the arguments of a command value
+func commandParts(v Value) []string {
+	parts := make([]string, len(v.array))
+
+	for i, arg := range v.array {
+		parts[i] = arg.bulk
+	}
+
+	return parts
+}
+
+func TestStreamPendingRanges(t *testing.T) {
+	c := dialTestServer(t)
+
+	for i := 1; i <= 30; i++ {
+		c.do("XADD", "stream:pel", fmt.Sprintf("%d-0", i), "f", "v")
+	}
+	c.expect("+OK\r\n", "XGROUP", "CREATE", "stream:pel", "g", "0")
+	c.do("XREADGROUP", "GROUP", "g", "alice", "COUNT", "20", "STREAMS", "stream:pel", ">")
+	c.do("XREADGROUP", "GROUP", "g", "bob", "STREAMS", "stream:pel", ">")
+	c.expect(":2\r\n", "XACK", "stream:pel", "g", "1-0", "25-0")
+
+	c.expect("*4\r\n:28\r\n$3\r\n2-0\r\n$4\r\n30-0\r\n*2\r\n*2\r\n$5\r\nalice\r\n$2\r\n19\r\n*2\r\n$3\r\nbob\r\n$1\r\n9\r\n",
+		"XPENDING", "stream:pel", "g")
+
+	ids := func(v Value) []string {
+		var got []string
+		for _, entry := range v.array {
+			got = append(got, entry.array[0].bulk)
+		}
+		return got
+	}
+
+	got := ids(c.do("XPENDING", "stream:pel", "g", "-", "+", "3"))
+	if strings.Join(got, " ") != "2-0 3-0 4-0" {
+		t.Errorf("XPENDING - + 3 = %v", got)
+	}
+
+	got = ids(c.do("XPENDING", "stream:pel", "g", "(20-0", "+", "4", "bob"))
+	if strings.Join(got, " ") != "21-0 22-0 23-0 24-0" {
+		t.Errorf("XPENDING (20-0 + 4 bob = %v", got)
+	}
+
+	// History reads return the consumer's own pending entries in order
+	reply := c.do("XREADGROUP", "GROUP", "g", "bob", "COUNT", "3", "STREAMS", "stream:pel", "23-0")
+	got = ids(reply.array[0].array[1])
+	if strings.Join(got, " ") != "24-0 26-0 27-0" {
+		t.Errorf("XREADGROUP history = %v", got)
+	}
+
+	reply = c.do("XAUTOCLAIM", "stream:pel", "g", "carol", "0", "10-0", "COUNT", "5", "JUSTID")
+	if reply.array[0].bulk != "15-0" || strings.Join(commandParts(reply.array[1]), " ") != "10-0 11-0 12-0 13-0 14-0" {
+		t.Errorf("XAUTOCLAIM = %q", reply.Marshal())
+	}
+}
+
+func TestStreamAdd(t *testing.T) {
+	c := dialTestServer(t)
+	t.Cleanup(func() { runCommand("CONFIG", "SET", "stream-node-max-entries", "100") })
+
+	c.expect("$3\r\n1-1\r\n", "XADD", "xadd:k", "1-1", "f", "v")
+	c.expect("$3\r\n1-2\r\n", "XADD", "xadd:k", "1-*", "f", "v")
+	c.expect("$3\r\n5-0\r\n", "XADD", "xadd:k", "5", "f", "v")
+	c.expect("-ERR The ID specified in XADD is equal or smaller than the target stream top item\r\n", "XADD", "xadd:k", "5-0", "f", "v")
+	c.expect("-ERR The ID specified in XADD is equal or smaller than the target stream top item\r\n", "XADD", "xadd:k", "4-*", "f", "v")
+	c.expect("-ERR The ID specified in XADD must be greater than 0-0\r\n", "XADD", "xadd:zero", "0-0", "f", "v")
+	c.expect("-ERR Invalid stream ID specified as stream command argument\r\n", "XADD", "xadd:k", "x-1", "f", "v")
+	c.expect("-ERR wrong number of arguments for 'xadd' command\r\n", "XADD", "xadd:k", "*", "f")
+
+	// Generated IDs use the clock and never go backwards
+	now := uint64(time.Now().UnixMilli())
+	id, err := parseStreamID(c.do("XADD", "xadd:k", "*", "f", "v").bulk, 0)
+
+	if err != nil || id.ms < now || id.ms > now+1000 {
+		t.Errorf("XADD * generated %v at %d", id, now)
+	}
+
+	c.expect("$22\r\n18446744073709551615-0\r\n", "XADD", "xadd:max", "18446744073709551615-0", "f", "v")
+	c.expect("$22\r\n18446744073709551615-1\r\n", "XADD", "xadd:max", "*", "f", "v")
+
+	c.expect("$-1\r\n", "XADD", "xadd:nomk", "NOMKSTREAM", "*", "f", "v")
+	c.expect(":0\r\n", "EXISTS", "xadd:nomk")
+
+	c.expect("+stream\r\n", "TYPE", "xadd:k")
+	c.expect("$6\r\nstream\r\n", "OBJECT", "ENCODING", "xadd:k")
+	c.expect(":4\r\n", "XLEN", "xadd:k")
+
+	// Entries are split into radix tree nodes of stream-node-max-entries
+	c.expect("+OK\r\n", "CONFIG", "SET", "stream-node-max-entries", "2")
+
+	for i := 1; i <= 5; i++ {
+		c.do("XADD", "xadd:nodes", fmt.Sprintf("%d-0", i), "f", "v")
+	}
+
+	info := c.do("XINFO", "STREAM", "xadd:nodes")
+
+	if info.array[2].bulk != "radix-tree-keys" || info.array[3].num != 3 {
+		t.Errorf("XINFO STREAM = %q, want 3 radix tree keys", info.Marshal())
+	}
+
+	c.expect("*5\r\n*2\r\n$3\r\n1-0\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n*2\r\n$3\r\n2-0\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n*2\r\n$3\r\n3-0\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n*2\r\n$3\r\n4-0\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n*2\r\n$3\r\n5-0\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n",
+		"XRANGE", "xadd:nodes", "-", "+")
+}
+
+// Returns the IDs of the entries in an XRANGE style reply
+func streamReplyIDs(v Value) string {
+	ids := make([]string, len(v.array))
+
+	for i, entry := range v.array {
+		ids[i] = entry.array[0].bulk
+	}
+
+	return strings.Join(ids, " ")
+}
+
+func TestStreamRangesAndTrimming(t *testing.T) {
+	c := dialTestServer(t)
+
+	for i := 1; i <= 10; i++ {
+		c.do("XADD", "xr:k", fmt.Sprintf("%d-0", i), "n", fmt.Sprint(i))
+	}
+
+	for _, tc := range []struct {
+		want  string
+		parts []string
+	}{
+		{"1-0 2-0 3-0", []string{"XRANGE", "xr:k", "-", "+", "COUNT", "3"}},
+		{"4-0 5-0", []string{"XRANGE", "xr:k", "(3-0", "5"}},
+		{"10-0 9-0", []string{"XREVRANGE", "xr:k", "+", "-", "COUNT", "2"}},
+		{"7-0 6-0", []string{"XREVRANGE", "xr:k", "(8-0", "6"}},
+		{"", []string{"XRANGE", "xr:k", "5", "4"}},
+		{"", []string{"XRANGE", "xr:missing", "-", "+"}},
+	} {
+		if got := streamReplyIDs(c.do(tc.parts...)); got != tc.want {
+			t.Errorf("%q = %q, want %q", tc.parts, got, tc.want)
+		}
+	}
+
+	c.expect("*1\r\n*2\r\n$3\r\n2-0\r\n*2\r\n$1\r\nn\r\n$1\r\n2\r\n", "XRANGE", "xr:k", "2", "2")
+
+	c.expect(":2\r\n", "XDEL", "xr:k", "2-0", "4-0", "99-0")
+	c.expect(":8\r\n", "XLEN", "xr:k")
+
+	if got := streamReplyIDs(c.do("XRANGE", "xr:k", "-", "5")); got != "1-0 3-0 5-0" {
+		t.Errorf("XRANGE after XDEL = %q", got)
+	}
+
+	c.expect(":3\r\n", "XTRIM", "xr:k", "MAXLEN", "5")
+	if got := streamReplyIDs(c.do("XRANGE", "xr:k", "-", "+")); got != "6-0 7-0 8-0 9-0 10-0" {
+		t.Errorf("XRANGE after XTRIM MAXLEN = %q", got)
+	}
+
+	c.expect(":2\r\n", "XTRIM", "xr:k", "MINID", "8")
+	c.expect(":0\r\n", "XTRIM", "xr:k", "MINID", "8")
+
+	// Approximate trimming only drops whole nodes, none are full here
+	c.expect(":0\r\n", "XTRIM", "xr:k", "MAXLEN", "~", "1")
+
+	c.expect("$4\r\n11-0\r\n", "XADD", "xr:k", "MAXLEN", "2", "11-0", "n", "11")
+	if got := streamReplyIDs(c.do("XRANGE", "xr:k", "-", "+")); got != "10-0 11-0" {
+		t.Errorf("XRANGE after XADD MAXLEN = %q", got)
+	}
+
+	c.expect("$4\r\n12-0\r\n", "XADD", "xr:k", "MINID", "11", "12-0", "n", "12")
+	c.expect(":2\r\n", "XLEN", "xr:k")
+
+	// Trimming keeps the last ID so new entries still sort after it
+	c.expect(":2\r\n", "XTRIM", "xr:k", "MAXLEN", "0")
+	c.expect(":0\r\n", "XLEN", "xr:k")
+	c.expect("-ERR The ID specified in XADD is equal or smaller than the target stream top item\r\n", "XADD", "xr:k", "12-0", "n", "v")
+
+	c.expect("-ERR syntax error, LIMIT cannot be used without the special ~ option\r\n", "XTRIM", "xr:k", "MAXLEN", "1", "LIMIT", "10")
+}
+
+func TestStreamRead(t *testing.T) {
+	addr := startTestServer(t)
+	c := dialTest(t, addr)
+	other := dialTest(t, addr)
+
+	c.do("XADD", "xread:a", "1-0", "f", "v")
+	c.do("XADD", "xread:a", "2-0", "f", "v")
+	c.do("XADD", "xread:b", "1-0", "f", "v")
+
+	c.expect("*2\r\n*2\r\n$7\r\nxread:a\r\n*1\r\n*2\r\n$3\r\n2-0\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n*2\r\n$7\r\nxread:b\r\n*1\r\n*2\r\n$3\r\n1-0\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n",
+		"XREAD", "STREAMS", "xread:a", "xread:b", "1-0", "0")
+
+	if got := streamReplyIDs(c.do("XREAD", "COUNT", "1", "STREAMS", "xread:a", "0").array[0].array[1]); got != "1-0" {
+		t.Errorf("XREAD COUNT 1 = %q", got)
+	}
+
+	c.expect("*-1\r\n", "XREAD", "STREAMS", "xread:a", "$")
+	c.expect("*-1\r\n", "XREAD", "BLOCK", "50", "STREAMS", "xread:a", "xread:missing", "$", "$")
+
+	// $ means entries added after the call, even while blocked
+	if _, err := c.conn.Write(commandValue("XREAD", "BLOCK", "0", "STREAMS", "xread:a", "$").Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	waitBlocked(t, "xread:a", 1)
+
+	other.do("XADD", "xread:b", "2-0", "f", "v")
+	other.do("XADD", "xread:a", "3-0", "g", "w")
+	c.receive("*1\r\n*2\r\n$7\r\nxread:a\r\n*1\r\n*2\r\n$3\r\n3-0\r\n*2\r\n$1\r\ng\r\n$1\r\nw\r\n")
+
+	// A blocked read of a missing stream is served once it is created
+	if _, err := c.conn.Write(commandValue("XREAD", "BLOCK", "0", "STREAMS", "xread:new", "0").Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	waitBlocked(t, "xread:new", 1)
+	other.do("XADD", "xread:new", "5-0", "f", "v")
+	c.receive("*1\r\n*2\r\n$9\r\nxread:new\r\n*1\r\n*2\r\n$3\r\n5-0\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n")
+
+	c.expect("-ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.\r\n", "XREAD", "STREAMS", "xread:a", "xread:b", "0")
+	c.expect("-ERR timeout is not an integer or out of range\r\n", "XREAD", "BLOCK", "x", "STREAMS", "xread:a", "0")
+}
+
+func TestStreamConsumerGroups(t *testing.T) {
+	addr := startTestServer(t)
+	c := dialTest(t, addr)
+	other := dialTest(t, addr)
+
+	c.expect("-ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.\r\n",
+		"XGROUP", "CREATE", "xg:k", "g", "$")
+	c.expect("+OK\r\n", "XGROUP", "CREATE", "xg:k", "g", "$", "MKSTREAM")
+	c.expect("-BUSYGROUP Consumer Group name already exists\r\n", "XGROUP", "CREATE", "xg:k", "g", "$")
+	c.expect("-NOGROUP No such key 'xg:k' or consumer group 'nope' in XREADGROUP with GROUP option\r\n",
+		"XREADGROUP", "GROUP", "nope", "alice", "STREAMS", "xg:k", ">")
+
+	for i := 1; i <= 4; i++ {
+		c.do("XADD", "xg:k", fmt.Sprintf("%d-0", i), "f", "v")
+	}
+
+	// New entries go to one consumer each and stay pending until acknowledged
+	if got := streamReplyIDs(c.do("XREADGROUP", "GROUP", "g", "alice", "COUNT", "2", "STREAMS", "xg:k", ">").array[0].array[1]); got != "1-0 2-0" {
+		t.Errorf("XREADGROUP alice = %q", got)
+	}
+	if got := streamReplyIDs(c.do("XREADGROUP", "GROUP", "g", "bob", "STREAMS", "xg:k", ">").array[0].array[1]); got != "3-0 4-0" {
+		t.Errorf("XREADGROUP bob = %q", got)
+	}
+	c.expect("*-1\r\n", "XREADGROUP", "GROUP", "g", "bob", "STREAMS", "xg:k", ">")
+
+	// Reading history returns the consumer's own pending entries
+	if got := streamReplyIDs(c.do("XREADGROUP", "GROUP", "g", "alice", "STREAMS", "xg:k", "0").array[0].array[1]); got != "1-0 2-0" {
+		t.Errorf("XREADGROUP alice history = %q", got)
+	}
+
+	c.expect(":1\r\n", "XACK", "xg:k", "g", "1-0", "9-0")
+	c.expect(":0\r\n", "XACK", "xg:k", "g", "1-0")
+
+	pending := c.do("XPENDING", "xg:k", "g", "-", "+", "10", "alice")
+	if len(pending.array) != 1 || pending.array[0].array[0].bulk != "2-0" || pending.array[0].array[3].num != 2 {
+		t.Errorf("XPENDING alice = %q, want 2-0 delivered twice", pending.Marshal())
+	}
+	c.expect("*0\r\n", "XPENDING", "xg:k", "g", "IDLE", "60000", "-", "+", "10")
+
+	// Claims move idle entries and count deliveries
+	c.expect("*0\r\n", "XCLAIM", "xg:k", "g", "carol", "60000", "3-0")
+	c.expect("*1\r\n$3\r\n3-0\r\n", "XCLAIM", "xg:k", "g", "carol", "0", "3-0", "JUSTID")
+	c.expect("*1\r\n*2\r\n$3\r\n3-0\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n", "XCLAIM", "xg:k", "g", "alice", "0", "3-0", "RETRYCOUNT", "7")
+
+	pending = c.do("XPENDING", "xg:k", "g", "3-0", "3-0", "1")
+	if pending.array[0].array[1].bulk != "alice" || pending.array[0].array[3].num != 7 {
+		t.Errorf("XPENDING 3-0 = %q, want alice with 7 deliveries", pending.Marshal())
+	}
+
+	// XAUTOCLAIM reports entries deleted from the stream and drops them
+	c.expect(":1\r\n", "XDEL", "xg:k", "4-0")
+	c.expect("*3\r\n$3\r\n0-0\r\n*2\r\n$3\r\n2-0\r\n$3\r\n3-0\r\n*1\r\n$3\r\n4-0\r\n", "XAUTOCLAIM", "xg:k", "g", "dave", "0", "-", "JUSTID")
+	c.expect("*4\r\n:2\r\n$3\r\n2-0\r\n$3\r\n3-0\r\n*1\r\n*2\r\n$4\r\ndave\r\n$1\r\n2\r\n", "XPENDING", "xg:k", "g")
+
+	c.expect(":2\r\n", "XGROUP", "DELCONSUMER", "xg:k", "g", "dave")
+	c.expect("*4\r\n:0\r\n$-1\r\n$-1\r\n*-1\r\n", "XPENDING", "xg:k", "g")
+
+	// NOACK reads deliver without adding to the pending list
+	c.expect("+OK\r\n", "XGROUP", "SETID", "xg:k", "g", "0")
+	if got := streamReplyIDs(c.do("XREADGROUP", "GROUP", "g", "erin", "NOACK", "STREAMS", "xg:k", ">").array[0].array[1]); got != "1-0 2-0 3-0" {
+		t.Errorf("XREADGROUP NOACK = %q", got)
+	}
+	c.expect("*4\r\n:0\r\n$-1\r\n$-1\r\n*-1\r\n", "XPENDING", "xg:k", "g")
+
+	// A blocked group read is served by the next XADD
+	if _, err := c.conn.Write(commandValue("XREADGROUP", "GROUP", "g", "frank", "BLOCK", "0", "STREAMS", "xg:k", ">").Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	waitBlocked(t, "xg:k", 1)
+	other.do("XADD", "xg:k", "5-0", "f", "v")
+	c.receive("*1\r\n*2\r\n$4\r\nxg:k\r\n*1\r\n*2\r\n$3\r\n5-0\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n")
+
+	c.expect(":1\r\n", "XGROUP", "DESTROY", "xg:k", "g")
+	c.expect(":0\r\n", "XGROUP", "DESTROY", "xg:k", "g")
+}
+
+// Looks up a field of a flat XINFO reply
+func infoField(t *testing.T, v Value, name string) Value {
+	t.Helper()
+
+	for i := 0; i+1 < len(v.array); i += 2 {
+		if v.array[i].bulk == name {
+			return v.array[i+1]
+		}
+	}
+
+	t.Fatalf("field %q missing from %q", name, v.Marshal())
+	return Value{}
+}
+
+func TestStreamInfo(t *testing.T) {
+	addr := startTestServer(t)
+	c := dialTest(t, addr)
+
+	c.expect("-ERR no such key\r\n", "XINFO", "STREAM", "xi:k")
+
+	for i := 1; i <= 5; i++ {
+		c.do("XADD", "xi:k", fmt.Sprintf("%d-0", i), "f", "v")
+	}
+	c.do("XDEL", "xi:k", "5-0")
+
+	stream := c.do("XINFO", "STREAM", "xi:k")
+	for name, want := range map[string]string{
+		"length":               ":4\r\n",
+		"last-generated-id":    "$3\r\n5-0\r\n",
+		"max-deleted-entry-id": "$3\r\n5-0\r\n",
+		"entries-added":        ":5\r\n",
+		"groups":               ":0\r\n",
+		"first-entry":          "*2\r\n$3\r\n1-0\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n",
+		"last-entry":           "*2\r\n$3\r\n4-0\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n",
+	} {
+		if got := string(infoField(t, stream, name).Marshal()); got != want {
+			t.Errorf("XINFO STREAM %s = %q, want %q", name, got, want)
+		}
+	}
+
+	// Lag is the number of entries a group has yet to read
+	for i := 1; i <= 4; i++ {
+		c.do("XADD", "xi:g", fmt.Sprintf("%d-0", i), "f", "v")
+	}
+	c.do("XGROUP", "CREATE", "xi:g", "g", "0")
+	c.do("XREADGROUP", "GROUP", "g", "alice", "COUNT", "1", "STREAMS", "xi:g", ">")
+	c.do("XGROUP", "CREATECONSUMER", "xi:g", "g", "bob")
+
+	groups := c.do("XINFO", "GROUPS", "xi:g")
+	if len(groups.array) != 1 {
+		t.Fatalf("XINFO GROUPS = %q", groups.Marshal())
+	}
+	for name, want := range map[string]string{
+		"name":              "$1\r\ng\r\n",
+		"consumers":         ":2\r\n",
+		"pending":           ":1\r\n",
+		"last-delivered-id": "$3\r\n1-0\r\n",
+		"entries-read":      ":1\r\n",
+		"lag":               ":3\r\n",
+	} {
+		if got := string(infoField(t, groups.array[0], name).Marshal()); got != want {
+			t.Errorf("XINFO GROUPS %s = %q, want %q", name, got, want)
+		}
+	}
+
+	// A deletion after the group's position makes the lag unknown
+	c.do("XDEL", "xi:g", "3-0")
+	if got := infoField(t, c.do("XINFO", "GROUPS", "xi:g").array[0], "lag"); got.typ != "nullbulk" {
+		t.Errorf("lag after XDEL = %q, want null", got.Marshal())
+	}
+
+	consumers := c.do("XINFO", "CONSUMERS", "xi:g", "g")
+	if len(consumers.array) != 2 {
+		t.Fatalf("XINFO CONSUMERS = %q", consumers.Marshal())
+	}
+	if got := infoField(t, consumers.array[0], "name").bulk; got != "alice" {
+		t.Errorf("first consumer = %q, want alice", got)
+	}
+	if got := infoField(t, consumers.array[0], "pending").num; got != 1 {
+		t.Errorf("alice pending = %d, want 1", got)
+	}
+	if got := infoField(t, consumers.array[1], "inactive").num; got != -1 {
+		t.Errorf("bob inactive = %d, want -1", got)
+	}
+	c.expect("-NOGROUP No such consumer group 'nope' for key name 'xi:g'\r\n", "XINFO", "CONSUMERS", "xi:g", "nope")
+
+	full := c.do("XINFO", "STREAM", "xi:g", "FULL", "COUNT", "2")
+	if got := streamReplyIDs(infoField(t, full, "entries")); got != "1-0 2-0" {
+		t.Errorf("XINFO STREAM FULL entries = %q", got)
+	}
+	group := infoField(t, full, "groups").array[0]
+	if got := infoField(t, group, "pel-count").num; got != 1 {
+		t.Errorf("FULL pel-count = %d, want 1", got)
+	}
+	pending := infoField(t, group, "pending")
+	if len(pending.array) != 1 || pending.array[0].array[0].bulk != "1-0" || pending.array[0].array[1].bulk != "alice" {
+		t.Errorf("FULL pending = %q", pending.Marshal())
+	}
+	alice := infoField(t, group, "consumers").array[0]
+	if got := infoField(t, alice, "pel-count").num; got != 1 {
+		t.Errorf("FULL alice pel-count = %d, want 1", got)
+	}
+
+	c.expect("-ERR syntax error\r\n", "XINFO", "STREAM", "xi:g", "PARTIAL")
+}
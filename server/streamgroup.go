@@ -0,0 +1,1074 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Consumer group of a stream. Entries delivered to its consumers stay in the
+// pending entries list until acknowledged.
+type streamGroup struct {
+	lastID      StreamID
+	entriesRead int64 // entries delivered since the first ever, -1 when unknown
+	pel         pendingList
+	consumers   map[string]*streamConsumer
+}
+
+// Entry delivered to a consumer and not acknowledged yet
+type pendingEntry struct {
+	consumer      *streamConsumer
+	deliveryTime  int64 // unix milliseconds of the last delivery
+	deliveryCount int
+}
+
+// Consumer of a group with its own view of the pending entries
+type streamConsumer struct {
+	name       string
+	seenTime   int64 // unix milliseconds of the last attempted interaction
+	activeTime int64 // unix milliseconds of the last successful interaction, -1 if none
+	pel        pendingList
+}
+
+// Pending entries list kept in ID order in a radix tree like Redis does, so
+// ranges are read without sorting the whole list
+type pendingList struct {
+	rax rax[pendingEntry]
+}
+
+// Returns the pending entry with the given ID, nil when there is none
+func (l *pendingList) Get(id StreamID) *pendingEntry {
+	return l.rax.Find(id.key())
+}
+
+// Adds or replaces the pending entry with the given ID
+func (l *pendingList) Set(id StreamID, nack *pendingEntry) {
+	l.rax.Insert(id.key(), nack)
+}
+
+// Removes the pending entry with the given ID
+func (l *pendingList) Delete(id StreamID) {
+	l.rax.Remove(id.key())
+}
+
+// Returns the number of pending entries
+func (l *pendingList) Len() int {
+	return l.rax.Len()
+}
+
+// Calls fn for the pending entries between start and end in order until it
+// returns false. fn must not add or remove entries.
+func (l *pendingList) Range(start StreamID, end StreamID, fn func(id StreamID, nack *pendingEntry) bool) {
+	l.rax.Ascend(start.key(), func(key []byte, nack *pendingEntry) bool {
+		id := streamIDFromKey(key)
+
+		if end.Less(id) {
+			return false
+		}
+
+		return fn(id, nack)
+	})
+}
+
+// Returns up to count IDs between start and end in order, all of them when
+// count is not positive
+func (l *pendingList) IDs(start StreamID, end StreamID, count int) []StreamID {
+	ids := []StreamID{}
+
+	l.Range(start, end, func(id StreamID, _ *pendingEntry) bool {
+		ids = append(ids, id)
+		return count <= 0 || len(ids) < count
+	})
+
+	return ids
+}
+
+// Returns the smallest and largest pending IDs, false when the list is empty
+func (l *pendingList) Bounds() (StreamID, StreamID, bool) {
+	var first, last StreamID
+	found := false
+
+	l.rax.Ascend(nil, func(key []byte, _ *pendingEntry) bool {
+		first, found = streamIDFromKey(key), true
+		return false
+	})
+	l.rax.Descend(nil, func(key []byte, _ *pendingEntry) bool {
+		last = streamIDFromKey(key)
+		return false
+	})
+
+	return first, last, found
+}
+
+// Creates a group delivering entries after lastID
+func newStreamGroup(lastID StreamID, entriesRead int64) *streamGroup {
+	return &streamGroup{
+		lastID:      lastID,
+		entriesRead: entriesRead,
+		consumers:   map[string]*streamConsumer{},
+	}
+}
+
+// Returns the consumer called name, creating it if asked. The boolean is true
+// when the consumer was created.
+func (g *streamGroup) consumer(name string, create bool) (*streamConsumer, bool) {
+	if c, ok := g.consumers[name]; ok {
+		return c, false
+	}
+	if !create {
+		return nil, false
+	}
+
+	c := &streamConsumer{
+		name:       name,
+		seenTime:   time.Now().UnixMilli(),
+		activeTime: -1,
+	}
+	g.consumers[name] = c
+
+	return c, true
+}
+
+// Assigns a pending entry to a consumer, adding it to the pending list if needed
+func (g *streamGroup) assign(id StreamID, c *streamConsumer) *pendingEntry {
+	nack := g.pel.Get(id)
+
+	if nack == nil {
+		nack = &pendingEntry{}
+		g.pel.Set(id, nack)
+	} else {
+		nack.consumer.pel.Delete(id)
+	}
+
+	nack.consumer = c
+	c.pel.Set(id, nack)
+
+	return nack
+}
+
+// Removes an entry from the pending lists, returns true if it was pending
+func (g *streamGroup) ack(id StreamID) bool {
+	nack := g.pel.Get(id)
+
+	if nack == nil {
+		return false
+	}
+
+	nack.consumer.pel.Delete(id)
+	g.pel.Delete(id)
+
+	return true
+}
+
+// Checks whether an entry at or after start was deleted, which makes counting
+// the entries after start impossible without walking them
+func (s *Stream) hasTombstones(start StreamID) bool {
+	if s.length == 0 || s.maxDeletedID == streamMinID {
+		return false
+	}
+
+	return !s.maxDeletedID.Less(start)
+}
+
+// Estimates how many entries were added up to id since the first ever, or -1
+// when deletions make it unknown
+func (s *Stream) entriesUpTo(id StreamID) int64 {
+	if s.entriesAdded == 0 {
+		return 0
+	}
+
+	added := int64(s.entriesAdded)
+
+	if s.length == 0 && !s.lastID.Less(id) {
+		return added
+	}
+
+	switch s.lastID.Compare(id) {
+	case 0:
+		return added
+	case -1:
+		// Future IDs have no count yet
+		return -1
+	}
+
+	first, _ := s.First()
+
+	// Without deletions past the first entry the count follows from the length
+	if s.maxDeletedID == streamMinID || s.maxDeletedID.Less(first.id) {
+		switch id.Compare(first.id) {
+		case -1:
+			return added - int64(s.length)
+		case 0:
+			return added - int64(s.length) + 1
+		}
+	}
+
+	return -1
+}
+
+// Counts an entry delivered by the group, recomputing the counter when it is
+// unknown or deletions ahead make incrementing it wrong
+func (g *streamGroup) countRead(s *Stream, id StreamID) {
+	if g.entriesRead != -1 && !s.hasTombstones(id) {
+		g.entriesRead++
+	} else if s.entriesAdded > 0 {
+		g.entriesRead = s.entriesUpTo(id)
+	}
+}
+
+// Returns the number of entries the group has yet to read, false when unknown
+func (g *streamGroup) lag(s *Stream) (int64, bool) {
+	if s.entriesAdded == 0 {
+		return 0, true
+	}
+
+	if g.entriesRead != -1 && !s.hasTombstones(g.lastID) {
+		return int64(s.entriesAdded) - g.entriesRead, true
+	}
+
+	if read := s.entriesUpTo(g.lastID); read != -1 {
+		return int64(s.entriesAdded) - read, true
+	}
+
+	return 0, false
+}
+
+// Returns the live entry with the given ID
+func (s *Stream) Lookup(id StreamID) (streamEntry, bool) {
+	var entry streamEntry
+	found := false
+
+	s.Range(id, id, false, func(e streamEntry) bool {
+		entry, found = e, true
+		return false
+	})
+
+	return entry, found
+}
+
+// Error for commands naming a missing stream or group
+func errNoGroup(key string, group string) error {
+	return newReplyError(codeNoGroup, "No such key '"+key+"' or consumer group '"+group+"'")
+}
+
+// Returns the group of the stream at key, the caller holds XSETsMu
+func streamGroupOf(key string, group string) (*Stream, *streamGroup, error) {
+	stream, ok := XSETs[key]
+
+	if !ok {
+		return nil, nil, errNoGroup(key, group)
+	}
+
+	g, ok := stream.groups[group]
+
+	if !ok {
+		return nil, nil, errNoGroup(key, group)
+	}
+
+	return stream, g, nil
+}
+
+// Logs the delivery of a pending entry as an XCLAIM with absolute values so
+// the AOF rebuilds the same pending entries list
+func streamPropagateClaim(key string, group string, g *streamGroup, id StreamID, nack *pendingEntry) {
+	propagate(commandValue("XCLAIM", key, group, nack.consumer.name, "0", id.String(),
+		"TIME", strconv.FormatInt(nack.deliveryTime, 10),
+		"RETRYCOUNT", strconv.Itoa(nack.deliveryCount),
+		"FORCE", "JUSTID", "LASTID", g.lastID.String()))
+}
+
+// Parses the ID of XGROUP CREATE and SETID where $ is the last entry
+func parseGroupID(stream *Stream, arg string) (StreamID, error) {
+	if arg == "$" {
+		if stream == nil {
+			return streamMinID, nil
+		}
+		return stream.lastID, nil
+	}
+
+	return parseStreamID(arg, 0)
+}
+
+// XGROUP CREATE|SETID|DESTROY|CREATECONSUMER|DELCONSUMER key group ...
+func xgroup(args []Value) Value {
+	if len(args) == 0 {
+		return arityError("xgroup")
+	}
+
+	subcommand := strings.ToUpper(args[0].bulk)
+
+	switch {
+	case subcommand == "CREATE" && len(args) >= 4 && len(args) <= 7,
+		subcommand == "SETID" && (len(args) == 4 || len(args) == 6),
+		subcommand == "DESTROY" && len(args) == 3,
+		subcommand == "CREATECONSUMER" && len(args) == 4,
+		subcommand == "DELCONSUMER" && len(args) == 4:
+	case subcommand == "CREATE", subcommand == "SETID", subcommand == "DESTROY",
+		subcommand == "CREATECONSUMER", subcommand == "DELCONSUMER":
+		return arityError("xgroup|" + strings.ToLower(subcommand))
+	default:
+		return errorValue(codeErr, "unknown subcommand '"+args[0].bulk+"'. Try XGROUP HELP.")
+	}
+
+	key, group := args[1].bulk, args[2].bulk
+	mkstream := false
+	entriesRead := int64(-1)
+
+	if subcommand == "CREATE" || subcommand == "SETID" {
+		for i := 4; i < len(args); i++ {
+			opt := strings.ToUpper(args[i].bulk)
+
+			switch {
+			case opt == "MKSTREAM" && subcommand == "CREATE":
+				mkstream = true
+			case opt == "ENTRIESREAD" && i+1 < len(args):
+				i++
+				n, err := strconv.ParseInt(args[i].bulk, 10, 64)
+
+				if err != nil {
+					return errorReply(errNotInteger)
+				}
+				if n < -1 {
+					return errorValue(codeErr, "value for ENTRIESREAD must be positive or -1")
+				}
+
+				entriesRead = n
+			default:
+				return errorReply(errSyntax)
+			}
+		}
+	}
+
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+
+	if err := checkStreamType(key); err != nil {
+		return errorReply(err)
+	}
+
+	XSETsMu.Lock()
+	defer XSETsMu.Unlock()
+
+	stream, ok := XSETs[key]
+
+	if !ok && !(subcommand == "CREATE" && mkstream) {
+		if subcommand == "CREATE" {
+			return errorValue(codeErr, "The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+		}
+		return errorReply(errNoGroup(key, group))
+	}
+
+	switch subcommand {
+	case "CREATE":
+		id, err := parseGroupID(stream, args[3].bulk)
+
+		if err != nil {
+			return errorReply(err)
+		}
+		if ok {
+			if _, exists := stream.groups[group]; exists {
+				return errorValue(codeBusyGroup, "Consumer Group name already exists")
+			}
+		} else {
+			stream = NewStream()
+			XSETs[key] = stream
+		}
+
+		stream.groups[group] = newStreamGroup(id, entriesRead)
+		notifyKeyspaceEvent(notifyStream, "xgroup-create", key)
+
+		// Logged with $ resolved to the ID it stood for
+		propagate(commandValue("XGROUP", "CREATE", key, group, id.String(), "MKSTREAM",
+			"ENTRIESREAD", strconv.FormatInt(entriesRead, 10)))
+
+		return Value{typ: "string", str: "OK"}
+	case "DESTROY":
+		if _, exists := stream.groups[group]; !exists {
+			return Value{typ: "integer", num: 0}
+		}
+
+		delete(stream.groups, group)
+		notifyKeyspaceEvent(notifyStream, "xgroup-destroy", key)
+		propagate(commandValue("XGROUP", "DESTROY", key, group))
+
+		// Readers blocked on the group find out it is gone
+		signalKey(key)
+
+		return Value{typ: "integer", num: 1}
+	}
+
+	g, exists := stream.groups[group]
+
+	if !exists {
+		return errorValue(codeNoGroup, "No such consumer group '"+group+"' for key name '"+key+"'")
+	}
+
+	switch subcommand {
+	case "SETID":
+		id, err := parseGroupID(stream, args[3].bulk)
+
+		if err != nil {
+			return errorReply(err)
+		}
+
+		g.lastID = id
+		g.entriesRead = entriesRead
+		notifyKeyspaceEvent(notifyStream, "xgroup-setid", key)
+		propagate(commandValue("XGROUP", "SETID", key, group, id.String(),
+			"ENTRIESREAD", strconv.FormatInt(entriesRead, 10)))
+
+		return Value{typ: "string", str: "OK"}
+	case "CREATECONSUMER":
+		if _, created := g.consumer(args[3].bulk, true); !created {
+			return Value{typ: "integer", num: 0}
+		}
+
+		notifyKeyspaceEvent(notifyStream, "xgroup-createconsumer", key)
+		propagate(commandValue("XGROUP", "CREATECONSUMER", key, group, args[3].bulk))
+
+		return Value{typ: "integer", num: 1}
+	default:
+		c, _ := g.consumer(args[3].bulk, false)
+
+		if c == nil {
+			return Value{typ: "integer", num: 0}
+		}
+
+		pending := c.pel.Len()
+
+		for _, id := range c.pel.IDs(streamMinID, streamMaxID, 0) {
+			g.ack(id)
+		}
+		delete(g.consumers, c.name)
+		notifyKeyspaceEvent(notifyStream, "xgroup-delconsumer", key)
+
+		propagate(commandValue("XGROUP", "DELCONSUMER", key, group, c.name))
+
+		return Value{typ: "integer", num: pending}
+	}
+}
+
+// Delivers entries to a consumer for XREADGROUP. New entries are read after
+// the last delivered ID of the group for ">", otherwise the consumer's own
+// pending entries after the ID are read again. Returns a null array when no
+// new entries were delivered and no history was asked for.
+func streamReadGroup(r streamReadArgs) (Value, error) {
+	XSETsMu.Lock()
+	defer XSETsMu.Unlock()
+
+	now := time.Now().UnixMilli()
+	streams := []Value{}
+
+	for i, key := range r.keys {
+		stream, g, err := streamGroupOf(key, r.group)
+
+		if err != nil {
+			return Value{}, newReplyError(codeNoGroup, "No such key '"+key+"' or consumer group '"+r.group+"' in XREADGROUP with GROUP option")
+		}
+
+		c, created := g.consumer(r.consumer, true)
+		c.seenTime = now
+
+		if created {
+			notifyKeyspaceEvent(notifyStream, "xgroup-createconsumer", key)
+			propagate(commandValue("XGROUP", "CREATECONSUMER", key, r.group, r.consumer))
+		}
+
+		entries := []Value{}
+
+		if r.ids[i] == ">" {
+			start, more := g.lastID.Incr()
+
+			if !more {
+				continue
+			}
+
+			stream.Range(start, streamMaxID, false, func(e streamEntry) bool {
+				g.lastID = e.id
+				g.countRead(stream, e.id)
+				entries = append(entries, streamEntryReply(e))
+
+				if !r.noack {
+					nack := g.assign(e.id, c)
+					nack.deliveryTime = now
+					nack.deliveryCount = 1
+					streamPropagateClaim(key, r.group, g, e.id, nack)
+				}
+
+				return r.count <= 0 || len(entries) < r.count
+			})
+
+			if len(entries) == 0 {
+				continue
+			}
+
+			c.activeTime = now
+
+			// The claims logged above do not carry the read counter, so it is
+			// logged after them for the replayed group to report the same lag
+			propagate(commandValue("XGROUP", "SETID", key, r.group, g.lastID.String(),
+				"ENTRIESREAD", strconv.FormatInt(g.entriesRead, 10)))
+
+			streams = append(streams, Value{typ: "bulk", bulk: key}, Value{typ: "array", array: entries})
+			continue
+		}
+
+		from, _ := parseStreamID(r.ids[i], 0)
+		start, more := from.Incr()
+
+		if more {
+			c.pel.Range(start, streamMaxID, func(id StreamID, nack *pendingEntry) bool {
+				nack.deliveryTime = now
+				nack.deliveryCount++
+
+				// Entries deleted since their delivery are reported without fields
+				if e, ok := stream.Lookup(id); ok {
+					entries = append(entries, streamEntryReply(e))
+				} else {
+					entries = append(entries, Value{typ: "array", array: []Value{
+						{typ: "bulk", bulk: id.String()},
+						{typ: "nullarray"},
+					}})
+				}
+
+				return r.count <= 0 || len(entries) < r.count
+			})
+		}
+
+		// History reads always report every stream, even without entries
+		streams = append(streams, Value{typ: "bulk", bulk: key}, Value{typ: "array", array: entries})
+	}
+
+	if len(streams) == 0 {
+		return Value{typ: "nullarray"}, nil
+	}
+
+	return Value{typ: "pairmap", array: streams}, nil
+}
+
+// XREADGROUP GROUP group consumer [COUNT count] [BLOCK milliseconds] [NOACK]
+// STREAMS key [key ...] id [id ...]
+func xreadgroup(args []Value) Value {
+	return xreadgroupBlocking(nil, args)
+}
+
+// XREADGROUP served to a client that may wait
+func xreadgroupBlocking(c *Client, args []Value) Value {
+	if len(args) < 6 {
+		return arityError("xreadgroup")
+	}
+
+	r, err := parseStreamReadArgs(args, "xreadgroup")
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	history := false
+
+	for i, key := range r.keys {
+		if err := checkStreamType(key); err != nil {
+			return errorReply(err)
+		}
+
+		if r.ids[i] != ">" {
+			if _, err := parseStreamID(r.ids[i], 0); err != nil {
+				return errorReply(err)
+			}
+			history = true
+		}
+	}
+
+	reply, err := streamReadGroup(r)
+
+	// Only reads of new entries wait for them
+	if err == nil && r.block && !history && reply.typ == "nullarray" {
+		blockUntil(c, r.keys, r.timeout, func() bool {
+			reply, err = streamReadGroup(r)
+			return err != nil || reply.typ != "nullarray"
+		})
+	}
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	return reply
+}
+
+// XACK key group id [id ...]
+func xack(args []Value) Value {
+	if len(args) < 3 {
+		return arityError("xack")
+	}
+
+	key, group := args[0].bulk, args[1].bulk
+	ids := make([]StreamID, len(args)-2)
+
+	for i, arg := range args[2:] {
+		id, err := parseStreamID(arg.bulk, 0)
+
+		if err != nil {
+			return errorReply(err)
+		}
+
+		ids[i] = id
+	}
+
+	if err := checkStreamType(key); err != nil {
+		return errorReply(err)
+	}
+
+	XSETsMu.Lock()
+	defer XSETsMu.Unlock()
+
+	_, g, err := streamGroupOf(key, group)
+
+	if err != nil {
+		return Value{typ: "integer", num: 0}
+	}
+
+	acked := 0
+
+	for _, id := range ids {
+		if g.ack(id) {
+			acked++
+		}
+	}
+
+	return Value{typ: "integer", num: acked}
+}
+
+// XPENDING key group [[IDLE min-idle-time] start end count [consumer]]
+func xpending(args []Value) Value {
+	if len(args) < 2 {
+		return arityError("xpending")
+	}
+
+	key, group := args[0].bulk, args[1].bulk
+	extended := len(args) > 2
+	minIdle := int64(0)
+	pos := 2
+
+	if extended && strings.ToUpper(args[pos].bulk) == "IDLE" {
+		if len(args) < 4 {
+			return errorReply(errSyntax)
+		}
+
+		n, err := strconv.ParseInt(args[pos+1].bulk, 10, 64)
+
+		if err != nil {
+			return errorReply(errNotInteger)
+		}
+
+		minIdle = n
+		pos += 2
+	}
+
+	var start, end StreamID
+	var consumer string
+	count := 0
+
+	if extended {
+		if len(args)-pos < 3 || len(args)-pos > 4 {
+			return errorReply(errSyntax)
+		}
+
+		var err error
+
+		if start, err = parseRangeID(args[pos].bulk, true); err != nil {
+			return errorReply(err)
+		}
+		if end, err = parseRangeID(args[pos+1].bulk, false); err != nil {
+			return errorReply(err)
+		}
+		if count, err = strconv.Atoi(args[pos+2].bulk); err != nil {
+			return errorReply(errNotInteger)
+		}
+		if count < 0 {
+			count = 0
+		}
+		if len(args)-pos == 4 {
+			consumer = args[pos+3].bulk
+		}
+	}
+
+	if err := checkStreamType(key); err != nil {
+		return errorReply(err)
+	}
+
+	XSETsMu.RLock()
+	defer XSETsMu.RUnlock()
+
+	_, g, err := streamGroupOf(key, group)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	if !extended {
+		first, last, ok := g.pel.Bounds()
+
+		if !ok {
+			return Value{typ: "array", array: []Value{
+				{typ: "integer", num: 0},
+				{typ: "null"},
+				{typ: "null"},
+				{typ: "nullarray"},
+			}}
+		}
+
+		names := make([]string, 0, len(g.consumers))
+
+		for name, c := range g.consumers {
+			if c.pel.Len() > 0 {
+				names = append(names, name)
+			}
+		}
+
+		sort.Strings(names)
+
+		consumers := make([]Value, len(names))
+
+		for i, name := range names {
+			consumers[i] = Value{typ: "array", array: []Value{
+				{typ: "bulk", bulk: name},
+				{typ: "bulk", bulk: strconv.Itoa(g.consumers[name].pel.Len())},
+			}}
+		}
+
+		return Value{typ: "array", array: []Value{
+			{typ: "integer", num: g.pel.Len()},
+			{typ: "bulk", bulk: first.String()},
+			{typ: "bulk", bulk: last.String()},
+			{typ: "array", array: consumers},
+		}}
+	}
+
+	pel := &g.pel
+
+	if consumer != "" {
+		c, _ := g.consumer(consumer, false)
+
+		if c == nil {
+			return Value{typ: "array", array: []Value{}}
+		}
+
+		pel = &c.pel
+	}
+
+	now := time.Now().UnixMilli()
+	entries := []Value{}
+
+	pel.Range(start, end, func(id StreamID, nack *pendingEntry) bool {
+		if len(entries) >= count {
+			return false
+		}
+
+		idle := now - nack.deliveryTime
+
+		if idle < minIdle {
+			return true
+		}
+
+		entries = append(entries, Value{typ: "array", array: []Value{
+			{typ: "bulk", bulk: id.String()},
+			{typ: "bulk", bulk: nack.consumer.name},
+			{typ: "integer", num: int(idle)},
+			{typ: "integer", num: nack.deliveryCount},
+		}})
+
+		return true
+	})
+
+	return Value{typ: "array", array: entries}
+}
+
+// Parses the min-idle-time of XCLAIM and XAUTOCLAIM
+func parseMinIdle(arg string, command string) (int64, error) {
+	n, err := strconv.ParseInt(arg, 10, 64)
+
+	if err != nil {
+		return 0, newReplyError(codeErr, "Invalid min-idle-time argument for "+command)
+	}
+	if n < 0 {
+		n = 0
+	}
+
+	return n, nil
+}
+
+// Moves a pending entry to a consumer if it was idle long enough. Entries
+// deleted from the stream are dropped from the pending list instead. Returns
+// the entry and whether it was claimed or deleted.
+func streamClaim(key string, group string, stream *Stream, g *streamGroup, c *streamConsumer, id StreamID, minIdle int64, deliveryTime int64, retryCount int, justID bool) (streamEntry, bool, bool) {
+	nack := g.pel.Get(id)
+	e, exists := stream.Lookup(id)
+
+	if !exists {
+		if nack != nil {
+			g.ack(id)
+			propagate(commandValue("XACK", key, group, id.String()))
+			return e, false, true
+		}
+		return e, false, false
+	}
+
+	if nack == nil || time.Now().UnixMilli()-nack.deliveryTime < minIdle {
+		return e, false, false
+	}
+
+	nack = g.assign(id, c)
+	nack.deliveryTime = deliveryTime
+
+	if retryCount >= 0 {
+		nack.deliveryCount = retryCount
+	} else if !justID {
+		nack.deliveryCount++
+	}
+
+	c.activeTime = time.Now().UnixMilli()
+	streamPropagateClaim(key, group, g, id, nack)
+
+	return e, true, false
+}
+
+// XCLAIM key group consumer min-idle-time id [id ...] [IDLE ms]
+// [TIME unix-time-milliseconds] [RETRYCOUNT count] [FORCE] [JUSTID] [LASTID id]
+func xclaim(args []Value) Value {
+	if len(args) < 5 {
+		return arityError("xclaim")
+	}
+
+	key, group, consumer := args[0].bulk, args[1].bulk, args[2].bulk
+	minIdle, err := parseMinIdle(args[3].bulk, "XCLAIM")
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	// IDs run until the first argument that does not parse as one
+	ids := []StreamID{}
+	pos := 4
+
+	for ; pos < len(args); pos++ {
+		id, err := parseStreamID(args[pos].bulk, 0)
+
+		if err != nil {
+			break
+		}
+
+		ids = append(ids, id)
+	}
+
+	now := time.Now().UnixMilli()
+	deliveryTime := now
+	retryCount := -1
+	force, justID := false, false
+	var lastID StreamID
+
+	for ; pos < len(args); pos++ {
+		opt := strings.ToUpper(args[pos].bulk)
+		moreArgs := len(args) - 1 - pos
+
+		switch {
+		case opt == "FORCE":
+			force = true
+		case opt == "JUSTID":
+			justID = true
+		case (opt == "IDLE" || opt == "TIME" || opt == "RETRYCOUNT") && moreArgs > 0:
+			pos++
+			n, err := strconv.ParseInt(args[pos].bulk, 10, 64)
+
+			if err != nil {
+				return errorValue(codeErr, "Invalid "+opt+" option argument for XCLAIM")
+			}
+
+			switch opt {
+			case "IDLE":
+				deliveryTime = now - n
+			case "TIME":
+				deliveryTime = n
+			default:
+				retryCount = int(n)
+			}
+		case opt == "LASTID" && moreArgs > 0:
+			pos++
+			id, err := parseStreamID(args[pos].bulk, 0)
+
+			if err != nil {
+				return errorReply(err)
+			}
+
+			lastID = id
+		default:
+			return errorValue(codeErr, "Unrecognized XCLAIM option '"+args[pos].bulk+"'")
+		}
+	}
+
+	// Entries are never delivered in the future
+	if deliveryTime > now {
+		deliveryTime = now
+	}
+
+	if err := checkStreamType(key); err != nil {
+		return errorReply(err)
+	}
+
+	XSETsMu.Lock()
+	defer XSETsMu.Unlock()
+
+	stream, g, err := streamGroupOf(key, group)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	if g.lastID.Less(lastID) {
+		g.lastID = lastID
+	}
+
+	c, created := g.consumer(consumer, true)
+	c.seenTime = now
+
+	if created {
+		notifyKeyspaceEvent(notifyStream, "xgroup-createconsumer", key)
+		propagate(commandValue("XGROUP", "CREATECONSUMER", key, group, consumer))
+	}
+
+	claimed := []Value{}
+
+	for _, id := range ids {
+		idle := minIdle
+
+		// FORCE creates pending entries for IDs no consumer was delivered
+		if g.pel.Get(id) == nil && force {
+			if _, exists := stream.Lookup(id); exists {
+				g.assign(id, c).deliveryTime = deliveryTime
+				idle = 0
+			}
+		}
+
+		e, ok, _ := streamClaim(key, group, stream, g, c, id, idle, deliveryTime, retryCount, justID)
+
+		if !ok {
+			continue
+		}
+
+		if justID {
+			claimed = append(claimed, Value{typ: "bulk", bulk: id.String()})
+		} else {
+			claimed = append(claimed, streamEntryReply(e))
+		}
+	}
+
+	return Value{typ: "array", array: claimed}
+}
+
+// XAUTOCLAIM key group consumer min-idle-time start [COUNT count] [JUSTID]
+func xautoclaim(args []Value) Value {
+	if len(args) < 5 {
+		return arityError("xautoclaim")
+	}
+
+	key, group, consumer := args[0].bulk, args[1].bulk, args[2].bulk
+	minIdle, err := parseMinIdle(args[3].bulk, "XAUTOCLAIM")
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	start, err := parseRangeID(args[4].bulk, true)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	count := 100
+	justID := false
+
+	for pos := 5; pos < len(args); pos++ {
+		opt := strings.ToUpper(args[pos].bulk)
+
+		switch {
+		case opt == "JUSTID":
+			justID = true
+		case opt == "COUNT" && pos+1 < len(args):
+			pos++
+			n, err := strconv.Atoi(args[pos].bulk)
+
+			if err != nil {
+				return errorReply(errNotInteger)
+			}
+			if n < 1 {
+				return errorValue(codeErr, "COUNT must be > 0")
+			}
+
+			count = n
+		default:
+			return errorReply(errSyntax)
+		}
+	}
+
+	if err := checkStreamType(key); err != nil {
+		return errorReply(err)
+	}
+
+	XSETsMu.Lock()
+	defer XSETsMu.Unlock()
+
+	stream, g, err := streamGroupOf(key, group)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	now := time.Now().UnixMilli()
+	c, created := g.consumer(consumer, true)
+	c.seenTime = now
+
+	if created {
+		notifyKeyspaceEvent(notifyStream, "xgroup-createconsumer", key)
+		propagate(commandValue("XGROUP", "CREATECONSUMER", key, group, consumer))
+	}
+
+	claimed := []Value{}
+	deleted := []Value{}
+	next := streamMinID
+
+	// Scans at most ten times count pending entries per call, taking one more
+	// ID to reply as the next start. Claims change the list, so the IDs are
+	// taken before claiming.
+	attempts := count * 10
+	ids := g.pel.IDs(start, streamMaxID, attempts+1)
+
+	for i, id := range ids {
+		if attempts == 0 || len(claimed) >= count {
+			next = id
+			break
+		}
+		attempts--
+
+		e, ok, gone := streamClaim(key, group, stream, g, c, id, minIdle, now, -1, justID)
+
+		switch {
+		case gone:
+			deleted = append(deleted, Value{typ: "bulk", bulk: id.String()})
+		case ok && justID:
+			claimed = append(claimed, Value{typ: "bulk", bulk: id.String()})
+		case ok:
+			claimed = append(claimed, streamEntryReply(e))
+		}
+
+		if i == len(ids)-1 {
+			next = streamMinID
+		}
+	}
+
+	return Value{typ: "array", array: []Value{
+		{typ: "bulk", bulk: next.String()},
+		{typ: "array", array: claimed},
+		{typ: "array", array: deleted},
+	}}
+}
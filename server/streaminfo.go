@@ -0,0 +1,293 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Help lines for XINFO HELP
+var xinfoHelp = []string{
+	"XINFO <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"CONSUMERS <key> <groupname>",
+	"    Show consumers of <groupname>.",
+	"GROUPS <key>",
+	"    Show the stream consumer groups.",
+	"STREAM <key> [FULL [COUNT <count>]",
+	"    Show information about the stream.",
+	"HELP",
+	"    Print this help.",
+}
+
+// Reply for an ID that may not exist, such as the first entry of an empty stream
+func streamEntryOrNull(e streamEntry, ok bool) Value {
+	if !ok {
+		return Value{typ: "null"}
+	}
+	return streamEntryReply(e)
+}
+
+// Reply for a counter that is -1 when unknown
+func streamCounterReply(n int64) Value {
+	if n == -1 {
+		return Value{typ: "null"}
+	}
+	return Value{typ: "integer", num: int(n)}
+}
+
+// Returns the group names of a stream in order
+func streamGroupNames(s *Stream) []string {
+	names := make([]string, 0, len(s.groups))
+
+	for name := range s.groups {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Returns the consumer names of a group in order
+func streamConsumerNames(g *streamGroup) []string {
+	names := make([]string, 0, len(g.consumers))
+
+	for name := range g.consumers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Fields of XINFO STREAM shared by the summary and FULL forms
+func streamInfoHeader(s *Stream) []Value {
+	first, _ := s.First()
+
+	return []Value{
+		{typ: "bulk", bulk: "length"}, {typ: "integer", num: s.length},
+		{typ: "bulk", bulk: "radix-tree-keys"}, {typ: "integer", num: s.rax.Len()},
+		{typ: "bulk", bulk: "radix-tree-nodes"}, {typ: "integer", num: s.rax.Nodes()},
+		{typ: "bulk", bulk: "last-generated-id"}, {typ: "bulk", bulk: s.lastID.String()},
+		{typ: "bulk", bulk: "max-deleted-entry-id"}, {typ: "bulk", bulk: s.maxDeletedID.String()},
+		{typ: "bulk", bulk: "entries-added"}, {typ: "integer", num: int(s.entriesAdded)},
+		{typ: "bulk", bulk: "recorded-first-entry-id"}, {typ: "bulk", bulk: first.id.String()},
+	}
+}
+
+// Reply for XINFO GROUPS describing one group
+func streamGroupInfo(s *Stream, name string) Value {
+	g := s.groups[name]
+	lag := Value{typ: "null"}
+
+	if n, ok := g.lag(s); ok {
+		lag = Value{typ: "integer", num: int(n)}
+	}
+
+	return Value{typ: "map", array: []Value{
+		{typ: "bulk", bulk: "name"}, {typ: "bulk", bulk: name},
+		{typ: "bulk", bulk: "consumers"}, {typ: "integer", num: len(g.consumers)},
+		{typ: "bulk", bulk: "pending"}, {typ: "integer", num: g.pel.Len()},
+		{typ: "bulk", bulk: "last-delivered-id"}, {typ: "bulk", bulk: g.lastID.String()},
+		{typ: "bulk", bulk: "entries-read"}, streamCounterReply(g.entriesRead),
+		{typ: "bulk", bulk: "lag"}, lag,
+	}}
+}
+
+// Reply for XINFO CONSUMERS describing one consumer
+func streamConsumerInfo(c *streamConsumer, now int64) Value {
+	inactive := int64(-1)
+
+	if c.activeTime != -1 {
+		inactive = now - c.activeTime
+	}
+
+	return Value{typ: "map", array: []Value{
+		{typ: "bulk", bulk: "name"}, {typ: "bulk", bulk: c.name},
+		{typ: "bulk", bulk: "pending"}, {typ: "integer", num: c.pel.Len()},
+		{typ: "bulk", bulk: "idle"}, {typ: "integer", num: int(now - c.seenTime)},
+		{typ: "bulk", bulk: "inactive"}, {typ: "integer", num: int(inactive)},
+	}}
+}
+
+// Reply for XINFO STREAM key FULL, listing at most count entries and pending
+// entries per group and consumer when count is positive
+func streamInfoFull(s *Stream, count int) Value {
+	info := streamInfoHeader(s)
+	entries := []Value{}
+
+	s.Range(streamMinID, streamMaxID, false, func(e streamEntry) bool {
+		entries = append(entries, streamEntryReply(e))
+		return count <= 0 || len(entries) < count
+	})
+
+	groups := []Value{}
+
+	for _, name := range streamGroupNames(s) {
+		g := s.groups[name]
+		lag := Value{typ: "null"}
+
+		if n, ok := g.lag(s); ok {
+			lag = Value{typ: "integer", num: int(n)}
+		}
+
+		pending := []Value{}
+
+		g.pel.Range(streamMinID, streamMaxID, func(id StreamID, nack *pendingEntry) bool {
+			pending = append(pending, Value{typ: "array", array: []Value{
+				{typ: "bulk", bulk: id.String()},
+				{typ: "bulk", bulk: nack.consumer.name},
+				{typ: "integer", num: int(nack.deliveryTime)},
+				{typ: "integer", num: nack.deliveryCount},
+			}})
+			return count <= 0 || len(pending) < count
+		})
+
+		consumers := []Value{}
+
+		for _, consumerName := range streamConsumerNames(g) {
+			c := g.consumers[consumerName]
+			consumerPending := []Value{}
+
+			c.pel.Range(streamMinID, streamMaxID, func(id StreamID, nack *pendingEntry) bool {
+				consumerPending = append(consumerPending, Value{typ: "array", array: []Value{
+					{typ: "bulk", bulk: id.String()},
+					{typ: "integer", num: int(nack.deliveryTime)},
+					{typ: "integer", num: nack.deliveryCount},
+				}})
+				return count <= 0 || len(consumerPending) < count
+			})
+
+			consumers = append(consumers, Value{typ: "map", array: []Value{
+				{typ: "bulk", bulk: "name"}, {typ: "bulk", bulk: c.name},
+				{typ: "bulk", bulk: "seen-time"}, {typ: "integer", num: int(c.seenTime)},
+				{typ: "bulk", bulk: "active-time"}, {typ: "integer", num: int(c.activeTime)},
+				{typ: "bulk", bulk: "pel-count"}, {typ: "integer", num: c.pel.Len()},
+				{typ: "bulk", bulk: "pending"}, {typ: "array", array: consumerPending},
+			}})
+		}
+
+		groups = append(groups, Value{typ: "map", array: []Value{
+			{typ: "bulk", bulk: "name"}, {typ: "bulk", bulk: name},
+			{typ: "bulk", bulk: "last-delivered-id"}, {typ: "bulk", bulk: g.lastID.String()},
+			{typ: "bulk", bulk: "entries-read"}, streamCounterReply(g.entriesRead),
+			{typ: "bulk", bulk: "lag"}, lag,
+			{typ: "bulk", bulk: "pel-count"}, {typ: "integer", num: g.pel.Len()},
+			{typ: "bulk", bulk: "pending"}, {typ: "array", array: pending},
+			{typ: "bulk", bulk: "consumers"}, {typ: "array", array: consumers},
+		}})
+	}
+
+	info = append(info,
+		Value{typ: "bulk", bulk: "entries"}, Value{typ: "array", array: entries},
+		Value{typ: "bulk", bulk: "groups"}, Value{typ: "array", array: groups})
+
+	return Value{typ: "map", array: info}
+}
+
+// XINFO STREAM key [FULL [COUNT count]], XINFO GROUPS key,
+// XINFO CONSUMERS key group and XINFO HELP
+func xinfo(args []Value) Value {
+	if len(args) == 0 {
+		return arityError("xinfo")
+	}
+
+	subcommand := strings.ToUpper(args[0].bulk)
+
+	switch {
+	case subcommand == "HELP":
+		lines := make([]Value, len(xinfoHelp))
+		for i, line := range xinfoHelp {
+			lines[i] = Value{typ: "string", str: line}
+		}
+		return Value{typ: "array", array: lines}
+	case subcommand == "STREAM" && len(args) >= 2,
+		subcommand == "GROUPS" && len(args) == 2,
+		subcommand == "CONSUMERS" && len(args) == 3:
+	case subcommand == "STREAM", subcommand == "GROUPS", subcommand == "CONSUMERS":
+		return arityError("xinfo|" + strings.ToLower(subcommand))
+	default:
+		return errorValue(codeErr, "unknown subcommand '"+args[0].bulk+"'. Try XINFO HELP.")
+	}
+
+	key := args[1].bulk
+	full := false
+	count := 10
+
+	if subcommand == "STREAM" && len(args) > 2 {
+		if strings.ToUpper(args[2].bulk) != "FULL" {
+			return errorReply(errSyntax)
+		}
+
+		full = true
+
+		if len(args) > 3 {
+			if len(args) != 5 || strings.ToUpper(args[3].bulk) != "COUNT" {
+				return errorReply(errSyntax)
+			}
+
+			n, err := strconv.Atoi(args[4].bulk)
+
+			if err != nil {
+				return errorReply(errNotInteger)
+			}
+
+			count = n
+		}
+	}
+
+	if err := checkStreamType(key); err != nil {
+		return errorReply(err)
+	}
+
+	XSETsMu.RLock()
+	defer XSETsMu.RUnlock()
+
+	s, ok := XSETs[key]
+
+	if !ok {
+		return errorValue(codeErr, "no such key")
+	}
+
+	switch subcommand {
+	case "GROUPS":
+		groups := []Value{}
+
+		for _, name := range streamGroupNames(s) {
+			groups = append(groups, streamGroupInfo(s, name))
+		}
+
+		return Value{typ: "array", array: groups}
+	case "CONSUMERS":
+		g, ok := s.groups[args[2].bulk]
+
+		if !ok {
+			return errorValue(codeNoGroup, "No such consumer group '"+args[2].bulk+"' for key name '"+key+"'")
+		}
+
+		now := time.Now().UnixMilli()
+		consumers := []Value{}
+
+		for _, name := range streamConsumerNames(g) {
+			consumers = append(consumers, streamConsumerInfo(g.consumers[name], now))
+		}
+
+		return Value{typ: "array", array: consumers}
+	}
+
+	if full {
+		return streamInfoFull(s, count)
+	}
+
+	first, hasFirst := s.First()
+	last, hasLast := s.Last()
+
+	info := append(streamInfoHeader(s),
+		Value{typ: "bulk", bulk: "groups"}, Value{typ: "integer", num: len(s.groups)},
+		Value{typ: "bulk", bulk: "first-entry"}, streamEntryOrNull(first, hasFirst),
+		Value{typ: "bulk", bulk: "last-entry"}, streamEntryOrNull(last, hasLast))
+
+	return Value{typ: "map", array: info}
+}
@@ -0,0 +1,1808 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Member of a sorted set with its score
+type zsetEntry struct {
+	member string
+	score  float64
+}
+
+// Sorted set stored as a listpack of member, score pairs while small and as
+// a member lookup table alongside a skiplist ordered by score and then by
+// member once it grows past zset-max-listpack-entries or -value
+type ZSet struct {
+	objectMeta
+	lp   listpack
+	dict map[string]float64
+	zsl  *zskiplist
+}
+
+// In memory sorted sets
+var ZSETs = map[string]*ZSet{}
+var ZSETsMu = sync.RWMutex{}
+
+// Ways of combining scores in ZUNION and ZINTER
+const (
+	zaggSum = iota
+	zaggMin
+	zaggMax
+)
+
+// Kinds of ranges accepted by ZRANGE
+const (
+	zrangeByRank = iota
+	zrangeByScore
+	zrangeByLex
+)
+
+// Errors specific to sorted set commands
+var (
+	errScoreRange   = newReplyError(codeErr, "min or max is not a float")
+	errLexRange     = newReplyError(codeErr, "min or max not valid string range item")
+	errNaNScore     = newReplyError(codeErr, "resulting score is not a number (NaN)")
+	errLimitNoBy    = newReplyError(codeErr, "syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+	errLexWithScore = newReplyError(codeErr, "syntax error, WITHSCORES not supported in combination with BYLEX")
+)
+
+// Creates an empty listpack encoded sorted set
+func NewZSet() *ZSet {
+	return &ZSet{objectMeta: newObjectMeta()}
+}
+
+// Returns the name OBJECT ENCODING reports
+func (z *ZSet) Encoding() string {
+	if z.dict == nil {
+		return "listpack"
+	}
+	return "skiplist"
+}
+
+// Returns the entries ordered by score and then by member in a new slice
+func (z *ZSet) entries() []zsetEntry {
+	if z.dict != nil {
+		entries := make([]zsetEntry, 0, z.zsl.length)
+
+		for x := z.zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+			entries = append(entries, x.entry)
+		}
+
+		return entries
+	}
+
+	pairs := z.lp.Entries()
+	entries := make([]zsetEntry, len(pairs)/2)
+
+	for i := range entries {
+		score, _ := strconv.ParseFloat(pairs[i*2+1], 64)
+		entries[i] = zsetEntry{member: pairs[i*2], score: score}
+	}
+
+	return entries
+}
+
+// Stores ordered entries in the listpack, converting to the skiplist
+// encoding when they no longer fit the configured limits
+func (z *ZSet) lpStore(entries []zsetEntry) {
+	maxValue := configInt("zset-max-listpack-value")
+	fits := len(entries) <= configInt("zset-max-listpack-entries")
+
+	for i := 0; i < len(entries) && fits; i++ {
+		fits = len(entries[i].member) <= maxValue
+	}
+
+	if !fits {
+		z.dict = make(map[string]float64, len(entries))
+		z.zsl = newZskiplist()
+		for _, e := range entries {
+			z.dict[e.member] = e.score
+			z.zsl.Insert(e)
+		}
+		z.lp = listpack{}
+		return
+	}
+
+	pairs := make([]string, 0, len(entries)*2)
+
+	for _, e := range entries {
+		pairs = append(pairs, e.member, formatScore(e.score))
+	}
+
+	z.lp.Reset(pairs)
+}
+
+// Ordering of the entries
+func zsetLess(a, b zsetEntry) bool {
+	if a.score != b.score {
+		return a.score < b.score
+	}
+	return a.member < b.member
+}
+
+// Returns the number of members
+func (z *ZSet) Len() int {
+	if z.dict == nil {
+		return z.lp.Len() / 2
+	}
+	return len(z.dict)
+}
+
+// Returns the score of a member
+func (z *ZSet) Score(member string) (float64, bool) {
+	if z.dict != nil {
+		score, ok := z.dict[member]
+		return score, ok
+	}
+
+	for _, e := range z.entries() {
+		if e.member == member {
+			return e.score, true
+		}
+	}
+
+	return 0, false
+}
+
+// Adds a member or updates its score, returns true if the member is new
+func (z *ZSet) Add(member string, score float64) bool {
+	if z.dict == nil {
+		entries := z.entries()
+		exists := false
+
+		for i, e := range entries {
+			if e.member == member {
+				if e.score == score {
+					return false
+				}
+				entries = append(entries[:i], entries[i+1:]...)
+				exists = true
+				break
+			}
+		}
+
+		e := zsetEntry{member: member, score: score}
+		i := sort.Search(len(entries), func(i int) bool { return !zsetLess(entries[i], e) })
+		entries = append(entries, zsetEntry{})
+		copy(entries[i+1:], entries[i:])
+		entries[i] = e
+
+		z.lpStore(entries)
+
+		return !exists
+	}
+
+	old, exists := z.dict[member]
+
+	if exists {
+		if old == score {
+			return false
+		}
+		z.zsl.Delete(zsetEntry{member: member, score: old})
+	}
+
+	z.dict[member] = score
+	z.zsl.Insert(zsetEntry{member: member, score: score})
+
+	return !exists
+}
+
+// Removes a member, returns true if it was present
+func (z *ZSet) Remove(member string) bool {
+	if z.dict == nil {
+		entries := z.entries()
+
+		for i, e := range entries {
+			if e.member == member {
+				z.lpStore(append(entries[:i], entries[i+1:]...))
+				return true
+			}
+		}
+
+		return false
+	}
+
+	score, ok := z.dict[member]
+
+	if !ok {
+		return false
+	}
+
+	delete(z.dict, member)
+	z.zsl.Delete(zsetEntry{member: member, score: score})
+
+	return true
+}
+
+// Counts the leading entries for which below holds. below must hold for a
+// prefix of the order, like being under a score.
+func (z *ZSet) countBelow(below func(zsetEntry) bool) int {
+	if z.dict != nil {
+		return z.zsl.CountBelow(below)
+	}
+
+	entries := z.entries()
+
+	return sort.Search(len(entries), func(i int) bool { return !below(entries[i]) })
+}
+
+// Calls fn for the entries from position start towards the end, or towards
+// the first entry when rev, until fn returns false
+func (z *ZSet) walk(start int, rev bool, fn func(zsetEntry) bool) {
+	if z.dict != nil {
+		for x := z.zsl.Node(start); x != nil && fn(x.entry); {
+			if rev {
+				x = x.backward
+			} else {
+				x = x.level[0].forward
+			}
+		}
+		return
+	}
+
+	entries := z.entries()
+
+	for i := start; i >= 0 && i < len(entries) && fn(entries[i]); {
+		if rev {
+			i--
+		} else {
+			i++
+		}
+	}
+}
+
+// Collects the entries walked from start while inRange holds, skipping
+// offset of them and returning at most count when count is not negative
+func (z *ZSet) rangeFrom(start int, rev bool, inRange func(zsetEntry) bool, offset, count int) []zsetEntry {
+	entries := make([]zsetEntry, 0)
+
+	z.walk(start, rev, func(e zsetEntry) bool {
+		if count == 0 || !inRange(e) {
+			return false
+		}
+		if offset > 0 {
+			offset--
+			return true
+		}
+
+		entries = append(entries, e)
+		count--
+
+		return true
+	})
+
+	return entries
+}
+
+// Inclusive or exclusive score interval
+type zscoreRange struct {
+	min, max     float64
+	minex, maxex bool
+}
+
+// Checks the score is above the lower bound
+func (r zscoreRange) gteMin(score float64) bool {
+	if r.minex {
+		return score > r.min
+	}
+	return score >= r.min
+}
+
+// Checks the score is below the upper bound
+func (r zscoreRange) lteMax(score float64) bool {
+	if r.maxex {
+		return score < r.max
+	}
+	return score <= r.max
+}
+
+// One end of a lexicographic interval, inf is -1 for "-" and 1 for "+"
+type zlexBound struct {
+	val string
+	inf int
+	ex  bool
+}
+
+// Lexicographic interval
+type zlexRange struct {
+	min, max zlexBound
+}
+
+// Checks the member is above the lower bound
+func (r zlexRange) gteMin(member string) bool {
+	switch r.min.inf {
+	case -1:
+		return true
+	case 1:
+		return false
+	}
+	if r.min.ex {
+		return member > r.min.val
+	}
+	return member >= r.min.val
+}
+
+// Checks the member is below the upper bound
+func (r zlexRange) lteMax(member string) bool {
+	switch r.max.inf {
+	case 1:
+		return true
+	case -1:
+		return false
+	}
+	if r.max.ex {
+		return member < r.max.val
+	}
+	return member <= r.max.val
+}
+
+// Parses a score rejecting NaN, accepts inf, +inf and -inf
+func parseScore(s string) (float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+
+	if err != nil || math.IsNaN(f) {
+		return 0, errNotFloat
+	}
+
+	return f, nil
+}
+
+// Parses a score interval where a leading "(" makes the bound exclusive
+func parseScoreRange(min, max string) (zscoreRange, error) {
+	r := zscoreRange{}
+	var err error
+
+	if strings.HasPrefix(min, "(") {
+		r.minex = true
+		min = min[1:]
+	}
+	if strings.HasPrefix(max, "(") {
+		r.maxex = true
+		max = max[1:]
+	}
+
+	if r.min, err = parseScore(min); err != nil {
+		return r, errScoreRange
+	}
+	if r.max, err = parseScore(max); err != nil {
+		return r, errScoreRange
+	}
+
+	return r, nil
+}
+
+// Parses one end of a lexicographic interval
+func parseLexBound(s string) (zlexBound, error) {
+	switch {
+	case s == "-":
+		return zlexBound{inf: -1}, nil
+	case s == "+":
+		return zlexBound{inf: 1}, nil
+	case strings.HasPrefix(s, "["):
+		return zlexBound{val: s[1:]}, nil
+	case strings.HasPrefix(s, "("):
+		return zlexBound{val: s[1:], ex: true}, nil
+	default:
+		return zlexBound{}, errLexRange
+	}
+}
+
+// Parses a lexicographic interval
+func parseLexRange(min, max string) (zlexRange, error) {
+	lo, err := parseLexBound(min)
+
+	if err != nil {
+		return zlexRange{}, err
+	}
+
+	hi, err := parseLexBound(max)
+
+	if err != nil {
+		return zlexRange{}, err
+	}
+
+	return zlexRange{min: lo, max: hi}, nil
+}
+
+// Returns entries between two ranks, negative ranks count from the end
+func (z *ZSet) rangeByRank(start, stop int, rev bool) []zsetEntry {
+	n := z.Len()
+
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > stop || start >= n {
+		return []zsetEntry{}
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+
+	count := stop - start + 1
+
+	if rev {
+		start = n - 1 - start
+	}
+
+	return z.rangeFrom(start, rev, func(zsetEntry) bool { return true }, 0, count)
+}
+
+// Returns entries within a score interval, skipping offset and returning
+// at most count entries when count is not negative
+func (z *ZSet) rangeByScore(r zscoreRange, rev bool, offset, count int) []zsetEntry {
+	if rev {
+		start := z.countBelow(func(e zsetEntry) bool { return r.lteMax(e.score) }) - 1
+		return z.rangeFrom(start, true, func(e zsetEntry) bool { return r.gteMin(e.score) }, offset, count)
+	}
+
+	start := z.countBelow(func(e zsetEntry) bool { return !r.gteMin(e.score) })
+
+	return z.rangeFrom(start, false, func(e zsetEntry) bool { return r.lteMax(e.score) }, offset, count)
+}
+
+// Returns entries within a lexicographic interval, members are expected
+// to share the same score as in Redis
+func (z *ZSet) rangeByLex(r zlexRange, rev bool, offset, count int) []zsetEntry {
+	if rev {
+		start := z.countBelow(func(e zsetEntry) bool { return r.lteMax(e.member) }) - 1
+		return z.rangeFrom(start, true, func(e zsetEntry) bool { return r.gteMin(e.member) }, offset, count)
+	}
+
+	start := z.countBelow(func(e zsetEntry) bool { return !r.gteMin(e.member) })
+
+	return z.rangeFrom(start, false, func(e zsetEntry) bool { return r.lteMax(e.member) }, offset, count)
+}
+
+// Parsed form of every ZRANGE style command
+type zrangeSpec struct {
+	by         int
+	rev        bool
+	withScores bool
+	hasLimit   bool
+	offset     int
+	count      int
+	start      int
+	stop       int
+	score      zscoreRange
+	lex        zlexRange
+}
+
+// Parses the start and stop arguments and trailing options of a ZRANGE style
+// command. unified allows BYSCORE, BYLEX and REV as in the Redis 6.2 syntax,
+// store rejects WITHSCORES for ZRANGESTORE.
+func parseZrange(start, stop string, opts []Value, by int, rev bool, unified bool, store bool) (zrangeSpec, error) {
+	spec := zrangeSpec{by: by, rev: rev, count: -1}
+
+	for i := 0; i < len(opts); i++ {
+		switch strings.ToUpper(opts[i].bulk) {
+		case "WITHSCORES":
+			if store {
+				return spec, errSyntax
+			}
+			spec.withScores = true
+		case "BYSCORE":
+			if !unified || spec.by == zrangeByLex {
+				return spec, errSyntax
+			}
+			spec.by = zrangeByScore
+		case "BYLEX":
+			if !unified || spec.by == zrangeByScore {
+				return spec, errSyntax
+			}
+			spec.by = zrangeByLex
+		case "REV":
+			if !unified {
+				return spec, errSyntax
+			}
+			spec.rev = true
+		case "LIMIT":
+			if i+2 >= len(opts) {
+				return spec, errSyntax
+			}
+			offset, err := strconv.Atoi(opts[i+1].bulk)
+			if err != nil {
+				return spec, errNotInteger
+			}
+			count, err := strconv.Atoi(opts[i+2].bulk)
+			if err != nil {
+				return spec, errNotInteger
+			}
+			spec.hasLimit = true
+			spec.offset = offset
+			spec.count = count
+			i += 2
+		default:
+			return spec, errSyntax
+		}
+	}
+
+	if spec.hasLimit && spec.by == zrangeByRank {
+		return spec, errLimitNoBy
+	}
+	if spec.withScores && spec.by == zrangeByLex {
+		return spec, errLexWithScore
+	}
+
+	// Reverse score and lex ranges are given from max to min
+	if spec.rev && spec.by != zrangeByRank {
+		start, stop = stop, start
+	}
+
+	var err error
+
+	switch spec.by {
+	case zrangeByScore:
+		spec.score, err = parseScoreRange(start, stop)
+	case zrangeByLex:
+		spec.lex, err = parseLexRange(start, stop)
+	default:
+		if spec.start, err = strconv.Atoi(start); err != nil {
+			return spec, errNotInteger
+		}
+		if spec.stop, err = strconv.Atoi(stop); err != nil {
+			return spec, errNotInteger
+		}
+	}
+
+	return spec, err
+}
+
+// Selects the entries described by a parsed ZRANGE
+func (z *ZSet) selectRange(spec zrangeSpec) []zsetEntry {
+	// A negative offset always produces an empty reply
+	if spec.offset < 0 {
+		return []zsetEntry{}
+	}
+
+	switch spec.by {
+	case zrangeByScore:
+		return z.rangeByScore(spec.score, spec.rev, spec.offset, spec.count)
+	case zrangeByLex:
+		return z.rangeByLex(spec.lex, spec.rev, spec.offset, spec.count)
+	default:
+		return z.rangeByRank(spec.start, spec.stop, spec.rev)
+	}
+}
+
+// Formats a score the way Redis replies with it
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	case score == math.Trunc(score) && math.Abs(score) < 1e17:
+		// Integral scores such as geohashes are printed without an exponent
+		return strconv.FormatFloat(score, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+// Builds the array reply for a range of entries. With scores RESP3 clients
+// get [member, score] pairs, RESP2 ones a flat array.
+func zsetReply(entries []zsetEntry, withScores bool) Value {
+	values := make([]Value, 0, len(entries))
+
+	for _, e := range entries {
+		values = append(values, Value{typ: "bulk", bulk: e.member})
+		if withScores {
+			values = append(values, Value{typ: "double", double: e.score})
+		}
+	}
+
+	if withScores {
+		return Value{typ: "pairs", array: values}
+	}
+
+	return Value{typ: "array", array: values}
+}
+
+// Builds the flat member, score reply of a single popped entry
+func zsetEntryReply(e zsetEntry) []Value {
+	return []Value{{typ: "bulk", bulk: e.member}, {typ: "double", double: e.score}}
+}
+
+// ZADD key [NX|XX] [GT|LT] [CH] [INCR] score member [score member ...]
+func zAdd(args []Value) Value {
+	if len(args) < 3 {
+		return arityError("zadd")
+	}
+
+	key := args[0].bulk
+	var nx, xx, gt, lt, ch, incr bool
+	i := 1
+
+	// Options come before the first score
+options:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		case "CH":
+			ch = true
+		case "INCR":
+			incr = true
+		default:
+			break options
+		}
+	}
+
+	pairs := args[i:]
+
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return errorReply(errSyntax)
+	}
+	if nx && xx {
+		return errorValue(codeErr, "XX and NX options at the same time are not compatible")
+	}
+	if (gt && lt) || (nx && (gt || lt)) {
+		return errorValue(codeErr, "GT, LT, and/or NX options at the same time are not compatible")
+	}
+	if incr && len(pairs) != 2 {
+		return errorValue(codeErr, "INCR option supports a single increment-element pair")
+	}
+
+	scores := make([]float64, len(pairs)/2)
+
+	for j := range scores {
+		score, err := parseScore(pairs[j*2].bulk)
+		if err != nil {
+			return errorReply(err)
+		}
+		scores[j] = score
+	}
+
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+
+	if err := checkZsetType(key); err != nil {
+		return errorReply(err)
+	}
+
+	added, changed := 0, 0
+
+	ZSETsMu.Lock()
+	defer ZSETsMu.Unlock()
+
+	zset, ok := ZSETs[key]
+
+	if !ok {
+		zset = NewZSet()
+	}
+
+	for j, score := range scores {
+		member := pairs[j*2+1].bulk
+		cur, exists := zset.Score(member)
+
+		if exists {
+			if nx {
+				continue
+			}
+			if incr {
+				score += cur
+				if math.IsNaN(score) {
+					return errorReply(errNaNScore)
+				}
+			}
+			if (gt && score <= cur) || (lt && score >= cur) {
+				continue
+			}
+			if score != cur {
+				zset.Add(member, score)
+				changed++
+			}
+		} else {
+			if xx {
+				continue
+			}
+			zset.Add(member, score)
+			added++
+		}
+
+		if incr {
+			ZSETs[key] = zset
+			notifyKeyspaceEvent(notifyZset, "zincr", key)
+			if added > 0 {
+				signalKey(key)
+			}
+			return Value{typ: "double", double: score}
+		}
+	}
+
+	if zset.Len() > 0 {
+		ZSETs[key] = zset
+	}
+	if added+changed > 0 {
+		notifyKeyspaceEvent(notifyZset, "zadd", key)
+	}
+	if added > 0 {
+		signalKey(key)
+	}
+
+	if incr {
+		// Update skipped due to NX, XX, GT or LT
+		return Value{typ: "null"}
+	}
+	if ch {
+		return Value{typ: "integer", num: added + changed}
+	}
+
+	return Value{typ: "integer", num: added}
+}
+
+// ZREM key member [member ...]
+func zRem(args []Value) Value {
+	if len(args) < 2 {
+		return arityError("zrem")
+	}
+
+	key := args[0].bulk
+	removed := 0
+
+	if err := checkZsetType(key); err != nil {
+		return errorReply(err)
+	}
+
+	ZSETsMu.Lock()
+	defer ZSETsMu.Unlock()
+
+	zset, ok := ZSETs[key]
+
+	if !ok {
+		return Value{typ: "integer", num: 0}
+	}
+
+	for _, member := range args[1:] {
+		if zset.Remove(member.bulk) {
+			removed++
+		}
+	}
+
+	if removed > 0 {
+		notifyKeyspaceEvent(notifyZset, "zrem", key)
+	}
+	if zset.Len() == 0 {
+		delete(ZSETs, key)
+		notifyKeyspaceEvent(notifyGeneric, "del", key)
+	}
+
+	return Value{typ: "integer", num: removed}
+}
+
+// ZCARD key
+func zCard(args []Value) Value {
+	if len(args) != 1 {
+		return arityError("zcard")
+	}
+
+	if err := checkZsetType(args[0].bulk); err != nil {
+		return errorReply(err)
+	}
+
+	ZSETsMu.RLock()
+	defer ZSETsMu.RUnlock()
+
+	zset, ok := ZSETs[args[0].bulk]
+
+	if !ok {
+		return Value{typ: "integer", num: 0}
+	}
+
+	return Value{typ: "integer", num: zset.Len()}
+}
+
+// ZSCORE key member
+func zScore(args []Value) Value {
+	if len(args) != 2 {
+		return arityError("zscore")
+	}
+
+	if err := checkZsetType(args[0].bulk); err != nil {
+		return errorReply(err)
+	}
+
+	ZSETsMu.RLock()
+	defer ZSETsMu.RUnlock()
+
+	zset, ok := ZSETs[args[0].bulk]
+
+	if !ok {
+		return Value{typ: "null"}
+	}
+
+	score, ok := zset.Score(args[1].bulk)
+
+	if !ok {
+		return Value{typ: "null"}
+	}
+
+	return Value{typ: "double", double: score}
+}
+
+// Runs a parsed range against a key and replies with its members
+func zrangeReply(key string, spec zrangeSpec) Value {
+	if err := checkZsetType(key); err != nil {
+		return errorReply(err)
+	}
+
+	ZSETsMu.RLock()
+	defer ZSETsMu.RUnlock()
+
+	zset, ok := ZSETs[key]
+
+	if !ok {
+		return Value{typ: "array", array: []Value{}}
+	}
+
+	return zsetReply(zset.selectRange(spec), spec.withScores)
+}
+
+// ZRANGE key start stop [BYSCORE|BYLEX] [REV] [LIMIT offset count] [WITHSCORES]
+func zRange(args []Value) Value {
+	if len(args) < 3 {
+		return arityError("zrange")
+	}
+
+	spec, err := parseZrange(args[1].bulk, args[2].bulk, args[3:], zrangeByRank, false, true, false)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	return zrangeReply(args[0].bulk, spec)
+}
+
+// ZRANGESTORE dst src min max [BYSCORE|BYLEX] [REV] [LIMIT offset count]
+func zRangeStore(args []Value) Value {
+	if len(args) < 4 {
+		return arityError("zrangestore")
+	}
+
+	dst := args[0].bulk
+	spec, err := parseZrange(args[2].bulk, args[3].bulk, args[4:], zrangeByRank, false, true, true)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	if err := checkZsetType(args[1].bulk); err != nil {
+		return errorReply(err)
+	}
+
+	members := map[string]float64{}
+
+	ZSETsMu.RLock()
+	if src, ok := ZSETs[args[1].bulk]; ok {
+		for _, e := range src.selectRange(spec) {
+			members[e.member] = e.score
+		}
+	}
+	ZSETsMu.RUnlock()
+
+	return zsetStoreResult("zrangestore", dst, members)
+}
+
+// ZREVRANGE key start stop [WITHSCORES]
+func zRevRange(args []Value) Value {
+	if len(args) < 3 {
+		return arityError("zrevrange")
+	}
+
+	spec, err := parseZrange(args[1].bulk, args[2].bulk, args[3:], zrangeByRank, true, false, false)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	return zrangeReply(args[0].bulk, spec)
+}
+
+// ZRANGEBYSCORE key min max [WITHSCORES] [LIMIT offset count]
+func zRangeByScore(args []Value) Value {
+	if len(args) < 3 {
+		return arityError("zrangebyscore")
+	}
+
+	spec, err := parseZrange(args[1].bulk, args[2].bulk, args[3:], zrangeByScore, false, false, false)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	return zrangeReply(args[0].bulk, spec)
+}
+
+// ZREVRANGEBYSCORE key max min [WITHSCORES] [LIMIT offset count]
+func zRevRangeByScore(args []Value) Value {
+	if len(args) < 3 {
+		return arityError("zrevrangebyscore")
+	}
+
+	spec, err := parseZrange(args[1].bulk, args[2].bulk, args[3:], zrangeByScore, true, false, false)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	return zrangeReply(args[0].bulk, spec)
+}
+
+// ZRANGEBYLEX key min max [LIMIT offset count]
+func zRangeByLex(args []Value) Value {
+	if len(args) < 3 {
+		return arityError("zrangebylex")
+	}
+
+	spec, err := parseZrange(args[1].bulk, args[2].bulk, args[3:], zrangeByLex, false, false, false)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	return zrangeReply(args[0].bulk, spec)
+}
+
+// ZREVRANGEBYLEX key max min [LIMIT offset count]
+func zRevRangeByLex(args []Value) Value {
+	if len(args) < 3 {
+		return arityError("zrevrangebylex")
+	}
+
+	spec, err := parseZrange(args[1].bulk, args[2].bulk, args[3:], zrangeByLex, true, false, false)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	return zrangeReply(args[0].bulk, spec)
+}
+
+// ZCOUNT key min max
+func zCount(args []Value) Value {
+	if len(args) != 3 {
+		return arityError("zcount")
+	}
+
+	r, err := parseScoreRange(args[1].bulk, args[2].bulk)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	if err := checkZsetType(args[0].bulk); err != nil {
+		return errorReply(err)
+	}
+
+	ZSETsMu.RLock()
+	defer ZSETsMu.RUnlock()
+
+	zset, ok := ZSETs[args[0].bulk]
+
+	if !ok {
+		return Value{typ: "integer", num: 0}
+	}
+
+	return Value{typ: "integer", num: len(zset.rangeByScore(r, false, 0, -1))}
+}
+
+// ZLEXCOUNT key min max
+func zLexCount(args []Value) Value {
+	if len(args) != 3 {
+		return arityError("zlexcount")
+	}
+
+	r, err := parseLexRange(args[1].bulk, args[2].bulk)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	if err := checkZsetType(args[0].bulk); err != nil {
+		return errorReply(err)
+	}
+
+	ZSETsMu.RLock()
+	defer ZSETsMu.RUnlock()
+
+	zset, ok := ZSETs[args[0].bulk]
+
+	if !ok {
+		return Value{typ: "integer", num: 0}
+	}
+
+	return Value{typ: "integer", num: len(zset.rangeByLex(r, false, 0, -1))}
+}
+
+// Removes every entry of a parsed range from a key and replies with the count
+func zremrange(event string, key string, spec zrangeSpec) Value {
+	if err := checkZsetType(key); err != nil {
+		return errorReply(err)
+	}
+
+	ZSETsMu.Lock()
+	defer ZSETsMu.Unlock()
+
+	zset, ok := ZSETs[key]
+
+	if !ok {
+		return Value{typ: "integer", num: 0}
+	}
+
+	entries := zset.selectRange(spec)
+
+	for _, e := range entries {
+		zset.Remove(e.member)
+	}
+
+	if len(entries) > 0 {
+		notifyKeyspaceEvent(notifyZset, event, key)
+	}
+	if zset.Len() == 0 {
+		delete(ZSETs, key)
+		notifyKeyspaceEvent(notifyGeneric, "del", key)
+	}
+
+	return Value{typ: "integer", num: len(entries)}
+}
+
+// ZREMRANGEBYRANK key start stop
+func zRemRangeByRank(args []Value) Value {
+	if len(args) != 3 {
+		return arityError("zremrangebyrank")
+	}
+
+	spec, err := parseZrange(args[1].bulk, args[2].bulk, nil, zrangeByRank, false, false, true)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	return zremrange("zremrangebyrank", args[0].bulk, spec)
+}
+
+// ZREMRANGEBYSCORE key min max
+func zRemRangeByScore(args []Value) Value {
+	if len(args) != 3 {
+		return arityError("zremrangebyscore")
+	}
+
+	spec, err := parseZrange(args[1].bulk, args[2].bulk, nil, zrangeByScore, false, false, true)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	return zremrange("zremrangebyscore", args[0].bulk, spec)
+}
+
+// ZREMRANGEBYLEX key min max
+func zRemRangeByLex(args []Value) Value {
+	if len(args) != 3 {
+		return arityError("zremrangebylex")
+	}
+
+	spec, err := parseZrange(args[1].bulk, args[2].bulk, nil, zrangeByLex, false, false, true)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	return zremrange("zremrangebylex", args[0].bulk, spec)
+}
+
+// Parsed arguments of ZUNION, ZINTER, ZDIFF and their STORE variants
+type zsetOp struct {
+	keys       []string
+	weights    []float64
+	aggregate  int
+	withScores bool
+	limit      int
+}
+
+// Parses numkeys, the input keys and trailing options. weights allows WEIGHTS
+// and AGGREGATE, scores allows WITHSCORES and limit allows LIMIT.
+func parseZsetOp(command string, args []Value, weights, scores, limit bool) (zsetOp, error) {
+	op := zsetOp{}
+
+	if len(args) == 0 {
+		return op, errSyntax
+	}
+
+	numkeys, err := strconv.Atoi(args[0].bulk)
+
+	if err != nil {
+		return op, errNotInteger
+	}
+	if numkeys <= 0 {
+		if limit {
+			return op, newReplyError(codeErr, "numkeys should be greater than 0")
+		}
+		return op, newReplyError(codeErr, "at least 1 input key is needed for '"+command+"' command")
+	}
+	if numkeys > len(args)-1 {
+		return op, errSyntax
+	}
+
+	op.keys = make([]string, numkeys)
+	op.weights = make([]float64, numkeys)
+
+	for i := range op.keys {
+		op.keys[i] = args[i+1].bulk
+		op.weights[i] = 1
+	}
+
+	opts := args[numkeys+1:]
+
+	for i := 0; i < len(opts); i++ {
+		switch strings.ToUpper(opts[i].bulk) {
+		case "WEIGHTS":
+			if !weights || i+numkeys >= len(opts) {
+				return op, errSyntax
+			}
+			for j := 0; j < numkeys; j++ {
+				w, err := parseScore(opts[i+1+j].bulk)
+				if err != nil {
+					return op, newReplyError(codeErr, "weight value is not a float")
+				}
+				op.weights[j] = w
+			}
+			i += numkeys
+		case "AGGREGATE":
+			if !weights || i+1 >= len(opts) {
+				return op, errSyntax
+			}
+			switch strings.ToUpper(opts[i+1].bulk) {
+			case "SUM":
+				op.aggregate = zaggSum
+			case "MIN":
+				op.aggregate = zaggMin
+			case "MAX":
+				op.aggregate = zaggMax
+			default:
+				return op, errSyntax
+			}
+			i++
+		case "WITHSCORES":
+			if !scores {
+				return op, errSyntax
+			}
+			op.withScores = true
+		case "LIMIT":
+			if !limit || i+1 >= len(opts) {
+				return op, errSyntax
+			}
+			n, err := strconv.Atoi(opts[i+1].bulk)
+			if err != nil {
+				return op, errNotInteger
+			}
+			if n < 0 {
+				return op, newReplyError(codeErr, "LIMIT can't be negative")
+			}
+			op.limit = n
+			i++
+		default:
+			return op, errSyntax
+		}
+	}
+
+	return op, nil
+}
+
+// Reads the members and scores of each input key, members of plain sets
+// get a score of 1 and missing keys are empty
+func zsetLoadInputs(keys []string) ([]map[string]float64, error) {
+	for _, key := range keys {
+		switch keyType(key) {
+		case "zset", "set", "none":
+		default:
+			return nil, errWrongType
+		}
+	}
+
+	inputs := make([]map[string]float64, len(keys))
+
+	ZSETsMu.RLock()
+	SSETsMu.RLock()
+	defer SSETsMu.RUnlock()
+	defer ZSETsMu.RUnlock()
+
+	for i, key := range keys {
+		inputs[i] = map[string]float64{}
+
+		if zset, ok := ZSETs[key]; ok {
+			for _, e := range zset.entries() {
+				inputs[i][e.member] = e.score
+			}
+		} else if set, ok := SSETs[key]; ok {
+			for _, member := range set.Members() {
+				inputs[i][member] = 1
+			}
+		}
+	}
+
+	return inputs, nil
+}
+
+// Multiplies a score by its weight, where 0 * inf counts as 0
+func zsetWeighted(score, weight float64) float64 {
+	result := score * weight
+
+	if math.IsNaN(result) {
+		return 0
+	}
+
+	return result
+}
+
+// Combines two scores, where inf + -inf counts as 0
+func zsetAggregate(aggregate int, a, b float64) float64 {
+	switch aggregate {
+	case zaggMin:
+		return math.Min(a, b)
+	case zaggMax:
+		return math.Max(a, b)
+	}
+
+	sum := a + b
+
+	if math.IsNaN(sum) {
+		return 0
+	}
+
+	return sum
+}
+
+// Members found in any input
+func zsetUnion(inputs []map[string]float64, op zsetOp) map[string]float64 {
+	result := map[string]float64{}
+
+	for i, input := range inputs {
+		for member, score := range input {
+			score = zsetWeighted(score, op.weights[i])
+
+			if cur, ok := result[member]; ok {
+				result[member] = zsetAggregate(op.aggregate, cur, score)
+			} else {
+				result[member] = score
+			}
+		}
+	}
+
+	return result
+}
+
+// Members found in every input, stops after limit members when limit is positive
+func zsetInter(inputs []map[string]float64, op zsetOp) map[string]float64 {
+	result := map[string]float64{}
+
+	for member, score := range inputs[0] {
+		score = zsetWeighted(score, op.weights[0])
+		found := true
+
+		for i := 1; i < len(inputs); i++ {
+			other, ok := inputs[i][member]
+
+			if !ok {
+				found = false
+				break
+			}
+
+			score = zsetAggregate(op.aggregate, score, zsetWeighted(other, op.weights[i]))
+		}
+
+		if found {
+			result[member] = score
+
+			if op.limit > 0 && len(result) >= op.limit {
+				break
+			}
+		}
+	}
+
+	return result
+}
+
+// Members of the first input missing from every other input
+func zsetDiff(inputs []map[string]float64) map[string]float64 {
+	result := map[string]float64{}
+
+	for member, score := range inputs[0] {
+		found := false
+
+		for i := 1; i < len(inputs) && !found; i++ {
+			_, found = inputs[i][member]
+		}
+
+		if !found {
+			result[member] = score
+		}
+	}
+
+	return result
+}
+
+// Builds a sorted set out of a member to score map, sorting the members once
+func zsetFromMap(members map[string]float64) *ZSet {
+	entries := make([]zsetEntry, 0, len(members))
+
+	for member, score := range members {
+		entries = append(entries, zsetEntry{member: member, score: score})
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return zsetLess(entries[i], entries[j]) })
+
+	zset := NewZSet()
+	zset.lpStore(entries)
+
+	return zset
+}
+
+// Stores the result of a set operation at dst replacing any previous value,
+// event names the keyspace event sent for it. A sorted set at dst is swapped
+// under one lock so readers never see dst missing in between
+func zsetStoreResult(event string, dst string, members map[string]float64) Value {
+	var zset *ZSet
+
+	if len(members) > 0 {
+		zset = zsetFromMap(members)
+	}
+
+	keyspaceMu.Lock()
+	defer keyspaceMu.Unlock()
+
+	existed := false
+
+	if keyType(dst) != "zset" {
+		existed = deleteKey(dst)
+	}
+
+	ZSETsMu.Lock()
+	if _, ok := ZSETs[dst]; ok {
+		existed = true
+	}
+	if zset == nil {
+		delete(ZSETs, dst)
+	} else {
+		ZSETs[dst] = zset
+		notifyKeyspaceEvent(notifyZset, event, dst)
+	}
+	ZSETsMu.Unlock()
+
+	if zset == nil {
+		if existed {
+			notifyKeyspaceEvent(notifyGeneric, "del", dst)
+		}
+		return Value{typ: "integer", num: 0}
+	}
+
+	signalKey(dst)
+
+	return Value{typ: "integer", num: len(members)}
+}
+
+// Shared body of ZUNION, ZINTER and ZDIFF
+func zsetOpReply(command string, args []Value, weights bool, combine func([]map[string]float64, zsetOp) map[string]float64) Value {
+	op, err := parseZsetOp(command, args, weights, true, false)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	inputs, err := zsetLoadInputs(op.keys)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	return zsetReply(zsetFromMap(combine(inputs, op)).entries(), op.withScores)
+}
+
+// Shared body of ZUNIONSTORE, ZINTERSTORE and ZDIFFSTORE
+func zsetOpStore(command string, args []Value, weights bool, combine func([]map[string]float64, zsetOp) map[string]float64) Value {
+	op, err := parseZsetOp(command, args[1:], weights, false, false)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	inputs, err := zsetLoadInputs(op.keys)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	return zsetStoreResult(command, args[0].bulk, combine(inputs, op))
+}
+
+// Adapts zsetDiff to the shape shared with union and intersection
+func zsetDiffOp(inputs []map[string]float64, op zsetOp) map[string]float64 {
+	return zsetDiff(inputs)
+}
+
+// ZUNION numkeys key [key ...] [WEIGHTS weight ...] [AGGREGATE SUM|MIN|MAX] [WITHSCORES]
+func zUnion(args []Value) Value {
+	if len(args) < 2 {
+		return arityError("zunion")
+	}
+
+	return zsetOpReply("zunion", args, true, zsetUnion)
+}
+
+// ZINTER numkeys key [key ...] [WEIGHTS weight ...] [AGGREGATE SUM|MIN|MAX] [WITHSCORES]
+func zInter(args []Value) Value {
+	if len(args) < 2 {
+		return arityError("zinter")
+	}
+
+	return zsetOpReply("zinter", args, true, zsetInter)
+}
+
+// ZDIFF numkeys key [key ...] [WITHSCORES]
+func zDiff(args []Value) Value {
+	if len(args) < 2 {
+		return arityError("zdiff")
+	}
+
+	return zsetOpReply("zdiff", args, false, zsetDiffOp)
+}
+
+// ZUNIONSTORE dst numkeys key [key ...] [WEIGHTS weight ...] [AGGREGATE SUM|MIN|MAX]
+func zUnionStore(args []Value) Value {
+	if len(args) < 3 {
+		return arityError("zunionstore")
+	}
+
+	return zsetOpStore("zunionstore", args, true, zsetUnion)
+}
+
+// ZINTERSTORE dst numkeys key [key ...] [WEIGHTS weight ...] [AGGREGATE SUM|MIN|MAX]
+func zInterStore(args []Value) Value {
+	if len(args) < 3 {
+		return arityError("zinterstore")
+	}
+
+	return zsetOpStore("zinterstore", args, true, zsetInter)
+}
+
+// ZDIFFSTORE dst numkeys key [key ...]
+func zDiffStore(args []Value) Value {
+	if len(args) < 3 {
+		return arityError("zdiffstore")
+	}
+
+	return zsetOpStore("zdiffstore", args, false, zsetDiffOp)
+}
+
+// ZINTERCARD numkeys key [key ...] [LIMIT limit]
+func zInterCard(args []Value) Value {
+	if len(args) < 2 {
+		return arityError("zintercard")
+	}
+
+	op, err := parseZsetOp("zintercard", args, false, false, true)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	inputs, err := zsetLoadInputs(op.keys)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	return Value{typ: "integer", num: len(zsetInter(inputs, op))}
+}
+
+// Removes and returns up to count of the lowest or highest scored entries
+func (z *ZSet) pop(count int, max bool) []zsetEntry {
+	start := 0
+
+	if max {
+		start = z.Len() - 1
+	}
+
+	entries := z.rangeFrom(start, max, func(zsetEntry) bool { return true }, 0, count)
+
+	for _, e := range entries {
+		z.Remove(e.member)
+	}
+
+	return entries
+}
+
+// Pops from the first non empty key, returning the key and its popped entries
+func zsetPopFirst(keys []string, count int, max bool) (string, []zsetEntry, error) {
+	for _, key := range keys {
+		if err := checkZsetType(key); err != nil {
+			return "", nil, err
+		}
+	}
+
+	ZSETsMu.Lock()
+	defer ZSETsMu.Unlock()
+
+	for _, key := range keys {
+		zset, ok := ZSETs[key]
+
+		if !ok {
+			continue
+		}
+
+		entries := zset.pop(count, max)
+
+		if len(entries) > 0 {
+			if max {
+				notifyKeyspaceEvent(notifyZset, "zpopmax", key)
+			} else {
+				notifyKeyspaceEvent(notifyZset, "zpopmin", key)
+			}
+		}
+		if zset.Len() == 0 {
+			delete(ZSETs, key)
+			notifyKeyspaceEvent(notifyGeneric, "del", key)
+		}
+
+		return key, entries, nil
+	}
+
+	return "", nil, nil
+}
+
+// Logs a served blocking pop as the equivalent ZPOPMIN or ZPOPMAX
+func zsetPropagatePop(key string, count int, max bool) {
+	command := "ZPOPMIN"
+
+	if max {
+		command = "ZPOPMAX"
+	}
+
+	propagate(commandValue(command, key, strconv.Itoa(count)))
+}
+
+// Builds the [[member, score], ...] reply of ZMPOP
+func zsetPairsReply(entries []zsetEntry) Value {
+	pairs := make([]Value, len(entries))
+
+	for i, e := range entries {
+		pairs[i] = Value{typ: "array", array: zsetEntryReply(e)}
+	}
+
+	return Value{typ: "array", array: pairs}
+}
+
+// Shared body of ZPOPMIN and ZPOPMAX
+func zpop(command string, args []Value, max bool) Value {
+	if len(args) != 1 && len(args) != 2 {
+		return arityError(command)
+	}
+
+	count := 1
+
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1].bulk)
+		if err != nil {
+			return errorReply(errNotInteger)
+		}
+		if n < 0 {
+			return errorValue(codeErr, "value is out of range, must be positive")
+		}
+		count = n
+	}
+
+	_, entries, err := zsetPopFirst([]string{args[0].bulk}, count, max)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	// Only a count makes RESP3 clients get pairs
+	if len(args) == 1 {
+		reply := []Value{}
+
+		for _, e := range entries {
+			reply = append(reply, zsetEntryReply(e)...)
+		}
+
+		return Value{typ: "array", array: reply}
+	}
+
+	return zsetReply(entries, true)
+}
+
+// ZPOPMIN key [count]
+func zPopMin(args []Value) Value {
+	return zpop("zpopmin", args, false)
+}
+
+// ZPOPMAX key [count]
+func zPopMax(args []Value) Value {
+	return zpop("zpopmax", args, true)
+}
+
+// Shared body of BZPOPMIN and BZPOPMAX, replies with key, member and score
+func bzpop(c *Client, command string, args []Value, max bool) Value {
+	if len(args) < 2 {
+		return arityError(command)
+	}
+
+	timeout, err := parseTimeout(args[len(args)-1].bulk)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	keys := make([]string, len(args)-1)
+
+	for i := range keys {
+		keys[i] = args[i].bulk
+	}
+
+	var key string
+	var entries []zsetEntry
+
+	served := blockUntil(c, keys, timeout, func() bool {
+		key, entries, err = zsetPopFirst(keys, 1, max)
+		return err != nil || len(entries) > 0
+	})
+
+	if err != nil {
+		return errorReply(err)
+	}
+	if !served {
+		return Value{typ: "nullarray"}
+	}
+
+	zsetPropagatePop(key, 1, max)
+
+	return Value{typ: "array", array: append([]Value{{typ: "bulk", bulk: key}}, zsetEntryReply(entries[0])...)}
+}
+
+// BZPOPMIN key [key ...] timeout
+func bzPopMin(args []Value) Value {
+	return bzpop(nil, "bzpopmin", args, false)
+}
+
+// BZPOPMIN served to a client that may wait
+func bzPopMinBlocking(c *Client, args []Value) Value {
+	return bzpop(c, "bzpopmin", args, false)
+}
+
+// BZPOPMAX key [key ...] timeout
+func bzPopMax(args []Value) Value {
+	return bzpop(nil, "bzpopmax", args, true)
+}
+
+// BZPOPMAX served to a client that may wait
+func bzPopMaxBlocking(c *Client, args []Value) Value {
+	return bzpop(c, "bzpopmax", args, true)
+}
+
+// Parses numkeys key [key ...] MIN|MAX [COUNT count] of ZMPOP and BZMPOP
+func parseZmpop(args []Value) (keys []string, max bool, count int, err error) {
+	numkeys, err := strconv.Atoi(args[0].bulk)
+
+	if err != nil {
+		return nil, false, 0, errNotInteger
+	}
+	if numkeys <= 0 {
+		return nil, false, 0, newReplyError(codeErr, "numkeys should be greater than 0")
+	}
+	if numkeys >= len(args)-1 {
+		return nil, false, 0, errSyntax
+	}
+
+	keys = make([]string, numkeys)
+
+	for i := range keys {
+		keys[i] = args[i+1].bulk
+	}
+
+	switch strings.ToUpper(args[numkeys+1].bulk) {
+	case "MIN":
+	case "MAX":
+		max = true
+	default:
+		return nil, false, 0, errSyntax
+	}
+
+	count = 1
+	opts := args[numkeys+2:]
+
+	switch {
+	case len(opts) == 0:
+	case len(opts) == 2 && strings.ToUpper(opts[0].bulk) == "COUNT":
+		count, err = strconv.Atoi(opts[1].bulk)
+		if err != nil || count <= 0 {
+			return nil, false, 0, newReplyError(codeErr, "count should be greater than 0")
+		}
+	default:
+		return nil, false, 0, errSyntax
+	}
+
+	return keys, max, count, nil
+}
+
+// ZMPOP numkeys key [key ...] MIN|MAX [COUNT count]
+func zmPop(args []Value) Value {
+	if len(args) < 3 {
+		return arityError("zmpop")
+	}
+
+	keys, max, count, err := parseZmpop(args)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	key, entries, err := zsetPopFirst(keys, count, max)
+
+	if err != nil {
+		return errorReply(err)
+	}
+	if len(entries) == 0 {
+		return Value{typ: "nullarray"}
+	}
+
+	return Value{typ: "array", array: []Value{{typ: "bulk", bulk: key}, zsetPairsReply(entries)}}
+}
+
+// BZMPOP timeout numkeys key [key ...] MIN|MAX [COUNT count]
+func bzmPop(args []Value) Value {
+	return bzmPopBlocking(nil, args)
+}
+
+// BZMPOP served to a client that may wait
+func bzmPopBlocking(c *Client, args []Value) Value {
+	if len(args) < 4 {
+		return arityError("bzmpop")
+	}
+
+	timeout, err := parseTimeout(args[0].bulk)
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	keys, max, count, err := parseZmpop(args[1:])
+
+	if err != nil {
+		return errorReply(err)
+	}
+
+	var key string
+	var entries []zsetEntry
+
+	served := blockUntil(c, keys, timeout, func() bool {
+		key, entries, err = zsetPopFirst(keys, count, max)
+		return err != nil || len(entries) > 0
+	})
+
+	if err != nil {
+		return errorReply(err)
+	}
+	if !served {
+		return Value{typ: "nullarray"}
+	}
+
+	zsetPropagatePop(key, len(entries), max)
+
+	return Value{typ: "array", array: []Value{{typ: "bulk", bulk: key}, zsetPairsReply(entries)}}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestZsetWrongType(t *testing.T) {
+	c := dialTestServer(t)
+	wrongType := "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+
+	c.expect("+OK\r\n", "SET", "zwrong:str", "v")
+
+	for _, command := range [][]string{
+		{"ZADD", "zwrong:str", "1", "a"},
+		{"ZREM", "zwrong:str", "a"},
+		{"ZCARD", "zwrong:str"},
+		{"ZSCORE", "zwrong:str", "a"},
+		{"ZRANGE", "zwrong:str", "0", "-1"},
+		{"ZRANGEBYSCORE", "zwrong:str", "-inf", "+inf"},
+		{"ZREVRANGEBYLEX", "zwrong:str", "+", "-"},
+		{"ZCOUNT", "zwrong:str", "-inf", "+inf"},
+		{"ZLEXCOUNT", "zwrong:str", "-", "+"},
+		{"ZREMRANGEBYRANK", "zwrong:str", "0", "-1"},
+		{"ZRANGESTORE", "zwrong:dst", "zwrong:str", "0", "-1"},
+		{"ZPOPMIN", "zwrong:str"},
+	} {
+		c.expect(wrongType, command...)
+	}
+
+	c.expect(":1\r\n", "EXISTS", "zwrong:str")
+	c.expect("$1\r\nv\r\n", "GET", "zwrong:str")
+	c.expect("+string\r\n", "TYPE", "zwrong:str")
+}
+
+func TestZrangeStoreReplacesDestination(t *testing.T) {
+	c := dialTestServer(t)
+
+	c.expect(":2\r\n", "ZADD", "zstore:src", "1", "a", "2", "b")
+	c.expect("+OK\r\n", "SET", "zstore:dst", "v")
+	c.expect(":2\r\n", "ZRANGESTORE", "zstore:dst", "zstore:src", "0", "-1")
+	c.expect("+zset\r\n", "TYPE", "zstore:dst")
+	c.expect("*2\r\n$1\r\na\r\n$1\r\nb\r\n", "ZRANGE", "zstore:dst", "0", "-1")
+
+	c.expect(":0\r\n", "ZRANGESTORE", "zstore:dst", "zstore:src", "5", "10")
+	c.expect(":0\r\n", "EXISTS", "zstore:dst")
+}
+
+func TestZsetStoreNeverHidesDestination(t *testing.T) {
+	resetDataset()
+
+	runCommand("ZADD", "zswap:src", "1", "a", "2", "b")
+	runCommand("ZADD", "zswap:dst", "1", "a")
+
+	stop := make(chan struct{})
+	missed := make(chan int)
+
+	go func() {
+		n := 0
+		for {
+			select {
+			case <-stop:
+				missed <- n
+				return
+			default:
+			}
+			if runCommand("EXISTS", "zswap:dst").num != 1 {
+				n++
+			}
+		}
+	}()
+
+	for i := 0; i < 5000; i++ {
+		runCommand("ZUNIONSTORE", "zswap:dst", "1", "zswap:src")
+		runCommand("GEOSEARCHSTORE", "zswap:dst", "zswap:src", "FROMMEMBER", "a", "BYRADIUS", "100", "km")
+		runCommand("ZRANGESTORE", "zswap:dst", "zswap:src", "0", "-1")
+	}
+
+	close(stop)
+
+	if n := <-missed; n != 0 {
+		t.Fatalf("zswap:dst was missing %d times while it was replaced", n)
+	}
+}
+
+// Applies a range query to a sorted reference slice
+func zsetModelRange(ref []zsetEntry, rev bool, inRange func(zsetEntry) bool, offset, count int) []zsetEntry {
+	got := []zsetEntry{}
+
+	for i := range ref {
+		e := ref[i]
+		if rev {
+			e = ref[len(ref)-1-i]
+		}
+		if !inRange(e) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		if count == 0 {
+			break
+		}
+		got = append(got, e)
+		count--
+	}
+
+	return got
+}
+
+func TestZsetMatchesModel(t *testing.T) {
+	t.Cleanup(func() { runCommand("CONFIG", "SET", "zset-max-listpack-entries", "128") })
+
+	for _, maxEntries := range []string{"128", "0"} {
+		runCommand("CONFIG", "SET", "zset-max-listpack-entries", maxEntries)
+
+		rng := rand.New(rand.NewSource(1))
+		z := NewZSet()
+		model := map[string]float64{}
+
+		for step := 0; step < 2000; step++ {
+			member := fmt.Sprintf("m%03d", rng.Intn(150))
+
+			if rng.Intn(3) == 0 {
+				if z.Remove(member) != (model[member] != 0) {
+					t.Fatalf("Remove(%s) disagrees with the model", member)
+				}
+				delete(model, member)
+			} else {
+				// Few distinct scores so members often break ties
+				score := float64(rng.Intn(10) + 1)
+				_, existed := model[member]
+				if z.Add(member, score) == existed {
+					t.Fatalf("Add(%s) disagrees with the model", member)
+				}
+				model[member] = score
+			}
+
+			if step%50 != 0 {
+				continue
+			}
+
+			ref := make([]zsetEntry, 0, len(model))
+			for m, score := range model {
+				ref = append(ref, zsetEntry{member: m, score: score})
+			}
+			sort.Slice(ref, func(i, j int) bool { return zsetLess(ref[i], ref[j]) })
+
+			wantEncoding := "listpack"
+			if maxEntries == "0" && len(ref) > 0 {
+				wantEncoding = "skiplist"
+			}
+			if z.Len() != len(ref) || z.Encoding() != wantEncoding {
+				t.Fatalf("%s set with %d members, want %s with %d", z.Encoding(), z.Len(), wantEncoding, len(ref))
+			}
+			if fmt.Sprint(z.entries()) != fmt.Sprint(ref) {
+				t.Fatalf("entries differ from the model at step %d", step)
+			}
+
+			for q := 0; q < 20; q++ {
+				start, stop := rng.Intn(len(ref)+4)-2, rng.Intn(len(ref)+4)-2
+				rev := rng.Intn(2) == 0
+
+				from, to := start, stop
+				if from < 0 {
+					from = max(from+len(ref), 0)
+				}
+				if to < 0 {
+					to += len(ref)
+				}
+				want := []zsetEntry{}
+				for i := from; i <= to && i < len(ref); i++ {
+					if rev {
+						want = append(want, ref[len(ref)-1-i])
+					} else {
+						want = append(want, ref[i])
+					}
+				}
+				if got := z.rangeByRank(start, stop, rev); fmt.Sprint(got) != fmt.Sprint(want) {
+					t.Fatalf("rangeByRank(%d, %d, %v) = %v, want %v", start, stop, rev, got, want)
+				}
+
+				r := zscoreRange{min: float64(rng.Intn(12)), max: float64(rng.Intn(12)), minex: rng.Intn(2) == 0, maxex: rng.Intn(2) == 0}
+				offset, count := rng.Intn(5), rng.Intn(20)-1
+				inScore := func(e zsetEntry) bool { return r.gteMin(e.score) && r.lteMax(e.score) }
+				if got, want := z.rangeByScore(r, rev, offset, count), zsetModelRange(ref, rev, inScore, offset, count); fmt.Sprint(got) != fmt.Sprint(want) {
+					t.Fatalf("rangeByScore(%+v, %v, %d, %d) = %v, want %v", r, rev, offset, count, got, want)
+				}
+			}
+		}
+
+		for z.Len() > 0 {
+			n := z.Len()
+			first, last := z.rangeByRank(0, 0, false)[0], z.rangeByRank(0, 0, true)[0]
+
+			if got := z.pop(2, true); len(got) != min(2, n) || got[0] != last {
+				t.Fatalf("pop(2, true) = %v, want %v first", got, last)
+			}
+			if z.Len() > 0 && z.pop(1, false)[0] != first {
+				t.Fatalf("pop(1, false) did not return %v", first)
+			}
+		}
+	}
+}
+
+func TestZsetLexRanges(t *testing.T) {
+	c := dialTestServer(t)
+	t.Cleanup(func() { runCommand("CONFIG", "SET", "zset-max-listpack-entries", "128") })
+
+	for _, maxEntries := range []string{"128", "0"} {
+		key := "zlex:" + maxEntries
+		c.expect("+OK\r\n", "CONFIG", "SET", "zset-max-listpack-entries", maxEntries)
+		c.expect(":7\r\n", "ZADD", key, "0", "a", "0", "b", "0", "c", "0", "d", "0", "e", "0", "f", "0", "g")
+
+		c.expect("*3\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n", "ZRANGEBYLEX", key, "-", "[c")
+		c.expect("*2\r\n$1\r\na\r\n$1\r\nb\r\n", "ZRANGEBYLEX", key, "-", "(c")
+		c.expect("*3\r\n$1\r\nf\r\n$1\r\ne\r\n$1\r\nd\r\n", "ZREVRANGEBYLEX", key, "(g", "[aaa", "LIMIT", "0", "3")
+		c.expect("*2\r\n$1\r\nd\r\n$1\r\ne\r\n", "ZRANGE", key, "[c", "+", "BYLEX", "LIMIT", "1", "2")
+		c.expect("*2\r\n$1\r\ne\r\n$1\r\nd\r\n", "ZRANGE", key, "+", "[c", "BYLEX", "REV", "LIMIT", "2", "2")
+		c.expect(":4\r\n", "ZLEXCOUNT", key, "[b", "(f")
+		c.expect("*0\r\n", "ZRANGEBYLEX", key, "+", "-")
+	}
+}
+
+func TestZsetStoreBuildsLargeResult(t *testing.T) {
+	c := dialTestServer(t)
+
+	first := []string{"ZADD", "zbig:a"}
+	second := []string{"ZADD", "zbig:b"}
+
+	for i := 0; i < 300; i++ {
+		first = append(first, fmt.Sprint(i), fmt.Sprintf("m%03d", i))
+		second = append(second, "1", fmt.Sprintf("m%03d", i))
+	}
+
+	c.do(first...)
+	c.do(second...)
+
+	c.expect(":300\r\n", "ZUNIONSTORE", "zbig:dst", "2", "zbig:a", "zbig:b", "WEIGHTS", "-1", "1")
+	c.expect("$8\r\nskiplist\r\n", "OBJECT", "ENCODING", "zbig:dst")
+	c.expect("*4\r\n$4\r\nm299\r\n$4\r\n-298\r\n$4\r\nm298\r\n$4\r\n-297\r\n", "ZRANGE", "zbig:dst", "0", "1", "WITHSCORES")
+	c.expect("*2\r\n$4\r\nm000\r\n$4\r\nm001\r\n", "ZRANGE", "zbig:dst", "0", "1", "REV")
+	c.expect(":11\r\n", "ZCOUNT", "zbig:dst", "-10", "0")
+}
+
+func TestZrangeUnified(t *testing.T) {
+	c := dialTestServer(t)
+
+	c.expect(":5\r\n", "ZADD", "zr:k", "1", "one", "2", "two", "3", "three", "4", "four", "5", "five")
+
+	c.expect("*3\r\n$3\r\none\r\n$3\r\ntwo\r\n$5\r\nthree\r\n", "ZRANGE", "zr:k", "0", "2")
+	c.expect("*2\r\n$4\r\nfour\r\n$4\r\nfive\r\n", "ZRANGE", "zr:k", "-2", "-1")
+	c.expect("*2\r\n$4\r\nfive\r\n$4\r\nfour\r\n", "ZRANGE", "zr:k", "0", "1", "REV")
+	c.expect("*4\r\n$3\r\none\r\n$1\r\n1\r\n$3\r\ntwo\r\n$1\r\n2\r\n", "ZRANGE", "zr:k", "0", "1", "WITHSCORES")
+	c.expect("*0\r\n", "ZRANGE", "zr:k", "3", "1")
+	c.expect("*0\r\n", "ZRANGE", "zr:missing", "0", "-1")
+
+	c.expect("*3\r\n$3\r\ntwo\r\n$5\r\nthree\r\n$4\r\nfour\r\n", "ZRANGE", "zr:k", "(1", "4", "BYSCORE")
+	c.expect("*2\r\n$5\r\nthree\r\n$4\r\nfour\r\n", "ZRANGE", "zr:k", "-inf", "+inf", "BYSCORE", "LIMIT", "2", "2")
+	c.expect("*2\r\n$4\r\nfour\r\n$5\r\nthree\r\n", "ZRANGE", "zr:k", "(5", "0", "BYSCORE", "REV", "LIMIT", "0", "2")
+	c.expect("*1\r\n$4\r\nfive\r\n", "ZRANGEBYSCORE", "zr:k", "(4", "+inf")
+	c.expect("*2\r\n$4\r\nfive\r\n$1\r\n5\r\n", "ZREVRANGEBYSCORE", "zr:k", "+inf", "(4", "WITHSCORES")
+	c.expect("*0\r\n", "ZRANGE", "zr:k", "(1", "(2", "BYSCORE")
+
+	c.expect("-ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX\r\n", "ZRANGE", "zr:k", "0", "1", "LIMIT", "0", "1")
+	c.expect("-ERR syntax error, WITHSCORES not supported in combination with BYLEX\r\n", "ZRANGE", "zr:k", "-", "+", "BYLEX", "WITHSCORES")
+	c.expect("-ERR min or max is not a float\r\n", "ZRANGE", "zr:k", "x", "1", "BYSCORE")
+	c.expect("-ERR min or max not valid string range item\r\n", "ZRANGE", "zr:k", "a", "b", "BYLEX")
+
+	c.expect(":2\r\n", "ZRANGESTORE", "zr:dst", "zr:k", "4", "+inf", "BYSCORE")
+	c.expect("*4\r\n$4\r\nfour\r\n$1\r\n4\r\n$4\r\nfive\r\n$1\r\n5\r\n", "ZRANGE", "zr:dst", "0", "-1", "WITHSCORES")
+	c.expect(":2\r\n", "ZRANGESTORE", "zr:dst", "zr:k", "0", "1", "REV")
+	c.expect("*2\r\n$4\r\nfour\r\n$4\r\nfive\r\n", "ZRANGE", "zr:dst", "0", "-1")
+}
+
+func TestZsetSetOperations(t *testing.T) {
+	c := dialTestServer(t)
+
+	c.expect(":2\r\n", "ZADD", "zop:a", "1", "one", "2", "two")
+	c.expect(":3\r\n", "ZADD", "zop:b", "1", "one", "2", "two", "3", "three")
+	c.expect(":2\r\n", "SADD", "zop:set", "two", "four")
+
+	c.expect(":3\r\n", "ZUNIONSTORE", "zop:out", "2", "zop:a", "zop:b", "WEIGHTS", "2", "3")
+	c.expect("*6\r\n$3\r\none\r\n$1\r\n5\r\n$5\r\nthree\r\n$1\r\n9\r\n$3\r\ntwo\r\n$2\r\n10\r\n", "ZRANGE", "zop:out", "0", "-1", "WITHSCORES")
+
+	c.expect(":2\r\n", "ZINTERSTORE", "zop:out", "2", "zop:a", "zop:b", "AGGREGATE", "MAX")
+	c.expect("*4\r\n$3\r\none\r\n$1\r\n1\r\n$3\r\ntwo\r\n$1\r\n2\r\n", "ZRANGE", "zop:out", "0", "-1", "WITHSCORES")
+	c.expect(":2\r\n", "ZINTERSTORE", "zop:out", "2", "zop:a", "zop:b", "WEIGHTS", "1", "-1", "AGGREGATE", "MIN")
+	c.expect("*4\r\n$3\r\ntwo\r\n$2\r\n-2\r\n$3\r\none\r\n$2\r\n-1\r\n", "ZRANGE", "zop:out", "0", "-1", "WITHSCORES")
+
+	// Plain sets count as sorted sets with every score at 1
+	c.expect("*2\r\n$3\r\ntwo\r\n$1\r\n3\r\n", "ZINTER", "2", "zop:b", "zop:set", "AGGREGATE", "SUM", "WITHSCORES")
+	c.expect("*2\r\n$3\r\none\r\n$5\r\nthree\r\n", "ZDIFF", "2", "zop:b", "zop:set")
+	c.expect(":1\r\n", "ZDIFFSTORE", "zop:out", "2", "zop:b", "zop:a")
+	c.expect("*2\r\n$5\r\nthree\r\n$1\r\n3\r\n", "ZRANGE", "zop:out", "0", "-1", "WITHSCORES")
+	c.expect("*3\r\n$4\r\nfour\r\n$3\r\none\r\n$3\r\ntwo\r\n", "ZUNION", "2", "zop:a", "zop:set")
+	c.expect(":1\r\n", "ZINTERCARD", "2", "zop:a", "zop:set")
+	c.expect(":1\r\n", "ZINTERCARD", "2", "zop:a", "zop:b", "LIMIT", "1")
+
+	// An empty result deletes the destination
+	c.expect(":0\r\n", "ZINTERSTORE", "zop:out", "2", "zop:a", "zop:missing")
+	c.expect(":0\r\n", "EXISTS", "zop:out")
+
+	c.expect("-ERR syntax error\r\n", "ZUNIONSTORE", "zop:out", "2", "zop:a", "zop:b", "WEIGHTS", "1")
+	c.expect("-ERR weight value is not a float\r\n", "ZUNIONSTORE", "zop:out", "2", "zop:a", "zop:b", "WEIGHTS", "1", "x")
+	c.expect("-ERR at least 1 input key is needed for 'zunionstore' command\r\n", "ZUNIONSTORE", "zop:out", "0", "zop:a")
+}
+
+func TestZsetPops(t *testing.T) {
+	c := dialTestServer(t)
+
+	c.expect(":4\r\n", "ZADD", "zpop:k", "1", "a", "2", "b", "3", "c", "4", "d")
+	c.expect("*2\r\n$1\r\na\r\n$1\r\n1\r\n", "ZPOPMIN", "zpop:k")
+	c.expect("*4\r\n$1\r\nd\r\n$1\r\n4\r\n$1\r\nc\r\n$1\r\n3\r\n", "ZPOPMAX", "zpop:k", "2")
+	c.expect("*0\r\n", "ZPOPMIN", "zpop:missing")
+
+	c.expect("*-1\r\n", "ZMPOP", "1", "zpop:missing", "MIN")
+	c.expect("*2\r\n$6\r\nzpop:k\r\n*1\r\n*2\r\n$1\r\nb\r\n$1\r\n2\r\n", "ZMPOP", "2", "zpop:missing", "zpop:k", "MIN", "COUNT", "5")
+	c.expect(":0\r\n", "EXISTS", "zpop:k")
+
+	c.expect("-ERR numkeys should be greater than 0\r\n", "ZMPOP", "0", "zpop:k", "MIN")
+	c.expect("-ERR count should be greater than 0\r\n", "ZMPOP", "1", "zpop:k", "MAX", "COUNT", "0")
+}
+
+func TestBlockingZsetPops(t *testing.T) {
+	addr := startTestServer(t)
+	c := dialTest(t, addr)
+	other := dialTest(t, addr)
+
+	// Data already there is returned without blocking
+	other.expect(":1\r\n", "ZADD", "bzpop:ready", "1", "a")
+	c.expect("*3\r\n$11\r\nbzpop:ready\r\n$1\r\na\r\n$1\r\n1\r\n", "BZPOPMIN", "bzpop:missing", "bzpop:ready", "0")
+
+	c.expect("*-1\r\n", "BZPOPMAX", "bzpop:missing", "0.05")
+	c.expect("*-1\r\n", "BZMPOP", "0.05", "1", "bzpop:missing", "MIN")
+
+	// A waiting client is served by the first ZADD to any of its keys
+	if _, err := c.conn.Write(commandValue("BZPOPMIN", "bzpop:one", "bzpop:two", "0").Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	waitBlocked(t, "bzpop:two", 1)
+	other.expect(":2\r\n", "ZADD", "bzpop:two", "5", "x", "3", "y")
+	c.receive("*3\r\n$9\r\nbzpop:two\r\n$1\r\ny\r\n$1\r\n3\r\n")
+	waitBlocked(t, "bzpop:one", 0)
+
+	if _, err := c.conn.Write(commandValue("BZMPOP", "0", "1", "bzpop:two", "MAX", "COUNT", "2").Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	c.receive("*2\r\n$9\r\nbzpop:two\r\n*1\r\n*2\r\n$1\r\nx\r\n$1\r\n5\r\n")
+
+	c.expect("-ERR timeout is negative\r\n", "BZPOPMIN", "bzpop:one", "-1")
+}
+
+func TestZsetResp3Replies(t *testing.T) {
+	c := dialTestServer(t)
+	c.do("HELLO", "3")
+
+	c.do("ZADD", "zresp3:k", "1", "a", "2", "b", "3", "c", "4", "d", "5", "e")
+	c.expect("*2\r\n*2\r\n$1\r\na\r\n,1\r\n*2\r\n$1\r\nb\r\n,2\r\n", "ZRANGE", "zresp3:k", "0", "1", "WITHSCORES")
+	c.expect("*1\r\n*2\r\n$1\r\ne\r\n,5\r\n", "ZRANGEBYSCORE", "zresp3:k", "5", "5", "WITHSCORES")
+	c.expect("*2\r\n$1\r\na\r\n$1\r\nb\r\n", "ZRANGE", "zresp3:k", "0", "1")
+
+	// Pops nest pairs only when given a count
+	c.expect("*2\r\n$1\r\na\r\n,1\r\n", "ZPOPMIN", "zresp3:k")
+	c.expect("*1\r\n*2\r\n$1\r\nb\r\n,2\r\n", "ZPOPMIN", "zresp3:k", "1")
+	c.expect("*3\r\n$8\r\nzresp3:k\r\n$1\r\nc\r\n,3\r\n", "BZPOPMIN", "zresp3:k", "0")
+	c.expect("*2\r\n$8\r\nzresp3:k\r\n*1\r\n*2\r\n$1\r\nd\r\n,4\r\n", "ZMPOP", "1", "zresp3:k", "MIN")
+
+	c.do("HSET", "zresp3:h", "f", "v")
+	c.expect("*1\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n", "HRANDFIELD", "zresp3:h", "1", "WITHVALUES")
+
+	c.expect("*1\r\n*2\r\n$1\r\ne\r\n,5\r\n", "ZINTER", "1", "zresp3:k", "WITHSCORES")
+
+	// RESP2 clients keep the flat replies
+	c.do("HELLO", "2")
+	c.expect("*2\r\n$1\r\ne\r\n$1\r\n5\r\n", "ZRANGE", "zresp3:k", "0", "-1", "WITHSCORES")
+	c.expect("*2\r\n$1\r\nf\r\n$1\r\nv\r\n", "HRANDFIELD", "zresp3:h", "1", "WITHVALUES")
+	c.expect("*2\r\n$8\r\nzresp3:k\r\n*1\r\n*2\r\n$1\r\ne\r\n$1\r\n5\r\n", "ZMPOP", "1", "zresp3:k", "MIN")
+}